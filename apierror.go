@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"naivecoin/blockchain"
+	"naivecoin/p2p"
+	tx "naivecoin/transactions"
+	"naivecoin/txpool"
+	"naivecoin/wallet"
+	"net/http"
+	"strings"
+)
+
+// machine-readable codes of api errors, they are stable while messages may change
+const (
+	codeInvalidRequest     = "INVALID_REQUEST"
+	codeInvalidAddress     = "INVALID_ADDRESS"
+	codeInvalidAmount      = "INVALID_AMOUNT"
+	codeInvalidFee         = "INVALID_FEE"
+	codeFeeTooLow          = "FEE_TOO_LOW"
+	codeInsufficientFunds  = "INSUFFICIENT_FUNDS"
+	codeInvalidTransaction = "INVALID_TRANSACTION"
+	codePoolFull           = "POOL_FULL"
+	codePoolConflict       = "POOL_CONFLICT"
+	codeAlreadyInPool      = "ALREADY_IN_POOL"
+	codeConflictingSpend   = "CONFLICTING_SPEND"
+	codePeerUnreachable    = "PEER_UNREACHABLE"
+	codePeerLimit          = "PEER_LIMIT"
+	codeWalletLocked       = "WALLET_LOCKED"
+	codeWrongPassphrase    = "WRONG_PASSPHRASE"
+	codeInvalidPrivateKey  = "INVALID_PRIVATE_KEY"
+	codeMiningStopped      = "MINING_STOPPED"
+	codeTipChanged         = "TIP_CHANGED"
+	codeTxDropped          = "TRANSACTION_DROPPED"
+	codeInvalidBlock       = "INVALID_BLOCK"
+	codeMiningCancelled    = "MINING_CANCELLED"
+	codeMiningTimeout      = "MINING_TIMEOUT"
+	codeResyncInProgress   = "RESYNC_IN_PROGRESS"
+	codeNotFound           = "NOT_FOUND"
+	codeUnauthorized       = "UNAUTHORIZED"
+	codeRateLimited        = "RATE_LIMITED"
+	codeTimeout            = "TIMEOUT"
+	codeInternal           = "INTERNAL_ERROR"
+)
+
+// statusClientClosedRequest is the non-standard status of requests the client went away from before the response
+const statusClientClosedRequest int = 499
+
+// envelopeMediaType is accepted by clients that want successful responses wrapped in {"data": ...}
+// errors are always wrapped in {"error": ...}
+const envelopeMediaType string = "application/vnd.naivecoin.v1+json"
+
+// apiError is an error of an api request with the status code and error code it is written with
+type apiError struct {
+	status  int
+	Code    string      `json:"code"`
+	Message string      `json:"message"`
+	Details interface{} `json:"details,omitempty"`
+}
+
+func (e *apiError) Error() string {
+	return e.Message
+}
+
+// newApiError returns an api error with a given status code, error code and message
+func newApiError(status int, code string, message string) *apiError {
+	return &apiError{status: status, Code: code, Message: message}
+}
+
+// fundsDetails are details of an INSUFFICIENT_FUNDS error
+type fundsDetails struct {
+	Have float64 `json:"have"`
+	Need float64 `json:"need"`
+}
+
+// conflictDetails are details of a CONFLICTING_SPEND error
+type conflictDetails struct {
+	ConflictingTxId string `json:"conflictingTxId"`
+}
+
+// writeError writes an error response {"error": {"code": ..., "message": ...}}
+func writeError(w http.ResponseWriter, status int, code string, message string) {
+	writeApiError(w, newApiError(status, code, message))
+}
+
+// writeErrorFor writes an error of a wallet, pool or peer operation with a matching status code and error code
+func writeErrorFor(w http.ResponseWriter, err error) {
+	writeApiError(w, toApiError(err))
+}
+
+// writeApiError writes an error response with the status code of an api error, details are written if it has them
+func writeApiError(w http.ResponseWriter, apiErr *apiError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(apiErr.status)
+	json.NewEncoder(w).Encode(struct {
+		Error *apiError `json:"error"`
+	}{Error: apiErr})
+}
+
+// toApiError returns an api error with a status code and error code matching an error of a wallet, pool or peer operation
+func toApiError(err error) *apiError {
+	var apiErr *apiError
+	var feeTooLow txpool.FeeTooLowError
+	var insufficientFunds wallet.InsufficientFundsError
+	var conflictingSpend txpool.ConflictingSpendError
+	var blockErr blockchain.BlockError
+	switch {
+	case errors.As(err, &apiErr):
+		return apiErr
+	case errors.Is(err, txpool.ErrPoolFull):
+		return newApiError(http.StatusServiceUnavailable, codePoolFull, err.Error())
+	case errors.Is(err, txpool.ErrAlreadyInPool):
+		return newApiError(http.StatusConflict, codeAlreadyInPool, err.Error())
+	case errors.As(err, &conflictingSpend):
+		var apiErr *apiError = newApiError(http.StatusConflict, codeConflictingSpend, err.Error())
+		apiErr.Details = conflictDetails{ConflictingTxId: conflictingSpend.ConflictingTxId}
+		return apiErr
+	case errors.Is(err, blockchain.ErrMiningStopped):
+		return newApiError(http.StatusServiceUnavailable, codeMiningStopped, err.Error())
+	case errors.Is(err, blockchain.ErrTipChanged):
+		return newApiError(http.StatusConflict, codeTipChanged, err.Error())
+	case errors.As(err, &blockErr):
+		return newApiError(http.StatusBadRequest, codeInvalidBlock, err.Error())
+	case errors.Is(err, blockchain.ErrTransactionDropped):
+		return newApiError(http.StatusConflict, codeTxDropped, err.Error())
+	case errors.Is(err, blockchain.ErrMiningDeadlineExceeded):
+		return newApiError(http.StatusRequestTimeout, codeMiningTimeout, err.Error())
+	case errors.Is(err, blockchain.ErrMiningCancelled):
+		return newApiError(statusClientClosedRequest, codeMiningCancelled, err.Error())
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, context.Canceled):
+		return newApiError(http.StatusServiceUnavailable, codeTimeout, "request timed out or was cancelled")
+	case errors.Is(err, wallet.ErrWalletLocked):
+		return newApiError(http.StatusForbidden, codeWalletLocked, err.Error())
+	case errors.Is(err, wallet.ErrWrongPassphrase):
+		return newApiError(http.StatusUnauthorized, codeWrongPassphrase, err.Error())
+	case errors.Is(err, wallet.ErrInvalidPrivateKey):
+		return newApiError(http.StatusBadRequest, codeInvalidPrivateKey, err.Error())
+	case errors.As(err, &insufficientFunds):
+		var apiErr *apiError = newApiError(http.StatusBadRequest, codeInsufficientFunds, err.Error())
+		apiErr.Details = fundsDetails{Have: insufficientFunds.Have, Need: insufficientFunds.Need}
+		return apiErr
+	case errors.Is(err, wallet.ErrInsufficientFunds):
+		return newApiError(http.StatusBadRequest, codeInsufficientFunds, err.Error())
+	case errors.Is(err, blockchain.ErrInvalidAddress), errors.Is(err, blockchain.ErrInvalidRewardAddress):
+		return newApiError(http.StatusBadRequest, codeInvalidAddress, err.Error())
+	case errors.Is(err, blockchain.ErrInvalidAmount), errors.Is(err, tx.ErrInvalidTxOutAmount):
+		return newApiError(http.StatusBadRequest, codeInvalidAmount, err.Error())
+	case errors.Is(err, blockchain.ErrInvalidFee), errors.Is(err, blockchain.ErrInvalidFeeRate):
+		return newApiError(http.StatusBadRequest, codeInvalidFee, err.Error())
+	case errors.As(err, &feeTooLow):
+		return newApiError(http.StatusBadRequest, codeFeeTooLow, err.Error())
+	case errors.Is(err, p2p.ErrOutboundLimit):
+		return newApiError(http.StatusServiceUnavailable, codePeerLimit, err.Error())
+	case errors.Is(err, p2p.ErrResyncInProgress):
+		return newApiError(http.StatusConflict, codeResyncInProgress, err.Error())
+	case errors.Is(err, p2p.ErrPeerNotFound):
+		return newApiError(http.StatusNotFound, codeNotFound, err.Error())
+	default:
+		return newApiError(http.StatusBadRequest, codeInvalidTransaction, err.Error())
+	}
+}
+
+// wantsEnvelope checks if a client accepts successful responses wrapped in {"data": ...}
+func wantsEnvelope(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), envelopeMediaType)
+}
+
+// writeJSON writes a successful response, wrapped in {"data": ...} for clients that accept the envelope
+func writeJSON(w http.ResponseWriter, r *http.Request, data interface{}) {
+	writeJSONStatus(w, r, http.StatusOK, data)
+}
+
+// writeJSONStatus writes a response with a given status code, wrapped in {"data": ...} for clients that accept the envelope
+func writeJSONStatus(w http.ResponseWriter, r *http.Request, status int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if wantsEnvelope(r) {
+		json.NewEncoder(w).Encode(struct {
+			Data interface{} `json:"data"`
+		}{Data: data})
+		return
+	}
+	json.NewEncoder(w).Encode(data)
+}
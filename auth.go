@@ -0,0 +1,98 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+// apiTokenEnv is the environment variable the api token can be given in
+const apiTokenEnv string = "NAIVECOIN_API_TOKEN"
+
+// apiTokenSize is the number of random bytes of a generated api token
+const apiTokenSize int = 32
+
+// apiToken is the bearer token api requests are authenticated with
+var apiToken string
+
+// authenticateReads makes read-only endpoints require the api token as well
+var authenticateReads bool = false
+
+// loadApiToken reads the api token from a file, a new token is generated to the file on the first start
+func loadApiToken(path string) (string, error) {
+	content, err := ioutil.ReadFile(path)
+	if err == nil {
+		var token string = strings.TrimSpace(string(content))
+		if token == "" {
+			return "", fmt.Errorf("empty api token file at %s", path)
+		}
+		return token, nil
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	tokenBytes := make([]byte, apiTokenSize)
+	if _, err := rand.Read(tokenBytes); err != nil {
+		return "", err
+	}
+	var token string = hex.EncodeToString(tokenBytes)
+	if err := ioutil.WriteFile(path, []byte(token+"\n"), 0600); err != nil {
+		return "", err
+	}
+	fmt.Printf("api token generated to %s\n", path)
+	return token, nil
+}
+
+// requestToken returns the token a request is authenticated with, given in Authorization: Bearer header
+// browsers can't set headers on websocket upgrades, so web clients may give it in token query parameter instead
+func requestToken(r *http.Request) string {
+	var authorization string = r.Header.Get("Authorization")
+	if strings.HasPrefix(authorization, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(authorization, "Bearer "))
+	}
+	if websocket.IsWebSocketUpgrade(r) {
+		return r.URL.Query().Get("token")
+	}
+	return ""
+}
+
+// isAuthenticated checks if a request carries the api token, comparing in constant time
+func isAuthenticated(r *http.Request) bool {
+	var token string = requestToken(r)
+	return token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(apiToken)) == 1
+}
+
+// writeUnauthorized responds to a request without a valid api token
+func writeUnauthorized(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", "Bearer")
+	writeError(w, http.StatusUnauthorized, codeUnauthorized, "missing or invalid api token")
+}
+
+// mutating wraps a handler of an endpoint that spends, mines or changes the node, it always requires the api token
+func mutating(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !isAuthenticated(r) {
+			writeUnauthorized(w)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// readOnly wraps a handler of an endpoint that only reads the node state, it requires the api token if authenticateReads is set
+func readOnly(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if authenticateReads && !isAuthenticated(r) {
+			writeUnauthorized(w)
+			return
+		}
+		handler(w, r)
+	}
+}
@@ -0,0 +1,952 @@
+package blockchain
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	tx "naivecoin/transactions"
+	"naivecoin/txpool"
+	"naivecoin/utils"
+	"naivecoin/wallet"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testNetwork stands in for the p2p network, blocks are not sent anywhere
+type testNetwork struct{}
+
+func (testNetwork) BroadcastLatest()       {}
+func (testNetwork) BlockAdded(block Block) {}
+
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "blockchain")
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if err := wallet.InitWallet(dir+"/wallet.json", "test"); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	SetNetwork(testNetwork{})
+	var code int = m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// resetChain starts every test from a chain holding the genesis block only and an empty transaction pool
+func resetChain(tb testing.TB) {
+	lock.Lock()
+	setState(newGenesisState())
+	lock.Unlock()
+	// every pool transaction has txIns, none of them is found among no unspent txOuts
+	txpool.UpdateTransactionPool([]tx.UnspentTxOut{})
+	tb.Cleanup(func() {
+		txpool.SetReplaceByFee(false, 0.001)
+	})
+}
+
+// testKey returns a private key derived from a number and the full public key address it owns
+func testKey(tb testing.TB, n int) (string, string) {
+	var privateKey string = fmt.Sprintf("%064x", n)
+	publicKey, err := utils.GetPublicKey(privateKey)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	address, err := utils.Base58Encode(publicKey)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return privateKey, address
+}
+
+// mineBlocks mines count blocks on the current chain paying their coinbase to an address
+func mineBlocks(tb testing.TB, count int, address string) []Block {
+	var blocks []Block = []Block{}
+	for n := 0; n < count; n++ {
+		block, err := ProduceNextBlock(context.Background(), address)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		blocks = append(blocks, block)
+	}
+	return blocks
+}
+
+// testTransaction returns a transaction spending given txOuts, paying amount to an address and leaving fee to be burned
+func testTransaction(tb testing.TB, privateKey string, spent []tx.UnspentTxOut, address string, amount float64, fee float64) tx.Transaction {
+	var transaction tx.Transaction = tx.Transaction{Version: tx.CurrentTxVersion}
+	var total float64
+	for _, unspentTxOut := range spent {
+		transaction.TxIns = append(transaction.TxIns, tx.TxIn{TxOutId: unspentTxOut.TxOutId, TxOutIndex: unspentTxOut.TxOutIndex})
+		total += unspentTxOut.Amount
+	}
+	transaction.TxOuts = tx.TxOutCollection{{Address: address, Amount: amount}}
+	if change := total - amount - fee; change > 0 {
+		transaction.TxOuts = append(transaction.TxOuts, tx.TxOut{Address: spent[0].Address, Amount: change})
+	}
+	transaction.Id = tx.GetTransactionId(transaction)
+	for n := 0; n < len(transaction.TxIns); n++ {
+		signature, err := tx.SignTxIn(transaction, n, privateKey, spent)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		transaction.TxIns[n].Signature = signature
+	}
+	return transaction
+}
+
+// unspentTxOutsOf returns unspent txOuts of the current chain owned by an address
+func unspentTxOutsOf(address string) []tx.UnspentTxOut {
+	return wallet.FindUnspentTxOutsForAddress(address, GetUnspentTxOuts())
+}
+
+// containsTransaction checks if a block holds a transaction with a given id
+func containsTransaction(block Block, txId string) bool {
+	for _, transaction := range block.Fields.Transactions {
+		if transaction.Id == txId {
+			return true
+		}
+	}
+	return false
+}
+
+func TestReplaceByFeeMinesReplacementOnly(test *testing.T) {
+	resetChain(test)
+	privateKey, address := testKey(test, 1)
+	_, recipient := testKey(test, 2)
+	mineBlocks(test, 1, address)
+	txpool.SetReplaceByFee(true, 0.01)
+
+	var spent []tx.UnspentTxOut = unspentTxOutsOf(address)
+	var original tx.Transaction = testTransaction(test, privateKey, spent, recipient, 10, 0.1)
+	if err := HandleReceivedTransaction(original); err != nil {
+		test.Fatal(err)
+	}
+	var replacement tx.Transaction = testTransaction(test, privateKey, spent, recipient, 10, 0.5)
+	if err := HandleReceivedTransaction(replacement); err != nil {
+		test.Fatal(err)
+	}
+
+	var block Block = mineBlocks(test, 1, address)[0]
+	if !containsTransaction(block, replacement.Id) || containsTransaction(block, original.Id) {
+		test.Fatalf("block must hold the replacement %s only", replacement.Id)
+	}
+	if txpool.HasTransaction(original.Id) || txpool.HasTransaction(replacement.Id) {
+		test.Fatal("pool must be empty after the replacement is mined")
+	}
+}
+
+func TestSendTransactionIssuesChangeAddressOnceAdmitted(test *testing.T) {
+	resetChain(test)
+	_, recipient := testKey(test, 2)
+	mineBlocks(test, 1, wallet.GetBase58Address())
+	var addressCount int = len(wallet.GetAddresses())
+
+	// the pool rejects a transaction paying no fee, the change address reserved for it is not issued
+	txpool.SetMinFeeRate(1)
+	test.Cleanup(func() { txpool.SetMinFeeRate(0) })
+	if _, _, err := SendTransaction(recipient, 10, wallet.SendOptions{}); err == nil {
+		test.Fatal("transaction paying no fee must be rejected")
+	}
+	if count := len(wallet.GetAddresses()); count != addressCount {
+		test.Fatalf("rejected transaction issued %d addresses", count-addressCount)
+	}
+
+	txpool.SetMinFeeRate(0)
+	transaction, _, err := SendTransaction(recipient, 10, wallet.SendOptions{})
+	if err != nil {
+		test.Fatal(err)
+	}
+	var addresses []string = wallet.GetAddresses()
+	if len(addresses) != addressCount+1 || addresses[addressCount] != transaction.TxOuts[1].Address {
+		test.Fatal("change address of an admitted transaction must be issued")
+	}
+}
+
+// hashMatchesPrefix is the former difficulty check, hex hash converted to a binary string that must start with difficulty zeroes
+func hashMatchesPrefix(tb testing.TB, hash []byte, difficulty uint32) bool {
+	hashInBinary, err := utils.HexToBin(hex.EncodeToString(hash))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return strings.HasPrefix(hashInBinary, strings.Repeat("0", int(difficulty)))
+}
+
+func TestHashTargetMatchesPrefix(test *testing.T) {
+	var blockFields BlockFields = GenesisBlock.Fields
+	for n := 0; n < 20000; n++ {
+		blockFields.Nonce = uint64(n)
+		var hash []byte = hasher.Sum(blockHashInput(blockFields))
+		for _, difficulty := range []uint32{0, 1, 2, 3, 4, 7, 8, 9, 16, 255, 256} {
+			if hashMeetsTarget(hash, getTarget(difficulty)) != hashMatchesPrefix(test, hash, difficulty) {
+				test.Fatalf("hash %x at difficulty %d: target and prefix disagree", hash, difficulty)
+			}
+		}
+	}
+}
+
+// BenchmarkGetAccountBalance measures the balance of the node wallet among unspent txOuts mostly owned by another address
+// wallet keys and addresses are kept in memory, so no key file is read and no public key is computed per call
+func BenchmarkGetAccountBalance(b *testing.B) {
+	resetChain(b)
+	_, other := testKey(b, 2)
+	var unspentTxOuts []tx.UnspentTxOut = []tx.UnspentTxOut{}
+	for n := 0; n < 1000; n++ {
+		var owner string = other
+		if n%10 == 0 {
+			owner = wallet.GetBase58Address()
+		}
+		unspentTxOuts = append(unspentTxOuts, tx.UnspentTxOut{TxOutId: utils.Hash(fmt.Sprintf("txOut %d", n)), Address: owner, Amount: 50})
+	}
+	var s chainState = *currentState()
+	s.unspentTxOuts = unspentTxOuts
+	lock.Lock()
+	setState(&s)
+	lock.Unlock()
+	b.Cleanup(func() { resetChain(b) })
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		if balances := GetBalances(); balances.Confirmed != 5000 {
+			b.Fatalf("expected a balance of 5000, got %v", balances.Confirmed)
+		}
+	}
+}
+
+// BenchmarkHashDifficultyCheck compares hashing a block template with the big.Int target against the binary string prefix
+func BenchmarkHashDifficultyCheck(b *testing.B) {
+	const difficulty uint32 = 16
+	var checks = []struct {
+		name  string
+		check func(hash []byte) bool
+	}{
+		{name: "prefix", check: func(hash []byte) bool { return hashMatchesPrefix(b, hash, difficulty) }},
+		{name: "target", check: func(target *big.Int) func(hash []byte) bool {
+			return func(hash []byte) bool { return hashMeetsTarget(hash, target) }
+		}(getTarget(difficulty))},
+	}
+	for _, c := range checks {
+		b.Run(c.name, func(b *testing.B) {
+			var blockFields BlockFields = GenesisBlock.Fields
+			var start time.Time = time.Now()
+			b.ReportAllocs()
+			b.ResetTimer()
+			for n := 0; n < b.N; n++ {
+				blockFields.Nonce = uint64(n)
+				c.check(hasher.Sum(blockHashInput(blockFields)))
+			}
+			b.ReportMetric(float64(b.N)/time.Since(start).Seconds(), "hashes/s")
+		})
+	}
+}
+
+// mineTestBlock returns a block of given fields with the first nonce whose hash meets their difficulty, or the first one missing it
+func mineTestBlock(blockFields BlockFields, meetsDifficulty bool) Block {
+	var target *big.Int = getTarget(blockFields.Difficulty)
+	for blockFields.Nonce = 0; ; blockFields.Nonce++ {
+		var hash []byte = hasher.Sum(blockHashInput(blockFields))
+		if hashMeetsTarget(hash, target) == meetsDifficulty {
+			return Block{Fields: blockFields, Hash: hex.EncodeToString(hash)}
+		}
+	}
+}
+
+// testCompetingBlock returns a block of another node at the height of a mined block, paying its coinbase to an address
+func testCompetingBlock(tb testing.TB, minedBlock Block, address string, transactions ...tx.Transaction) Block {
+	var blockFields BlockFields = minedBlock.Fields
+	blockFields.Transactions = append([]tx.Transaction{tx.GetCoinbaseTransaction(address, blockFields.Index, blockFields.PrevHash)}, transactions...)
+	return mineTestBlock(blockFields, true)
+}
+
+func TestPaymentConfirmedAfterTipChange(test *testing.T) {
+	test.Cleanup(func() { addMinedBlock = AddBlockToChain })
+	_, recipient := testKey(test, 2)
+	_, peer := testKey(test, 3)
+	for _, confirmedByPeer := range []bool{false, true} {
+		resetChain(test)
+		mineBlocks(test, 1, wallet.GetBase58Address())
+
+		// a block of another node extends the chain while the payment is mined, so the mined block can't be added
+		var competing Block
+		var attempts int
+		addMinedBlock = func(block Block) error {
+			attempts++
+			if attempts == 1 {
+				var transactions []tx.Transaction
+				if confirmedByPeer {
+					transactions = block.Fields.Transactions[1:2]
+				}
+				competing = testCompetingBlock(test, block, peer, transactions...)
+				if err := AddBlockToChain(competing); err != nil {
+					test.Fatal(err)
+				}
+			}
+			return AddBlockToChain(block)
+		}
+
+		block, transaction, _, err := SendCoinsToAddress(context.Background(), recipient, 10, wallet.SendOptions{})
+		if err != nil {
+			test.Fatalf("confirmed by peer %v: %v", confirmedByPeer, err)
+		}
+		if !containsTransaction(block, transaction.Id) {
+			test.Fatalf("confirmed by peer %v: returned block must hold the payment", confirmedByPeer)
+		}
+		if info, found := GetTransaction(transaction.Id); !found || info.BlockHash != block.Hash {
+			test.Fatalf("confirmed by peer %v: payment must be confirmed in block %s", confirmedByPeer, block.Hash)
+		}
+		if txpool.HasTransaction(transaction.Id) {
+			test.Fatalf("confirmed by peer %v: confirmed payment must leave the pool", confirmedByPeer)
+		}
+		if confirmedByPeer && (block.Hash != competing.Hash || attempts != 1) {
+			test.Fatalf("expected the block of the other node %s, got %s after %d attempts", competing.Hash, block.Hash, attempts)
+		}
+		// otherwise the payment is mined again on the new tip
+		if !confirmedByPeer && (block.Fields.PrevHash != competing.Hash || attempts != 2) {
+			test.Fatalf("expected the payment mined on top of %s, got a block on %s after %d attempts", competing.Hash, block.Fields.PrevHash, attempts)
+		}
+	}
+}
+
+func TestValidateBlock(test *testing.T) {
+	resetChain(test)
+	_, address := testKey(test, 1)
+	// blocks mined at once raise the difficulty, so that a hash can miss it
+	mineBlocks(test, int(difficultyAdjustmentInterval)+2, address)
+	var blocks []Block = currentState().blocks
+	var prevBlock Block = blocks[len(blocks)-1]
+	difficulty, _ := getDifficulty(blocks, prevBlock)
+	if difficulty == 0 {
+		test.Fatal("expected a difficulty above 0")
+	}
+	var now uint64 = uint64(time.Now().Unix())
+	var nextFields = func() BlockFields {
+		return BlockFields{
+			Index:        prevBlock.Fields.Index + 1,
+			PrevHash:     prevBlock.Hash,
+			Ts:           now,
+			Transactions: []tx.Transaction{tx.GetCoinbaseTransaction(address, prevBlock.Fields.Index+1, prevBlock.Hash)},
+			Difficulty:   difficulty,
+		}
+	}
+
+	// each case changes the valid next block, checks run in the same order as before they returned reasons,
+	// so a block failing several of them is rejected for the first one
+	var cases = []struct {
+		name   string
+		block  func() Block
+		reason error
+	}{
+		{name: "valid", block: func() Block { return mineTestBlock(nextFields(), true) }},
+		{name: "index after the next one", reason: ErrNotSuccessor, block: func() Block {
+			var fields BlockFields = nextFields()
+			fields.Index++
+			return mineTestBlock(fields, true)
+		}},
+		{name: "index of the prev block", reason: ErrNotSuccessor, block: func() Block {
+			var fields BlockFields = nextFields()
+			fields.Index--
+			return mineTestBlock(fields, true)
+		}},
+		{name: "index and prev hash", reason: ErrNotSuccessor, block: func() Block {
+			var fields BlockFields = nextFields()
+			fields.Index++
+			fields.PrevHash = GenesisBlock.Hash
+			return mineTestBlock(fields, true)
+		}},
+		{name: "prev hash", reason: PrevHashMismatchError{Expected: prevBlock.Hash, Got: GenesisBlock.Hash}, block: func() Block {
+			var fields BlockFields = nextFields()
+			fields.PrevHash = GenesisBlock.Hash
+			return mineTestBlock(fields, true)
+		}},
+		{name: "hash of other fields", reason: ErrHashMismatch, block: func() Block {
+			var block Block = mineTestBlock(nextFields(), true)
+			block.Fields.Nonce++
+			return block
+		}},
+		{name: "hash not hex", reason: ErrHashMismatch, block: func() Block {
+			var block Block = mineTestBlock(nextFields(), true)
+			block.Hash = strings.ToUpper(block.Hash)
+			return block
+		}},
+		{name: "hash and timestamp", reason: ErrHashMismatch, block: func() Block {
+			var fields BlockFields = nextFields()
+			fields.Ts = prevBlock.Fields.Ts - 60
+			var block Block = mineTestBlock(fields, true)
+			block.Fields.Nonce++
+			return block
+		}},
+		{name: "a minute older than the prev block", reason: TimestampError{}, block: func() Block {
+			var fields BlockFields = nextFields()
+			fields.Ts = prevBlock.Fields.Ts - 60
+			return mineTestBlock(fields, true)
+		}},
+		{name: "less than a minute older than the prev block", block: func() Block {
+			var fields BlockFields = nextFields()
+			fields.Ts = prevBlock.Fields.Ts - 59
+			return mineTestBlock(fields, true)
+		}},
+		{name: "beyond the max clock drift", reason: FutureTimestampError{}, block: func() Block {
+			var fields BlockFields = nextFields()
+			fields.Ts = now + maxClockDrift + 10
+			return mineTestBlock(fields, true)
+		}},
+		{name: "within the max clock drift", block: func() Block {
+			var fields BlockFields = nextFields()
+			fields.Ts = now + maxClockDrift/2
+			return mineTestBlock(fields, true)
+		}},
+		{name: "timestamp and difficulty", reason: TimestampError{}, block: func() Block {
+			var fields BlockFields = nextFields()
+			fields.Ts = prevBlock.Fields.Ts - 60
+			fields.Difficulty++
+			return mineTestBlock(fields, true)
+		}},
+		{name: "difficulty above the required one", reason: DifficultyMismatchError{Expected: difficulty, Got: difficulty + 1}, block: func() Block {
+			var fields BlockFields = nextFields()
+			fields.Difficulty++
+			return mineTestBlock(fields, true)
+		}},
+		{name: "difficulty below the required one", reason: DifficultyMismatchError{Expected: difficulty, Got: difficulty - 1}, block: func() Block {
+			var fields BlockFields = nextFields()
+			fields.Difficulty--
+			return mineTestBlock(fields, true)
+		}},
+		{name: "difficulty and proof of work", reason: DifficultyMismatchError{Expected: difficulty, Got: difficulty + 1}, block: func() Block {
+			var fields BlockFields = nextFields()
+			fields.Difficulty++
+			return mineTestBlock(fields, false)
+		}},
+		{name: "proof of work", reason: ErrInsufficientPoW, block: func() Block { return mineTestBlock(nextFields(), false) }},
+	}
+	for _, c := range cases {
+		var block Block = c.block()
+		var err error = IsValidBlock(blocks, prevBlock, block)
+		if c.reason == nil {
+			if err != nil {
+				test.Fatalf("%s: expected the block to be valid, got %v", c.name, err)
+			}
+			continue
+		}
+		var blockErr BlockError
+		if !errors.As(err, &blockErr) || blockErr.Hash != block.Hash || blockErr.Index != block.Fields.Index {
+			test.Fatalf("%s: expected a BlockError of block %d %s, got %v", c.name, block.Fields.Index, block.Hash, err)
+		}
+		switch reason := c.reason.(type) {
+		case TimestampError:
+			var timestampErr TimestampError
+			if !errors.As(err, &timestampErr) || timestampErr.Ts != block.Fields.Ts || timestampErr.PrevTs != prevBlock.Fields.Ts {
+				test.Fatalf("%s: expected a TimestampError, got %v", c.name, err)
+			}
+		case FutureTimestampError:
+			var futureErr FutureTimestampError
+			if !errors.As(err, &futureErr) || futureErr.Ts != block.Fields.Ts || futureErr.MaxDrift != maxClockDrift {
+				test.Fatalf("%s: expected a FutureTimestampError, got %v", c.name, err)
+			}
+		case PrevHashMismatchError, DifficultyMismatchError:
+			if blockErr.Err != reason {
+				test.Fatalf("%s: expected %v, got %v", c.name, reason, blockErr.Err)
+			}
+		default:
+			if !errors.Is(err, reason) {
+				test.Fatalf("%s: expected %v, got %v", c.name, reason, err)
+			}
+		}
+		// a block refused alone is refused as part of a chain as well
+		if _, err := IsValidBlockChain(append(append([]Block{}, blocks...), block)); err == nil {
+			test.Fatalf("%s: chain ending with the block must not be valid", c.name)
+		}
+	}
+}
+
+// testFork returns count blocks of another node extending a given chain, paying their coinbase to an address; they are not added
+func testFork(tb testing.TB, chain []Block, count int, address string) []Block {
+	var fork []Block = append([]Block{}, chain...)
+	for n := 0; n < count; n++ {
+		var prevBlock Block = fork[len(fork)-1]
+		difficulty, found := getDifficulty(fork, prevBlock)
+		if !found {
+			tb.Fatal("adjustment block missing from the chain")
+		}
+		fork = append(fork, mineTestBlock(BlockFields{
+			Index:        prevBlock.Fields.Index + 1,
+			PrevHash:     prevBlock.Hash,
+			Ts:           uint64(time.Now().Unix()),
+			Transactions: []tx.Transaction{tx.GetCoinbaseTransaction(address, prevBlock.Fields.Index+1, prevBlock.Hash)},
+			Difficulty:   difficulty,
+		}, true))
+	}
+	return fork[len(chain):]
+}
+
+// checkCumulativeDifficulty fails the test if the cumulative difficulty of the chain state is not the one of its blocks
+func checkCumulativeDifficulty(tb testing.TB) {
+	var s *chainState = currentState()
+	if expected := GetCumulativeDifficulty(s.blocks); s.cumulativeDifficulty.Cmp(expected) != 0 {
+		tb.Fatalf("expected cumulative difficulty %v of %d blocks, got %v", expected, len(s.blocks), s.cumulativeDifficulty)
+	}
+}
+
+func TestCumulativeDifficultyDoesNotWrap(test *testing.T) {
+	var blocks []Block = []Block{{Fields: BlockFields{Difficulty: 256}}, {Fields: BlockFields{Difficulty: 256}}, {Fields: BlockFields{Difficulty: 64}}, {Fields: BlockFields{Difficulty: 0}}}
+	var expected *big.Int = new(big.Int).Lsh(big.NewInt(1), 257)
+	expected.Add(expected, new(big.Int).Lsh(big.NewInt(1), 64))
+	expected.Add(expected, big.NewInt(1))
+	if difficulty := GetCumulativeDifficulty(blocks); difficulty.Cmp(expected) != 0 {
+		test.Fatalf("expected %v, got %v", expected, difficulty)
+	}
+
+	// two blocks at difficulty 63 are as much work as one at 64, and less than one at 65
+	var s *chainState = &chainState{
+		blocks:               []Block{{Fields: BlockFields{Difficulty: 64}, Hash: "b"}},
+		cumulativeDifficulty: GetCumulativeDifficulty([]Block{{Fields: BlockFields{Difficulty: 64}}}),
+	}
+	var equal *big.Int = GetCumulativeDifficulty([]Block{{Fields: BlockFields{Difficulty: 63}}, {Fields: BlockFields{Difficulty: 63}}})
+	if !isPreferredChain(s, equal, "a") || isPreferredChain(s, equal, "c") {
+		test.Fatal("chains of equal work must be decided by their tip hashes")
+	}
+	if isPreferredChain(s, GetCumulativeDifficulty([]Block{{Fields: BlockFields{Difficulty: 63}}}), "a") {
+		test.Fatal("chain of less work must not be preferred")
+	}
+	if !isPreferredChain(s, GetCumulativeDifficulty([]Block{{Fields: BlockFields{Difficulty: 65}}}), "c") {
+		test.Fatal("chain of more work must be preferred")
+	}
+	if s.cumulativeDifficulty.Cmp(blockWork(64)) != 0 {
+		test.Fatal("comparing chains must not change the cumulative difficulty of the state")
+	}
+}
+
+func TestReplaceChainBeforeAnyMining(test *testing.T) {
+	resetChain(test)
+	_, address := testKey(test, 1)
+	_, peer := testKey(test, 3)
+	checkCumulativeDifficulty(test)
+
+	// the same chain holding the genesis block only is not preferred to itself
+	if err := ReplaceChain([]Block{GenesisBlock}); !errors.Is(err, ErrLessWork) {
+		test.Fatalf("expected %v replacing with the genesis block, got %v", ErrLessWork, err)
+	}
+	// the first chain received replaces the genesis block, the work of the genesis block is counted on both sides
+	var received []Block = append([]Block{GenesisBlock}, testFork(test, []Block{GenesisBlock}, 3, peer)...)
+	if err := ReplaceChain(received); err != nil {
+		test.Fatal(err)
+	}
+	if GetLatestBlock().Hash != received[len(received)-1].Hash {
+		test.Fatal("received chain must replace the genesis block")
+	}
+	checkCumulativeDifficulty(test)
+
+	// blocks added afterwards, mined and received, keep the cumulative difficulty of the whole chain
+	mineBlocks(test, 2, address)
+	checkCumulativeDifficulty(test)
+	if err := AppendBlocks(testFork(test, currentState().blocks, 2, peer)); err != nil {
+		test.Fatal(err)
+	}
+	checkCumulativeDifficulty(test)
+	var snapshot ChainSnapshot = GetChainSnapshot()
+	if snapshot.CumulativeDifficulty.Cmp(GetCumulativeDifficulty(snapshot.Blocks)) != 0 {
+		test.Fatalf("snapshot cumulative difficulty %v does not match its blocks", snapshot.CumulativeDifficulty)
+	}
+	// the shorter received chain is now less work
+	if err := ReplaceChain(received); !errors.Is(err, ErrLessWork) {
+		test.Fatalf("expected %v, got %v", ErrLessWork, err)
+	}
+}
+
+func TestEqualWorkChainsTieBreak(test *testing.T) {
+	_, first := testKey(test, 3)
+	_, second := testKey(test, 4)
+	var forks [][]Block = [][]Block{
+		append([]Block{GenesisBlock}, testFork(test, []Block{GenesisBlock}, 1, first)...),
+		append([]Block{GenesisBlock}, testFork(test, []Block{GenesisBlock}, 1, second)...),
+	}
+	var preferred string = forks[0][1].Hash
+	if forks[1][1].Hash < preferred {
+		preferred = forks[1][1].Hash
+	}
+
+	// nodes holding either fork end up with the one of the smaller tip hash, whichever fork they receive
+	for n := 0; n < len(forks); n++ {
+		var held, received []Block = forks[n], forks[1-n]
+		resetChain(test)
+		if err := AddBlockToChain(held[1]); err != nil {
+			test.Fatal(err)
+		}
+		var err error = ReplaceChain(received)
+		if received[1].Hash == preferred && err != nil {
+			test.Fatalf("fork %s with the smaller tip hash must replace %s: %v", received[1].Hash, held[1].Hash, err)
+		}
+		if received[1].Hash != preferred && !errors.Is(err, ErrLessWork) {
+			test.Fatalf("expected %v for fork %s, got %v", ErrLessWork, received[1].Hash, err)
+		}
+		if GetLatestBlock().Hash != preferred {
+			test.Fatalf("holding %s, expected the tip %s, got %s", held[1].Hash, preferred, GetLatestBlock().Hash)
+		}
+		checkCumulativeDifficulty(test)
+		// receiving the held chain again changes nothing
+		if err := ReplaceChain(GetBlockChain()); !errors.Is(err, ErrLessWork) {
+			test.Fatalf("expected %v for the held chain, got %v", ErrLessWork, err)
+		}
+	}
+}
+
+// countingHasher counts the hashes of block fields
+type countingHasher struct {
+	utils.Hasher
+	count int
+}
+
+func (h *countingHasher) Sum(o interface{}) []byte {
+	h.count++
+	return h.Hasher.Sum(o)
+}
+
+func TestReplaceChainHashesEachBlockOnce(test *testing.T) {
+	resetChain(test)
+	_, peer := testKey(test, 3)
+	var received []Block = append([]Block{GenesisBlock}, testFork(test, []Block{GenesisBlock}, 25, peer)...)
+	var counting *countingHasher = &countingHasher{Hasher: hasher}
+	hasher = counting
+	test.Cleanup(func() { hasher = counting.Hasher })
+
+	if err := ReplaceChain(received); err != nil {
+		test.Fatal(err)
+	}
+	if counting.count != len(received)-1 {
+		test.Fatalf("expected %d blocks hashed once each, got %d hashes", len(received)-1, counting.count)
+	}
+	checkCumulativeDifficulty(test)
+	if hashes := currentState().hashes; len(hashes) != len(received) || !hashes[received[len(received)-1].Hash] {
+		test.Fatalf("expected hashes of %d blocks indexed, got %d", len(received), len(hashes))
+	}
+
+	// a copy of the current chain sharing its transactions is hashed as well, a block changed in it is refused
+	var tampered []Block = append(GetBlockChain(), testFork(test, received, 1, peer)...)
+	tampered[10].Fields.Nonce++
+	if err := ReplaceChain(tampered); !errors.Is(err, ErrHashMismatch) {
+		test.Fatalf("expected %v, got %v", ErrHashMismatch, err)
+	}
+}
+
+// BenchmarkReplaceChain hashes a 10k-block chain, validates it received from a peer, and validates it extended by a block while it is the current one
+func BenchmarkReplaceChain(b *testing.B) {
+	_, address := testKey(b, 1)
+	// blocks mined blockGenerationInterval apart keep the difficulty of the genesis block
+	var chain []Block = []Block{GenesisBlock}
+	for n := 1; n <= 10000; n++ {
+		var prevBlock Block = chain[n-1]
+		chain = append(chain, mineTestBlock(BlockFields{
+			Index:        n,
+			PrevHash:     prevBlock.Hash,
+			Ts:           prevBlock.Fields.Ts + uint64(blockGenerationInterval),
+			Transactions: []tx.Transaction{tx.GetCoinbaseTransaction(address, n, prevBlock.Hash)},
+			Difficulty:   prevBlock.Fields.Difficulty,
+		}, true))
+	}
+	resetChain(b)
+
+	// hashing the fields of every block, indexing their hashes and summing their work, once per validation run
+	b.Run("hashing", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			hashChain(chain)
+		}
+	})
+	b.Run("received", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			b.StopTimer()
+			resetChain(b)
+			b.StartTimer()
+			if err := ReplaceChain(chain); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	// the current chain is the 10k-block one now, the candidate holds its blocks followed by a new one
+	var s *chainState = currentState()
+	var extended []Block = append(GetBlockChain(), testFork(b, s.blocks, 1, address)...)
+	b.Run("extending current", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			b.StopTimer()
+			lock.Lock()
+			setState(s)
+			lock.Unlock()
+			b.StartTimer()
+			if err := ReplaceChain(extended); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestRefreshTemplate(test *testing.T) {
+	_, address := testKey(test, 1)
+	var coinbaseTx tx.Transaction = tx.GetCoinbaseTransaction(address, 1, GenesisBlock.Hash)
+	var blockFields BlockFields = BlockFields{Index: 1, PrevHash: GenesisBlock.Hash, Ts: 1000, Transactions: []tx.Transaction{coinbaseTx}, Nonce: 7}
+	var before uint64 = uint64(time.Now().Unix())
+	refreshTemplate(&blockFields)
+	var transaction tx.Transaction = blockFields.Transactions[0]
+	if blockFields.Ts < before || blockFields.Nonce != 0 {
+		test.Fatalf("expected a timestamp from %d on and nonce 0, got %d and %d", before, blockFields.Ts, blockFields.Nonce)
+	}
+	var extraNonce uint64 = coinbaseTx.TxIns[0].ExtraNonce + 1
+	if extraNonce == 0 {
+		extraNonce = 1
+	}
+	if transaction.TxIns[0].ExtraNonce != extraNonce || transaction.Id != tx.GetTransactionId(transaction) || transaction.Id == coinbaseTx.Id {
+		test.Fatalf("expected extra nonce %d with a new id, got extra nonce %d and id %s", extraNonce, transaction.TxIns[0].ExtraNonce, transaction.Id)
+	}
+	if coinbaseTx.TxIns[0].ExtraNonce == transaction.TxIns[0].ExtraNonce {
+		test.Fatal("refreshing a template must not change the transactions it was built from")
+	}
+}
+
+func TestTinyNonceSearchWindowRefreshesTemplate(test *testing.T) {
+	resetChain(test)
+	_, address := testKey(test, 1)
+	// blocks mined at once raise the difficulty, so that most nonces miss it
+	mineBlocks(test, 3*int(difficultyAdjustmentInterval)+1, address)
+	if err := SetNonceSearchWindow(1); err != nil {
+		test.Fatal(err)
+	}
+	test.Cleanup(func() { SetNonceSearchWindow(defaultNonceSearchWindow) })
+
+	// with a single nonce per template, every miss refreshes the template, blocks are found at nonce 0 on later templates
+	ResetMinerStats()
+	var blocks []Block = mineBlocks(test, 10, address)
+	for _, block := range blocks {
+		if block.Fields.Difficulty < 3 || block.Fields.Nonce != 0 {
+			test.Fatalf("expected nonce 0 at difficulty 3 or more, got nonce %d at difficulty %d", block.Fields.Nonce, block.Fields.Difficulty)
+		}
+		if err := IsValidBlock(currentState().blocks[:block.Fields.Index], currentState().blocks[block.Fields.Index-1], block); err != nil {
+			test.Fatal(err)
+		}
+	}
+	// every hash was tried on its own template, the templates missing the difficulty were refreshed
+	if hashes := GetMinerStats().Hashes; hashes <= uint64(len(blocks)) {
+		test.Fatalf("expected templates refreshed, got %d hashes for %d blocks", hashes, len(blocks))
+	}
+	if _, err := IsValidBlockChain(currentState().blocks); err != nil {
+		test.Fatal(err)
+	}
+}
+
+// setTestChainParams sets chain parameters for a test, the parameters and the genesis block before it are restored exactly after it
+func setTestChainParams(tb testing.TB, params ChainParams) {
+	var paramsBefore ChainParams = chainParams
+	var genesisBefore Block = GenesisBlock
+	if err := SetChainParams(params); err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() {
+		if err := SetChainParams(paramsBefore); err != nil {
+			tb.Error(err)
+		}
+		if !reflect.DeepEqual(GenesisBlock, genesisBefore) {
+			tb.Errorf("expected genesis block %+v restored, got %+v", genesisBefore, GenesisBlock)
+		}
+	})
+}
+
+func TestMaxClockDriftBoundary(test *testing.T) {
+	_, address := testKey(test, 1)
+	for _, drift := range []uint64{0, 5, defaultMaxClockDrift} {
+		var params ChainParams = defaultChainParams
+		params.MaxClockDrift = drift
+		setTestChainParams(test, params)
+		resetChain(test)
+		mineBlocks(test, 1, address)
+		var blocks []Block = currentState().blocks
+		var prevBlock Block = blocks[len(blocks)-1]
+		for _, ahead := range []uint64{drift, drift + 1, 600} {
+			// a second passing during validation would move the boundary, such a try is repeated
+			for {
+				var now uint64 = uint64(time.Now().Unix())
+				var block Block = mineTestBlock(BlockFields{
+					Index:        prevBlock.Fields.Index + 1,
+					PrevHash:     prevBlock.Hash,
+					Ts:           now + ahead,
+					Transactions: []tx.Transaction{tx.GetCoinbaseTransaction(address, prevBlock.Fields.Index+1, prevBlock.Hash)},
+					Difficulty:   prevBlock.Fields.Difficulty,
+				}, true)
+				var err error = IsValidBlock(blocks, prevBlock, block)
+				if uint64(time.Now().Unix()) != now {
+					continue
+				}
+				var futureErr FutureTimestampError
+				if ahead <= drift && err != nil {
+					test.Fatalf("drift %d: block %ds ahead must be valid, got %v", drift, ahead, err)
+				}
+				if ahead > drift && (!errors.As(err, &futureErr) || futureErr.MaxDrift != drift || futureErr.AcceptableAt().Unix() != int64(now+ahead-drift)) {
+					test.Fatalf("drift %d: expected a FutureTimestampError for a block %ds ahead, got %v", drift, ahead, err)
+				}
+				break
+			}
+		}
+	}
+}
+
+// testLegacyForks returns two one-block forks on top of genesis whose coinbases have the version before CoinbasePrevHashTxVersion,
+// without the prev hash, for the same address and extra nonce
+func testLegacyForks(address string, ts uint64) []Block {
+	var coinbaseTx tx.Transaction = tx.GetCoinbaseTransaction(address, 1, "")
+	coinbaseTx.Version = tx.CoinbasePrevHashTxVersion - 1
+	coinbaseTx.TxIns[0].ExtraNonce = 7
+	coinbaseTx.Id = tx.GetTransactionId(coinbaseTx)
+	var forks []Block = []Block{}
+	for n := 0; n < 2; n++ {
+		var blockFields BlockFields = BlockFields{Index: 1, PrevHash: GenesisBlock.Hash, Ts: ts - uint64(n), Difficulty: GenesisBlock.Fields.Difficulty, Transactions: []tx.Transaction{coinbaseTx}}
+		forks = append(forks, mineTestBlock(blockFields, true))
+	}
+	return forks
+}
+
+func TestLegacyCoinbaseOfForksRefused(test *testing.T) {
+	resetChain(test)
+	_, address := testKey(test, 1)
+	var ts uint64 = uint64(time.Now().Unix())
+	var forks []Block = testLegacyForks(address, ts)
+	if forks[0].Hash == forks[1].Hash || forks[0].Fields.Transactions[0].Id != forks[1].Fields.Transactions[0].Id {
+		test.Fatal("forks must differ while their legacy coinbases share an id")
+	}
+	for _, fork := range forks {
+		if _, err := IsValidBlockChain([]Block{GenesisBlock, fork}); err == nil {
+			test.Fatal("legacy coinbase without the prev hash must be refused")
+		}
+	}
+
+	// current coinbases of the same height, address and extra nonce differ by the prev hash of their fork
+	var coinbaseTxs []tx.Transaction = []tx.Transaction{tx.GetCoinbaseTransaction(address, 1, forks[0].Hash), tx.GetCoinbaseTransaction(address, 1, forks[1].Hash)}
+	coinbaseTxs[1].TxIns[0].ExtraNonce = coinbaseTxs[0].TxIns[0].ExtraNonce
+	coinbaseTxs[1].Id = tx.GetTransactionId(coinbaseTxs[1])
+	if coinbaseTxs[0].Id == coinbaseTxs[1].Id {
+		test.Fatal("coinbases on different forks must have different ids")
+	}
+
+	// below the activation height of a network the rule of the transaction version still applies,
+	// the height only changes validation, so that the network keeps its genesis block
+	var params ChainParams = defaultChainParams
+	params.CoinbasePrevHashHeight = -1
+	if err := SetChainParams(params); err == nil {
+		test.Fatal("negative activation height must be refused")
+	}
+	params.CoinbasePrevHashHeight = 2
+	setTestChainParams(test, params)
+	if GenesisBlock.Hash != genesisHash {
+		test.Fatalf("expected genesis hash %s kept, got %s", genesisHash, GenesisBlock.Hash)
+	}
+	for _, fork := range forks {
+		if _, err := IsValidBlockChain([]Block{GenesisBlock, fork}); err != nil {
+			test.Fatalf("legacy coinbase below the activation height must be accepted: %v", err)
+		}
+	}
+}
+
+// savedTransactionIds returns ids of transactions saved in a pool file
+func savedTransactionIds(tb testing.TB, path string) map[string]bool {
+	transactions, err := txpool.ReadFromFile(path)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	var ids map[string]bool = map[string]bool{}
+	for _, transaction := range transactions {
+		ids[transaction.Id] = true
+	}
+	return ids
+}
+
+func TestSavedTransactionsAddedOnceSynced(test *testing.T) {
+	resetChain(test)
+	test.Cleanup(func() {
+		savedTransactionsLock.Lock()
+		savedTransactions = nil
+		savedTransactionsLock.Unlock()
+	})
+	privateKey, address := testKey(test, 1)
+	_, recipient := testKey(test, 2)
+	mineBlocks(test, 2, address)
+	var spendable []tx.UnspentTxOut = unspentTxOutsOf(address)
+	var kept tx.Transaction = testTransaction(test, privateKey, spendable[:1], recipient, 10, 0.001)
+	var stale tx.Transaction = testTransaction(test, privateKey, spendable[1:2], recipient, 10, 0.001)
+	for _, transaction := range []tx.Transaction{kept, stale} {
+		if err := HandleReceivedTransaction(transaction); err != nil {
+			test.Fatal(err)
+		}
+	}
+	var path string = filepath.Join(test.TempDir(), "txpool.json")
+	SaveTransactionPool(path)
+	if ids := savedTransactionIds(test, path); len(ids) != 2 || !ids[kept.Id] || !ids[stale.Id] {
+		test.Fatalf("expected both pool transactions saved, got %v", ids)
+	}
+
+	// the chain the node syncs to has the stale transaction mined meanwhile
+	var blocks []Block = GetBlockChain()
+	var block Block = testFork(test, blocks, 1, address)[0]
+	block.Fields.Transactions = append(block.Fields.Transactions, stale)
+	var synced []Block = append(blocks, mineTestBlock(block.Fields, true))
+
+	// on restart the chain holds the genesis block only, saved transactions are pending and still saved
+	resetChain(test)
+	LoadTransactionPool(path)
+	if txpool.HasTransaction(kept.Id) || txpool.HasTransaction(stale.Id) {
+		test.Fatal("saved transactions must not enter the pool before the chain has synced")
+	}
+	SaveTransactionPool(path)
+	if ids := savedTransactionIds(test, path); len(ids) != 2 {
+		test.Fatalf("expected pending transactions saved again, got %v", ids)
+	}
+
+	if err := ReplaceChain(synced); err != nil {
+		test.Fatal(err)
+	}
+	AddSavedTransactions()
+	if !txpool.HasTransaction(kept.Id) || txpool.HasTransaction(stale.Id) {
+		test.Fatal("expected the saved transaction still valid added and the mined one discarded")
+	}
+	SaveTransactionPool(path)
+	if ids := savedTransactionIds(test, path); len(ids) != 1 || !ids[kept.Id] {
+		test.Fatalf("expected only the transaction added to the pool saved, got %v", ids)
+	}
+	// saved transactions are added once
+	resetChain(test)
+	AddSavedTransactions()
+	if txpool.HasTransaction(kept.Id) {
+		test.Fatal("saved transactions must not be added again")
+	}
+}
+
+func TestLoadMissingOrCorruptTransactionPool(test *testing.T) {
+	resetChain(test)
+	var dir string = test.TempDir()
+	var corruptPath string = filepath.Join(dir, "corrupt.json")
+	for content, path := range map[string]string{"": filepath.Join(dir, "missing.json"), "[{\"Id\":": corruptPath, "{}": filepath.Join(dir, "object.json")} {
+		if content != "" {
+			if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+				test.Fatal(err)
+			}
+		}
+		LoadTransactionPool(path)
+		savedTransactionsLock.Lock()
+		var pending int = len(savedTransactions)
+		savedTransactionsLock.Unlock()
+		if pending != 0 {
+			test.Fatalf("%s: expected no saved transactions, got %d", path, pending)
+		}
+		AddSavedTransactions()
+		if len(txpool.GetTransactionPool()) != 0 {
+			test.Fatalf("%s: expected an empty pool", path)
+		}
+	}
+	// the empty pool is saved over a corrupt file
+	SaveTransactionPool(corruptPath)
+	if ids := savedTransactionIds(test, corruptPath); len(ids) != 0 {
+		test.Fatalf("expected an empty pool saved, got %v", ids)
+	}
+}
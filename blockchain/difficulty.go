@@ -0,0 +1,56 @@
+package blockchain
+
+// DifficultyForecast describes the difficulty of the next block and the next difficulty adjustment
+// NextAdjustmentHeight is the index of the next block mined at an adjusted difficulty, BlocksUntilAdjustment the number of blocks mined before it
+// AverageBlockInterval is the average number of seconds between blocks since the last adjustment, 0 if no block was mined since
+// EstimatedNextDifficulty is an estimate: the retarget rule applied as if the rest of the window is mined at the average interval
+type DifficultyForecast struct {
+	Difficulty              uint32
+	NextAdjustmentHeight    int
+	BlocksUntilAdjustment   int
+	AverageBlockInterval    float64
+	EstimatedNextDifficulty uint32
+}
+
+// GetDifficultyForecast returns the difficulty forecast of the current blockchain
+func GetDifficultyForecast() DifficultyForecast {
+	return forecastDifficulty(currentState().blocks)
+}
+
+// forecastDifficulty returns the difficulty forecast of a given blockchain
+// the estimate applies retargetDifficulty to the partial window extrapolated to a full one, as getAdjustedDifficulty does to a full window
+func forecastDifficulty(blockchain_ []Block) DifficultyForecast {
+	var (
+		latestBlock Block = blockchain_[len(blockchain_)-1]
+		interval    int   = int(difficultyAdjustmentInterval)
+		forecast    DifficultyForecast
+	)
+	// the forecast is made for the current chain, which starts with the genesis block
+	forecast.Difficulty, _ = getDifficulty(blockchain_, latestBlock)
+
+	// a block is mined at an adjusted difficulty if the block before it has a non-zero index that is a multiple of the interval,
+	// the next block is excluded, its difficulty is already known
+	var nextIndex int = latestBlock.Fields.Index + 1
+	forecast.NextAdjustmentHeight = (nextIndex/interval+1)*interval + 1
+	if nextIndex%interval == 0 {
+		forecast.NextAdjustmentHeight = nextIndex + 1
+	}
+	forecast.BlocksUntilAdjustment = forecast.NextAdjustmentHeight - nextIndex
+	forecast.EstimatedNextDifficulty = forecast.Difficulty
+
+	// the window starts with the block mined at the last adjustment, it may not be mined yet
+	var windowStart int = forecast.NextAdjustmentHeight - interval
+	var blocksMined int = latestBlock.Fields.Index - windowStart
+	if blocksMined <= 0 {
+		return forecast
+	}
+	startBlock, _ := blockAtHeight(blockchain_, latestBlock, windowStart)
+	var elapsed float64 = float64(latestBlock.Fields.Ts) - float64(startBlock.Fields.Ts)
+	if elapsed < 0 {
+		elapsed = 0
+	}
+	forecast.AverageBlockInterval = elapsed / float64(blocksMined)
+	var projected uint64 = uint64(forecast.AverageBlockInterval * float64(interval-1))
+	forecast.EstimatedNextDifficulty = retargetDifficulty(startBlock.Fields.Difficulty, projected)
+	return forecast
+}
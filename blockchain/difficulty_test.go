@@ -0,0 +1,178 @@
+package blockchain
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// syntheticChain returns a chain of blocks mined given seconds apart, each at the difficulty the retarget rule gives it
+// blocks are not mined, only their indexes, timestamps, difficulties and links are set
+func syntheticChain(initialDifficulty uint32, intervals []uint64) []Block {
+	var chain []Block = []Block{{Fields: BlockFields{Index: 0, Ts: 1000000, Difficulty: initialDifficulty}, Hash: "0"}}
+	return extendSyntheticChain(chain, intervals)
+}
+
+// extendSyntheticChain appends blocks mined given seconds apart to a synthetic chain
+func extendSyntheticChain(chain []Block, intervals []uint64) []Block {
+	for _, interval := range intervals {
+		var prevBlock Block = chain[len(chain)-1]
+		difficulty, found := getDifficulty(chain, prevBlock)
+		if !found {
+			panic("adjustment block missing from synthetic chain")
+		}
+		chain = append(chain, Block{
+			Fields: BlockFields{Index: prevBlock.Fields.Index + 1, PrevHash: prevBlock.Hash, Ts: prevBlock.Fields.Ts + interval, Difficulty: difficulty},
+			Hash:   fmt.Sprint(prevBlock.Fields.Index + 1),
+		})
+	}
+	return chain
+}
+
+// repeatInterval returns count intervals of given seconds
+func repeatInterval(seconds uint64, count int) []uint64 {
+	var intervals []uint64 = make([]uint64, count)
+	for n := 0; n < count; n++ {
+		intervals[n] = seconds
+	}
+	return intervals
+}
+
+func TestForecastAdjustmentHeight(test *testing.T) {
+	var chain []Block = syntheticChain(0, nil)
+	for latestIndex := 0; latestIndex < 45; latestIndex++ {
+		var forecast DifficultyForecast = forecastDifficulty(chain)
+		// the next adjustment is the first block after the next one whose prev block makes getDifficulty retarget
+		var nextIndex int = latestIndex + 1
+		var expected int = nextIndex + 1
+		for (expected-1)%int(difficultyAdjustmentInterval) != 0 || expected-1 == 0 {
+			expected++
+		}
+		if forecast.NextAdjustmentHeight != expected || forecast.BlocksUntilAdjustment != expected-nextIndex {
+			test.Fatalf("latest block %d: expected adjustment at %d in %d blocks, got %d in %d",
+				latestIndex, expected, expected-nextIndex, forecast.NextAdjustmentHeight, forecast.BlocksUntilAdjustment)
+		}
+		if difficulty, _ := getDifficulty(chain, chain[len(chain)-1]); forecast.Difficulty != difficulty {
+			test.Fatalf("latest block %d: expected difficulty %d, got %d", latestIndex, difficulty, forecast.Difficulty)
+		}
+		chain = extendSyntheticChain(chain, []uint64{uint64(blockGenerationInterval)})
+	}
+}
+
+func TestForecastMatchesRetarget(test *testing.T) {
+	// blocks mined too fast, on time, too slow, and the boundaries of the retarget rule
+	for _, seconds := range []uint64{0, 1, 4, 5, 6, 10, 20, 22, 23, 40} {
+		for _, initialDifficulty := range []uint32{0, 3} {
+			// partial windows of every length after the first adjustments
+			for mined := 12; mined < 12+2*int(difficultyAdjustmentInterval); mined++ {
+				var chain []Block = syntheticChain(initialDifficulty, repeatInterval(seconds, mined))
+				var forecast DifficultyForecast = forecastDifficulty(chain)
+				// with no block of the window mined past its first one there is no average to estimate from
+				if blocksMined := mined - (forecast.NextAdjustmentHeight - int(difficultyAdjustmentInterval)); blocksMined <= 0 {
+					continue
+				}
+				if forecast.AverageBlockInterval != float64(seconds) {
+					test.Fatalf("%ds blocks, %d mined: expected average interval %d, got %v", seconds, mined, seconds, forecast.AverageBlockInterval)
+				}
+
+				// mining the rest of the window at the average interval gives the estimated difficulty
+				chain = extendSyntheticChain(chain, repeatInterval(uint64(forecast.AverageBlockInterval), forecast.BlocksUntilAdjustment))
+				var latestBlock Block = chain[len(chain)-1]
+				if latestBlock.Fields.Index+1 != forecast.NextAdjustmentHeight {
+					test.Fatalf("expected the adjustment block next, latest block is %d", latestBlock.Fields.Index)
+				}
+				difficulty, _ := getDifficulty(chain, latestBlock)
+				if difficulty != forecast.EstimatedNextDifficulty {
+					test.Fatalf("%ds blocks, %d mined: estimated %d, retarget gives %d", seconds, mined, forecast.EstimatedNextDifficulty, difficulty)
+				}
+			}
+		}
+	}
+}
+
+func TestForecastWithoutBlocksSinceAdjustment(test *testing.T) {
+	var forecast DifficultyForecast = forecastDifficulty(syntheticChain(2, nil))
+	if forecast.AverageBlockInterval != 0 || forecast.EstimatedNextDifficulty != 2 || forecast.Difficulty != 2 {
+		test.Fatalf("genesis only: expected difficulty 2 with no average interval, got %+v", forecast)
+	}
+
+	// the block the window starts with is not mined yet
+	var chain []Block = syntheticChain(0, repeatInterval(1, int(difficultyAdjustmentInterval)))
+	forecast = forecastDifficulty(chain)
+	if forecast.AverageBlockInterval != 0 || forecast.EstimatedNextDifficulty != forecast.Difficulty || forecast.Difficulty != 1 {
+		test.Fatalf("adjustment block next: expected difficulty 1 kept as the estimate, got %+v", forecast)
+	}
+}
+
+func TestForecastWithTimestampsGoingBack(test *testing.T) {
+	var chain []Block = syntheticChain(1, repeatInterval(10, 12))
+	// a block may have a timestamp before the block the window starts with
+	chain[len(chain)-1].Fields.Ts = chain[len(chain)-2].Fields.Ts - 100
+	var forecast DifficultyForecast = forecastDifficulty(chain)
+	if forecast.AverageBlockInterval != 0 {
+		test.Fatalf("expected no average interval, got %v", forecast.AverageBlockInterval)
+	}
+	if forecast.EstimatedNextDifficulty != retargetDifficulty(chain[11].Fields.Difficulty, 0) {
+		test.Fatalf("expected the estimate of a window mined at once, got %d", forecast.EstimatedNextDifficulty)
+	}
+}
+
+func TestDifficultyOfChainFragment(test *testing.T) {
+	// blocks mined too fast and too slow, so that each adjustment changes the difficulty
+	var intervals []uint64 = append(repeatInterval(1, 15), repeatInterval(40, 12)...)
+	var chain []Block = syntheticChain(3, append(intervals, repeatInterval(2, 10)...))
+	for start := 1; start < len(chain); start++ {
+		var fragment []Block = chain[start:]
+		for n := 0; n < len(fragment); n++ {
+			var latestBlock Block = fragment[n]
+			expected, _ := getDifficulty(chain, latestBlock)
+			// an adjusted difficulty needs the block the window starts with, it must be in the fragment
+			var index int = latestBlock.Fields.Index
+			var adjusted bool = index != 0 && index%int(difficultyAdjustmentInterval) == 0
+			var inFragment bool = index+1-int(difficultyAdjustmentInterval) >= start
+			difficulty, found := getDifficulty(fragment[:n+1], latestBlock)
+			if adjusted && !inFragment {
+				if found {
+					test.Fatalf("fragment from %d, block %d: adjustment block must not be found", start, index)
+				}
+				continue
+			}
+			if !found || difficulty != expected {
+				test.Fatalf("fragment from %d, block %d: expected difficulty %d, got %d (found %v)", start, index, expected, difficulty, found)
+			}
+			// positions don't match indexes in a reversed fragment, the block is found by its PrevHash links
+			var reversed []Block = make([]Block, n+1)
+			for i := 0; i <= n; i++ {
+				reversed[i] = fragment[n-i]
+			}
+			if difficulty, found := getDifficulty(reversed, latestBlock); !found || difficulty != expected {
+				test.Fatalf("reversed fragment from %d, block %d: expected difficulty %d, got %d (found %v)", start, index, expected, difficulty, found)
+			}
+		}
+	}
+}
+
+func TestValidateBlockOfChainFragment(test *testing.T) {
+	resetChain(test)
+	_, address := testKey(test, 1)
+	// blocks mined at once raise the difficulty at every adjustment
+	var blocks []Block = append([]Block{GenesisBlock}, mineBlocks(test, 2*int(difficultyAdjustmentInterval)+3, address)...)
+	for n := 1; n < len(blocks); n++ {
+		var prevIndex int = blocks[n-1].Fields.Index
+		var adjusted bool = prevIndex != 0 && prevIndex%int(difficultyAdjustmentInterval) == 0
+		for start := 0; start < n; start++ {
+			// the fragment holds the prev block and the blocks before it from start on
+			var err error = IsValidBlock(blocks[start:n], blocks[n-1], blocks[n])
+			if adjusted && prevIndex+1-int(difficultyAdjustmentInterval) < start {
+				if !errors.Is(err, ErrAdjustmentBlockMissing) {
+					test.Fatalf("block %d in fragment from %d: expected %v, got %v", n, start, ErrAdjustmentBlockMissing, err)
+				}
+			} else if err != nil {
+				test.Fatalf("block %d in fragment from %d: %v", n, start, err)
+			}
+		}
+	}
+	if blocks[len(blocks)-1].Fields.Difficulty == GenesisBlock.Fields.Difficulty {
+		test.Fatal("expected the difficulty to be adjusted")
+	}
+}
@@ -0,0 +1,86 @@
+package blockchain
+
+import (
+	"fmt"
+	tx "naivecoin/transactions"
+)
+
+// GenesisMismatchError is a reason of a blockchain not starting with the genesis block, Field names the first field that differs
+type GenesisMismatchError struct {
+	Field string
+}
+
+func (e GenesisMismatchError) Error() string {
+	return fmt.Sprintf("%s: %s differs", ErrGenesisMismatch.Error(), e.Field)
+}
+
+func (e GenesisMismatchError) Is(target error) bool {
+	return target == ErrGenesisMismatch
+}
+
+// matchGenesisBlock compares a block with the genesis block field by field
+// returns a GenesisMismatchError naming the first field that differs, nil if the block is the genesis block
+func matchGenesisBlock(block Block) error {
+	var genesis BlockFields = GenesisBlock.Fields
+	switch {
+	case block.Hash != GenesisBlock.Hash:
+		return GenesisMismatchError{Field: "Hash"}
+	case block.Fields.Index != genesis.Index:
+		return GenesisMismatchError{Field: "Index"}
+	case block.Fields.PrevHash != genesis.PrevHash:
+		return GenesisMismatchError{Field: "PrevHash"}
+	case block.Fields.Ts != genesis.Ts:
+		return GenesisMismatchError{Field: "Ts"}
+	case block.Fields.Difficulty != genesis.Difficulty:
+		return GenesisMismatchError{Field: "Difficulty"}
+	case block.Fields.Nonce != genesis.Nonce:
+		return GenesisMismatchError{Field: "Nonce"}
+	case len(block.Fields.Transactions) != len(genesis.Transactions):
+		return GenesisMismatchError{Field: "Transactions"}
+	}
+	for n := 0; n < len(genesis.Transactions); n++ {
+		if field := transactionMismatch(block.Fields.Transactions[n], genesis.Transactions[n]); field != "" {
+			return GenesisMismatchError{Field: fmt.Sprintf("Transactions[%d].%s", n, field)}
+		}
+	}
+	return nil
+}
+
+// transactionMismatch returns the name of the first field of a transaction that differs from an expected one, empty if none does
+func transactionMismatch(transaction tx.Transaction, expected tx.Transaction) string {
+	switch {
+	case transaction.Id != expected.Id:
+		return "Id"
+	case transaction.Version != expected.Version:
+		return "Version"
+	case len(transaction.TxIns) != len(expected.TxIns):
+		return "TxIns"
+	case len(transaction.TxOuts) != len(expected.TxOuts):
+		return "TxOuts"
+	}
+	for n := 0; n < len(expected.TxIns); n++ {
+		var txIn, expectedTxIn tx.TxIn = transaction.TxIns[n], expected.TxIns[n]
+		switch {
+		case txIn.TxOutId != expectedTxIn.TxOutId:
+			return fmt.Sprintf("TxIns[%d].TxOutId", n)
+		case txIn.TxOutIndex != expectedTxIn.TxOutIndex:
+			return fmt.Sprintf("TxIns[%d].TxOutIndex", n)
+		case txIn.Signature != expectedTxIn.Signature:
+			return fmt.Sprintf("TxIns[%d].Signature", n)
+		case txIn.ExtraNonce != expectedTxIn.ExtraNonce:
+			return fmt.Sprintf("TxIns[%d].ExtraNonce", n)
+		case txIn.PubKey != expectedTxIn.PubKey:
+			return fmt.Sprintf("TxIns[%d].PubKey", n)
+		}
+	}
+	for n := 0; n < len(expected.TxOuts); n++ {
+		var txOut, expectedTxOut tx.TxOut = transaction.TxOuts[n], expected.TxOuts[n]
+		switch {
+		case txOut.Address != expectedTxOut.Address:
+			return fmt.Sprintf("TxOuts[%d].Address", n)
+		case txOut.Amount != expectedTxOut.Amount:
+			return fmt.Sprintf("TxOuts[%d].Amount", n)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,130 @@
+package blockchain
+
+import (
+	"errors"
+	tx "naivecoin/transactions"
+	"naivecoin/utils"
+	"reflect"
+	"testing"
+)
+
+// copyGenesisBlock returns a copy of the genesis block sharing nothing with it
+func copyGenesisBlock() Block {
+	var block Block = GenesisBlock
+	block.Fields.Transactions = []tx.Transaction{}
+	for _, transaction := range GenesisBlock.Fields.Transactions {
+		transaction.TxIns = append(tx.TxInCollection{}, transaction.TxIns...)
+		transaction.TxOuts = append(tx.TxOutCollection{}, transaction.TxOuts...)
+		block.Fields.Transactions = append(block.Fields.Transactions, transaction)
+	}
+	return block
+}
+
+func TestGenesisMismatchNamesField(test *testing.T) {
+	var cases = []struct {
+		field  string
+		tamper func(block *Block)
+	}{
+		{"Hash", func(block *Block) { block.Hash = hashBlockFields(block.Fields) + "0" }},
+		{"Index", func(block *Block) { block.Fields.Index = 1 }},
+		{"PrevHash", func(block *Block) { block.Fields.PrevHash = GenesisBlock.Hash }},
+		{"Ts", func(block *Block) { block.Fields.Ts++ }},
+		{"Difficulty", func(block *Block) { block.Fields.Difficulty++ }},
+		{"Nonce", func(block *Block) { block.Fields.Nonce++ }},
+		{"Transactions", func(block *Block) {
+			block.Fields.Transactions = append(block.Fields.Transactions, block.Fields.Transactions[0])
+		}},
+		{"Transactions", func(block *Block) { block.Fields.Transactions = nil }},
+		{"Transactions[0].Id", func(block *Block) { block.Fields.Transactions[0].Id = GenesisBlock.Hash }},
+		{"Transactions[0].Version", func(block *Block) { block.Fields.Transactions[0].Version = tx.CurrentTxVersion + 1 }},
+		{"Transactions[0].TxIns", func(block *Block) { block.Fields.Transactions[0].TxIns = nil }},
+		{"Transactions[0].TxOuts", func(block *Block) {
+			block.Fields.Transactions[0].TxOuts = append(block.Fields.Transactions[0].TxOuts, block.Fields.Transactions[0].TxOuts[0])
+		}},
+		{"Transactions[0].TxIns[0].TxOutId", func(block *Block) { block.Fields.Transactions[0].TxIns[0].TxOutId = "a" }},
+		{"Transactions[0].TxIns[0].TxOutIndex", func(block *Block) { block.Fields.Transactions[0].TxIns[0].TxOutIndex = 1 }},
+		{"Transactions[0].TxIns[0].Signature", func(block *Block) { block.Fields.Transactions[0].TxIns[0].Signature = "a" }},
+		{"Transactions[0].TxIns[0].ExtraNonce", func(block *Block) { block.Fields.Transactions[0].TxIns[0].ExtraNonce = 1 }},
+		{"Transactions[0].TxIns[0].PubKey", func(block *Block) { block.Fields.Transactions[0].TxIns[0].PubKey = "a" }},
+		{"Transactions[0].TxOuts[0].Address", func(block *Block) {
+			_, address := testKey(test, 1)
+			block.Fields.Transactions[0].TxOuts[0].Address = address
+		}},
+		{"Transactions[0].TxOuts[0].Amount", func(block *Block) { block.Fields.Transactions[0].TxOuts[0].Amount = 50.000001 }},
+		// the first field that differs is named, the hash is checked before the fields it is the hash of
+		{"Hash", func(block *Block) {
+			block.Fields.Index = 1
+			block.Hash = hashBlockFields(block.Fields)
+		}},
+		{"Index", func(block *Block) {
+			block.Fields.Index = 1
+			block.Fields.Transactions[0].Id = GenesisBlock.Hash
+		}},
+	}
+
+	if err := matchGenesisBlock(copyGenesisBlock()); err != nil {
+		test.Fatalf("copy of the genesis block must match it: %v", err)
+	}
+	for _, c := range cases {
+		var block Block = copyGenesisBlock()
+		c.tamper(&block)
+		for _, err := range []error{matchGenesisBlock(block), func() error { _, err := IsValidBlockChain([]Block{block}); return err }()} {
+			var genesisErr GenesisMismatchError
+			if !errors.Is(err, ErrGenesisMismatch) || !errors.As(err, &genesisErr) || genesisErr.Field != c.field {
+				test.Fatalf("expected %s to differ, got %v", c.field, err)
+			}
+		}
+	}
+	if err := matchGenesisBlock(copyGenesisBlock()); err != nil {
+		test.Fatalf("tampering with copies must not change the genesis block: %v", err)
+	}
+}
+
+func TestDefaultGenesisHash(test *testing.T) {
+	if GenesisBlock.Hash != genesisHash || hashBlockFields(GenesisBlock.Fields) != genesisHash {
+		test.Fatalf("expected genesis hash %s, got %s hashed to %s", genesisHash, GenesisBlock.Hash, hashBlockFields(GenesisBlock.Fields))
+	}
+	if tx.GetTransactionId(GenesisTransaction) != GenesisTransaction.Id {
+		test.Fatalf("expected genesis transaction id %s, got %s", GenesisTransaction.Id, tx.GetTransactionId(GenesisTransaction))
+	}
+}
+
+func TestSetChainParamsRestoresGenesis(test *testing.T) {
+	test.Cleanup(func() { SetChainParams(defaultChainParams) })
+	var genesis Block = copyGenesisBlock()
+	var cases = []ChainParams{
+		{Hasher: utils.DoubleSHA256Hasher{}.Name(), Version: LegacyChainVersion, MaxClockDrift: defaultMaxClockDrift},
+		{Hasher: utils.SHA256Hasher{}.Name(), Version: CompactDifficultyChainVersion, MaxClockDrift: defaultMaxClockDrift},
+	}
+	for _, params := range cases {
+		if err := SetChainParams(params); err != nil {
+			test.Fatal(err)
+		}
+		if GenesisBlock.Hash == genesisHash || hashBlockFields(GenesisBlock.Fields) != GenesisBlock.Hash {
+			test.Fatalf("%+v: expected a rehashed genesis block, got %s", params, GenesisBlock.Hash)
+		}
+		if GenesisBlock.Fields.Transactions[0].Id != GenesisTransaction.Id || tx.GetTransactionId(GenesisTransaction) != GenesisTransaction.Id {
+			test.Fatalf("%+v: genesis block must hold the genesis transaction of its hasher", params)
+		}
+		if err := SetChainParams(defaultChainParams); err != nil {
+			test.Fatal(err)
+		}
+		if err := matchGenesisBlock(genesis); err != nil || !reflect.DeepEqual(GenesisBlock, genesis) || !reflect.DeepEqual(GenesisTransaction, genesis.Fields.Transactions[0]) {
+			test.Fatalf("%+v: default parameters must restore the hardcoded genesis block, got %+v", params, GenesisBlock)
+		}
+	}
+}
+
+func TestValidationParamsKeepGenesis(test *testing.T) {
+	var genesis Block = copyGenesisBlock()
+	var cases = []ChainParams{
+		{Hasher: utils.SHA256Hasher{}.Name(), Version: LegacyChainVersion, MaxClockDrift: 600},
+		{Hasher: utils.SHA256Hasher{}.Name(), Version: LegacyChainVersion, MaxClockDrift: defaultMaxClockDrift, CoinbasePrevHashHeight: 1000},
+	}
+	for _, params := range cases {
+		setTestChainParams(test, params)
+		if !reflect.DeepEqual(GenesisBlock, genesis) {
+			test.Fatalf("%+v: expected the hardcoded genesis block, got %+v", params, GenesisBlock)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package blockchain
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// hashRateWindow is the number of one-second buckets the hash rate is averaged over
+const hashRateWindow int = 30
+
+// hashCountInterval is the number of hashes tried between updates of miner stats and checks for a new tip or a done context
+const hashCountInterval int = 4096
+
+// minedBlocksKept is the number of recently found blocks checked for being forked off when the chain is replaced
+const minedBlocksKept int = 100
+
+// MinerStats describes mining since the node started or since stats were last reset
+// HashRate is hashes per second over the last 30 seconds, SecondsSinceLastBlock is nil if no block was found
+// BlocksOrphaned counts found blocks that were rejected or later forked off by a replaced chain
+type MinerStats struct {
+	Mining                bool
+	Hashes                uint64
+	HashRate              float64
+	BlocksFound           int
+	BlocksOrphaned        int
+	SecondsSinceLastBlock *int64
+}
+
+// minerStats holds counters of mining, guarded by minerStatsLock
+// hashBuckets holds hashes tried in each of the last seconds, hashBucketSeconds holds the unix second of each bucket
+var minerStats struct {
+	hashes            uint64
+	hashBuckets       [hashRateWindow]uint64
+	hashBucketSeconds [hashRateWindow]int64
+	blocksFound       int
+	blocksOrphaned    int
+	lastBlockFound    time.Time
+	minedBlocks       []string
+}
+var minerStatsLock sync.Mutex
+
+// recordHashes adds a number of tried hashes to miner stats
+func recordHashes(count int) {
+	minerStatsLock.Lock()
+	defer minerStatsLock.Unlock()
+	var second int64 = time.Now().Unix()
+	var bucket int = int(second % int64(hashRateWindow))
+	if minerStats.hashBucketSeconds[bucket] != second {
+		minerStats.hashBucketSeconds[bucket] = second
+		minerStats.hashBuckets[bucket] = 0
+	}
+	minerStats.hashBuckets[bucket] += uint64(count)
+	minerStats.hashes += uint64(count)
+}
+
+// recordBlockFound counts a block with a valid hash, orphaned if it was not added to the chain
+func recordBlockFound(hash string, added bool) {
+	minerStatsLock.Lock()
+	defer minerStatsLock.Unlock()
+	minerStats.blocksFound++
+	minerStats.lastBlockFound = time.Now()
+	if !added {
+		minerStats.blocksOrphaned++
+		return
+	}
+	minerStats.minedBlocks = append(minerStats.minedBlocks, hash)
+	if len(minerStats.minedBlocks) > minedBlocksKept {
+		minerStats.minedBlocks = minerStats.minedBlocks[len(minerStats.minedBlocks)-minedBlocksKept:]
+	}
+}
+
+// recordChainReplaced counts recently found blocks missing from a replaced chain as orphaned
+func recordChainReplaced(chainHashes map[string]bool) {
+	minerStatsLock.Lock()
+	defer minerStatsLock.Unlock()
+	var kept []string = []string{}
+	for _, hash := range minerStats.minedBlocks {
+		if chainHashes[hash] {
+			kept = append(kept, hash)
+		} else {
+			minerStats.blocksOrphaned++
+		}
+	}
+	minerStats.minedBlocks = kept
+}
+
+// GetMinerStats returns counters of mining, they survive restarts of mining on a new tip
+func GetMinerStats() MinerStats {
+	minerStatsLock.Lock()
+	defer minerStatsLock.Unlock()
+	var now int64 = time.Now().Unix()
+	var windowHashes uint64
+	for n := 0; n < hashRateWindow; n++ {
+		// the current second is not over yet, so it is left out of the rate
+		if age := now - minerStats.hashBucketSeconds[n]; age > 0 && age <= int64(hashRateWindow) {
+			windowHashes += minerStats.hashBuckets[n]
+		}
+	}
+	var stats MinerStats = MinerStats{
+		Mining:         IsMining(),
+		Hashes:         minerStats.hashes,
+		HashRate:       float64(windowHashes) / float64(hashRateWindow),
+		BlocksFound:    minerStats.blocksFound,
+		BlocksOrphaned: minerStats.blocksOrphaned,
+	}
+	if !minerStats.lastBlockFound.IsZero() {
+		var seconds int64 = int64(time.Since(minerStats.lastBlockFound).Seconds())
+		stats.SecondsSinceLastBlock = &seconds
+	}
+	return stats
+}
+
+// ResetMinerStats sets all counters of mining to zero
+func ResetMinerStats() {
+	minerStatsLock.Lock()
+	defer minerStatsLock.Unlock()
+	minerStats.hashes = 0
+	minerStats.hashBuckets = [hashRateWindow]uint64{}
+	minerStats.hashBucketSeconds = [hashRateWindow]int64{}
+	minerStats.blocksFound = 0
+	minerStats.blocksOrphaned = 0
+	minerStats.lastBlockFound = time.Time{}
+	minerStats.minedBlocks = nil
+}
+
+// Summary returns miner stats in one line, e.g. "mining 1.2 kH/s, 5 found, 1 orphaned, last 42s ago"
+func (stats MinerStats) Summary() string {
+	var state string = "idle"
+	if stats.Mining {
+		state = "mining"
+	}
+	var rate string = fmt.Sprintf("%.0f H/s", stats.HashRate)
+	if stats.HashRate >= 1e6 {
+		rate = fmt.Sprintf("%.1f MH/s", stats.HashRate/1e6)
+	} else if stats.HashRate >= 1e3 {
+		rate = fmt.Sprintf("%.1f kH/s", stats.HashRate/1e3)
+	}
+	var summary string = fmt.Sprintf("%s %s, %d found, %d orphaned", state, rate, stats.BlocksFound, stats.BlocksOrphaned)
+	if stats.SecondsSinceLastBlock != nil {
+		summary += fmt.Sprintf(", last %ds ago", *stats.SecondsSinceLastBlock)
+	}
+	return summary
+}
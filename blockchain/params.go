@@ -0,0 +1,226 @@
+package blockchain
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	tx "naivecoin/transactions"
+	"naivecoin/utils"
+	"strconv"
+	"strings"
+)
+
+// chain versions: the version of a chain is set in its chain parameters, it changes how block hashes are computed
+// blocks of legacy chains hash their difficulty as decimal digits, the same digits the float difficulty of earlier releases hashed to
+// since version 2 block hashes commit to the difficulty as compact bits of its target and to the chain version
+const (
+	LegacyChainVersion            int = 1
+	CompactDifficultyChainVersion int = 2
+	currentChainVersion           int = CompactDifficultyChainVersion
+)
+
+// ChainParams holds parameters all nodes of a network must agree on, the genesis block is built with them
+// Hasher names the hasher of block hashes and transaction ids, see utils.GetHasher
+// Version is the chain version, see LegacyChainVersion and CompactDifficultyChainVersion
+// MaxClockDrift is the number of seconds a block timestamp may be ahead of the clock of a node validating it
+// CoinbasePrevHashHeight is the height from which every coinbase must refer to the prev block hash whatever its transaction version,
+// networks with blocks mined before the rule set it past their tip so that those blocks stay valid
+type ChainParams struct {
+	Hasher                 string
+	Version                int
+	MaxClockDrift          uint64
+	CoinbasePrevHashHeight int
+}
+
+// defaultMaxClockDrift is the max clock drift of the hardcoded genesis block, in seconds
+const defaultMaxClockDrift uint64 = 60
+
+// defaultChainParams are the parameters of the hardcoded genesis block
+var defaultChainParams ChainParams = ChainParams{Hasher: utils.SHA256Hasher{}.Name(), Version: LegacyChainVersion, MaxClockDrift: defaultMaxClockDrift}
+
+// chainParams are the parameters set last, see SetChainParams
+var chainParams ChainParams = defaultChainParams
+
+// hasher computes block hashes, set from chain parameters
+var hasher utils.Hasher = utils.SHA256Hasher{}
+
+// chainVersion is the version of the chain, set from chain parameters
+var chainVersion int = LegacyChainVersion
+
+// maxClockDrift is the number of seconds a block timestamp may be ahead of now, set from chain parameters
+var maxClockDrift uint64 = defaultMaxClockDrift
+
+// LoadChainParams reads chain parameters from a json file, missing fields keep their defaults, and sets them
+func LoadChainParams(path string) error {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var params ChainParams = defaultChainParams
+	if err := json.Unmarshal(content, &params); err != nil {
+		return fmt.Errorf("invalid chain parameters %s: %s", path, err.Error())
+	}
+	return SetChainParams(params)
+}
+
+// SetChainParams sets chain parameters and rebuilds the genesis block with them, it must be called before the blockchain grows
+// the genesis block keeps its hardcoded id and hash with the default hasher and chain version, nodes with another hasher or version
+// have another genesis hash, so the handshake keeps them apart, other parameters only change how blocks are validated
+func SetChainParams(params ChainParams) error {
+	hasher_, err := utils.GetHasher(params.Hasher)
+	if err != nil {
+		return err
+	}
+	if params.Version < LegacyChainVersion || params.Version > currentChainVersion {
+		return fmt.Errorf("unknown chain version %d", params.Version)
+	}
+	if params.CoinbasePrevHashHeight < 0 {
+		return fmt.Errorf("invalid coinbase prev hash height %d", params.CoinbasePrevHashHeight)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	chainParams = params
+	hasher = hasher_
+	chainVersion = params.Version
+	maxClockDrift = params.MaxClockDrift
+	tx.SetHasher(hasher_)
+	tx.SetCoinbasePrevHashHeight(params.CoinbasePrevHashHeight)
+	GenesisTransaction, GenesisBlock = newGenesisBlock(params)
+	setState(newGenesisState())
+	return nil
+}
+
+// hashBlockFields returns the hex encoded hash of block fields
+func hashBlockFields(fields BlockFields) string {
+	return hex.EncodeToString(hasher.Sum(blockHashInput(fields)))
+}
+
+// blockHashInput returns what the hasher hashes for block fields in the version of the chain
+func blockHashInput(fields BlockFields) interface{} {
+	if chainVersion >= CompactDifficultyChainVersion {
+		return compactHeader{
+			Version:      chainVersion,
+			Index:        fields.Index,
+			PrevHash:     fields.PrevHash,
+			Ts:           fields.Ts,
+			Transactions: fields.Transactions,
+			Bits:         difficultyToBits(fields.Difficulty),
+			Nonce:        fields.Nonce,
+		}
+	}
+	return legacyFields(fields)
+}
+
+// legacyFields are what blocks of legacy chains hash: formatted by %v, they read as block fields of the first release did,
+// the extra nonce and public key of a txIn and the version of a transaction, which came later, are only written once set,
+// so that blocks of the first release and the hardcoded genesis block keep their hashes
+type legacyFields BlockFields
+
+// String formats legacy fields as %v formatted block fields of the first release
+func (fields legacyFields) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "{%d %s %d [", fields.Index, fields.PrevHash, fields.Ts)
+	for n, transaction := range fields.Transactions {
+		if n > 0 {
+			b.WriteString(" ")
+		}
+		fmt.Fprintf(&b, "{%s [", transaction.Id)
+		for i, txIn := range transaction.TxIns {
+			if i > 0 {
+				b.WriteString(" ")
+			}
+			if txIn.ExtraNonce == 0 && txIn.PubKey == "" {
+				fmt.Fprintf(&b, "{%s %d %s}", txIn.TxOutId, txIn.TxOutIndex, txIn.Signature)
+			} else {
+				fmt.Fprintf(&b, "{%s %d %s %d %s}", txIn.TxOutId, txIn.TxOutIndex, txIn.Signature, txIn.ExtraNonce, txIn.PubKey)
+			}
+		}
+		fmt.Fprintf(&b, "] %v", transaction.TxOuts)
+		if transaction.Version != 0 {
+			fmt.Fprintf(&b, " %d", transaction.Version)
+		}
+		b.WriteString("}")
+	}
+	fmt.Fprintf(&b, "] %d %d}", fields.Difficulty, fields.Nonce)
+	return b.String()
+}
+
+// CanonicalBytes encodes legacy fields as their block fields
+func (fields legacyFields) CanonicalBytes() []byte {
+	return BlockFields(fields).CanonicalBytes()
+}
+
+// compactHeader is what blocks of CompactDifficultyChainVersion chains hash instead of their fields
+// the difficulty is replaced with compact bits of its target, which have a single fixed-width encoding
+type compactHeader struct {
+	Version      int
+	Index        int
+	PrevHash     string
+	Ts           uint64
+	Transactions []tx.Transaction
+	Bits         uint32
+	Nonce        uint64
+}
+
+// difficultyToBits returns the compact encoding of the target of a difficulty, as bitcoin encodes targets:
+// the size of the target in bytes in the high byte followed by its three most significant bytes, the top bit of which is never set
+func difficultyToBits(difficulty uint32) uint32 {
+	var target *big.Int = getTarget(difficulty)
+	if target.Sign() == 0 {
+		return 0
+	}
+	var size uint = uint(len(target.Bytes()))
+	var mantissa uint64
+	if size <= 3 {
+		mantissa = target.Uint64() << (8 * (3 - size))
+	} else {
+		mantissa = new(big.Int).Rsh(target, 8*(size-3)).Uint64()
+	}
+	if mantissa&0x00800000 != 0 {
+		mantissa >>= 8
+		size++
+	}
+	return uint32(size)<<24 | uint32(mantissa)
+}
+
+// CanonicalBytes encodes block fields unambiguously for hashers that hash canonical bytes
+// transactions are encoded with their ids, and signatures and public keys which ids leave out
+func (fields BlockFields) CanonicalBytes() []byte {
+	var b strings.Builder
+	utils.WriteCanonicalField(&b, strconv.Itoa(fields.Index))
+	utils.WriteCanonicalField(&b, fields.PrevHash)
+	utils.WriteCanonicalField(&b, strconv.FormatUint(fields.Ts, 10))
+	utils.WriteCanonicalField(&b, strconv.FormatUint(uint64(fields.Difficulty), 10))
+	utils.WriteCanonicalField(&b, strconv.FormatUint(fields.Nonce, 10))
+	writeCanonicalTransactions(&b, fields.Transactions)
+	return []byte(b.String())
+}
+
+// CanonicalBytes encodes a compact header unambiguously for hashers that hash canonical bytes, bits are written as 8 hex digits
+func (header compactHeader) CanonicalBytes() []byte {
+	var b strings.Builder
+	utils.WriteCanonicalField(&b, strconv.Itoa(header.Version))
+	utils.WriteCanonicalField(&b, strconv.Itoa(header.Index))
+	utils.WriteCanonicalField(&b, header.PrevHash)
+	utils.WriteCanonicalField(&b, strconv.FormatUint(header.Ts, 10))
+	utils.WriteCanonicalField(&b, fmt.Sprintf("%08x", header.Bits))
+	utils.WriteCanonicalField(&b, strconv.FormatUint(header.Nonce, 10))
+	writeCanonicalTransactions(&b, header.Transactions)
+	return []byte(b.String())
+}
+
+// writeCanonicalTransactions writes transactions of a block with their ids, and signatures and public keys which ids leave out
+func writeCanonicalTransactions(b *strings.Builder, transactions []tx.Transaction) {
+	utils.WriteCanonicalField(b, strconv.Itoa(len(transactions)))
+	for _, transaction := range transactions {
+		utils.WriteCanonicalField(b, transaction.Id)
+		utils.WriteCanonicalField(b, strconv.Itoa(len(transaction.TxIns)))
+		for _, txIn := range transaction.TxIns {
+			utils.WriteCanonicalField(b, txIn.Signature)
+			utils.WriteCanonicalField(b, txIn.PubKey)
+		}
+	}
+}
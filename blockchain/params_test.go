@@ -0,0 +1,110 @@
+package blockchain
+
+import (
+	"encoding/hex"
+	tx "naivecoin/transactions"
+	"naivecoin/utils"
+	"testing"
+)
+
+func TestLegacyBlockHashUnchanged(test *testing.T) {
+	// fields of a block of the first release, its hash was computed with the float difficulty and the structs of that release
+	var fields BlockFields = BlockFields{
+		Index:      1,
+		PrevHash:   genesisHash,
+		Ts:         1600000000,
+		Difficulty: 5,
+		Nonce:      1234,
+		Transactions: []tx.Transaction{
+			{Id: "c0", TxIns: tx.TxInCollection{{TxOutIndex: 1}}, TxOuts: tx.TxOutCollection{{Address: "miner", Amount: 50}}},
+			{Id: "d1", TxIns: tx.TxInCollection{{TxOutId: "c0", Signature: "3045sig"}}, TxOuts: tx.TxOutCollection{{Address: "recipient", Amount: 20.5}, {Address: "miner", Amount: 29.5}}},
+		},
+	}
+	const expected string = "5c273df36c97cddfeaba6d0625a2be87cb05e3cbb2e1465648f718fbc150a1fd"
+	if hash := hashBlockFields(fields); hash != expected {
+		test.Fatalf("expected legacy block hash %s, got %s", expected, hash)
+	}
+
+	// blocks with an extra nonce, public keys and versions hash as %v of their fields did
+	fields.Transactions[0].TxIns[0].ExtraNonce = 7
+	fields.Transactions[1].TxIns[0].PubKey = "02ab"
+	fields.Transactions[0].Version = tx.CurrentTxVersion
+	fields.Transactions[1].Version = tx.CurrentTxVersion
+	if hash, expected := hashBlockFields(fields), hex.EncodeToString(utils.SHA256Hasher{}.Sum(fields)); hash != expected {
+		test.Fatalf("expected legacy block hash %s, got %s", expected, hash)
+	}
+}
+
+func TestDifficultyToBits(test *testing.T) {
+	var cases = []struct {
+		difficulty uint32
+		bits       uint32
+	}{
+		// a target of 2^256 is 33 bytes long
+		{0, 0x21010000},
+		// the top bit of the mantissa is set for targets starting with 0x80, the mantissa is shifted into the next byte
+		{1, 0x21008000},
+		{7, 0x20020000},
+		{8, 0x20010000},
+		{9, 0x20008000},
+		{16, 0x1f010000},
+		{20, 0x1e100000},
+		{249, 0x02008000},
+		{255, 0x01020000},
+		{256, 0x01010000},
+		// no hash meets a target of 0
+		{257, 0},
+		{1000, 0},
+	}
+	for _, c := range cases {
+		if bits := difficultyToBits(c.difficulty); bits != c.bits {
+			test.Fatalf("difficulty %d: expected bits %08x, got %08x", c.difficulty, c.bits, bits)
+		}
+	}
+}
+
+func TestMineAndValidateByChainVersion(test *testing.T) {
+	_, address := testKey(test, 1)
+	var chains map[int][]Block = map[int][]Block{}
+	for _, version := range []int{LegacyChainVersion, CompactDifficultyChainVersion} {
+		for _, hasher_ := range []utils.Hasher{utils.SHA256Hasher{}, utils.DoubleSHA256Hasher{}} {
+			var params ChainParams = defaultChainParams
+			params.Version = version
+			params.Hasher = hasher_.Name()
+			setTestChainParams(test, params)
+			resetChain(test)
+			// blocks mined at once past a retarget, so that the difficulty of later blocks is raised
+			mineBlocks(test, int(difficultyAdjustmentInterval)+2, address)
+			var blocks []Block = GetBlockChain()
+			if blocks[len(blocks)-1].Fields.Difficulty == 0 {
+				test.Fatalf("version %d, %s: expected a raised difficulty", version, hasher_.Name())
+			}
+			if _, err := IsValidBlockChain(blocks); err != nil {
+				test.Fatalf("version %d, %s: %v", version, hasher_.Name(), err)
+			}
+			for _, block := range blocks[1:] {
+				if !hashMatchesDifficulty(block.Hash, block.Fields.Difficulty) || hashBlockFields(block.Fields) != block.Hash {
+					test.Fatalf("version %d, %s: block %d hashes to %s", version, hasher_.Name(), block.Fields.Index, hashBlockFields(block.Fields))
+				}
+			}
+			// a compact header commits to the chain version and the bits of the difficulty
+			if header, ok := blockHashInput(blocks[len(blocks)-1].Fields).(compactHeader); (version == CompactDifficultyChainVersion) != ok ||
+				ok && (header.Version != version || header.Bits != difficultyToBits(blocks[len(blocks)-1].Fields.Difficulty)) {
+				test.Fatalf("version %d, %s: unexpected hash input %+v", version, hasher_.Name(), header)
+			}
+			if hasher_.Name() == defaultChainParams.Hasher {
+				chains[version] = blocks
+			}
+		}
+	}
+
+	// chains of one version are refused by nodes of the other one
+	for version, blocks := range chains {
+		var params ChainParams = defaultChainParams
+		params.Version = LegacyChainVersion + CompactDifficultyChainVersion - version
+		setTestChainParams(test, params)
+		if _, err := IsValidBlockChain(blocks); err == nil {
+			test.Fatalf("chain of version %d must be refused by version %d", version, params.Version)
+		}
+	}
+}
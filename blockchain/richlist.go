@@ -0,0 +1,124 @@
+package blockchain
+
+import (
+	tx "naivecoin/transactions"
+	"sort"
+)
+
+// addressHolding is the confirmed balance of an address and the number of unspent txOuts it is made of
+type addressHolding struct {
+	balance           float64
+	unspentTxOutCount int
+}
+
+// indexBalances builds an index of addresses holding given unspent txOuts
+func indexBalances(unspentTxOuts []tx.UnspentTxOut) map[string]addressHolding {
+	var balances map[string]addressHolding = map[string]addressHolding{}
+	for n := 0; n < len(unspentTxOuts); n++ {
+		var holding addressHolding = balances[unspentTxOuts[n].Address]
+		holding.balance += unspentTxOuts[n].Amount
+		holding.unspentTxOutCount++
+		balances[unspentTxOuts[n].Address] = holding
+	}
+	return balances
+}
+
+// copyBalances returns a copy of an index of address balances, a published index is never modified
+func copyBalances(balances map[string]addressHolding) map[string]addressHolding {
+	var cpy map[string]addressHolding = make(map[string]addressHolding, len(balances))
+	for address, holding := range balances {
+		cpy[address] = holding
+	}
+	return cpy
+}
+
+// applyBlockBalances updates an index of address balances with txOuts a block spends and creates
+// unspentTxOuts are the unspent txOuts before the block, which its transactions spend
+func applyBlockBalances(balances map[string]addressHolding, block Block, unspentTxOuts []tx.UnspentTxOut) {
+	var transactions []tx.Transaction = block.Fields.Transactions
+	var spent map[spentRef]bool = map[spentRef]bool{}
+	for n := 1; n < len(transactions); n++ {
+		for _, txIn := range transactions[n].TxIns {
+			spent[spentRef{txOutId: txIn.TxOutId, txOutIndex: txIn.TxOutIndex}] = true
+		}
+	}
+	if len(spent) > 0 {
+		for n := 0; n < len(unspentTxOuts); n++ {
+			if !spent[spentRef{txOutId: unspentTxOuts[n].TxOutId, txOutIndex: unspentTxOuts[n].TxOutIndex}] {
+				continue
+			}
+			var holding addressHolding = balances[unspentTxOuts[n].Address]
+			holding.balance -= unspentTxOuts[n].Amount
+			holding.unspentTxOutCount--
+			if holding.unspentTxOutCount <= 0 {
+				delete(balances, unspentTxOuts[n].Address)
+			} else {
+				balances[unspentTxOuts[n].Address] = holding
+			}
+		}
+	}
+	for _, transaction := range transactions {
+		for _, txOut := range transaction.TxOuts {
+			var holding addressHolding = balances[txOut.Address]
+			holding.balance += txOut.Amount
+			holding.unspentTxOutCount++
+			balances[txOut.Address] = holding
+		}
+	}
+}
+
+// RichListEntry is an address with its confirmed balance, the number of its unspent txOuts and its share of coins in circulation in percent
+type RichListEntry struct {
+	Address           string
+	Balance           float64
+	UnspentTxOutCount int
+	SupplyPercent     float64
+}
+
+// RichList lists addresses of the current chain with the greatest balances, Circulating is the supply their shares are computed of
+type RichList struct {
+	Height      int
+	Circulating float64
+	Addresses   []RichListEntry
+}
+
+// GetRichList returns up to limit addresses with balances of at least minBalance, ordered by balance descending, then by address
+// a limit below 1 returns no addresses
+// balances are read from an index kept with the chain state, so unspent txOuts are not scanned
+func GetRichList(limit int, minBalance float64) RichList {
+	var s *chainState = currentState()
+	var circulating float64 = s.supply.minted - s.supply.feesBurned
+	var entries []RichListEntry = []RichListEntry{}
+	for address, holding := range s.balances {
+		if holding.balance < minBalance {
+			continue
+		}
+		var percent float64
+		if circulating > 0 {
+			percent = holding.balance / circulating * 100
+		}
+		entries = append(entries, RichListEntry{
+			Address:           address,
+			Balance:           holding.balance,
+			UnspentTxOutCount: holding.unspentTxOutCount,
+			SupplyPercent:     percent,
+		})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Balance != entries[j].Balance {
+			return entries[i].Balance > entries[j].Balance
+		}
+		return entries[i].Address < entries[j].Address
+	})
+	if limit < 0 {
+		limit = 0
+	}
+	if len(entries) > limit {
+		entries = entries[:limit]
+	}
+	return RichList{
+		Height:      s.latestBlock().Fields.Index,
+		Circulating: circulating,
+		Addresses:   entries,
+	}
+}
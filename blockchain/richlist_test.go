@@ -0,0 +1,50 @@
+package blockchain
+
+import (
+	"testing"
+)
+
+func TestRichListOrder(test *testing.T) {
+	resetChain(test)
+	var addresses []string = []string{}
+	for n := 1; n <= 4; n++ {
+		_, address := testKey(test, n)
+		addresses = append(addresses, address)
+	}
+	// balances of 150, 100 and two ties of 50 with the genesis address
+	var counts []int = []int{1, 3, 1, 2}
+	for n := 0; n < len(addresses); n++ {
+		mineBlocks(test, counts[n], addresses[n])
+	}
+
+	var richList RichList = GetRichList(10, 0)
+	if richList.Height != 7 || richList.Circulating != 400 || len(richList.Addresses) != 5 {
+		test.Fatalf("expected 5 addresses at height 7 of 400 coins, got %+v", richList)
+	}
+	for n := 1; n < len(richList.Addresses); n++ {
+		var prev, entry RichListEntry = richList.Addresses[n-1], richList.Addresses[n]
+		if prev.Balance < entry.Balance || (prev.Balance == entry.Balance && prev.Address >= entry.Address) {
+			test.Fatalf("expected balances descending then addresses ascending, got %+v before %+v", prev, entry)
+		}
+	}
+	var first RichListEntry = richList.Addresses[0]
+	if first.Address != addresses[1] || first.Balance != 150 || first.UnspentTxOutCount != 3 || first.SupplyPercent != 37.5 {
+		test.Fatalf("expected %s with 150 coins in 3 txOuts and 37.5 percent first, got %+v", addresses[1], first)
+	}
+	if richList.Addresses[1].Address != addresses[3] || richList.Addresses[1].Balance != 100 {
+		test.Fatalf("expected %s with 100 coins second, got %+v", addresses[3], richList.Addresses[1])
+	}
+
+	var top []RichListEntry = GetRichList(3, 0).Addresses
+	if len(top) != 3 || top[0] != richList.Addresses[0] || top[2] != richList.Addresses[2] {
+		test.Fatalf("expected the first 3 addresses of the full list, got %+v", top)
+	}
+	if rich := GetRichList(10, 100).Addresses; len(rich) != 2 || rich[1].Balance != 100 {
+		test.Fatalf("expected 2 addresses with at least 100 coins, got %+v", rich)
+	}
+	for _, limit := range []int{0, -1, -100} {
+		if entries := GetRichList(limit, 0).Addresses; entries == nil || len(entries) != 0 {
+			test.Fatalf("limit %d: expected an empty list, got %v", limit, entries)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package blockchain
+
+import (
+	"math"
+	tx "naivecoin/transactions"
+)
+
+// supplyTolerance is the largest difference between the unspent total and minted coins less burned fees
+// that is put down to float rounding rather than a corrupt chain state
+const supplyTolerance float64 = 1e-6
+
+// Supply describes coins of the current chain: Minted is the sum of coinbase outputs up to the tip,
+// FeesBurned the sum of transaction fees, which coinbase transactions don't collect, Circulating is Minted less FeesBurned
+// and UnspentTotal the sum of unspent txOuts, computed separately as a cross-check
+// MaxSupply is nil, the block reward doesn't halve, so the supply has no maximum
+// Consistent is false if UnspentTotal is not Circulating, Discrepancy is the difference, which means the chain state is corrupt
+type Supply struct {
+	Height       int
+	Minted       float64
+	FeesBurned   float64
+	Circulating  float64
+	UnspentTotal float64
+	MaxSupply    *float64
+	Consistent   bool
+	Discrepancy  float64
+}
+
+// GetSupply returns the supply of the current chain
+// minted coins and burned fees are kept with the chain state as blocks are added, unspent txOuts are summed on every call
+func GetSupply() Supply {
+	var s *chainState = currentState()
+	var unspentTotal float64
+	for n := 0; n < len(s.unspentTxOuts); n++ {
+		unspentTotal += s.unspentTxOuts[n].Amount
+	}
+	var circulating float64 = s.supply.minted - s.supply.feesBurned
+	var discrepancy float64 = unspentTotal - circulating
+	return Supply{
+		Height:       s.latestBlock().Fields.Index,
+		Minted:       s.supply.minted,
+		FeesBurned:   s.supply.feesBurned,
+		Circulating:  circulating,
+		UnspentTotal: unspentTotal,
+		MaxSupply:    nil,
+		Consistent:   math.Abs(discrepancy) <= supplyTolerance,
+		Discrepancy:  discrepancy,
+	}
+}
+
+// spentRef identifies a txOut spent by a txIn
+type spentRef struct {
+	txOutId    string
+	txOutIndex int
+}
+
+// supplyTotals are coins minted by coinbase transactions and fees burned by other transactions of a chain
+type supplyTotals struct {
+	minted     float64
+	feesBurned float64
+}
+
+// add returns supply totals with coins minted and fees burned by a block added
+// unspentTxOuts are the unspent txOuts before the block, which its transactions spend
+func (totals supplyTotals) add(block Block, unspentTxOuts []tx.UnspentTxOut) supplyTotals {
+	var transactions []tx.Transaction = block.Fields.Transactions
+	if len(transactions) == 0 {
+		return totals
+	}
+	for _, txOut := range transactions[0].TxOuts {
+		totals.minted += txOut.Amount
+	}
+
+	var spent map[spentRef]bool = map[spentRef]bool{}
+	var paid float64
+	for n := 1; n < len(transactions); n++ {
+		for _, txIn := range transactions[n].TxIns {
+			spent[spentRef{txOutId: txIn.TxOutId, txOutIndex: txIn.TxOutIndex}] = true
+		}
+		for _, txOut := range transactions[n].TxOuts {
+			paid += txOut.Amount
+		}
+	}
+	if len(spent) == 0 {
+		return totals
+	}
+	var inputs float64
+	for n := 0; n < len(unspentTxOuts); n++ {
+		if spent[spentRef{txOutId: unspentTxOuts[n].TxOutId, txOutIndex: unspentTxOuts[n].TxOutIndex}] {
+			inputs += unspentTxOuts[n].Amount
+		}
+	}
+	totals.feesBurned += inputs - paid
+	return totals
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"naivecoin/blockchain"
+	"naivecoin/wallet"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// walletRequestTimeout is the deadline of a request wallet subcommands send to a running node
+const walletRequestTimeout time.Duration = 30 * time.Second
+
+const usageText string = `usage: naivecoin <command> [flags]
+
+commands:
+  node            run a node, the default if no command is given
+  wallet new      create a new wallet keystore
+  wallet address  print the primary address of the wallet keystore
+  wallet balance  print the balance of the wallet address, asking a running node
+
+run naivecoin <command> -h for flags of a command
+`
+
+// usage prints commands to standard error
+func usage() {
+	fmt.Fprint(os.Stderr, usageText)
+}
+
+// usageError prints an error of command line arguments with usage of a command and exits with status 2, like bad flags do
+func usageError(fs *flag.FlagSet, format string, args ...interface{}) {
+	fmt.Fprintf(fs.Output(), format+"\n", args...)
+	fs.Usage()
+	os.Exit(2)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		runNode(nil)
+		return
+	}
+	switch os.Args[1] {
+	case "node":
+		runNode(os.Args[2:])
+	case "wallet":
+		runWallet(os.Args[2:])
+	case "help", "-h", "-help", "--help":
+		usage()
+	default:
+		// flags and the port given without a command run a node, as before commands were added
+		if !strings.HasPrefix(os.Args[1], "-") && !isPort(os.Args[1]) {
+			fmt.Fprintf(os.Stderr, "unknown command %q\n", os.Args[1])
+			usage()
+			os.Exit(2)
+		}
+		runNode(os.Args[1:])
+	}
+}
+
+// isPort checks if an argument is a port number given without a command
+func isPort(arg string) bool {
+	for _, c := range arg {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return arg != ""
+}
+
+// walletFlags holds flags shared by wallet subcommands
+type walletFlags struct {
+	dataDir string
+	keyFile string
+}
+
+// newWalletFlagSet returns a flag set of a wallet subcommand with flags locating the keystore
+func newWalletFlagSet(name string, description string, flags *walletFlags) *flag.FlagSet {
+	fs := flag.NewFlagSet("wallet "+name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: naivecoin wallet %s [flags]\n%s\n", name, description)
+		fs.PrintDefaults()
+	}
+	fs.StringVar(&flags.dataDir, "datadir", "", "directory the node keeps its files in, may also be given in "+dataDirEnv+", defaults to the current directory")
+	fs.StringVar(&flags.keyFile, "keyfile", "", "wallet keystore file, may also be given in "+keyFileEnv+", defaults to wallet.json")
+	return fs
+}
+
+// keyFilePath returns the path of the keystore resolved against the data directory
+func (flags walletFlags) keyFilePath() string {
+	return resolveDataPath(flagOrEnv(flags.dataDir, dataDirEnv, "."), flagOrEnv(flags.keyFile, keyFileEnv, "wallet.json"))
+}
+
+// runWallet runs a wallet subcommand
+func runWallet(args []string) {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "missing wallet command")
+		usage()
+		os.Exit(2)
+	}
+	var err error
+	switch args[0] {
+	case "new":
+		err = walletNew(args[1:])
+	case "address":
+		err = walletAddress(args[1:])
+	case "balance":
+		err = walletBalance(args[1:])
+	default:
+		fmt.Fprintf(os.Stderr, "unknown wallet command %q\n", args[0])
+		usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+}
+
+// walletNew creates a new keystore, an existing one is never overwritten
+func walletNew(args []string) error {
+	var flags walletFlags
+	fs := newWalletFlagSet("new", "creates a new wallet keystore and prints mnemonic words that restore it", &flags)
+	passphrase := fs.String("wallet-passphrase", "", "passphrase to encrypt the keystore with, may also be given in "+walletPassphraseEnv+" or prompted for on the terminal")
+	fs.Parse(args)
+	if fs.NArg() > 0 {
+		usageError(fs, "unexpected arguments: %s", strings.Join(fs.Args(), " "))
+	}
+
+	var keyFile string = flags.keyFilePath()
+	if _, err := os.Stat(keyFile); err == nil {
+		return fmt.Errorf("%s: %s", wallet.ErrWalletExists.Error(), keyFile)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(keyFile), 0700); err != nil {
+		return err
+	}
+	if err := openWallet(keyFile, *passphrase, false); err != nil {
+		return err
+	}
+	fmt.Printf("Your address: %s\n", wallet.GetBase58Address())
+	return nil
+}
+
+// walletAddress prints the primary address of the keystore, the passphrase is not needed
+func walletAddress(args []string) error {
+	var flags walletFlags
+	fs := newWalletFlagSet("address", "prints the primary address of the wallet keystore", &flags)
+	fs.Parse(args)
+	if fs.NArg() > 0 {
+		usageError(fs, "unexpected arguments: %s", strings.Join(fs.Args(), " "))
+	}
+
+	address, err := wallet.ReadAddress(flags.keyFilePath())
+	if err != nil {
+		return err
+	}
+	fmt.Println(address)
+	return nil
+}
+
+// walletBalance asks a running node for the balance of the primary address of the keystore or of a given address
+func walletBalance(args []string) error {
+	var flags walletFlags
+	fs := newWalletFlagSet("balance", "prints the balance of the wallet address, asking a running node", &flags)
+	address := fs.String("address", "", "address to print the balance of instead of the wallet address")
+	node := fs.String("node", "http://localhost:8080", "url of the api of a running node")
+	token := fs.String("api-token", "", "api token of the node, needed if it runs with -api-auth-read, may also be given in "+apiTokenEnv+", defaults to the token in -api-token-file")
+	tokenFile := fs.String("api-token-file", "api.token", "file the node generated its api token to, read if it exists")
+	fs.Parse(args)
+	if fs.NArg() > 0 {
+		usageError(fs, "unexpected arguments: %s", strings.Join(fs.Args(), " "))
+	}
+
+	if *address == "" {
+		keyFileAddress, err := wallet.ReadAddress(flags.keyFilePath())
+		if err != nil {
+			return err
+		}
+		*address = keyFileAddress
+	}
+	var apiToken_ string = flagOrEnv(*token, apiTokenEnv, "")
+	if apiToken_ == "" {
+		content, err := ioutil.ReadFile(resolveDataPath(flagOrEnv(flags.dataDir, dataDirEnv, "."), *tokenFile))
+		if err == nil {
+			apiToken_ = strings.TrimSpace(string(content))
+		}
+	}
+
+	var balance blockchain.AddressBalance
+	if err := getFromNode(*node, "/api/balance/"+url.PathEscape(*address), apiToken_, &balance); err != nil {
+		return err
+	}
+	fmt.Printf("Address: %s\n", balance.Address)
+	fmt.Printf("Balance: %v\n", balance.Balance)
+	if balance.Unconfirmed != 0 {
+		fmt.Printf("Unconfirmed: %v\n", balance.Unconfirmed)
+	}
+	return nil
+}
+
+// getFromNode sends a GET request to the api of a running node and decodes its JSON response
+func getFromNode(node string, path string, apiToken_ string, response interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(node, "/")+path, nil)
+	if err != nil {
+		return err
+	}
+	if apiToken_ != "" {
+		req.Header.Set("Authorization", "Bearer "+apiToken_)
+	}
+	var client *http.Client = &http.Client{Timeout: walletRequestTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reach node at %s: %s", node, err.Error())
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var body struct {
+			Error *apiError `json:"error"`
+		}
+		if json.NewDecoder(resp.Body).Decode(&body) == nil && body.Error != nil {
+			return fmt.Errorf("node responded %s: %s", body.Error.Code, body.Error.Message)
+		}
+		return errors.New("node responded " + resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(response)
+}
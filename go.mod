@@ -3,9 +3,15 @@ module naivecoin
 go 1.16
 
 require (
-	github.com/btcsuite/btcutil v1.0.2 // indirect
-	github.com/ethereum/go-ethereum v1.10.4 // indirect
-	github.com/gorilla/mux v1.8.0 // indirect
-	github.com/gorilla/websocket v1.4.2 // indirect
+	github.com/btcsuite/btcutil v1.0.2
+	github.com/ethereum/go-ethereum v1.10.4
+	github.com/gorilla/mux v1.8.0
+	github.com/gorilla/websocket v1.4.2
+	github.com/tyler-smith/go-bip39 v1.1.0
+	github.com/vmihailenco/msgpack/v5 v5.3.5
+	golang.org/x/crypto v0.0.0-20211117183948-ae814b36b871
+	golang.org/x/term v0.0.0-20201126162022-7de9c90e9dd1
 	golang.org/x/tools v0.1.4 // indirect
+	google.golang.org/grpc v1.47.0
+	google.golang.org/protobuf v1.28.0
 )
@@ -0,0 +1,72 @@
+package grpcapi
+
+import (
+	"naivecoin/blockchain"
+	tx "naivecoin/transactions"
+	"naivecoin/txpool"
+)
+
+// toProtoTxIn converts a txIn to its protobuf message
+func toProtoTxIn(txIn tx.TxIn) *TxIn {
+	return &TxIn{
+		TxOutId:    txIn.TxOutId,
+		TxOutIndex: int64(txIn.TxOutIndex),
+		Signature:  txIn.Signature,
+		ExtraNonce: txIn.ExtraNonce,
+		PubKey:     txIn.PubKey,
+	}
+}
+
+// toProtoTxOut converts a txOut to its protobuf message
+func toProtoTxOut(txOut tx.TxOut) *TxOut {
+	return &TxOut{Address: txOut.Address, Amount: txOut.Amount}
+}
+
+// toProtoTransaction converts a transaction to its protobuf message
+func toProtoTransaction(transaction tx.Transaction) *Transaction {
+	var message *Transaction = &Transaction{
+		Id:      transaction.Id,
+		TxIns:   make([]*TxIn, 0, len(transaction.TxIns)),
+		TxOuts:  make([]*TxOut, 0, len(transaction.TxOuts)),
+		Version: int32(transaction.Version),
+	}
+	for n := 0; n < len(transaction.TxIns); n++ {
+		message.TxIns = append(message.TxIns, toProtoTxIn(transaction.TxIns[n]))
+	}
+	for n := 0; n < len(transaction.TxOuts); n++ {
+		message.TxOuts = append(message.TxOuts, toProtoTxOut(transaction.TxOuts[n]))
+	}
+	return message
+}
+
+// toProtoUnspentTxOut converts an unspent txOut to its protobuf message
+func toProtoUnspentTxOut(unspentTxOut tx.UnspentTxOut) *UnspentTxOut {
+	return &UnspentTxOut{
+		TxOutId:    unspentTxOut.TxOutId,
+		TxOutIndex: int64(unspentTxOut.TxOutIndex),
+		Address:    unspentTxOut.Address,
+		Amount:     unspentTxOut.Amount,
+	}
+}
+
+// toProtoBlock converts a block to its protobuf message
+func toProtoBlock(block blockchain.Block) *Block {
+	var message *Block = &Block{
+		Index:        int64(block.Fields.Index),
+		PrevHash:     block.Fields.PrevHash,
+		Ts:           block.Fields.Ts,
+		Transactions: make([]*Transaction, 0, len(block.Fields.Transactions)),
+		Difficulty:   float64(block.Fields.Difficulty),
+		Nonce:        int64(block.Fields.Nonce),
+		Hash:         block.Hash,
+	}
+	for n := 0; n < len(block.Fields.Transactions); n++ {
+		message.Transactions = append(message.Transactions, toProtoTransaction(block.Fields.Transactions[n]))
+	}
+	return message
+}
+
+// toProtoTxPoolEvent converts a transaction pool change to its protobuf message
+func toProtoTxPoolEvent(event txpool.PoolEvent) *TxPoolEvent {
+	return &TxPoolEvent{Type: string(event.Type), Transaction: toProtoTransaction(event.Transaction)}
+}
@@ -0,0 +1,145 @@
+package grpcapi
+
+import (
+	"math"
+	"naivecoin/blockchain"
+	tx "naivecoin/transactions"
+	"naivecoin/txpool"
+	"reflect"
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// fromProtoTxIn converts a txIn message back, the inverse of toProtoTxIn
+func fromProtoTxIn(message *TxIn) tx.TxIn {
+	return tx.TxIn{
+		TxOutId:    message.TxOutId,
+		TxOutIndex: int(message.TxOutIndex),
+		Signature:  message.Signature,
+		ExtraNonce: message.ExtraNonce,
+		PubKey:     message.PubKey,
+	}
+}
+
+// fromProtoTransaction converts a transaction message back, the inverse of toProtoTransaction
+func fromProtoTransaction(message *Transaction) tx.Transaction {
+	var transaction tx.Transaction = tx.Transaction{
+		Id:      message.Id,
+		TxIns:   make(tx.TxInCollection, 0, len(message.TxIns)),
+		TxOuts:  make(tx.TxOutCollection, 0, len(message.TxOuts)),
+		Version: int(message.Version),
+	}
+	for n := 0; n < len(message.TxIns); n++ {
+		transaction.TxIns = append(transaction.TxIns, fromProtoTxIn(message.TxIns[n]))
+	}
+	for n := 0; n < len(message.TxOuts); n++ {
+		transaction.TxOuts = append(transaction.TxOuts, tx.TxOut{Address: message.TxOuts[n].Address, Amount: message.TxOuts[n].Amount})
+	}
+	return transaction
+}
+
+// fromProtoBlock converts a block message back, the inverse of toProtoBlock
+func fromProtoBlock(message *Block) blockchain.Block {
+	var block blockchain.Block = blockchain.Block{
+		Fields: blockchain.BlockFields{
+			Index:        int(message.Index),
+			PrevHash:     message.PrevHash,
+			Ts:           message.Ts,
+			Transactions: make([]tx.Transaction, 0, len(message.Transactions)),
+			Difficulty:   uint32(message.Difficulty),
+			Nonce:        uint64(message.Nonce),
+		},
+		Hash: message.Hash,
+	}
+	for n := 0; n < len(message.Transactions); n++ {
+		block.Fields.Transactions = append(block.Fields.Transactions, fromProtoTransaction(message.Transactions[n]))
+	}
+	return block
+}
+
+// overWire encodes a message and decodes it into another of the same type, as a client receives it
+func overWire(tb testing.TB, message proto.Message, received proto.Message) {
+	encoded, err := proto.Marshal(message)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if err := proto.Unmarshal(encoded, received); err != nil {
+		tb.Fatal(err)
+	}
+}
+
+// testTransactions returns a coinbase and a regular transaction with every field set
+func testTransactions() []tx.Transaction {
+	return []tx.Transaction{
+		{
+			Id:      "c0ffee",
+			TxIns:   tx.TxInCollection{{TxOutId: "", TxOutIndex: 12, ExtraNonce: math.MaxUint64}},
+			TxOuts:  tx.TxOutCollection{{Address: "miner", Amount: 50.00012}},
+			Version: tx.CurrentTxVersion,
+		},
+		{
+			Id: "beef",
+			TxIns: tx.TxInCollection{
+				{TxOutId: "aa", TxOutIndex: 0, Signature: "3045", PubKey: "04ab"},
+				{TxOutId: "bb", TxOutIndex: math.MaxInt32, Signature: "3044"},
+			},
+			TxOuts:  tx.TxOutCollection{{Address: "a", Amount: 0.000001}, {Address: "b", Amount: tx.MaxMoney}},
+			Version: tx.PubKeyHashTxVersion,
+		},
+	}
+}
+
+func TestBlockRoundTrip(test *testing.T) {
+	var blocks []blockchain.Block = []blockchain.Block{
+		blockchain.GenesisBlock,
+		{
+			Fields: blockchain.BlockFields{Index: 12345, PrevHash: "00ab", Ts: math.MaxUint64, Transactions: testTransactions(), Difficulty: 256, Nonce: 42},
+			Hash:   "00cd",
+		},
+		// nonces above the int64 range are sent as negative numbers and read back unchanged
+		{
+			Fields: blockchain.BlockFields{Index: 1, Transactions: []tx.Transaction{}, Difficulty: 0, Nonce: math.MaxUint64},
+		},
+		{
+			Fields: blockchain.BlockFields{Index: 2, Transactions: []tx.Transaction{}, Difficulty: math.MaxUint32, Nonce: math.MaxInt64 + 1},
+		},
+	}
+	for _, block := range blocks {
+		var received *Block = &Block{}
+		overWire(test, toProtoBlock(block), received)
+		if converted := fromProtoBlock(received); !reflect.DeepEqual(converted, block) {
+			test.Fatalf("block %d changed over the wire: expected %+v, got %+v", block.Fields.Index, block, converted)
+		}
+	}
+}
+
+func TestTransactionRoundTrip(test *testing.T) {
+	for _, transaction := range append(testTransactions(), tx.Transaction{Id: "empty", TxIns: tx.TxInCollection{}, TxOuts: tx.TxOutCollection{}}) {
+		var received *Transaction = &Transaction{}
+		overWire(test, toProtoTransaction(transaction), received)
+		if converted := fromProtoTransaction(received); !reflect.DeepEqual(converted, transaction) {
+			test.Fatalf("transaction %s changed over the wire: expected %+v, got %+v", transaction.Id, transaction, converted)
+		}
+
+		var event *TxPoolEvent = &TxPoolEvent{}
+		overWire(test, toProtoTxPoolEvent(txpool.PoolEvent{Type: txpool.TxAdded, Transaction: transaction}), event)
+		if event.Type != string(txpool.TxAdded) || !reflect.DeepEqual(fromProtoTransaction(event.Transaction), transaction) {
+			test.Fatalf("pool event of %s changed over the wire: %v", transaction.Id, event)
+		}
+	}
+}
+
+func TestUnspentTxOutRoundTrip(test *testing.T) {
+	for _, unspentTxOut := range []tx.UnspentTxOut{
+		{TxOutId: "aa", TxOutIndex: 0, Address: "a", Amount: 0.000001},
+		{TxOutId: "bb", TxOutIndex: math.MaxInt32, Address: "b", Amount: tx.MaxMoney},
+	} {
+		var received *UnspentTxOut = &UnspentTxOut{}
+		overWire(test, toProtoUnspentTxOut(unspentTxOut), received)
+		var converted tx.UnspentTxOut = tx.UnspentTxOut{TxOutId: received.TxOutId, TxOutIndex: int(received.TxOutIndex), Address: received.Address, Amount: received.Amount}
+		if converted != unspentTxOut {
+			test.Fatalf("unspent txOut changed over the wire: expected %+v, got %+v", unspentTxOut, converted)
+		}
+	}
+}
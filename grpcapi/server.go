@@ -0,0 +1,256 @@
+package grpcapi
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"naivecoin/blockchain"
+	"naivecoin/p2p"
+	tx "naivecoin/transactions"
+	"naivecoin/txpool"
+	"naivecoin/utils"
+	"naivecoin/wallet"
+	"strings"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// subscriptionBuffer is the number of events queued for a subscriber, a subscriber falling further behind is dropped
+const subscriptionBuffer int = 64
+
+var logger *utils.Logger = utils.NewLogger("grpcapi")
+
+// mutatingMethods are methods that spend or change the node, they always require the api token
+var mutatingMethods map[string]bool = map[string]bool{
+	"/" + NodeService_ServiceDesc.ServiceName + "/SendTransaction": true,
+}
+
+// subscribers fans events out to streams of subscribed clients
+type subscribers struct {
+	lock     sync.Mutex
+	channels map[chan interface{}]bool
+}
+
+// subscribe returns a channel receiving published events, it is closed if the subscriber falls behind
+func (s *subscribers) subscribe() chan interface{} {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var events chan interface{} = make(chan interface{}, subscriptionBuffer)
+	s.channels[events] = true
+	return events
+}
+
+// unsubscribe stops publishing events to a channel
+func (s *subscribers) unsubscribe(events chan interface{}) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.channels[events] {
+		delete(s.channels, events)
+		close(events)
+	}
+}
+
+// publish queues an event for every subscriber without waiting, subscribers with full queues are dropped
+func (s *subscribers) publish(event interface{}) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for events := range s.channels {
+		select {
+		case events <- event:
+		default:
+			delete(s.channels, events)
+			close(events)
+		}
+	}
+}
+
+// Server implements NodeService on top of the blockchain, wallet and transaction pool of the node
+type Server struct {
+	UnimplementedNodeServiceServer
+	blockSubscribers  *subscribers
+	txPoolSubscribers *subscribers
+}
+
+// NewServer returns a grpc server serving NodeService, calls are authenticated with a given api token
+// read-only calls require the token only if authenticateReads is set
+// streams of new blocks and pool changes are fed by the same events web clients are notified with
+func NewServer(apiToken string, authenticateReads bool, options ...grpc.ServerOption) *grpc.Server {
+	var server *Server = &Server{
+		blockSubscribers:  &subscribers{channels: map[chan interface{}]bool{}},
+		txPoolSubscribers: &subscribers{channels: map[chan interface{}]bool{}},
+	}
+	p2p.RegisterBlockListener(func(block blockchain.Block) {
+		server.blockSubscribers.publish(block)
+	})
+	txpool.RegisterListener(func(event txpool.PoolEvent) {
+		server.txPoolSubscribers.publish(event)
+	})
+
+	var authorize = func(ctx context.Context, fullMethod string) error {
+		if !authenticateReads && !mutatingMethods[fullMethod] {
+			return nil
+		}
+		if !isAuthenticated(ctx, apiToken) {
+			return status.Error(codes.Unauthenticated, "missing or invalid api token")
+		}
+		return nil
+	}
+	options = append(options,
+		grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			if err := authorize(ctx, info.FullMethod); err != nil {
+				return nil, err
+			}
+			return handler(ctx, req)
+		}),
+		grpc.StreamInterceptor(func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			if err := authorize(stream.Context(), info.FullMethod); err != nil {
+				return err
+			}
+			return handler(srv, stream)
+		}),
+	)
+	var grpcServer *grpc.Server = grpc.NewServer(options...)
+	RegisterNodeServiceServer(grpcServer, server)
+	return grpcServer
+}
+
+// isAuthenticated checks if a call carries the api token in authorization metadata, comparing in constant time
+func isAuthenticated(ctx context.Context, apiToken string) bool {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return false
+	}
+	for _, authorization := range md.Get("authorization") {
+		if !strings.HasPrefix(authorization, "Bearer ") {
+			continue
+		}
+		var token string = strings.TrimSpace(strings.TrimPrefix(authorization, "Bearer "))
+		if token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(apiToken)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// statusFor returns a grpc status matching an error of a wallet or pool operation
+func statusFor(err error) error {
+	var feeTooLow txpool.FeeTooLowError
+	switch {
+	case errors.Is(err, blockchain.ErrInvalidAddress), errors.Is(err, blockchain.ErrInvalidAmount),
+		errors.Is(err, blockchain.ErrInvalidFee), errors.Is(err, blockchain.ErrInvalidFeeRate), errors.As(err, &feeTooLow):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, wallet.ErrInsufficientFunds), errors.Is(err, wallet.ErrWalletLocked):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case errors.Is(err, txpool.ErrPoolFull):
+		return status.Error(codes.ResourceExhausted, err.Error())
+	default:
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+}
+
+// GetBlock returns a block of the current blockchain by its hash or index
+func (s *Server) GetBlock(ctx context.Context, request *GetBlockRequest) (*Block, error) {
+	switch selector := request.GetSelector().(type) {
+	case *GetBlockRequest_Hash:
+		block, found := blockchain.GetBlockByHash(selector.Hash)
+		if !found {
+			return nil, status.Error(codes.NotFound, "block not found")
+		}
+		return toProtoBlock(block), nil
+	case *GetBlockRequest_Index:
+		var blocks []blockchain.Block = blockchain.GetBlocksRange(int(selector.Index), int(selector.Index))
+		if selector.Index < 0 || len(blocks) == 0 {
+			return nil, status.Error(codes.NotFound, "block not found")
+		}
+		return toProtoBlock(blocks[0]), nil
+	default:
+		return nil, status.Error(codes.InvalidArgument, "hash or index is required")
+	}
+}
+
+// GetBlocks streams blocks from from_index to to_index inclusive, up to the latest block if to_index is 0
+func (s *Server) GetBlocks(request *GetBlocksRequest, stream NodeService_GetBlocksServer) error {
+	var latestIndex int64 = int64(blockchain.GetLatestBlock().Fields.Index)
+	var toIndex int64 = request.GetToIndex()
+	if toIndex == 0 || toIndex > latestIndex {
+		toIndex = latestIndex
+	}
+	if request.GetFromIndex() < 0 || request.GetFromIndex() > toIndex {
+		return status.Error(codes.InvalidArgument, "invalid block range")
+	}
+	for _, block := range blockchain.GetBlocksRange(int(request.GetFromIndex()), int(toIndex)) {
+		if err := stream.Send(toProtoBlock(block)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetBalance returns the confirmed balance of an address with its unspent txOuts
+func (s *Server) GetBalance(ctx context.Context, request *GetBalanceRequest) (*Balance, error) {
+	if !tx.IsValidBase58Address(request.GetAddress()) {
+		return nil, status.Error(codes.InvalidArgument, "invalid address")
+	}
+	var balance blockchain.AddressBalance = blockchain.GetBalanceForAddress(request.GetAddress())
+	var message *Balance = &Balance{
+		Address:       balance.Address,
+		Balance:       balance.Balance,
+		Unconfirmed:   balance.Unconfirmed,
+		UnspentTxOuts: []*UnspentTxOut{},
+	}
+	for _, unspentTxOut := range blockchain.GetUnspentTxOutsForAddress(request.GetAddress()) {
+		message.UnspentTxOuts = append(message.UnspentTxOuts, toProtoUnspentTxOut(unspentTxOut.UnspentTxOut))
+	}
+	return message, nil
+}
+
+// SendTransaction creates a transaction from the wallet of the node, adds it to the transaction pool and broadcasts it to peers
+func (s *Server) SendTransaction(ctx context.Context, request *SendTransactionRequest) (*SendTransactionResponse, error) {
+	var options wallet.SendOptions = wallet.SendOptions{FeeRate: request.GetFeeRate()}
+	if options.FeeRate == 0 {
+		options.FeeRate = txpool.GetMinFeeRate()
+	}
+	transaction, fee, err := blockchain.SendTransaction(request.GetAddress(), request.GetAmount(), options)
+	if err != nil {
+		return nil, statusFor(err)
+	}
+	return &SendTransactionResponse{Transaction: toProtoTransaction(transaction), Fee: fee}, nil
+}
+
+// SubscribeBlocks streams every block added to the blockchain until the client cancels the call
+func (s *Server) SubscribeBlocks(request *SubscribeBlocksRequest, stream NodeService_SubscribeBlocksServer) error {
+	return s.stream(stream.Context(), s.blockSubscribers, func(event interface{}) error {
+		return stream.Send(toProtoBlock(event.(blockchain.Block)))
+	})
+}
+
+// SubscribeTxPool streams every transaction pool change until the client cancels the call
+func (s *Server) SubscribeTxPool(request *SubscribeTxPoolRequest, stream NodeService_SubscribeTxPoolServer) error {
+	return s.stream(stream.Context(), s.txPoolSubscribers, func(event interface{}) error {
+		return stream.Send(toProtoTxPoolEvent(event.(txpool.PoolEvent)))
+	})
+}
+
+// stream sends events published to subscribers until the call ends, a subscriber that falls behind gets ResourceExhausted
+func (s *Server) stream(ctx context.Context, subscribers_ *subscribers, send func(event interface{}) error) error {
+	var events chan interface{} = subscribers_.subscribe()
+	defer subscribers_.unsubscribe(events)
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-events:
+			if !ok {
+				logger.Warn("dropping subscriber that fell behind")
+				return status.Error(codes.ResourceExhausted, "subscriber fell behind")
+			}
+			if err := send(event); err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -1,144 +1,1436 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
+	"math"
 	"naivecoin/blockchain"
+	"naivecoin/grpcapi"
 	p2p "naivecoin/p2p"
+	tx "naivecoin/transactions"
+	"naivecoin/txpool"
+	"naivecoin/utils"
 	"naivecoin/wallet"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/gorilla/mux"
+	"golang.org/x/term"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 )
 
+// version and commit identify the build, they are set with -ldflags "-X main.version=... -X main.commit=..."
+var version string = "dev"
+var commit string = ""
+
+// startTime is when the node was started
+var startTime time.Time = time.Now()
+
 // port for wallet api requests
 var httpPort int = 8080
 
+// p2pPort is the port of the p2p endpoint, 0 serves it on httpPort together with the api
+var p2pPort int = 0
+
+// apiBindHost is the host the api listens on, such as 127.0.0.1 to keep it private, empty for all interfaces
+var apiBindHost string = ""
+
+// wsOnP2pPort serves the web client websocket on the p2p port instead of the api port
+var wsOnP2pPort bool = false
+
+// httpServer serves wallet api requests and websocket connections
+// it is created before the node starts, so that a shutdown signal can stop it at any time
+var httpServer *http.Server = &http.Server{}
+
+// p2pServer serves the p2p endpoint when it has a port of its own
+var p2pServer *http.Server = &http.Server{}
+
+// grpcServer serves the grpc api when -grpc-port is given, nil otherwise
+var grpcServer *grpc.Server
+
+// corsOrigins are origins of browser pages allowed to call the api, "*" allows any origin, none are allowed by default
+var corsOrigins []string = []string{}
+
+// methods and headers cross-origin api requests may use
+const (
+	corsAllowedMethods string = "GET, POST, DELETE, OPTIONS"
+	corsAllowedHeaders string = "Content-Type, Authorization"
+)
+
+// shutdownTimeout is how long the node waits for connections to close and state to be saved before exiting
+const shutdownTimeout time.Duration = 10 * time.Second
+
+// resyncTimeout bounds how long a resync request waits for the chain to be caught up with peers
+const resyncTimeout time.Duration = 2 * time.Minute
+
+// maxShutdownTimeout limits the shutdown timeout a stop request may give
+const maxShutdownTimeout time.Duration = 5 * time.Minute
+
+// stopRequests receives shutdown timeouts of stop requests, the node shuts down on the first one as it does on SIGTERM
+var stopRequests chan time.Duration = make(chan time.Duration, 1)
+
 // addPeer adds a new peer to peer list
+// the address is taken from the path, or from the address query parameter for ws:// and wss:// urls
 func addPeer(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	peerAddress := vars["peerAddress"]
+	if peerAddress == "" {
+		peerAddress = r.URL.Query().Get("address")
+	}
 	err := p2p.AddPeer(peerAddress)
-	w.Header().Set("Content-Type", "application/json")
 	if err == nil {
-		json.NewEncoder(w).Encode("success")
+		writeJSON(w, r, "success")
+	} else if errors.Is(err, p2p.ErrAlreadyConnected) {
+		writeJSON(w, r, "already connected")
+	} else if errors.Is(err, p2p.ErrOutboundLimit) {
+		writeErrorFor(w, err)
 	} else {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, codePeerUnreachable, err.Error())
 	}
 }
 
+// getPeers returns connection slot usage and the list of connected peers
+func getPeers(w http.ResponseWriter, r *http.Request) {
+	peers := struct {
+		Slots p2p.PeerSlots
+		Peers []p2p.Peer
+	}{
+		Slots: p2p.GetPeerSlots(),
+		Peers: p2p.GetPeers(),
+	}
+	writeJSON(w, r, peers)
+}
+
+// removePeer disconnects a peer with a given address
+func removePeer(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	peerAddress := vars["peerAddress"]
+	if err := p2p.RemovePeer(peerAddress); err != nil {
+		writeErrorFor(w, err)
+		return
+	}
+	writeJSON(w, r, "success")
+}
+
+// maxMiningTimeoutSeconds limits ?timeoutSeconds= of mining requests
+const maxMiningTimeoutSeconds int = 3600
+
+// miningContext returns the context a mining request mines with, it is done when the client goes away
+// or after ?timeoutSeconds= if given
+func miningContext(r *http.Request) (context.Context, context.CancelFunc, error) {
+	var timeoutParam string = r.URL.Query().Get("timeoutSeconds")
+	if timeoutParam == "" {
+		ctx, cancel := context.WithCancel(r.Context())
+		return ctx, cancel, nil
+	}
+	timeoutSeconds, err := strconv.Atoi(timeoutParam)
+	if err != nil || timeoutSeconds < 1 || timeoutSeconds > maxMiningTimeoutSeconds {
+		return nil, nil, newApiError(http.StatusBadRequest, codeInvalidRequest, fmt.Sprintf("timeoutSeconds must be between 1 and %d", maxMiningTimeoutSeconds))
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), time.Duration(timeoutSeconds)*time.Second)
+	return ctx, cancel, nil
+}
+
 // mineBlock mines a new block built with transactions in a transaction pool
-// also includes coinbase transaction
+// also includes coinbase transaction, paying ?rewardAddress= if given, the response echoes the address it pays
+// mining gives up when the client goes away or after ?timeoutSeconds=
 func mineBlock(w http.ResponseWriter, r *http.Request) {
-	block, err := blockchain.ProduceNextBlock()
-	w.Header().Set("Content-Type", "application/json")
-	if err == nil {
-		json.NewEncoder(w).Encode(block)
-	} else {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	ctx, cancel, err := miningContext(r)
+	if err != nil {
+		writeErrorFor(w, err)
+		return
+	}
+	defer cancel()
+	block, err := blockchain.ProduceNextBlock(ctx, r.URL.Query().Get("rewardAddress"))
+	if err != nil {
+		writeErrorFor(w, err)
+		return
+	}
+	writeJSON(w, r, struct {
+		blockchain.Block
+		RewardAddress string
+	}{Block: block, RewardAddress: block.Fields.Transactions[0].TxOuts[0].Address})
+}
+
+// maxGenerateBlocks limits the number of blocks a single generate request mines
+const maxGenerateBlocks int = 1000
+
+// generate mines n blocks back to back with transactions in a transaction pool and returns their hashes
+// coinbase transactions pay ?rewardAddress= if given, mining stops if the request is cancelled or after ?timeoutSeconds=
+func generate(w http.ResponseWriter, r *http.Request) {
+	count, err := strconv.Atoi(mux.Vars(r)["n"])
+	if err != nil || count < 1 || count > maxGenerateBlocks {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, fmt.Sprintf("n must be between 1 and %d", maxGenerateBlocks))
+		return
+	}
+	ctx, cancel, err := miningContext(r)
+	if err != nil {
+		writeErrorFor(w, err)
+		return
+	}
+	defer cancel()
+	hashes, err := blockchain.GenerateBlocks(ctx, count, r.URL.Query().Get("rewardAddress"))
+	if err != nil {
+		writeErrorFor(w, err)
+		return
+	}
+	writeJSON(w, r, hashes)
+}
+
+// adminStop shuts the node down the same way SIGTERM does, ?timeout= bounds how long shutdown may take
+// the response is written before shutdown starts, so the client receives it before the listener is closed
+func adminStop(w http.ResponseWriter, r *http.Request) {
+	var timeout time.Duration = shutdownTimeout
+	if timeoutParam := r.URL.Query().Get("timeout"); timeoutParam != "" {
+		parsed, err := time.ParseDuration(timeoutParam)
+		if err != nil || parsed <= 0 || parsed > maxShutdownTimeout {
+			writeError(w, http.StatusBadRequest, codeInvalidRequest, fmt.Sprintf("timeout must be a duration between 0 and %s", maxShutdownTimeout))
+			return
+		}
+		timeout = parsed
+	}
+	writeJSON(w, r, struct {
+		Stopping bool
+		Timeout  string
+	}{Stopping: true, Timeout: timeout.String()})
+	if flusher, ok := w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	select {
+	case stopRequests <- timeout:
+	default:
+		// shutdown is already requested
 	}
 }
 
 // getBlocks returns all blocks in a blockchain
 func getBlocks(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(blockchain.GetBlockChain())
+	writeJSON(w, r, blockchain.GetBlockChain())
 }
 
 // lastBlock returns the latest block in a blockchain
 func lastBlock(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(blockchain.GetLatestBlock())
+	writeJSON(w, r, blockchain.GetLatestBlock())
+}
+
+// getDifficulty returns the difficulty of the next block, when it is adjusted next and an estimate of the adjusted difficulty
+func getDifficulty(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, r, blockchain.GetDifficultyForecast())
+}
+
+// getSupply returns coins minted, fees burned and coins in circulation of the current chain, cross-checked against unspent txOuts
+func getSupply(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, r, blockchain.GetSupply())
 }
 
-// getBalance returns a sum of all unspent transactions for current wallet
+// defaultRichListLimit is the number of addresses the rich list returns unless ?limit= is given, maxRichListLimit the most it returns
+const defaultRichListLimit int = 100
+const maxRichListLimit int = 1000
+
+// getRichList returns addresses of the current chain with the greatest balances, their unspent txOut counts and shares of the supply
+// ?limit= caps the number of addresses, ?minBalance= leaves out addresses holding less
+func getRichList(w http.ResponseWriter, r *http.Request) {
+	var limit int = defaultRichListLimit
+	if limitParam := r.URL.Query().Get("limit"); limitParam != "" {
+		parsed, err := strconv.Atoi(limitParam)
+		if err != nil || parsed < 1 || parsed > maxRichListLimit {
+			writeError(w, http.StatusBadRequest, codeInvalidRequest, fmt.Sprintf("limit must be between 1 and %d", maxRichListLimit))
+			return
+		}
+		limit = parsed
+	}
+	var minBalance float64 = 0
+	if minBalanceParam := r.URL.Query().Get("minBalance"); minBalanceParam != "" {
+		parsed, err := strconv.ParseFloat(minBalanceParam, 64)
+		if err != nil || parsed < 0 || math.IsNaN(parsed) {
+			writeError(w, http.StatusBadRequest, codeInvalidAmount, "minBalance must be a non-negative number")
+			return
+		}
+		minBalance = parsed
+	}
+	writeJSON(w, r, blockchain.GetRichList(limit, minBalance))
+}
+
+// getBalance returns confirmed, spendable and pending balances of current wallet
 func getBalance(w http.ResponseWriter, r *http.Request) {
-	balance := blockchain.GetAccountBalance()
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(balance)
+	balance := blockchain.GetBalances()
+	writeJSON(w, r, balance)
 }
 
-// sendTx creates a new transaction, adds it into transaction pool and broadcasts it to peers
-func sendTx(w http.ResponseWriter, r *http.Request) {
+// getAddressBalance returns a balance of a given address, a valid address that was never used has zero balance
+func getAddressBalance(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	address := vars["address"]
-	amount := vars["amount"]
-	amountFloat, parseFloatError := strconv.ParseFloat(amount, 64)
+	if !tx.IsValidBase58Address(address) {
+		writeError(w, http.StatusBadRequest, codeInvalidAddress, "invalid address")
+		return
+	}
+	writeJSON(w, r, blockchain.GetBalanceForAddress(address))
+}
+
+// getWallet returns the wallet address, confirmed and pending balances and number of unspent txOuts the wallet owns
+func getWallet(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, r, blockchain.GetWalletInfo())
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	if parseFloatError != nil {
-		http.Error(w, parseFloatError.Error(), http.StatusBadRequest)
+// walletKeyRequest is the body of wallet key export and import requests
+// the wallet passphrase authenticates the request, PrivateKey is used by import only
+type walletKeyRequest struct {
+	Passphrase string
+	PrivateKey string
+}
+
+// walletKeyError writes an error of a wallet key request with a matching status code
+func walletKeyError(w http.ResponseWriter, err error) {
+	if errors.Is(err, wallet.ErrWrongPassphrase) || errors.Is(err, wallet.ErrInvalidPrivateKey) {
+		writeErrorFor(w, err)
 		return
 	}
+	writeError(w, http.StatusInternalServerError, codeInternal, err.Error())
+}
 
-	tx, sendCoinsError := blockchain.SendTransaction(address, amountFloat)
-	if sendCoinsError == nil {
-		json.NewEncoder(w).Encode(tx)
-	} else {
-		http.Error(w, sendCoinsError.Error(), http.StatusBadRequest)
+// exportWalletKey returns the master private key of the wallet in wallet import format
+func exportWalletKey(w http.ResponseWriter, r *http.Request) {
+	var request walletKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "invalid request body")
+		return
 	}
+	privateKey, err := wallet.ExportPrivateKey(request.Passphrase)
+	if err != nil {
+		walletKeyError(w, err)
+		return
+	}
+	writeJSON(w, r, struct{ PrivateKey string }{PrivateKey: privateKey})
 }
 
-// sendCoins creates a new transaction, adds it into a block, then mines this block and broadcasts it to peers
-func sendCoins(w http.ResponseWriter, r *http.Request) {
+// importWalletKey replaces the master key of the wallet and sends the new wallet info to web clients
+func importWalletKey(w http.ResponseWriter, r *http.Request) {
+	var request walletKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "invalid request body")
+		return
+	}
+	if err := wallet.ImportPrivateKey(request.PrivateKey, request.Passphrase); err != nil {
+		walletKeyError(w, err)
+		return
+	}
+	p2p.Network{}.WalletChanged()
+	writeJSON(w, r, blockchain.GetWalletInfo())
+}
+
+// walletUnlockRequest is the body of wallet unlock request, Timeout is in seconds, 0 keeps the wallet unlocked until locked
+type walletUnlockRequest struct {
+	Passphrase string
+	Timeout    int
+}
+
+// unlockWallet decrypts wallet keys so that the wallet can spend for a given time
+func unlockWallet(w http.ResponseWriter, r *http.Request) {
+	var request walletUnlockRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.Timeout < 0 {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "invalid request body")
+		return
+	}
+	if err := wallet.Unlock(request.Passphrase, time.Duration(request.Timeout)*time.Second); err != nil {
+		walletKeyError(w, err)
+		return
+	}
+	p2p.Network{}.WalletChanged()
+	writeJSON(w, r, blockchain.GetWalletInfo())
+}
+
+// lockWallet removes wallet keys from memory immediately
+func lockWallet(w http.ResponseWriter, r *http.Request) {
+	wallet.Lock()
+	p2p.Network{}.WalletChanged()
+	writeJSON(w, r, blockchain.GetWalletInfo())
+}
+
+// getNewAddress issues a new receive address of the wallet
+func getNewAddress(w http.ResponseWriter, r *http.Request) {
+	address, err := wallet.GetNewAddress()
+	if errors.Is(err, wallet.ErrWalletLocked) {
+		writeErrorFor(w, err)
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternal, err.Error())
+		return
+	}
+	writeJSON(w, r, address)
+}
+
+// getAddresses returns all addresses issued by the wallet, starting with the primary address
+func getAddresses(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, r, wallet.GetAddresses())
+}
+
+// getFeeRate returns the fee per byte given in feeRate query parameter, the minimum accepted by the transaction pool if not given
+func getFeeRate(r *http.Request) (float64, error) {
+	var feeRateParam string = r.URL.Query().Get("feeRate")
+	if feeRateParam == "" {
+		return txpool.GetMinFeeRate(), nil
+	}
+	feeRate, err := strconv.ParseFloat(feeRateParam, 64)
+	if err != nil {
+		return 0, newApiError(http.StatusBadRequest, codeInvalidFee, "invalid fee rate: "+err.Error())
+	}
+	return feeRate, nil
+}
+
+// transactionRequest is the body of POST /api/transactions and /api/blocks/mineWithTx
+// Fee is an absolute fee and FeeRate a fee per byte, at most one of them is given, the minimum fee rate of the transaction pool by default
+// Utxos restrict the wallet txOuts the transaction spends
+type transactionRequest struct {
+	Address string
+	Amount  float64
+	Fee     *float64
+	FeeRate *float64
+	Utxos   []wallet.TxOutRef
+}
+
+// fieldError describes an invalid field of a request with the error code it is reported with
+type fieldError struct {
+	code    string
+	message string
+}
+
+// validate returns an error for every invalid field of a transaction request, none if it is valid
+func (request transactionRequest) validate() []fieldError {
+	var fieldErrors []fieldError = []fieldError{}
+	if request.Address == "" {
+		fieldErrors = append(fieldErrors, fieldError{codeInvalidAddress, "address: required"})
+	} else if !tx.IsValidBase58Address(request.Address) {
+		fieldErrors = append(fieldErrors, fieldError{codeInvalidAddress, "address: invalid address"})
+	}
+	if !(request.Amount > 0) {
+		fieldErrors = append(fieldErrors, fieldError{codeInvalidAmount, "amount: must be positive"})
+	}
+	if request.Fee != nil && *request.Fee < 0 {
+		fieldErrors = append(fieldErrors, fieldError{codeInvalidFee, "fee: must not be negative"})
+	}
+	if request.FeeRate != nil && *request.FeeRate < 0 {
+		fieldErrors = append(fieldErrors, fieldError{codeInvalidFee, "feeRate: must not be negative"})
+	}
+	if request.Fee != nil && request.FeeRate != nil {
+		fieldErrors = append(fieldErrors, fieldError{codeInvalidFee, "fee: can't be given together with feeRate"})
+	}
+	var seen map[wallet.TxOutRef]bool = map[wallet.TxOutRef]bool{}
+	for n, ref := range request.Utxos {
+		if len(ref.TxOutId) != 64 || !utils.IsHex(ref.TxOutId) {
+			fieldErrors = append(fieldErrors, fieldError{codeInvalidRequest, fmt.Sprintf("utxos[%d].txOutId: invalid transaction id", n)})
+		}
+		if ref.TxOutIndex < 0 {
+			fieldErrors = append(fieldErrors, fieldError{codeInvalidRequest, fmt.Sprintf("utxos[%d].txOutIndex: must not be negative", n)})
+		}
+		if seen[ref] {
+			fieldErrors = append(fieldErrors, fieldError{codeInvalidRequest, fmt.Sprintf("utxos[%d]: duplicate txOut", n)})
+		}
+		seen[ref] = true
+	}
+	return fieldErrors
+}
+
+// fieldErrorsToApiError joins errors of invalid fields, reported with their common error code or INVALID_REQUEST if they differ
+func fieldErrorsToApiError(fieldErrors []fieldError) *apiError {
+	var code string = fieldErrors[0].code
+	var messages []string = []string{}
+	for _, fieldErr := range fieldErrors {
+		if fieldErr.code != code {
+			code = codeInvalidRequest
+		}
+		messages = append(messages, fieldErr.message)
+	}
+	return newApiError(http.StatusBadRequest, code, strings.Join(messages, "; "))
+}
+
+// sendOptions returns wallet options of a transaction request
+func (request transactionRequest) sendOptions() wallet.SendOptions {
+	var options wallet.SendOptions = wallet.SendOptions{FeeRate: txpool.GetMinFeeRate(), Fee: request.Fee, TxOuts: request.Utxos}
+	if request.FeeRate != nil {
+		options.FeeRate = *request.FeeRate
+	}
+	return options
+}
+
+// decodeTransactionRequest decodes a transaction request from a JSON body and validates it
+// unknown fields and data after the JSON object are rejected
+func decodeTransactionRequest(r *http.Request) (transactionRequest, error) {
+	var request transactionRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&request); err != nil {
+		return request, newApiError(http.StatusBadRequest, codeInvalidRequest, "invalid request body: "+err.Error())
+	}
+	if decoder.More() {
+		return request, newApiError(http.StatusBadRequest, codeInvalidRequest, "invalid request body: unexpected data after the JSON object")
+	}
+	if fieldErrors := request.validate(); len(fieldErrors) > 0 {
+		return request, fieldErrorsToApiError(fieldErrors)
+	}
+	return request, nil
+}
+
+// transactionResult describes a transaction created by the wallet, Change is what it sends back to the wallet
+type transactionResult struct {
+	Id     string
+	Fee    float64
+	Change float64
+}
+
+// newTransactionResult returns the result of a wallet transaction, which pays the recipient in the first txOut and change in the second one
+func newTransactionResult(transaction tx.Transaction, fee float64) transactionResult {
+	var result transactionResult = transactionResult{Id: transaction.Id, Fee: fee}
+	if len(transaction.TxOuts) > 1 {
+		result.Change = transaction.TxOuts[1].Amount
+	}
+	return result
+}
+
+// postTransaction creates a new transaction described by a JSON body, adds it into transaction pool and broadcasts it to peers
+func postTransaction(w http.ResponseWriter, r *http.Request) {
+	request, err := decodeTransactionRequest(r)
+	if err != nil {
+		writeErrorFor(w, err)
+		return
+	}
+	transaction, fee, err := blockchain.SendTransaction(request.Address, request.Amount, request.sendOptions())
+	if err != nil {
+		writeErrorFor(w, err)
+		return
+	}
+	writeJSON(w, r, newTransactionResult(transaction, fee))
+}
+
+// mineWithTx creates a new transaction described by a JSON body, adds it into transaction pool and broadcasts it to peers,
+// then mines a block with it and broadcasts this block; if mining fails, 202 Accepted is written with the pending transaction
+func mineWithTx(w http.ResponseWriter, r *http.Request) {
+	request, err := decodeTransactionRequest(r)
+	if err != nil {
+		writeErrorFor(w, err)
+		return
+	}
+	ctx, cancel, err := miningContext(r)
+	if err != nil {
+		writeErrorFor(w, err)
+		return
+	}
+	defer cancel()
+	block, transaction, fee, err := blockchain.SendCoinsToAddress(ctx, request.Address, request.Amount, request.sendOptions())
+	if err != nil {
+		writeSendCoinsError(w, r, err)
+		return
+	}
+	writeJSON(w, r, struct {
+		transactionResult
+		Block blockchain.Block
+	}{transactionResult: newTransactionResult(transaction, fee), Block: block})
+}
+
+// pendingTransactionResult describes a transaction left in the transaction pool after mining a block with it failed
+// Reason and Message are the api error code and message of the mining failure
+type pendingTransactionResult struct {
+	transactionResult
+	Pending bool
+	Reason  string
+	Message string
+}
+
+// writeSendCoinsError writes an error of sending coins in a mined block
+// if the transaction is pending, 202 Accepted is written with the transaction instead of an error
+func writeSendCoinsError(w http.ResponseWriter, r *http.Request, err error) {
+	var pending blockchain.PendingTransactionError
+	if !errors.As(err, &pending) {
+		writeErrorFor(w, err)
+		return
+	}
+	var apiErr *apiError = toApiError(pending.Err)
+	writeJSONStatus(w, r, http.StatusAccepted, pendingTransactionResult{
+		transactionResult: newTransactionResult(pending.Transaction, pending.Fee),
+		Pending:           true,
+		Reason:            apiErr.Code,
+		Message:           apiErr.Message,
+	})
+}
+
+// pathTransactionRequest returns a transaction request given by address and amount path variables and feeRate query parameter
+func pathTransactionRequest(r *http.Request) (transactionRequest, error) {
+	vars := mux.Vars(r)
+	amount, err := strconv.ParseFloat(vars["amount"], 64)
+	if err != nil {
+		return transactionRequest{}, newApiError(http.StatusBadRequest, codeInvalidAmount, err.Error())
+	}
+	var request transactionRequest = transactionRequest{Address: vars["address"], Amount: amount}
+	if r.URL.Query().Get("feeRate") != "" {
+		feeRate, err := getFeeRate(r)
+		if err != nil {
+			return transactionRequest{}, err
+		}
+		request.FeeRate = &feeRate
+	}
+	if fieldErrors := request.validate(); len(fieldErrors) > 0 {
+		return request, fieldErrorsToApiError(fieldErrors)
+	}
+	return request, nil
+}
+
+// sendTx creates a new transaction, adds it into transaction pool and broadcasts it to peers
+// the transaction pays the minimum fee rate of the transaction pool unless another fee per byte is given in feeRate query parameter
+// it is kept for older clients, POST /api/transactions takes the same request as a JSON body
+func sendTx(w http.ResponseWriter, r *http.Request) {
+	request, err := pathTransactionRequest(r)
+	if err != nil {
+		writeErrorFor(w, err)
+		return
+	}
+
+	transaction, fee, err := blockchain.SendTransaction(request.Address, request.Amount, request.sendOptions())
+	if err != nil {
+		writeErrorFor(w, err)
+		return
+	}
+	writeJSON(w, r, struct {
+		tx.Transaction
+		Fee float64
+	}{Transaction: transaction, Fee: fee})
+}
+
+// sweep sends the whole spendable balance of the wallet to a given address in a transaction added to the transaction pool
+// the response states the amount delivered after the fee
+func sweep(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	address := vars["address"]
-	amount := vars["amount"]
-	amountFloat, parseFloatError := strconv.ParseFloat(amount, 64)
+	feeRate, err := getFeeRate(r)
+	if err != nil {
+		writeErrorFor(w, err)
+		return
+	}
 
-	w.Header().Set("Content-Type", "application/json")
-	if parseFloatError != nil {
-		http.Error(w, parseFloatError.Error(), http.StatusBadRequest)
+	transaction, fee, err := blockchain.Sweep(address, feeRate)
+	if err != nil {
+		writeErrorFor(w, err)
 		return
 	}
+	writeJSON(w, r, struct {
+		tx.Transaction
+		Amount float64
+		Fee    float64
+	}{Transaction: transaction, Amount: transaction.TxOuts[0].Amount, Fee: fee})
+}
 
-	block, sendCoinsError := blockchain.SendCoinsToAddress(address, amountFloat)
-	if sendCoinsError == nil {
-		json.NewEncoder(w).Encode(block)
-	} else {
-		http.Error(w, sendCoinsError.Error(), http.StatusBadRequest)
+// sendCoins creates a new transaction, adds it into transaction pool, then mines a block with it and broadcasts both to peers
+// if mining fails, 202 Accepted is written with the pending transaction
+// it is kept for older clients, POST /api/blocks/mineWithTx takes the same request as a JSON body
+func sendCoins(w http.ResponseWriter, r *http.Request) {
+	request, err := pathTransactionRequest(r)
+	if err != nil {
+		writeErrorFor(w, err)
+		return
+	}
+
+	ctx, cancel, err := miningContext(r)
+	if err != nil {
+		writeErrorFor(w, err)
+		return
 	}
+	defer cancel()
+	block, _, _, err := blockchain.SendCoinsToAddress(ctx, request.Address, request.Amount, request.sendOptions())
+	if err != nil {
+		writeSendCoinsError(w, r, err)
+		return
+	}
+	writeJSON(w, r, block)
 }
 
 // unspentTxOuts returns unspent transactions for a blockchain
 func unspentTxOuts(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(blockchain.GetUnspentTxOuts())
+	writeJSON(w, r, blockchain.GetUnspentTxOuts())
+}
+
+// addressUnspentTxOuts returns unspent txOuts of a given address with their confirmations
+func addressUnspentTxOuts(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	address := vars["address"]
+	if !tx.IsValidBase58Address(address) {
+		writeError(w, http.StatusBadRequest, codeInvalidAddress, "invalid address")
+		return
+	}
+	writeJSON(w, r, blockchain.GetUnspentTxOutsForAddress(address))
+}
+
+// getTxPool returns all transactions in the transaction pool with their fees, sizes and ages
+func getTxPool(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, r, txpool.GetPoolTransactions(blockchain.GetUnspentTxOuts()))
+}
+
+// getTxPoolTransaction returns a single transaction from the transaction pool
+func getTxPoolTransaction(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	txId := vars["id"]
+	poolTx, found := txpool.GetPoolTransaction(txId, blockchain.GetUnspentTxOuts())
+	if !found {
+		writeError(w, http.StatusNotFound, codeNotFound, "transaction not found in pool")
+		return
+	}
+	writeJSON(w, r, poolTx)
+}
+
+// removeTxPoolTransaction removes a transaction from the local transaction pool and returns it
+func removeTxPoolTransaction(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	txId := vars["id"]
+	removed, err := txpool.RemoveTransaction(txId)
+	if errors.Is(err, txpool.ErrNotInPool) {
+		writeError(w, http.StatusNotFound, codeNotFound, err.Error())
+		return
+	} else if err != nil {
+		writeError(w, http.StatusConflict, codePoolConflict, err.Error())
+		return
+	}
+	writeJSON(w, r, removed)
+}
+
+// getAddressPending returns pool transactions paying to or spending from a given address
+func getAddressPending(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	address := vars["address"]
+	if !tx.IsValidBase58Address(address) {
+		writeError(w, http.StatusBadRequest, codeInvalidAddress, "invalid address")
+		return
+	}
+	writeJSON(w, r, txpool.GetTransactionsForAddress(address))
+}
+
+// getStats returns node statistics: transaction pool utilization and limits
+func getStats(w http.ResponseWriter, r *http.Request) {
+	stats := struct {
+		TxPool txpool.PoolStats
+	}{
+		TxPool: txpool.GetPoolStats(),
+	}
+	writeJSON(w, r, stats)
+}
+
+// getSync returns sync status: local height, best height reported by peers, number of blocks left to download
+// and whether blocks are being downloaded, a received chain is replacing the local one or a resync is running
+func getSync(w http.ResponseWriter, r *http.Request) {
+	var localHeight int = blockchain.GetLatestBlock().Fields.Index
+	var bestPeerHeight int = p2p.BestPeerHeight()
+	var remaining int = 0
+	if bestPeerHeight > localHeight {
+		remaining = bestPeerHeight - localHeight
+	}
+	var replacing bool = blockchain.IsReplacingChain()
+	var downloading bool = p2p.IsSyncing()
+	var resyncing bool = p2p.IsResyncing()
+	syncStatus := struct {
+		LocalHeight    int
+		BestPeerHeight int
+		Downloading    bool
+		Replacing      bool
+		Resyncing      bool
+		Remaining      int
+		Synced         bool
+	}{
+		LocalHeight:    localHeight,
+		BestPeerHeight: bestPeerHeight,
+		Downloading:    downloading,
+		Replacing:      replacing,
+		Resyncing:      resyncing,
+		Remaining:      remaining,
+		Synced:         remaining == 0 && !downloading && !replacing && !resyncing,
+	}
+	writeJSON(w, r, syncStatus)
+}
+
+// resync asks connected peers for their latest blocks and catches up with a higher tip,
+// it responds with the number of peers queried and whether a chain from peers was adopted
+func resync(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), resyncTimeout)
+	defer cancel()
+	result, err := p2p.Resync(ctx)
+	if err != nil {
+		writeErrorFor(w, err)
+		return
+	}
+	writeJSON(w, r, result)
+}
+
+// getMinerStats returns hashes tried, hash rate and blocks found by mining
+// ?reset=true sets the counters to zero after they are returned, it requires the api token like other mutating requests
+func getMinerStats(w http.ResponseWriter, r *http.Request) {
+	reset, err := strconv.ParseBool(r.URL.Query().Get("reset"))
+	if err != nil && r.URL.Query().Get("reset") != "" {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "invalid reset parameter")
+		return
+	}
+	if reset && !isAuthenticated(r) {
+		writeUnauthorized(w)
+		return
+	}
+	var stats blockchain.MinerStats = blockchain.GetMinerStats()
+	if reset {
+		blockchain.ResetMinerStats()
+	}
+	writeJSON(w, r, stats)
+}
+
+// getStatus returns a summary of the node for liveness and readiness probes
+// it responds with 503 while blocks are downloaded or a received chain replaces the local one, and takes no blockchain lock,
+// so that it does not wait for chain validation
+func getStatus(w http.ResponseWriter, r *http.Request) {
+	var latestBlock blockchain.Block = blockchain.GetLatestBlock()
+	var bestPeerHeight int = p2p.BestPeerHeight()
+	var slots p2p.PeerSlots = p2p.GetPeerSlots()
+	var downloading bool = p2p.IsSyncing()
+	var replacing bool = blockchain.IsReplacingChain()
+	status := struct {
+		UptimeSeconds int64
+		Version       string
+		Commit        string
+		Height        int
+		TipHash       string
+		Peers         int
+		TxPoolSize    int
+		Mining        bool
+		Synced        bool
+	}{
+		UptimeSeconds: int64(time.Since(startTime).Seconds()),
+		Version:       version,
+		Commit:        commit,
+		Height:        latestBlock.Fields.Index,
+		TipHash:       latestBlock.Hash,
+		Peers:         slots.Inbound.Used + slots.Outbound.Used,
+		TxPoolSize:    txpool.GetPoolStats().Count,
+		Mining:        blockchain.IsMining(),
+		Synced:        latestBlock.Fields.Index >= bestPeerHeight && !downloading && !replacing,
+	}
+	if downloading || replacing {
+		writeJSONStatus(w, r, http.StatusServiceUnavailable, status)
+		return
+	}
+	writeJSON(w, r, status)
+}
+
+// walletPassphraseEnv is the environment variable the wallet passphrase can be given in
+const walletPassphraseEnv string = "NAIVECOIN_WALLET_PASSPHRASE"
+
+// dataDirEnv and keyFileEnv are the environment variables the data directory and the wallet keystore file can be given in
+const (
+	dataDirEnv string = "NAIVECOIN_DATADIR"
+	keyFileEnv string = "NAIVECOIN_KEYFILE"
+)
+
+// flagOrEnv returns a flag value if set, otherwise a value of an environment variable if set, otherwise a default value
+func flagOrEnv(value string, env string, defaultValue string) string {
+	if value != "" {
+		return value
+	}
+	if value = os.Getenv(env); value != "" {
+		return value
+	}
+	return defaultValue
+}
+
+// resolveDataPath resolves a relative path of a file the node keeps its state in against the data directory
+// absolute paths and empty paths, which disable a file, are returned unchanged
+func resolveDataPath(dataDir string, path string) string {
+	if path == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(dataDir, path)
+}
+
+// maxPassphraseAttempts is how many times the wallet passphrase is prompted for before giving up
+const maxPassphraseAttempts int = 3
+
+// openWallet decrypts the wallet keystore at a given path with a passphrase given by a flag or in the environment,
+// or prompted for on the terminal if neither is set
+// if restore is set, the wallet is restored from mnemonic words read from standard input and encrypted with the passphrase
+func openWallet(keyFile string, passphrase string, restore bool) error {
+	if passphrase == "" {
+		passphrase = os.Getenv(walletPassphraseEnv)
+	}
+	if restore {
+		words, err := readMnemonic()
+		if err != nil {
+			return err
+		}
+		if passphrase == "" {
+			if passphrase, err = promptPassphrase(); err != nil {
+				return err
+			}
+		}
+		return wallet.RestoreFromMnemonic(keyFile, words, passphrase)
+	}
+	if passphrase != "" {
+		return wallet.InitWallet(keyFile, passphrase)
+	}
+	for n := 0; n < maxPassphraseAttempts; n++ {
+		passphrase, err := promptPassphrase()
+		if err != nil {
+			return err
+		}
+		err = wallet.InitWallet(keyFile, passphrase)
+		if !errors.Is(err, wallet.ErrWrongPassphrase) {
+			return err
+		}
+		fmt.Println(err.Error())
+	}
+	return wallet.ErrWrongPassphrase
+}
+
+// promptPassphrase reads the wallet passphrase from the terminal without echoing it
+func promptPassphrase() (string, error) {
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		return "", fmt.Errorf("no passphrase given, use -wallet-passphrase or %s", walletPassphraseEnv)
+	}
+	fmt.Print("Wallet passphrase: ")
+	passphraseBytes, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Println()
+	return string(passphraseBytes), err
+}
+
+// readMnemonic reads a line of mnemonic words from standard input
+func readMnemonic() (string, error) {
+	if term.IsTerminal(int(os.Stdin.Fd())) {
+		fmt.Print("Mnemonic words: ")
+	}
+	words, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && !(errors.Is(err, io.EOF) && words != "") {
+		return "", fmt.Errorf("failed to read mnemonic: %s", err.Error())
+	}
+	return words, nil
+}
+
+// loadP2pTLSConfig builds TLS configuration used to dial wss:// peers
+// caFile adds a trusted CA, certFile and keyFile set a client certificate, both are optional
+// insecureSkipVerify disables verification of peer certificates and applies to p2p dialing only
+func loadP2pTLSConfig(caFile string, certFile string, keyFile string, insecureSkipVerify bool) (*tls.Config, error) {
+	var config *tls.Config = &tls.Config{InsecureSkipVerify: insecureSkipVerify}
+	if caFile != "" {
+		caPem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(caPem) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// the api is served on httpPort and the p2p endpoint on p2pPort if it differs, both over HTTPS when tlsCertFile and tlsKeyFile are given
+func initHttpServer(tlsCertFile string, tlsKeyFile string, bootstrapPeers []string) {
+	var separateP2p bool = getP2pPort() != httpPort
+	apiMux, p2pMux := newServeMuxes(newApiRouter(), separateP2p)
+
+	setServerTimeouts(httpServer)
+	setServerTimeouts(p2pServer)
+	httpServer.Addr = net.JoinHostPort(apiBindHost, strconv.Itoa(httpPort))
+	httpServer.Handler = apiMux
+	var apiListener net.Listener = listen(httpServer, "api", tlsCertFile != "")
+	var p2pHost string = apiBindHost
+	if separateP2p {
+		p2pServer.Addr = fmt.Sprintf(":%d", p2pPort)
+		p2pServer.Handler = p2pMux
+		p2pHost = ""
+		go serve(p2pServer, listen(p2pServer, "p2p", tlsCertFile != ""), tlsCertFile, tlsKeyFile)
+	}
+	fmt.Printf("p2p url: %s\n", p2pEndpointURL(p2pHost, tlsCertFile != ""))
+
+	// peers may dial back as soon as they are connected, so bootstrap peers are dialed once the endpoints accept connections
+	go connectBootstrapPeers(bootstrapPeers)
+	serve(httpServer, apiListener, tlsCertFile, tlsKeyFile)
+	// Serve returns as soon as shutdown starts, the process exits once it is completed
+	select {}
 }
 
+// newApiRouter returns the router of the api endpoints
 // https://www.golangprograms.com/how-to-use-wildcard-or-a-variable-in-our-url-for-complex-routing.html
-func initHttpServer() {
+func newApiRouter() *mux.Router {
 	rtr := mux.NewRouter()
-	rtr.HandleFunc("/api/unspentTxOuts", unspentTxOuts)
-	rtr.HandleFunc("/api/blocks", getBlocks)
-	rtr.HandleFunc("/api/lastBlock", lastBlock)
-	rtr.HandleFunc("/api/balance", getBalance)
-	rtr.HandleFunc("/api/sendCoins/{address}/{amount}", sendCoins)
-	rtr.HandleFunc("/api/sendTx/{address}/{amount}", sendTx)
-	rtr.HandleFunc("/api/mineBlock", mineBlock)
-	rtr.HandleFunc("/api/addPeer/{peerAddress}", addPeer)
+	rtr.HandleFunc("/api/unspentTxOuts", readOnly(expensive(unspentTxOuts)))
+	rtr.HandleFunc("/api/unspentTxOuts/{address}", readOnly(addressUnspentTxOuts))
+	rtr.HandleFunc("/api/blocks", readOnly(expensive(getBlocks)))
+	rtr.HandleFunc("/api/lastBlock", readOnly(lastBlock))
+	rtr.HandleFunc("/api/difficulty", readOnly(getDifficulty))
+	rtr.HandleFunc("/api/supply", readOnly(getSupply))
+	rtr.HandleFunc("/api/richlist", readOnly(getRichList))
+	rtr.HandleFunc("/api/balance", readOnly(getBalance))
+	rtr.HandleFunc("/api/balance/{address}", readOnly(getAddressBalance))
+	rtr.HandleFunc("/api/wallet", readOnly(getWallet))
+	rtr.HandleFunc("/api/wallet/export", mutating(exportWalletKey)).Methods("POST")
+	rtr.HandleFunc("/api/wallet/import", mutating(importWalletKey)).Methods("POST")
+	rtr.HandleFunc("/api/wallet/unlock", mutating(unlockWallet)).Methods("POST")
+	rtr.HandleFunc("/api/wallet/lock", mutating(lockWallet)).Methods("POST")
+	rtr.HandleFunc("/api/newAddress", mutating(getNewAddress))
+	rtr.HandleFunc("/api/addresses", readOnly(getAddresses))
+	rtr.HandleFunc("/api/sendCoins/{address}/{amount}", mutating(expensive(sendCoins)))
+	rtr.HandleFunc("/api/sendTx/{address}/{amount}", mutating(sendTx))
+	rtr.HandleFunc("/api/transactions", mutating(postTransaction)).Methods("POST")
+	rtr.HandleFunc("/api/blocks/mineWithTx", mutating(expensive(mineWithTx))).Methods("POST")
+	rtr.HandleFunc("/api/sweep/{address}", mutating(sweep))
+	rtr.HandleFunc("/api/mineBlock", mutating(expensive(mineBlock)))
+	rtr.HandleFunc("/api/generate/{n}", mutating(expensive(generate)))
+	rtr.HandleFunc("/api/admin/stop", mutating(adminStop)).Methods("POST")
+	rtr.HandleFunc("/api/addPeer/{peerAddress}", mutating(addPeer))
+	rtr.HandleFunc("/api/addPeer", mutating(addPeer)).Queries("address", "{address}")
+	rtr.HandleFunc("/api/peers", readOnly(getPeers))
+	rtr.HandleFunc("/api/peers/{peerAddress}", mutating(removePeer)).Methods("DELETE")
+	rtr.HandleFunc("/api/stats", readOnly(getStats))
+	rtr.HandleFunc("/api/sync", readOnly(getSync))
+	rtr.HandleFunc("/api/resync", mutating(resync)).Methods("POST")
+	rtr.HandleFunc("/api/status", readOnly(getStatus))
+	rtr.HandleFunc("/api/miner/stats", readOnly(getMinerStats))
+	rtr.HandleFunc("/rpc", readOnly(rpcEndpoint)).Methods("POST")
+	rtr.HandleFunc("/api/txPool", readOnly(getTxPool))
+	rtr.HandleFunc("/api/txPool/{id}", mutating(removeTxPoolTransaction)).Methods("DELETE")
+	rtr.HandleFunc("/api/txPool/{id}", readOnly(getTxPoolTransaction))
+	rtr.HandleFunc("/api/address/{address}/pending", readOnly(getAddressPending))
+	rtr.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, http.StatusNotFound, codeNotFound, "no such endpoint")
+	})
+	rtr.MethodNotAllowedHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, http.StatusMethodNotAllowed, codeInvalidRequest, "method not allowed")
+	})
+	return rtr
+}
+
+// newServeMuxes returns the muxes of the api port and the p2p port, the same mux unless the p2p endpoint is served separately
+// the p2p and web client endpoints are not a part of the api, they are served without CORS headers
+func newServeMuxes(api http.Handler, separateP2p bool) (*http.ServeMux, *http.ServeMux) {
+	apiMux := http.NewServeMux()
+	apiMux.Handle("/", corsHandler(rateLimitHandler(api)))
+	var p2pMux *http.ServeMux = apiMux
+	if separateP2p {
+		p2pMux = http.NewServeMux()
+	}
+	if wsOnP2pPort {
+		p2pMux.HandleFunc("/ws", readOnly(p2p.WsEndpoint))
+	} else {
+		apiMux.HandleFunc("/ws", readOnly(p2p.WsEndpoint))
+	}
+	p2pMux.HandleFunc("/p2p", p2p.P2pEndpoint)
+	return apiMux, p2pMux
+}
 
-	http.Handle("/", rtr)
+// p2pEndpointURL returns the url of the p2p endpoint on a given host, localhost if it listens on all interfaces
+func p2pEndpointURL(host string, tls bool) string {
+	var scheme string = "ws"
+	if tls {
+		scheme = "wss"
+	}
+	if host == "" {
+		host = "localhost"
+	}
+	return fmt.Sprintf("%s://%s/p2p", scheme, net.JoinHostPort(host, strconv.Itoa(getP2pPort())))
+}
 
-	http.HandleFunc("/ws", p2p.WsEndpoint)
-	http.HandleFunc("/p2p", p2p.P2pEndpoint)
+// connectBootstrapPeers dials peers given on the command line, peers that are not reachable yet are retried in the background
+func connectBootstrapPeers(peers []string) {
+	for _, peer := range peers {
+		if err := p2p.ConnectOrRetry(peer); err != nil {
+			log.Printf("bootstrap peer %s not connected: %s, retrying in the background", peer, err.Error())
+			continue
+		}
+		log.Printf("bootstrap peer %s connected", peer)
+	}
+}
 
-	fmt.Printf("listening on port %d\n", httpPort)
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", httpPort), nil))
+// setServerTimeouts sets read and write timeouts of a server, writes may take as long as the api request deadline
+// websocket connections are not affected, their deadlines are cleared on upgrade
+func setServerTimeouts(server *http.Server) {
+	server.ReadHeaderTimeout = 10 * time.Second
+	server.ReadTimeout = 30 * time.Second
+	server.WriteTimeout = apiRequestTimeout + 10*time.Second
+	server.IdleTimeout = 2 * time.Minute
 }
 
-func main() {
-	args := os.Args
-	if len(args) == 2 {
-		if portNumber, err := strconv.Atoi(args[1]); err == nil {
-			httpPort = portNumber
+// isValidPort checks if a number is a tcp port a node can listen on
+func isValidPort(port int) bool {
+	return port >= 1 && port <= 65535
+}
+
+// getP2pPort returns the port of the p2p endpoint
+func getP2pPort() int {
+	if p2pPort != 0 {
+		return p2pPort
+	}
+	return httpPort
+}
+
+// listen starts listening on the address of a server, so that connections are accepted before it is served
+func listen(server *http.Server, name string, tls bool) net.Listener {
+	listener, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if tls {
+		fmt.Printf("%s listening on %s (https)\n", name, server.Addr)
+	} else {
+		fmt.Printf("%s listening on %s\n", name, server.Addr)
+	}
+	return listener
+}
+
+// serve serves http requests of a server on a listener until it is shut down, over HTTPS when tlsCertFile and tlsKeyFile are given
+func serve(server *http.Server, listener net.Listener, tlsCertFile string, tlsKeyFile string) {
+	var err error
+	if tlsCertFile != "" {
+		err = server.ServeTLS(listener, tlsCertFile, tlsKeyFile)
+	} else {
+		err = server.Serve(listener)
+	}
+	if err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+}
+
+// startGrpcServer serves the grpc api on a given port in the background, over TLS when tlsCertFile and tlsKeyFile are given
+// it listens on the same host as the api
+func startGrpcServer(port int, tlsCertFile string, tlsKeyFile string) error {
+	var options []grpc.ServerOption = []grpc.ServerOption{}
+	if tlsCertFile != "" {
+		creds, err := credentials.NewServerTLSFromFile(tlsCertFile, tlsKeyFile)
+		if err != nil {
+			return err
+		}
+		options = append(options, grpc.Creds(creds))
+	}
+	listener, err := net.Listen("tcp", net.JoinHostPort(apiBindHost, strconv.Itoa(port)))
+	if err != nil {
+		return err
+	}
+	grpcServer = grpcapi.NewServer(apiToken, authenticateReads, options...)
+	fmt.Printf("grpc listening on %s\n", listener.Addr().String())
+	go func() {
+		if err := grpcServer.Serve(listener); err != nil {
+			log.Fatal(err)
+		}
+	}()
+	return nil
+}
+
+// isAllowedOrigin checks if browser pages of a given origin may call the api
+func isAllowedOrigin(origin string) bool {
+	for _, allowed := range corsOrigins {
+		if allowed == "*" || allowed == origin {
+			return true
+		}
+	}
+	return false
+}
+
+// corsHandler sets CORS headers on responses to requests from allowed origins and answers their preflight requests
+// requests from other origins get no CORS headers, so browsers don't let pages of those origins read responses
+func corsHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var origin string = r.Header.Get("Origin")
+		if origin == "" || !isAllowedOrigin(origin) {
+			next.ServeHTTP(w, r)
+			return
 		}
+		w.Header().Add("Vary", "Origin")
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Set("Access-Control-Allow-Methods", corsAllowedMethods)
+			w.Header().Set("Access-Control-Allow-Headers", corsAllowedHeaders)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Shutdown stops mining, waits for in-flight requests while accepting no new connections,
+// closes connections to peers and web clients and saves the transaction pool
+func Shutdown(ctx context.Context, txPoolFile string) error {
+	blockchain.StopMining()
+	err := httpServer.Shutdown(ctx)
+	if p2pErr := p2pServer.Shutdown(ctx); err == nil {
+		err = p2pErr
 	}
+	if grpcServer != nil {
+		// streams of subscriptions never end on their own, so they are closed rather than waited for
+		grpcServer.Stop()
+	}
+	p2p.CloseAll()
+	if txPoolFile != "" {
+		blockchain.SaveTransactionPool(txPoolFile)
+	}
+	return err
+}
+
+// handleShutdown waits for SIGINT, SIGTERM or a stop request, shuts the node down and exits
+// the process exits after the shutdown timeout or on a second signal even if shutdown is not completed
+func handleShutdown(txPoolFile string) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	os.Exit(awaitShutdown(signals, txPoolFile))
+}
+
+// awaitShutdown waits for a signal or a stop request, shuts the node down and returns the exit code of the process
+func awaitShutdown(signals <-chan os.Signal, txPoolFile string) int {
+	var timeout time.Duration = shutdownTimeout
+	select {
+	case <-signals:
+		fmt.Println("shutting down")
+	case timeout = <-stopRequests:
+		fmt.Println("shutting down on stop request")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		if err := Shutdown(ctx, txPoolFile); err != nil {
+			log.Println(err)
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return 0
+	case <-ctx.Done():
+		log.Println("shutdown timed out")
+		return 1
+	case <-signals:
+		log.Println("shutdown interrupted")
+		return 1
+	}
+}
+
+// runNode parses flags of the node subcommand and runs the node until it is shut down
+func runNode(args []string) {
+	fs := flag.NewFlagSet("node", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: naivecoin node [flags] [port [peers]]\n")
+		fmt.Fprintf(fs.Output(), "port defaults to 8080, peers are comma-separated like -peers\n")
+		fs.PrintDefaults()
+	}
+	txPoolMaxCount := fs.Int("txpool-max-count", 5000, "maximum number of transactions in the transaction pool, 0 for no limit")
+	txPoolMaxBytes := fs.Int("txpool-max-bytes", 5*1024*1024, "maximum total size in bytes of the transaction pool, 0 for no limit")
+	txPoolTtl := fs.Duration("txpool-ttl", 24*time.Hour, "time after which unconfirmed transactions are removed from the transaction pool")
+	rbf := fs.Bool("rbf", false, "allow transactions paying a higher fee to replace conflicting transactions in the transaction pool")
+	rbfMinFeeIncrement := fs.Float64("rbf-min-fee-increment", 0.001, "minimum fee increase required to replace a transaction in the transaction pool")
+	dataDir := fs.String("datadir", "", "directory the node keeps its files in, relative file paths are resolved against it, may also be given in "+dataDirEnv+", defaults to the current directory")
+	keyFile := fs.String("keyfile", "", "wallet keystore file, may also be given in "+keyFileEnv+", defaults to wallet.json")
+	chainParamsFile := fs.String("chain-params", "", "json file with chain parameters all nodes of the network share, such as {\"Hasher\": \"double-sha256\", \"Version\": 2, \"MaxClockDrift\": 30}, defaults to the hardcoded genesis block of a version 1 chain")
+	txPoolFile := fs.String("txpool-file", "txpool.json", "file to persist the transaction pool across restarts, empty to disable")
+	minRelayFeeRate := fs.Float64("min-relay-fee-rate", 0, "minimum fee per byte a transaction must pay to be accepted to the transaction pool")
+	walletPassphrase := fs.String("wallet-passphrase", "", "passphrase the wallet keystore is encrypted with, may also be given in "+walletPassphraseEnv+" or prompted for on the terminal")
+	shortAddresses := fs.Bool("short-addresses", false, "give out short pubkey-hash addresses instead of full public key addresses, funds sent to either form of an address are found")
+	reuseChangeAddress := fs.Bool("reuse-change-address", false, "send change of wallet transactions to the primary address instead of a fresh address")
+	lockWalletOnStart := fs.Bool("lock-wallet", false, "lock the wallet once it is opened, spending then requires /api/wallet/unlock; mining to the wallet address does not")
+	mineTo := fs.String("mine-to", "", "address mined blocks pay rewards to instead of the wallet address, /api/mineBlock?rewardAddress= overrides it for a single block")
+	restoreWallet := fs.Bool("restore", false, "restore the wallet from mnemonic words read from standard input, an existing wallet is never overwritten")
+	nodeIdFile := fs.String("node-id-file", "node.id", "file to keep the node id peers know this node by across restarts, empty to generate a new id on every start")
+	peersFile := fs.String("peers-file", "peers.json", "file to save outbound peers, empty to disable")
+	noRestorePeers := fs.Bool("no-restore-peers", false, "do not reconnect to peers saved in the peers file on startup")
+	advertiseAddress := fs.String("advertise-address", "", "host:port or ws:// or wss:// url other nodes can use to connect to this node, defaults to the p2p port on the host peers see")
+	maxInboundPeers := fs.Int("max-inbound-peers", 32, "maximum number of peers connected to this node")
+	maxOutboundPeers := fs.Int("max-outbound-peers", 8, "maximum number of peers this node connects to, including discovered and reconnected peers")
+	maxMessageSize := fs.Int64("max-message-size", 4<<20, "maximum size of a message accepted from a peer, in bytes")
+	tlsCert := fs.String("tls-cert", "", "certificate file to serve the api and p2p endpoint over https and wss")
+	tlsKey := fs.String("tls-key", "", "private key file for -tls-cert")
+	p2pTLSCA := fs.String("p2p-tls-ca", "", "additional CA certificate file trusted when dialing wss:// peers")
+	p2pTLSCert := fs.String("p2p-tls-cert", "", "client certificate file presented when dialing wss:// peers")
+	p2pTLSKey := fs.String("p2p-tls-key", "", "private key file for -p2p-tls-cert")
+	p2pCheapRate := fs.Float64("p2p-cheap-rate", 20, "messages per second accepted from a single peer, except expensive requests")
+	p2pCheapBurst := fs.Float64("p2p-cheap-burst", 50, "number of messages a single peer may send at once, except expensive requests")
+	p2pExpensiveRate := fs.Float64("p2p-expensive-rate", 0.2, "full chain and transaction pool requests per second accepted from a single peer")
+	p2pExpensiveBurst := fs.Float64("p2p-expensive-burst", 3, "number of full chain and transaction pool requests a single peer may send at once")
+	logLevel := fs.String("log-level", "info", "lowest level of log messages written: debug, info, warn or error")
+	apiPort := fs.Int("api-port", 0, "port for api requests, overrides the positional port argument, defaults to 8080")
+	p2pPortFlag := fs.Int("p2p-port", 0, "port of the p2p endpoint peers connect to, defaults to the api port")
+	apiBind := fs.String("api-bind", "", "host the api listens on, such as 127.0.0.1 to keep it private, defaults to all interfaces; binds the p2p endpoint too unless -p2p-port is given")
+	wsOnP2p := fs.Bool("ws-on-p2p-port", false, "serve the web client websocket on the p2p port instead of the api port")
+	apiTokenFlag := fs.String("api-token", "", "bearer token api requests that spend, mine or change the node must carry, may also be given in "+apiTokenEnv+", defaults to a token generated to -api-token-file")
+	apiTokenFile := fs.String("api-token-file", "api.token", "file the api token is generated to on the first start and read from later")
+	apiAuthRead := fs.Bool("api-auth-read", false, "require the api token on read-only endpoints and the web client websocket as well")
+	apiRateFlag := fs.Float64("api-rate", 20, "api requests per second accepted from a single client ip, 0 with -api-burst 0 for no limit")
+	apiBurstFlag := fs.Float64("api-burst", 40, "number of api requests a single client ip may send at once")
+	apiExpensiveRateFlag := fs.Float64("api-expensive-rate", 0.5, "mining and full chain requests per second accepted from a single client ip, 0 with -api-expensive-burst 0 for no limit")
+	apiExpensiveBurstFlag := fs.Float64("api-expensive-burst", 3, "number of mining and full chain requests a single client ip may send at once")
+	apiRateLimitLocalhostFlag := fs.Bool("api-rate-limit-localhost", false, "apply api rate limits to clients on localhost as well, they are exempt by default")
+	apiRequestTimeoutFlag := fs.Duration("api-request-timeout", time.Minute, "deadline of an api request, writes of responses time out shortly after it")
+	grpcPort := fs.Int("grpc-port", 0, "port to serve the grpc api on, on the same host as the api; 0 disables it")
+	corsOriginsFlag := fs.String("cors-origins", "", "comma-separated origins of browser pages allowed to call the api, such as https://explorer.example.com, * for any origin")
+	p2pEncodings := fs.String("p2p-encodings", "msgpack,json", "comma-separated message encodings offered to peers in order of preference, json is always kept as a fallback")
+	peers := fs.String("peers", "", "comma-separated host:port or ws:// or wss:// urls of peers to connect to on startup, in addition to saved peers")
+	mine := fs.Bool("mine", false, "mine blocks in the background until the node is shut down, rewards are paid to -mine-to or the wallet address")
+	nonceSearchWindow := fs.Uint64("nonce-search-window", 1<<32, "number of nonces tried on a block before the miner refreshes its timestamp and coinbase extra nonce")
+	p2pInsecureSkipVerify := fs.Bool("p2p-insecure-skip-verify", false, "do not verify certificates of wss:// peers, e.g. self-signed ones; applies to p2p dialing only")
+	fs.Parse(args)
+	level, err := utils.ParseLogLevel(*logLevel)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "-log-level: %s\n", err.Error())
+		os.Exit(2)
+	}
+	utils.SetLogLevel(level)
+
+	// port is still accepted as a positional argument, optionally followed by bootstrap peers
+	if fs.NArg() > 2 {
+		usageError(fs, "unexpected arguments: %s", strings.Join(fs.Args()[2:], " "))
+	}
+	if fs.NArg() >= 1 {
+		portNumber, err := strconv.Atoi(fs.Arg(0))
+		if err != nil || !isValidPort(portNumber) {
+			usageError(fs, "invalid port %q, must be a number from 1 to 65535", fs.Arg(0))
+		}
+		httpPort = portNumber
+	}
+	if *apiPort != 0 {
+		httpPort = *apiPort
+	}
+	if *apiPort != 0 && !isValidPort(*apiPort) {
+		usageError(fs, "invalid -api-port %d, must be from 1 to 65535", *apiPort)
+	}
+	if *p2pPortFlag != 0 && !isValidPort(*p2pPortFlag) {
+		usageError(fs, "invalid -p2p-port %d, must be from 1 to 65535", *p2pPortFlag)
+	}
+	if *grpcPort != 0 && !isValidPort(*grpcPort) {
+		usageError(fs, "invalid -grpc-port %d, must be from 1 to 65535", *grpcPort)
+	}
+	var bootstrapPeers []string = []string{}
+	for _, peer := range strings.Split(*peers+","+fs.Arg(1), ",") {
+		if peer = strings.TrimSpace(peer); peer != "" {
+			bootstrapPeers = append(bootstrapPeers, peer)
+		}
+	}
+	p2pPort = *p2pPortFlag
+	apiBindHost = *apiBind
+	wsOnP2pPort = *wsOnP2p
+	*dataDir = flagOrEnv(*dataDir, dataDirEnv, ".")
+	if err := os.MkdirAll(*dataDir, 0700); err != nil {
+		log.Fatal(err)
+	}
+	*keyFile = resolveDataPath(*dataDir, flagOrEnv(*keyFile, keyFileEnv, "wallet.json"))
+	*txPoolFile = resolveDataPath(*dataDir, *txPoolFile)
+	*chainParamsFile = resolveDataPath(*dataDir, *chainParamsFile)
+	*nodeIdFile = resolveDataPath(*dataDir, *nodeIdFile)
+	*peersFile = resolveDataPath(*dataDir, *peersFile)
+	*apiTokenFile = resolveDataPath(*dataDir, *apiTokenFile)
+	if apiToken = flagOrEnv(*apiTokenFlag, apiTokenEnv, ""); apiToken == "" {
+		token, err := loadApiToken(*apiTokenFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		apiToken = token
+	}
+	authenticateReads = *apiAuthRead
+	apiCheapRate, apiCheapBurst = *apiRateFlag, *apiBurstFlag
+	apiExpensiveRate, apiExpensiveBurst = *apiExpensiveRateFlag, *apiExpensiveBurstFlag
+	apiRateLimitLocalhost = *apiRateLimitLocalhostFlag
+	apiRequestTimeout = *apiRequestTimeoutFlag
+	if *chainParamsFile != "" {
+		if err := blockchain.LoadChainParams(*chainParamsFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	txpool.SetMaxPoolSize(*txPoolMaxCount, *txPoolMaxBytes)
+	txpool.SetReplaceByFee(*rbf, *rbfMinFeeIncrement)
+	txpool.SetMinFeeRate(*minRelayFeeRate)
 	blockchain.SetNetwork(p2p.Network{})
-	wallet.InitWallet()
+	txpool.RegisterListener(p2p.Network{}.HandlePoolEvent)
+	blockchain.StartTxPoolExpiry(*txPoolTtl)
+	if *txPoolFile != "" {
+		blockchain.LoadTransactionPool(*txPoolFile)
+		blockchain.StartTxPoolPersistence(*txPoolFile)
+	}
+	go handleShutdown(*txPoolFile)
+	wallet.SetChangeToNewAddress(!*reuseChangeAddress)
+	wallet.SetShortAddresses(*shortAddresses)
+	if err := openWallet(*keyFile, *walletPassphrase, *restoreWallet); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to open wallet: %s\n", err.Error())
+		os.Exit(1)
+	}
+	if *lockWalletOnStart {
+		wallet.Lock()
+	}
 	fmt.Printf("Your address: %s\n", wallet.GetBase58Address())
-	initHttpServer()
+	if err := blockchain.SetRewardAddress(*mineTo); err != nil {
+		fmt.Fprintf(os.Stderr, "-mine-to: %s\n", err.Error())
+		os.Exit(1)
+	}
+	if err := blockchain.SetNonceSearchWindow(*nonceSearchWindow); err != nil {
+		fmt.Fprintf(os.Stderr, "-nonce-search-window: %s\n", err.Error())
+		os.Exit(1)
+	}
+	if *mineTo != "" {
+		fmt.Printf("Mining rewards are paid to: %s\n", *mineTo)
+	}
+	if *nodeIdFile != "" {
+		if err := p2p.LoadNodeId(*nodeIdFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	fmt.Printf("Node id: %s\n", p2p.GetNodeId())
+	if *tlsCert == "" && *tlsKey != "" || *tlsCert != "" && *tlsKey == "" {
+		log.Fatal("-tls-cert and -tls-key must be given together")
+	}
+	p2pTLSConfig, err := loadP2pTLSConfig(*p2pTLSCA, *p2pTLSCert, *p2pTLSKey, *p2pInsecureSkipVerify)
+	if err != nil {
+		log.Fatal(err)
+	}
+	p2p.SetTLSConfig(p2pTLSConfig)
+	if *advertiseAddress == "" {
+		*advertiseAddress = fmt.Sprintf(":%d", getP2pPort())
+		if *tlsCert != "" {
+			*advertiseAddress = fmt.Sprintf("wss://:%d", getP2pPort())
+		}
+	}
+	p2p.SetListenAddress(*advertiseAddress)
+	p2p.SetPeerLimits(*maxInboundPeers, *maxOutboundPeers)
+	p2p.SetMaxMessageSize(*maxMessageSize)
+	p2p.SetRateLimits(*p2pCheapRate, *p2pCheapBurst, *p2pExpensiveRate, *p2pExpensiveBurst)
+	for _, origin := range strings.Split(*corsOriginsFlag, ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			corsOrigins = append(corsOrigins, origin)
+		}
+	}
+	if err := p2p.SetEncodings(strings.Split(*p2pEncodings, ",")); err != nil {
+		log.Fatal(err)
+	}
+	p2p.SetPeersFile(*peersFile)
+	if !*noRestorePeers {
+		p2p.RestorePeers()
+	}
+	if *mine {
+		blockchain.StartMining()
+		fmt.Println("Mining in the background")
+	}
+	if *grpcPort != 0 {
+		if err := startGrpcServer(*grpcPort, *tlsCert, *tlsKey); err != nil {
+			log.Fatal(err)
+		}
+	}
+	initHttpServer(*tlsCert, *tlsKey, bootstrapPeers)
 }
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"naivecoin/blockchain"
+	"naivecoin/p2p"
+	"naivecoin/wallet"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "naivecoin")
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if err := wallet.InitWallet(filepath.Join(dir, "wallet.json"), "test"); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	blockchain.SetNetwork(p2p.Network{})
+	var code int = m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// setCorsOrigins allows browser pages of given origins to call the api until the test ends
+func setCorsOrigins(tb testing.TB, origins ...string) {
+	var previous []string = corsOrigins
+	corsOrigins = origins
+	tb.Cleanup(func() { corsOrigins = previous })
+}
+
+// serveFrom returns the response of a handler to a request from a browser page of a given origin
+func serveFrom(handler http.Handler, method string, path string, origin string, preflight bool) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(method, path, nil)
+	if origin != "" {
+		request.Header.Set("Origin", origin)
+	}
+	if preflight {
+		request.Header.Set("Access-Control-Request-Method", http.MethodPost)
+		request.Header.Set("Access-Control-Request-Headers", "Content-Type")
+	}
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	return recorder
+}
+
+func TestCorsPreflightFromAllowedOrigin(test *testing.T) {
+	setCorsOrigins(test, "https://explorer.example.com")
+	apiMux, _ := newServeMuxes(newApiRouter(), false)
+
+	response := serveFrom(apiMux, http.MethodOptions, "/api/transactions", "https://explorer.example.com", true)
+	if response.Code != http.StatusNoContent {
+		test.Fatalf("expected status %d, got %d", http.StatusNoContent, response.Code)
+	}
+	var expected = map[string]string{
+		"Access-Control-Allow-Origin":  "https://explorer.example.com",
+		"Access-Control-Allow-Methods": corsAllowedMethods,
+		"Access-Control-Allow-Headers": corsAllowedHeaders,
+		"Vary":                         "Origin",
+	}
+	for header, value := range expected {
+		if got := response.Header().Get(header); got != value {
+			test.Fatalf("expected %s %q, got %q", header, value, got)
+		}
+	}
+
+	// an actual request gets the origin allowed, but is answered by the api
+	response = serveFrom(apiMux, http.MethodGet, "/api/nonexistent", "https://explorer.example.com", false)
+	if response.Code != http.StatusNotFound || response.Header().Get("Access-Control-Allow-Origin") != "https://explorer.example.com" {
+		test.Fatalf("expected not found with the origin allowed, got %d and %q", response.Code, response.Header().Get("Access-Control-Allow-Origin"))
+	}
+	if response.Header().Get("Access-Control-Allow-Methods") != "" {
+		test.Fatal("only preflight requests get allowed methods")
+	}
+
+	// any origin is allowed by *
+	setCorsOrigins(test, "*")
+	response = serveFrom(apiMux, http.MethodOptions, "/api/transactions", "http://localhost:8080", true)
+	if response.Code != http.StatusNoContent || response.Header().Get("Access-Control-Allow-Origin") != "http://localhost:8080" {
+		test.Fatalf("expected preflight allowed by *, got %d and %q", response.Code, response.Header().Get("Access-Control-Allow-Origin"))
+	}
+}
+
+func TestCorsDisallowedOrigin(test *testing.T) {
+	setCorsOrigins(test, "https://explorer.example.com")
+	apiMux, _ := newServeMuxes(newApiRouter(), false)
+
+	for _, origin := range []string{"https://evil.example.com", "https://explorer.example.com.evil.com", "http://explorer.example.com", ""} {
+		for _, preflight := range []bool{true, false} {
+			var method string = http.MethodGet
+			if preflight {
+				method = http.MethodOptions
+			}
+			response := serveFrom(apiMux, method, "/api/nonexistent", origin, preflight)
+			if response.Code == http.StatusNoContent {
+				test.Fatalf("%q: preflight must not be answered", origin)
+			}
+			for _, header := range []string{"Access-Control-Allow-Origin", "Access-Control-Allow-Methods", "Access-Control-Allow-Headers"} {
+				if value := response.Header().Get(header); value != "" {
+					test.Fatalf("%q: expected no %s header, got %q", origin, header, value)
+				}
+			}
+		}
+	}
+
+	// no origins are allowed by default
+	setCorsOrigins(test)
+	response := serveFrom(apiMux, http.MethodOptions, "/api/transactions", "https://explorer.example.com", true)
+	if value := response.Header().Get("Access-Control-Allow-Origin"); value != "" {
+		test.Fatalf("expected no origin allowed by default, got %q", value)
+	}
+}
+
+func TestCorsHeadersNotSetOnP2pAndWs(test *testing.T) {
+	setCorsOrigins(test, "*")
+	for _, wsOnP2p := range []bool{false, true} {
+		for _, separateP2p := range []bool{false, true} {
+			var previous bool = wsOnP2pPort
+			wsOnP2pPort = wsOnP2p
+			apiMux, p2pMux := newServeMuxes(newApiRouter(), separateP2p)
+			wsOnP2pPort = previous
+
+			var wsMux *http.ServeMux = apiMux
+			if wsOnP2p {
+				wsMux = p2pMux
+			}
+			for path, handler := range map[string]http.Handler{"/p2p": p2pMux, "/ws": wsMux} {
+				for _, preflight := range []bool{true, false} {
+					var method string = http.MethodGet
+					if preflight {
+						method = http.MethodOptions
+					}
+					response := serveFrom(handler, method, path, "https://explorer.example.com", preflight)
+					if response.Code == http.StatusNoContent {
+						test.Fatalf("%s: preflight must not be answered", path)
+					}
+					if value := response.Header().Get("Access-Control-Allow-Origin"); value != "" {
+						test.Fatalf("%s with ws on p2p port %v and separate p2p port %v: expected no CORS headers, got %q", path, wsOnP2p, separateP2p, value)
+					}
+				}
+			}
+		}
+	}
+}
+
+// deleteTestPeer sends an authenticated request removing a peer to the api
+func deleteTestPeer(handler http.Handler, address string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(http.MethodDelete, "/api/peers/"+address, nil)
+	request.Header.Set("Authorization", "Bearer "+apiToken)
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	return recorder
+}
+
+func TestRemovePeerEndpoint(test *testing.T) {
+	setApiToken(test, "test-token")
+	var router http.Handler = newApiRouter()
+	server := httptest.NewServer(http.HandlerFunc(p2p.P2pEndpoint))
+	defer server.Close()
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer client.Close()
+
+	// the client is an inbound peer of the node once it is listed
+	var address string = client.LocalAddr().String()
+	var deadline time.Time = time.Now().Add(5 * time.Second)
+	for !hasTestPeer(address) {
+		if time.Now().After(deadline) {
+			test.Fatalf("peer %s was not connected", address)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	response := deleteTestPeer(router, address)
+	if response.Code != http.StatusOK || strings.TrimSpace(response.Body.String()) != `"success"` {
+		test.Fatalf("expected success, got %d and %s", response.Code, response.Body.String())
+	}
+	if hasTestPeer(address) {
+		test.Fatal("removed peer must not be listed")
+	}
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		if _, _, err := client.ReadMessage(); err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+				test.Fatalf("expected a normal close frame, got %v", err)
+			}
+			break
+		}
+	}
+
+	response = deleteTestPeer(router, address)
+	if response.Code != http.StatusNotFound || !strings.Contains(response.Body.String(), codeNotFound) {
+		test.Fatalf("expected not found for a removed peer, got %d and %s", response.Code, response.Body.String())
+	}
+}
+
+// hasTestPeer checks if a peer with a given address is listed by the node
+func hasTestPeer(address string) bool {
+	for _, p := range p2p.GetPeers() {
+		if p.Address == address {
+			return true
+		}
+	}
+	return false
+}
+
+// TestGracefulShutdown is the only test shutting the node down, mining and the p2p package stay stopped afterwards
+func TestGracefulShutdown(test *testing.T) {
+	httpServer = &http.Server{}
+	// an in-flight request is answered only once shutdown has started
+	shutdownStarted := make(chan struct{})
+	httpServer.RegisterOnShutdown(func() { close(shutdownStarted) })
+	requestStarted := make(chan struct{})
+	api := http.NewServeMux()
+	api.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		close(requestStarted)
+		<-shutdownStarted
+		time.Sleep(100 * time.Millisecond)
+		fmt.Fprint(w, "done")
+	})
+	apiMux, _ := newServeMuxes(api, false)
+	httpServer.Handler = apiMux
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		test.Fatal(err)
+	}
+	go httpServer.Serve(listener)
+	var address string = listener.Addr().String()
+
+	client, _, err := websocket.DefaultDialer.Dial("ws://"+address+"/ws", nil)
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer client.Close()
+	// the wallet info is sent once the web client is registered
+	if _, _, err := client.ReadMessage(); err != nil {
+		test.Fatal(err)
+	}
+
+	type result struct {
+		body string
+		err  error
+	}
+	responses := make(chan result, 1)
+	go func() {
+		response, err := http.Get("http://" + address + "/slow")
+		if err != nil {
+			responses <- result{err: err}
+			return
+		}
+		defer response.Body.Close()
+		body, err := ioutil.ReadAll(response.Body)
+		responses <- result{body: string(body), err: err}
+	}()
+	<-requestStarted
+
+	var txPoolFile string = filepath.Join(test.TempDir(), "txpool.json")
+	signals := make(chan os.Signal, 1)
+	signals <- syscall.SIGTERM
+	if code := awaitShutdown(signals, txPoolFile); code != 0 {
+		test.Fatalf("expected exit code 0, got %d", code)
+	}
+
+	select {
+	case response := <-responses:
+		if response.err != nil || response.body != "done" {
+			test.Fatalf("in-flight request must complete, got %q and %v", response.body, response.err)
+		}
+	case <-time.After(5 * time.Second):
+		test.Fatal("in-flight request was not answered")
+	}
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		_, _, err := client.ReadMessage()
+		if err == nil {
+			continue
+		}
+		if !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+			test.Fatalf("expected a going away close frame, got %v", err)
+		}
+		break
+	}
+	if _, err := os.Stat(txPoolFile); err != nil {
+		test.Fatalf("transaction pool must be saved: %v", err)
+	}
+	if _, err := http.Get("http://" + address + "/slow"); err == nil {
+		test.Fatal("no new requests must be accepted after shutdown")
+	}
+	if _, err := blockchain.ProduceNextBlock(context.Background(), ""); !errors.Is(err, blockchain.ErrMiningStopped) {
+		test.Fatalf("expected %v mining after shutdown, got %v", blockchain.ErrMiningStopped, err)
+	}
+}
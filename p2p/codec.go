@@ -0,0 +1,170 @@
+package p2p
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/gorilla/websocket"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// codec encodes messages sent to peers and decodes messages received from them
+// JSON messages are sent as text frames and msgpack messages as binary frames,
+// so a received message is decoded by its frame type whatever encoding was negotiated
+type codec struct {
+	name      string
+	frameType int
+	marshal   func(data interface{}) ([]byte, error)
+	unmarshal func(byteData []byte, data interface{}, strict bool) error
+}
+
+// frame is an encoded message queued to be written to a peer
+type frame struct {
+	messageType int
+	dataBytes   []byte
+}
+
+// jsonCodec is supported by every node and is used until a peer advertises other encodings in its HELLO
+var jsonCodec = &codec{
+	name:      "json",
+	frameType: websocket.TextMessage,
+	marshal:   json.Marshal,
+	unmarshal: unmarshalJson,
+}
+
+// msgpackCodec encodes messages in a compact binary format
+var msgpackCodec = &codec{
+	name:      "msgpack",
+	frameType: websocket.BinaryMessage,
+	marshal:   msgpack.Marshal,
+	unmarshal: unmarshalMsgpack,
+}
+
+// supportedCodecs lists all codecs this node implements
+var supportedCodecs []*codec = []*codec{msgpackCodec, jsonCodec}
+
+// enabledCodecs lists codecs advertised to peers in order of preference, JSON is always the last one
+var enabledCodecs []*codec = supportedCodecs
+
+// unmarshalJson decodes JSON data, strict decoding rejects fields the data does not define
+func unmarshalJson(byteData []byte, data interface{}, strict bool) error {
+	decoder := json.NewDecoder(bytes.NewReader(byteData))
+	if strict {
+		decoder.DisallowUnknownFields()
+	}
+	return decoder.Decode(data)
+}
+
+// unmarshalMsgpack decodes msgpack data, strict decoding rejects fields the data does not define
+func unmarshalMsgpack(byteData []byte, data interface{}, strict bool) error {
+	decoder := msgpack.NewDecoder(bytes.NewReader(byteData))
+	decoder.DisallowUnknownFields(strict)
+	return decoder.Decode(data)
+}
+
+// SetEncodings sets message encodings advertised to peers in order of preference
+// JSON can't be disabled, as it is the fallback for peers that support nothing else
+func SetEncodings(names []string) error {
+	var codecs []*codec = []*codec{}
+	for _, name := range names {
+		c := findCodec(name)
+		if c == nil {
+			return fmt.Errorf("unsupported encoding: %s", name)
+		}
+		if c != jsonCodec {
+			codecs = append(codecs, c)
+		}
+	}
+	enabledCodecs = append(codecs, jsonCodec)
+	return nil
+}
+
+// findCodec returns a supported codec with a given name, nil if there is none
+func findCodec(name string) *codec {
+	for _, c := range supportedCodecs {
+		if c.name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// getEncodings returns the names of enabled codecs in order of preference
+func getEncodings() []string {
+	var names []string = []string{}
+	for _, c := range enabledCodecs {
+		names = append(names, c.name)
+	}
+	return names
+}
+
+// negotiateCodec picks the most preferred enabled codec that a peer supports, falling back to JSON
+func negotiateCodec(peerEncodings []string) *codec {
+	for _, c := range enabledCodecs {
+		for _, name := range peerEncodings {
+			if c.name == name {
+				return c
+			}
+		}
+	}
+	return jsonCodec
+}
+
+// codecForFrame returns an enabled codec used for a given websocket frame type, nil if there is none
+func codecForFrame(messageType int) *codec {
+	for _, c := range enabledCodecs {
+		if c.frameType == messageType {
+			return c
+		}
+	}
+	return nil
+}
+
+// encode builds a frame holding a message with a given code, originating from a given node
+func (c *codec) encode(data interface{}, code string, origin string) (frame, error) {
+	dataBytes, err := c.marshal(Message{Code: code, Origin: origin, Data: data})
+	if err != nil {
+		logger.Error("failed to encode message", "code", code, "err", err)
+		return frame{}, err
+	}
+	return frame{messageType: c.frameType, dataBytes: dataBytes}, nil
+}
+
+// peerCodec returns the codec used for messages sent to a peer
+func peerCodec(p *Peer) *codec {
+	return p.outbox.codec.Load().(*codec)
+}
+
+// setPeerCodec sets the codec used for messages sent to a peer
+func setPeerCodec(p *Peer, c *codec) {
+	p.outbox.codec.Store(c)
+}
+
+// encodedMessage encodes a message sent to many peers once per codec
+type encodedMessage struct {
+	data   interface{}
+	code   string
+	origin string
+	frames map[*codec]frame
+}
+
+// newEncodedMessage creates a message originating from a given node to be sent to many peers
+func newEncodedMessage(data interface{}, code string, origin string) *encodedMessage {
+	return &encodedMessage{data: data, code: code, origin: origin, frames: map[*codec]frame{}}
+}
+
+// sendTo queues the message encoded with a peer's codec
+func (m *encodedMessage) sendTo(p *Peer) {
+	c := peerCodec(p)
+	f, ok := m.frames[c]
+	if !ok {
+		var err error
+		f, err = c.encode(m.data, m.code, m.origin)
+		if err != nil {
+			return
+		}
+		m.frames[c] = f
+	}
+	enqueue(p, f)
+}
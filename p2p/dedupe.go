@@ -0,0 +1,64 @@
+package p2p
+
+import (
+	"github.com/gorilla/websocket"
+)
+
+// duplicateConnectionReason is sent in a close frame when a connection to an already connected node is dropped
+const duplicateConnectionReason = "duplicate connection"
+
+// isConnectedAddress checks if there is a connection to a peer with a given address or listen address
+func isConnectedAddress(address string) bool {
+	peerSocketListLock.Lock()
+	defer peerSocketListLock.Unlock()
+	for _, p := range peers {
+		if p.Address == address || p.ListenAddress == address {
+			return true
+		}
+	}
+	return false
+}
+
+// findConnectedNode returns another peer that completed the handshake with a given node id, nil if not found
+func findConnectedNode(p *Peer) *Peer {
+	peerSocketListLock.Lock()
+	defer peerSocketListLock.Unlock()
+	for _, peer := range peers {
+		if peer != p && peer.handshakeDone && peer.NodeId == p.NodeId {
+			return peer
+		}
+	}
+	return nil
+}
+
+// isDuplicateClose checks if a connection was closed by the peer because it is a duplicate
+func isDuplicateClose(err error) bool {
+	closeErr, ok := err.(*websocket.CloseError)
+	return ok && closeErr.Text == duplicateConnectionReason
+}
+
+// resolveDuplicateConnection closes one of two connections to the same node
+// when both nodes dial each other at once, both keep the connection dialed by the node with the lower node id,
+// otherwise the newer connection is closed
+// returns false if a given peer was closed
+func resolveDuplicateConnection(p *Peer) bool {
+	var existing *Peer = findConnectedNode(p)
+	if existing == nil {
+		return true
+	}
+
+	var keepNew bool = false
+	if existing.Direction != p.Direction {
+		var preferOutbound bool = nodeId < p.NodeId
+		keepNew = (p.Direction == outbound) == preferOutbound
+	}
+
+	if keepNew {
+		logger.Info("closing duplicate connection", "node", existing.NodeId, "peer", existing.Address)
+		closePeer(existing, websocket.CloseNormalClosure, duplicateConnectionReason)
+		return true
+	}
+	logger.Info("closing duplicate connection", "node", p.NodeId, "peer", p.Address)
+	closePeer(p, websocket.CloseNormalClosure, duplicateConnectionReason)
+	return false
+}
@@ -0,0 +1,127 @@
+package p2p
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// startTestNode serves a p2p endpoint of another node with a given node id, which only completes handshakes
+// test peers for connections it accepted are returned by the function passed back
+func startTestNode(tb testing.TB, nodeId_ string) (string, func() []*testPeer) {
+	var accepted []*testPeer
+	var acceptedLock sync.Mutex
+	var remoteUpgrader websocket.Upgrader = websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := remoteUpgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		tp := &testPeer{conn: conn, nodeId: nodeId_}
+		if err := tp.hello(); err != nil {
+			conn.Close()
+			return
+		}
+		go tp.read()
+		acceptedLock.Lock()
+		accepted = append(accepted, tp)
+		acceptedLock.Unlock()
+	}))
+	tb.Cleanup(func() {
+		acceptedLock.Lock()
+		for _, tp := range accepted {
+			tp.conn.Close()
+		}
+		acceptedLock.Unlock()
+		server.Close()
+	})
+	return server.Listener.Addr().String(), func() []*testPeer {
+		acceptedLock.Lock()
+		defer acceptedLock.Unlock()
+		return append([]*testPeer{}, accepted...)
+	}
+}
+
+// countNodeConnections returns the number of connections to a given node and the direction of the last one
+func countNodeConnections(nodeId_ string) (int, string) {
+	peerSocketListLock.Lock()
+	defer peerSocketListLock.Unlock()
+	var count int = 0
+	var direction string
+	for _, p := range peers {
+		if p.NodeId == nodeId_ {
+			count++
+			direction = p.Direction
+		}
+	}
+	return count, direction
+}
+
+func TestConnectPeerTwice(test *testing.T) {
+	startNode(test)
+	address, _ := startTestNode(test, newNodeId())
+
+	if err := connectPeer(address); err != nil {
+		test.Fatal(err)
+	}
+	if err := connectPeer(address); !errors.Is(err, ErrAlreadyConnected) {
+		test.Fatalf("expected %v connecting to %s again, got %v", ErrAlreadyConnected, address, err)
+	}
+}
+
+func TestSimultaneousCrossConnect(test *testing.T) {
+	// both nodes keep the connection dialed by the node with the lower node id
+	var cases = []struct {
+		name      string
+		nodeId    string
+		direction string
+	}{
+		{"remote id lower", strings.Repeat("0", 32), inbound},
+		{"remote id higher", strings.Repeat("f", 32), outbound},
+	}
+	for _, c := range cases {
+		test.Run(c.name, func(test *testing.T) {
+			server := startNode(test)
+			address, accepted := startTestNode(test, c.nodeId)
+
+			// this node dials the remote one while the remote one dials this node
+			var dialErr error
+			var dialed sync.WaitGroup
+			dialed.Add(1)
+			go func() {
+				defer dialed.Done()
+				dialErr = connectPeer(address)
+			}()
+			var dialing *testPeer = connectTestPeer(test, server, c.nodeId, false)
+			dialed.Wait()
+			if dialErr != nil {
+				test.Fatal(dialErr)
+			}
+
+			waitFor(test, "duplicate connection to be closed", func() bool {
+				for _, tp := range append(accepted(), dialing) {
+					if tp.closedAsDuplicate() {
+						return true
+					}
+				}
+				return false
+			})
+			waitFor(test, "duplicate connection to be removed", func() bool {
+				count, _ := countNodeConnections(c.nodeId)
+				return count == 1
+			})
+			// the kept connection is not closed later on
+			time.Sleep(100 * time.Millisecond)
+			count, direction := countNodeConnections(c.nodeId)
+			if count != 1 || direction != c.direction {
+				test.Fatalf("expected one %s connection, got %d, the last one %s", c.direction, count, direction)
+			}
+		})
+	}
+}
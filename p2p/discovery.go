@@ -0,0 +1,170 @@
+package p2p
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// message codes used for peer discovery
+const (
+	getPeersMsg = "GET_PEERS"
+	peersMsg    = "PEERS"
+)
+
+// maxPeersPerMessage limits the number of addresses sent and accepted in a single PEERS message
+const maxPeersPerMessage int = 100
+
+// gossipEchoInterval is how long addresses learned from a peer are not sent back to it
+const gossipEchoInterval time.Duration = 10 * time.Minute
+
+// listenAddress is the address this node advertises to its peers
+// if it has no host, peers use the host this node connected from
+var listenAddress string
+
+// learnedAddress is a peer address received in PEERS message
+type learnedAddress struct {
+	sourceNodeId string
+	learnedAt    time.Time
+}
+
+// learnedAddresses holds addresses received from peers, used to avoid sending them straight back
+var learnedAddresses map[string]learnedAddress = map[string]learnedAddress{}
+var learnedAddressesLock sync.Mutex
+
+var hostnameRegexp = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9.-]*[a-zA-Z0-9])?$`)
+
+// SetListenAddress sets the address advertised to peers, e.g. "node.example.com:8080", ":8080" or "wss://:443"
+func SetListenAddress(address string) {
+	listenAddress = address
+}
+
+// isValidPeerAddress checks that an address received from a peer is a host:port pair or a ws:// or wss:// url that can be dialed
+func isValidPeerAddress(address string) bool {
+	if len(address) > 255 {
+		return false
+	}
+	if isPeerURL(address) {
+		u, err := parsePeerURL(address)
+		return err == nil && u.User == nil && isValidPeerAddress(u.Host)
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil || host == "" {
+		return false
+	}
+	portNumber, err := strconv.Atoi(port)
+	if err != nil || portNumber < 1 || portNumber > 65535 {
+		return false
+	}
+	return net.ParseIP(host) != nil || hostnameRegexp.MatchString(host)
+}
+
+// resolveListenAddress completes an address advertised by a peer with the host it connected from
+func resolveListenAddress(p *Peer, advertised string) string {
+	if isPeerURL(advertised) {
+		u, err := parsePeerURL(advertised)
+		if err != nil {
+			return ""
+		}
+		u.Host = resolveListenAddress(p, u.Host)
+		return u.String()
+	}
+	host, port, err := net.SplitHostPort(advertised)
+	if err != nil {
+		return ""
+	}
+	if host == "" {
+		remoteHost, _, err := net.SplitHostPort(p.conn.RemoteAddr().String())
+		if err != nil {
+			return ""
+		}
+		host = remoteHost
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// isKnownAddress checks if a given address belongs to a connected peer or an outbound peer
+func isKnownAddress(address string) bool {
+	peerSocketListLock.Lock()
+	for _, p := range peers {
+		if p.Address == address || p.ListenAddress == address {
+			peerSocketListLock.Unlock()
+			return true
+		}
+	}
+	peerSocketListLock.Unlock()
+
+	outboundPeersLock.Lock()
+	defer outboundPeersLock.Unlock()
+	_, found := outboundPeers[address]
+	return found
+}
+
+// getAddressesFor returns listen addresses of known peers to be sent to a given peer
+// the peer's own address and addresses recently learned from it are left out
+func getAddressesFor(p *Peer) []string {
+	var addresses []string = []string{}
+	peerSocketListLock.Lock()
+	for _, peer := range peers {
+		if peer != p && peer.ListenAddress != "" && len(addresses) < maxPeersPerMessage {
+			addresses = append(addresses, peer.ListenAddress)
+		}
+	}
+	var requesterNodeId string = p.NodeId
+	peerSocketListLock.Unlock()
+
+	learnedAddressesLock.Lock()
+	defer learnedAddressesLock.Unlock()
+	var result []string = []string{}
+	for _, address := range addresses {
+		learned, found := learnedAddresses[address]
+		if found && learned.sourceNodeId == requesterNodeId && time.Since(learned.learnedAt) < gossipEchoInterval {
+			continue
+		}
+		result = append(result, address)
+	}
+	return result
+}
+
+// unmarshalDtoToAddresses unmarshales dto to a list of peer addresses
+func unmarshalDtoToAddresses(c *codec, byteData []byte) ([]string, error) {
+	addresses := &[]string{}
+	if err := decodeStrict(c, byteData, addresses); err != nil {
+		return nil, err
+	}
+	if len(*addresses) > maxPeersPerMessage {
+		return nil, fmt.Errorf("too many peer addresses: %d", len(*addresses))
+	}
+	return *addresses, nil
+}
+
+// handleReceivedAddresses dials valid addresses received from a peer that are not connected yet, while outbound slots are free
+func handleReceivedAddresses(p *Peer, addresses []string) {
+	if len(addresses) > maxPeersPerMessage {
+		addresses = addresses[:maxPeersPerMessage]
+	}
+	for _, address := range addresses {
+		if !isValidPeerAddress(address) {
+			logger.Warn("ignoring invalid peer address", "address", address, "peer", p.Address)
+			continue
+		}
+		if isKnownAddress(address) {
+			continue
+		}
+		if !hasFreeSlot(outbound) {
+			return
+		}
+
+		learnedAddressesLock.Lock()
+		learnedAddresses[address] = learnedAddress{sourceNodeId: p.NodeId, learnedAt: time.Now()}
+		learnedAddressesLock.Unlock()
+
+		logger.Info("discovered peer", "address", address, "peer", p.Address)
+		if err := AddPeer(address); err != nil {
+			logger.Debug("failed to connect to discovered peer", "address", address, "err", err)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package p2p
+
+// errorMsg tells a peer that one of its messages was not understood or was rejected
+const errorMsg = "ERROR"
+
+// errorData is the payload of ERROR message
+type errorData struct {
+	// InReplyTo is the code of the rejected message, empty if the message could not be parsed at all
+	InReplyTo string
+	Reason    string
+}
+
+// sendError sends ERROR message describing why a message of a given code was rejected
+func sendError(p *Peer, inReplyTo string, reason string) {
+	send(p, errorData{InReplyTo: inReplyTo, Reason: reason}, errorMsg)
+}
+
+// rejectMessage replies to an invalid message with ERROR message and adds to the sender's misbehavior score
+func rejectMessage(p *Peer, inReplyTo string, score int, reason string) {
+	sendError(p, inReplyTo, reason)
+	misbehave(p, score, reason)
+}
+
+// unmarshalDtoToError unmarshales dto to ERROR message payload
+func unmarshalDtoToError(c *codec, byteData []byte) (errorData, error) {
+	data := &errorData{}
+	err := decodeStrict(c, byteData, data)
+	return *data, err
+}
+
+// handleError logs ERROR message received from a peer
+// it is never answered with another ERROR message, so that two nodes can't keep rejecting each other's errors
+func handleError(p *Peer, c *codec, messageBytes []byte) {
+	data, err := unmarshalDtoToError(c, messageBytes)
+	if err != nil {
+		misbehave(p, invalidDataScore, err.Error())
+		return
+	}
+	if data.InReplyTo == "" {
+		logger.Warn("peer reported an error", "peer", p.Address, "reason", data.Reason)
+		return
+	}
+	logger.Warn("peer rejected a message", "peer", p.Address, "code", data.InReplyTo, "reason", data.Reason)
+}
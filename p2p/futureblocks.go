@@ -0,0 +1,56 @@
+package p2p
+
+import (
+	"errors"
+	"naivecoin/blockchain"
+	"sync"
+	"time"
+)
+
+// maxFutureBlockDelay is how long a block only slightly ahead of the allowed clock drift is held before it is added,
+// blocks further in the future are rejected
+const maxFutureBlockDelay time.Duration = 2 * time.Minute
+
+// maxFutureBlocks limits the number of blocks held until their timestamps become acceptable
+const maxFutureBlocks int = 16
+
+// futureBlocks holds hashes of blocks waiting for their timestamps to become acceptable
+var futureBlocks map[string]bool = map[string]bool{}
+var futureBlocksLock sync.Mutex
+
+// holdFutureBlock holds a block rejected for a timestamp only slightly too far in the future and adds it once the timestamp is acceptable
+// returns false if the block was not rejected for its timestamp, is too far in the future or too many blocks are held already
+func holdFutureBlock(p *Peer, block blockchain.Block, err error) bool {
+	var futureErr blockchain.FutureTimestampError
+	if !errors.As(err, &futureErr) {
+		return false
+	}
+	var delay time.Duration = time.Until(futureErr.AcceptableAt())
+	if delay > maxFutureBlockDelay {
+		return false
+	}
+	futureBlocksLock.Lock()
+	defer futureBlocksLock.Unlock()
+	if futureBlocks[block.Hash] {
+		return true
+	}
+	if len(futureBlocks) >= maxFutureBlocks {
+		return false
+	}
+	futureBlocks[block.Hash] = true
+	logger.Debug("block timestamp is ahead of the clock, holding the block", "hash", block.Hash, "peer", p.Address, "delay", delay)
+	time.AfterFunc(delay, func() { releaseFutureBlock(p, block) })
+	return true
+}
+
+// releaseFutureBlock adds a held block if it still extends the chain
+func releaseFutureBlock(p *Peer, block blockchain.Block) {
+	futureBlocksLock.Lock()
+	delete(futureBlocks, block.Hash)
+	futureBlocksLock.Unlock()
+	if blockchain.GetLatestBlock().Hash != block.Fields.PrevHash {
+		logger.Debug("held block no longer extends the chain", "hash", block.Hash, "peer", p.Address)
+		return
+	}
+	addNextBlock(p, block)
+}
@@ -0,0 +1,82 @@
+package p2p
+
+import (
+	"naivecoin/blockchain"
+	tx "naivecoin/transactions"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testMaxClockDrift is the max clock drift of the default chain parameters, in seconds
+const testMaxClockDrift uint64 = 60
+
+// testBlockAhead returns a block extending the chain with a timestamp a given number of seconds ahead of the clock
+func testBlockAhead(tb testing.TB, seconds uint64, address string) blockchain.Block {
+	var prevBlock blockchain.Block = blockchain.GetLatestBlock()
+	var index int = prevBlock.Fields.Index + 1
+	return mineTestBlock(tb, blockchain.BlockFields{
+		Index:        index,
+		PrevHash:     prevBlock.Hash,
+		Ts:           uint64(time.Now().Unix()) + seconds,
+		Transactions: []tx.Transaction{tx.GetCoinbaseTransaction(address, index, prevBlock.Hash)},
+		Difficulty:   blockchain.GetDifficultyForecast().Difficulty,
+	})
+}
+
+// isHeld checks if a block is held until its timestamp becomes acceptable
+func isHeld(hash string) bool {
+	futureBlocksLock.Lock()
+	defer futureBlocksLock.Unlock()
+	return futureBlocks[hash]
+}
+
+func TestBlockTenMinutesAheadRejected(test *testing.T) {
+	server := startNode(test)
+	tp := dialTestPeer(test, server, false)
+	_, address := testKeyAddress(test, 407)
+	var tip string = blockchain.GetLatestBlock().Hash
+
+	var block blockchain.Block = testBlockAhead(test, 600, address)
+	tp.send(test, blockchainMsg, []blockchain.Block{block})
+	tp.sync(test)
+	if isHeld(block.Hash) || blockchain.GetLatestBlock().Hash != tip {
+		test.Fatal("block 10 minutes ahead must be rejected, not held")
+	}
+	var rejected bool
+	for _, message := range tp.messages(errorMsg) {
+		rejected = rejected || strings.Contains(string(message.Data), "seconds ahead of now")
+	}
+	if !rejected {
+		test.Fatal("expected an ERROR message rejecting the block for its timestamp")
+	}
+}
+
+func TestBlockSlightlyAheadHeldUntilAcceptable(test *testing.T) {
+	server := startNode(test)
+	tp := dialTestPeer(test, server, false)
+	_, address := testKeyAddress(test, 407)
+	var tip string = blockchain.GetLatestBlock().Hash
+
+	// 2 seconds past the max clock drift, the block is held, not rejected
+	var block blockchain.Block = testBlockAhead(test, testMaxClockDrift+2, address)
+	tp.send(test, blockchainMsg, []blockchain.Block{block})
+	tp.sync(test)
+	if !isHeld(block.Hash) || blockchain.GetLatestBlock().Hash != tip {
+		test.Fatal("block slightly ahead of the clock must be held")
+	}
+	if errors := tp.messages(errorMsg); len(errors) != 0 {
+		test.Fatalf("held block must not be rejected, got %s", errors[0].Data)
+	}
+
+	// once the timestamp is within the max clock drift, the block is added
+	waitFor(test, "held block added", func() bool {
+		return blockchain.GetLatestBlock().Hash == block.Hash
+	})
+	if isHeld(block.Hash) {
+		test.Fatal("added block must no longer be held")
+	}
+	if time.Now().Unix() < int64(block.Fields.Ts-testMaxClockDrift) {
+		test.Fatal("block must not be added before its timestamp is acceptable")
+	}
+}
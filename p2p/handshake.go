@@ -0,0 +1,161 @@
+package p2p
+
+import (
+	"fmt"
+	"naivecoin/blockchain"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// protocol versions: the version of this node and the oldest version it can talk to
+// since version 2 every message carries the id of the node it originates from
+// since version 3 transactions carry a version and txIns may reveal a public key, which changes block hashes
+// since version 4 new transactions have canonical ids, which nodes of earlier versions reject
+// since version 5 new transactions must have canonical signatures, which nodes of earlier versions reject as well
+// since version 6 block difficulty is an integer, msgpack encoded blocks of earlier versions carry a float which doesn't decode
+// since version 7 coinbase transactions refer to the prev block hash, which nodes of earlier versions reject
+const (
+	protocolVersion    int = 7
+	minProtocolVersion int = 7
+)
+
+// handshakeTimeout is how long a peer may take to send its HELLO message before it is disconnected
+const handshakeTimeout time.Duration = 10 * time.Second
+
+// helloMsg is the first message sent by both sides of a new connection
+const helloMsg = "HELLO"
+
+// helloData is the payload of HELLO message
+type helloData struct {
+	Version     int
+	GenesisHash string
+	Height      int
+	NodeId      string
+	// ListenAddress is the address other nodes can use to connect to this node, host may be omitted
+	ListenAddress string
+	// Encodings lists message encodings the node can decode in order of preference, JSON is assumed if empty
+	Encodings []string
+}
+
+// sendHello sends HELLO message describing this node to a websocket
+// must be called before the connection is added to the list of peers, so that HELLO is the first message sent
+// HELLO is always encoded as JSON, as the peer's encodings are not known yet
+func sendHello(ws *websocket.Conn) error {
+	hello := helloData{
+		Version:       protocolVersion,
+		GenesisHash:   blockchain.GenesisBlock.Hash,
+		Height:        blockchain.GetLatestBlock().Fields.Index,
+		NodeId:        nodeId,
+		ListenAddress: listenAddress,
+		Encodings:     getEncodings(),
+	}
+	helloBytes, err := buildMessage(hello, helloMsg)
+	if err != nil {
+		return err
+	}
+	return ws.WriteMessage(websocket.TextMessage, helloBytes)
+}
+
+// unmarshalDtoToHello unmarshales dto to HELLO message payload
+// unknown fields are allowed, so that newer protocol versions can extend HELLO
+func unmarshalDtoToHello(c *codec, byteData []byte) (helloData, error) {
+	hello := &helloData{}
+	dto := Message{Data: hello}
+	err := c.unmarshal(byteData, &dto, false)
+	return *hello, err
+}
+
+// validateHello checks that a peer runs a compatible protocol version on the same chain
+func validateHello(hello helloData) error {
+	if hello.Version < minProtocolVersion {
+		return fmt.Errorf("unsupported protocol version %d, minimum supported is %d", hello.Version, minProtocolVersion)
+	}
+	if hello.NodeId == nodeId {
+		return fmt.Errorf("connected to self")
+	}
+	if hello.GenesisHash != blockchain.GenesisBlock.Hash {
+		return fmt.Errorf("genesis block hash mismatch: expected %s, got %s", blockchain.GenesisBlock.Hash, hello.GenesisHash)
+	}
+	return nil
+}
+
+// handleHello completes the handshake with a peer, incompatible peers are disconnected
+func handleHello(p *Peer, c *codec, messageBytes []byte) {
+	hello, err := unmarshalDtoToHello(c, messageBytes)
+	if err == nil {
+		err = validateHello(hello)
+	}
+	if err != nil {
+		logger.Warn("handshake failed", "peer", p.Address, "err", err)
+		// there is no point in reconnecting to an incompatible peer
+		forgetOutboundPeer(p.Address)
+		closePeer(p, websocket.ClosePolicyViolation, err.Error())
+		return
+	}
+
+	var peerListenAddress string = resolveListenAddress(p, hello.ListenAddress)
+	if !isValidPeerAddress(peerListenAddress) {
+		peerListenAddress = ""
+	}
+
+	peerSocketListLock.Lock()
+	p.handshakeDone = true
+	p.Version = hello.Version
+	p.NodeId = hello.NodeId
+	p.ListenAddress = peerListenAddress
+	p.Height = hello.Height
+	var peerCodec_ *codec = negotiateCodec(hello.Encodings)
+	p.Encoding = peerCodec_.name
+	setPeerCodec(p, peerCodec_)
+	peerSocketListLock.Unlock()
+	logger.Info("handshake completed", "peer", p.Address, "node", hello.NodeId, "height", hello.Height, "encoding", peerCodec_.name)
+
+	if !resolveDuplicateConnection(p) {
+		return
+	}
+
+	startPeerSync(p)
+}
+
+// startPeerSync requests peer addresses and the latest block from a peer that completed the handshake
+// its transaction pool is requested once the latest block is received
+func startPeerSync(p *Peer) {
+	send(p, nil, getPeersMsg)
+
+	peerSocketListLock.Lock()
+	p.awaitingLatest = true
+	peerSocketListLock.Unlock()
+	send(p, nil, getLatestBlockMsg)
+}
+
+// takeAwaitingLatest checks if a peer was asked for its latest block on connect and clears the flag
+func takeAwaitingLatest(p *Peer) bool {
+	peerSocketListLock.Lock()
+	defer peerSocketListLock.Unlock()
+	var awaiting bool = p.awaitingLatest
+	p.awaitingLatest = false
+	return awaiting
+}
+
+// requestTransactionPool requests the transaction pool of a given peer
+func requestTransactionPool(p *Peer) {
+	send(p, nil, getTxPoolMsg)
+}
+
+// isHandshakeDone checks if a valid HELLO message was received from a peer
+func isHandshakeDone(p *Peer) bool {
+	peerSocketListLock.Lock()
+	defer peerSocketListLock.Unlock()
+	return p.handshakeDone
+}
+
+// expectHandshake disconnects a peer if it does not complete the handshake in time
+func expectHandshake(p *Peer) {
+	time.AfterFunc(handshakeTimeout, func() {
+		if !isHandshakeDone(p) {
+			logger.Warn("peer did not complete handshake in time", "peer", p.Address)
+			closePeer(p, websocket.ClosePolicyViolation, "handshake timeout")
+		}
+	})
+}
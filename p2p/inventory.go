@@ -0,0 +1,132 @@
+package p2p
+
+import (
+	"naivecoin/blockchain"
+)
+
+// message codes used to announce blocks by hash and fetch them on demand
+const (
+	invMsg     = "INV"
+	getDataMsg = "GETDATA"
+)
+
+// maxKnownBlocks limits the number of block hashes remembered per peer
+const maxKnownBlocks int = 1024
+
+// inventoryItem announces a block without sending its contents
+type inventoryItem struct {
+	Height int
+	Hash   string
+}
+
+// getDataRequest requests a full block by its hash
+type getDataRequest struct {
+	Hash string
+}
+
+// knownBlocks is a set of block hashes a peer is known to have, oldest hashes are forgotten first
+type knownBlocks struct {
+	hashes map[string]bool
+	order  []string
+}
+
+// add marks a block hash as known, should be called with peerSocketListLock held
+func (k *knownBlocks) add(hash string) {
+	if k.hashes == nil {
+		k.hashes = map[string]bool{}
+	}
+	if k.hashes[hash] {
+		return
+	}
+	k.hashes[hash] = true
+	k.order = append(k.order, hash)
+	if len(k.order) > maxKnownBlocks {
+		delete(k.hashes, k.order[0])
+		k.order = k.order[1:]
+	}
+}
+
+// has checks if a block hash is known, should be called with peerSocketListLock held
+func (k *knownBlocks) has(hash string) bool {
+	return k.hashes[hash]
+}
+
+// markBlocksKnown remembers that a peer has given blocks
+func markBlocksKnown(p *Peer, blocks []blockchain.Block) {
+	peerSocketListLock.Lock()
+	for _, block := range blocks {
+		p.knownBlocks.add(block.Hash)
+	}
+	peerSocketListLock.Unlock()
+}
+
+// announceBlock sends an inventory item for a block to all peers not known to have it
+// each block is announced once, keeping the origin of a block received from peers, and never sent back to its origin node
+func announceBlock(block blockchain.Block) {
+	_, origin, ok := seenBlocks.markRelayed(block.Hash)
+	if !ok {
+		return
+	}
+	message := newEncodedMessage(inventoryItem{Height: block.Fields.Index, Hash: block.Hash}, invMsg, origin)
+
+	peerSocketListLock.Lock()
+	for _, p := range peers {
+		if !p.handshakeDone || p.knownBlocks.has(block.Hash) || p.NodeId == origin {
+			continue
+		}
+		p.knownBlocks.add(block.Hash)
+		message.sendTo(p)
+	}
+	peerSocketListLock.Unlock()
+}
+
+// unmarshalDtoToInventoryItem unmarshales dto to an inventory item
+func unmarshalDtoToInventoryItem(c *codec, byteData []byte) (inventoryItem, error) {
+	item := &inventoryItem{}
+	if err := decodeStrict(c, byteData, item); err != nil {
+		return inventoryItem{}, err
+	}
+	return *item, validateInventoryItem(*item)
+}
+
+// unmarshalDtoToGetDataRequest unmarshales dto to a GETDATA request
+func unmarshalDtoToGetDataRequest(c *codec, byteData []byte) (getDataRequest, error) {
+	request := &getDataRequest{}
+	err := decodeStrict(c, byteData, request)
+	return *request, err
+}
+
+// handleInventory requests a block announced by a peer if it is not in the blockchain and extends it
+// the origin of the announcement is remembered for the block, so that it is kept when the block is announced further
+func handleInventory(p *Peer, item inventoryItem, origin string) {
+	peerSocketListLock.Lock()
+	p.knownBlocks.add(item.Hash)
+	peerSocketListLock.Unlock()
+	updatePeerHeight(p, item.Height, item.Hash)
+
+	var latestBlockHeld blockchain.Block = blockchain.GetLatestBlock()
+	var found bool = blockchain.HasBlock(item.Hash)
+
+	if found || item.Height <= latestBlockHeld.Fields.Index {
+		return
+	}
+
+	// the block is requested from the first peer announcing it only
+	if !seenBlocks.add(item.Hash, p, origin) {
+		return
+	}
+	send(p, getDataRequest{Hash: item.Hash}, getDataMsg)
+}
+
+// handleGetData sends a requested block to a peer, the peer handles it like any other received blocks
+func handleGetData(p *Peer, request getDataRequest) {
+	block, found := blockchain.GetBlockByHash(request.Hash)
+
+	if !found {
+		logger.Debug("peer requested unknown block", "peer", p.Address, "hash", request.Hash)
+		return
+	}
+
+	markBlocksKnown(p, []blockchain.Block{block})
+	send(p, []blockchain.Block{block}, blockchainMsg)
+}
@@ -0,0 +1,46 @@
+package p2p
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+)
+
+// nodeId identifies this node to its peers and is the origin of messages created by this node
+var nodeId string = newNodeId()
+
+// nodeIdRegexp matches a valid node id
+var nodeIdRegexp = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// newNodeId generates a random node id
+func newNodeId() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		logger.Error("failed to generate node id", "err", err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// LoadNodeId reads the node id from a file, so that peers see the same identity after a restart
+// if the file does not exist, the generated node id is saved to it
+func LoadNodeId(path string) error {
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return ioutil.WriteFile(path, []byte(nodeId), 0644)
+	} else if err != nil {
+		return err
+	}
+	if !nodeIdRegexp.Match(content) {
+		return fmt.Errorf("invalid node id in %s", path)
+	}
+	nodeId = string(content)
+	return nil
+}
+
+// GetNodeId returns the id of this node
+func GetNodeId() string {
+	return nodeId
+}
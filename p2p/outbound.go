@@ -0,0 +1,224 @@
+package p2p
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// reconnection delays, doubled after every failed attempt
+const (
+	minReconnectDelay time.Duration = time.Second
+	maxReconnectDelay time.Duration = 5 * time.Minute
+)
+
+// outboundPeer is an address added with AddPeer, it is reconnected when connection drops
+type outboundPeer struct {
+	address       string
+	reconnecting  bool
+	nextAttemptAt time.Time
+	// stop is closed to cancel reconnection attempts
+	stop chan struct{}
+}
+
+// outboundPeers holds addresses of outbound peers, connected or waiting to be reconnected
+var outboundPeers map[string]*outboundPeer = map[string]*outboundPeer{}
+var outboundPeersLock sync.Mutex
+
+// peersFile is a file where addresses of outbound peers are saved, empty to disable saving
+var peersFile string
+
+// SetPeersFile sets a file where addresses of outbound peers are saved on every change
+func SetPeersFile(path string) {
+	outboundPeersLock.Lock()
+	defer outboundPeersLock.Unlock()
+	peersFile = path
+}
+
+// savePeers writes addresses of outbound peers to the peers file, expects outboundPeersLock to be held
+func savePeers() {
+	if peersFile == "" {
+		return
+	}
+	var addresses []string = []string{}
+	for address := range outboundPeers {
+		addresses = append(addresses, address)
+	}
+	sort.Strings(addresses)
+	bytes, err := json.Marshal(addresses)
+	if err != nil {
+		logger.Error("failed to encode peers", "err", err)
+		return
+	}
+	if err := ioutil.WriteFile(peersFile, bytes, 0644); err != nil {
+		logger.Error("failed to save peers", "path", peersFile, "err", err)
+	}
+}
+
+// RestorePeers dials outbound peers saved in the peers file in the background
+// peers that cannot be reached are reconnected with exponential backoff
+func RestorePeers() {
+	outboundPeersLock.Lock()
+	var path string = peersFile
+	outboundPeersLock.Unlock()
+	if path == "" {
+		return
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return
+	} else if err != nil {
+		logger.Error("failed to read peers", "path", path, "err", err)
+		return
+	}
+	var addresses []string = []string{}
+	if err := json.Unmarshal(content, &addresses); err != nil {
+		logger.Error("failed to read peers", "path", path, "err", err)
+		return
+	}
+
+	for _, address := range addresses {
+		go func(address string) {
+			if err := ConnectOrRetry(address); err != nil {
+				logger.Warn("failed to restore peer", "peer", address, "err", err)
+			}
+		}(address)
+	}
+}
+
+// ConnectOrRetry dials an outbound peer as AddPeer does, and if it is not reachable yet, keeps reconnecting with exponential backoff
+// returns the error of the first attempt; an invalid address is not retried
+func ConnectOrRetry(address string) error {
+	if _, err := peerURL(address); err != nil {
+		return err
+	}
+	err := connectPeer(address)
+	if err == nil || err == ErrAlreadyConnected {
+		rememberOutboundPeer(address)
+		return nil
+	}
+	outboundPeersLock.Lock()
+	if _, found := outboundPeers[address]; !found {
+		outboundPeers[address] = &outboundPeer{address: address}
+	}
+	outboundPeersLock.Unlock()
+	scheduleReconnect(address)
+	return err
+}
+
+// rememberOutboundPeer records an address of a connected outbound peer
+// pending reconnection attempts to this address are cancelled
+func rememberOutboundPeer(address string) {
+	outboundPeersLock.Lock()
+	defer outboundPeersLock.Unlock()
+	if op, found := outboundPeers[address]; found {
+		if op.reconnecting {
+			close(op.stop)
+		}
+	}
+	outboundPeers[address] = &outboundPeer{address: address}
+	savePeers()
+}
+
+// forgetOutboundPeer removes an address of an outbound peer and cancels its reconnection attempts
+// returns false if the address is not an outbound peer
+func forgetOutboundPeer(address string) bool {
+	outboundPeersLock.Lock()
+	defer outboundPeersLock.Unlock()
+	op, found := outboundPeers[address]
+	if !found {
+		return false
+	}
+	if op.reconnecting {
+		close(op.stop)
+	}
+	delete(outboundPeers, address)
+	savePeers()
+	return true
+}
+
+// stopReconnecting cancels all running reconnection attempts, outbound peers are kept in the peers file
+func stopReconnecting() {
+	outboundPeersLock.Lock()
+	defer outboundPeersLock.Unlock()
+	for _, op := range outboundPeers {
+		if op.reconnecting {
+			close(op.stop)
+			op.reconnecting = false
+		}
+	}
+}
+
+// getReconnectingPeers returns outbound peers waiting to be reconnected
+func getReconnectingPeers() []Peer {
+	outboundPeersLock.Lock()
+	defer outboundPeersLock.Unlock()
+	var result []Peer = []Peer{}
+	for _, op := range outboundPeers {
+		if op.reconnecting {
+			result = append(result, Peer{
+				Address:       op.address,
+				Direction:     outbound,
+				State:         reconnecting,
+				NextAttemptAt: op.nextAttemptAt,
+			})
+		}
+	}
+	return result
+}
+
+// scheduleReconnect starts reconnection attempts to an outbound peer with exponential backoff
+func scheduleReconnect(address string) {
+	outboundPeersLock.Lock()
+	defer outboundPeersLock.Unlock()
+	op, found := outboundPeers[address]
+	if !found || op.reconnecting {
+		return
+	}
+	op.reconnecting = true
+	op.stop = make(chan struct{})
+	go reconnect(op)
+}
+
+// reconnect tries to connect to an outbound peer until it succeeds or attempts are cancelled
+func reconnect(op *outboundPeer) {
+	var delay time.Duration = minReconnectDelay
+	for {
+		outboundPeersLock.Lock()
+		op.nextAttemptAt = time.Now().Add(delay)
+		outboundPeersLock.Unlock()
+		logger.Info("reconnecting to peer", "peer", op.address, "delay", delay)
+
+		select {
+		case <-op.stop:
+			return
+		case <-time.After(delay):
+		}
+
+		// a connection to this address made in the meantime ends reconnection attempts as well
+		if err := connectPeer(op.address); err != nil && err != ErrAlreadyConnected {
+			logger.Warn("failed to reconnect to peer", "peer", op.address, "err", err)
+			delay *= 2
+			if delay > maxReconnectDelay {
+				delay = maxReconnectDelay
+			}
+			continue
+		}
+
+		outboundPeersLock.Lock()
+		var cancelled bool = outboundPeers[op.address] != op || !op.reconnecting
+		if !cancelled {
+			op.reconnecting = false
+		}
+		outboundPeersLock.Unlock()
+		// peer was removed or added again while connecting, drop this connection
+		if cancelled {
+			disconnectPeer(op.address)
+		}
+		return
+	}
+}
@@ -2,14 +2,15 @@ package p2p
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
 	"naivecoin/blockchain"
 	tx "naivecoin/transactions"
 	"naivecoin/txpool"
-	"naivecoin/wallet"
+	"naivecoin/utils"
 	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -17,9 +18,8 @@ import (
 
 // A single mutex to be used by both goroutines
 var peerSocketListLock sync.Mutex
-var peerSendLock sync.Mutex
-var webClientSocketLock sync.Mutex
-var webClientSendLock sync.Mutex
+
+var logger *utils.Logger = utils.NewLogger("p2p")
 
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
@@ -37,23 +37,131 @@ const (
 )
 
 // Message struct to hold data and message code
+// Origin is the id of the node that created the message, it is kept when the message is relayed
 type Message struct {
-	Code string
-	Data interface{}
+	Code   string
+	Origin string
+	Data   interface{}
+}
+
+// sendQueueSize is the number of messages that can be queued for a peer before it is considered too slow
+const sendQueueSize int = 256
+
+// writeTimeout is how long a single write to a peer may take
+const writeTimeout time.Duration = 10 * time.Second
+
+// peer connection directions
+const (
+	inbound  = "inbound"
+	outbound = "outbound"
+)
+
+// peer states
+const (
+	connected    = "connected"
+	reconnecting = "reconnecting"
+)
+
+// Peer holds a connection to a peer and its metadata
+// NextAttemptAt is set for outbound peers waiting to be reconnected
+// Height and LatestHash describe the best block the peer is known to have, from its HELLO and the blocks it sent or announced
+// Encoding is the message encoding used for messages sent to the peer, negotiated during the handshake
+// MisbehaviorScore grows with protocol violations, the peer is disconnected once it reaches banScore
+type Peer struct {
+	conn             *websocket.Conn
+	outbox           *outbox
+	handshakeDone    bool
+	awaitingLatest   bool
+	awaitingResync   bool
+	knownBlocks      knownBlocks
+	Address          string
+	Direction        string
+	State            string
+	Version          int
+	NodeId           string
+	ListenAddress    string
+	Height           int
+	LatestHash       string
+	Encoding         string
+	MisbehaviorScore int
+	RateLimit        PeerRateLimit
+	ConnectedAt      time.Time
+	LastMessageAt    time.Time
+	NextAttemptAt    time.Time
 }
 
-// peers is the list of connections to peers
-var peers []*websocket.Conn = []*websocket.Conn{}
+// ErrPeerNotFound is returned when there is no connected peer with a given address
+var ErrPeerNotFound = errors.New("peer not found")
+
+// ErrAlreadyConnected is returned when adding a peer that is already connected
+var ErrAlreadyConnected = errors.New("already connected")
+
+// ErrClosing is returned when adding a peer after CloseAll was called
+var ErrClosing = errors.New("node is shutting down")
+
+// closing is set to 1 by CloseAll
+var closing int32
 
-// webClientSocket is a connection to web client
-var webClientSocket *websocket.Conn
+// peers is the list of connected peers
+var peers []*Peer = []*Peer{}
 
 // getPeers returns the list of connected peers
-func getPeers() []*websocket.Conn {
+func getPeers() []*Peer {
 	return peers
 }
 
-// Network struct used by blockhain package to access BroadcastTransactionPool and BroadcastLatest functions
+// GetPeers returns a copy of connected peers metadata, including outbound peers waiting to be reconnected
+func GetPeers() []Peer {
+	peerSocketListLock.Lock()
+	var result []Peer = []Peer{}
+	for _, p := range getPeers() {
+		result = append(result, *p)
+	}
+	peerSocketListLock.Unlock()
+	return append(result, getReconnectingPeers()...)
+}
+
+// addPeer adds a new connection to the list of peers and starts its writer goroutine
+// an error is returned if all connection slots in a given direction are used
+func addPeer(ws *websocket.Conn, address string, direction string) (*Peer, error) {
+	var p *Peer = &Peer{
+		conn:          ws,
+		outbox:        newOutbox(),
+		Address:       address,
+		Direction:     direction,
+		State:         connected,
+		Encoding:      jsonCodec.name,
+		ConnectedAt:   time.Now(),
+		LastMessageAt: time.Now(),
+		RateLimit:     newPeerRateLimit(),
+	}
+	ws.SetReadLimit(maxMessageSize)
+	peerSocketListLock.Lock()
+	if countPeers(direction) >= maxPeersFor(direction) {
+		peerSocketListLock.Unlock()
+		if direction == inbound {
+			return nil, errInboundLimit
+		}
+		return nil, ErrOutboundLimit
+	}
+	peers = append(peers, p)
+	var peerCount int = len(peers)
+	peerSocketListLock.Unlock()
+	go writer(p)
+	sendPeerEventToWebClients(peerConnectedMsg, p, peerCount)
+	return p, nil
+}
+
+// rejectConnection closes a connection that was not added to the list of peers with a given reason
+func rejectConnection(ws *websocket.Conn, reason string) {
+	closeMessage := websocket.FormatCloseMessage(websocket.CloseTryAgainLater, reason)
+	if err := ws.WriteControl(websocket.CloseMessage, closeMessage, time.Now().Add(time.Second)); err != nil {
+		logger.Debug("failed to send close frame", "peer", ws.RemoteAddr().String(), "err", err)
+	}
+	ws.Close()
+}
+
+// Network struct used by blockhain package to access BroadcastLatest function
 type Network struct{}
 
 // BroadcastTransactionPool broadcasts transaction pool to all connected peers
@@ -63,302 +171,680 @@ func (Network) BroadcastTransactionPool() {
 	sendUpdateToWebClient()
 }
 
-// BroadcastLatest broadcasts the latest block in a blockchain to all connected peers
+// HandlePoolEvent reacts to transaction pool changes: relays added transactions to peers,
+// broadcasts transaction pool to peers when a transaction is expired, and sends an update to web clients on any change
+func (n Network) HandlePoolEvent(event txpool.PoolEvent) {
+	sendPoolEventToWebClients(event)
+	switch event.Type {
+	case txpool.TxAdded:
+		relayTransaction(event.Transaction)
+		sendUpdateToWebClient()
+	case txpool.TxExpired:
+		n.BroadcastTransactionPool()
+	default:
+		sendUpdateToWebClient()
+	}
+}
+
+// relayTransaction sends a transaction to all peers except the one it was received from
+// each transaction is relayed at most once while it is remembered in seenTransactions
+func relayTransaction(transaction tx.Transaction) {
+	source, origin, ok := seenTransactions.markRelayed(transaction.Id)
+	if !ok {
+		return
+	}
+	broadcastExcept([]tx.Transaction{transaction}, txPoolMsg, origin, source)
+}
+
+// BroadcastLatest announces the latest block in a blockchain to all connected peers that don't have it yet
 // also sends an update to web client
 func (Network) BroadcastLatest() {
-	latestBlock := []blockchain.Block{blockchain.GetLatestBlock()}
-	broadcast(latestBlock, blockchainMsg)
+	announceBlock(blockchain.GetLatestBlock())
 	sendUpdateToWebClient()
 }
 
-// buildMessage builds a message to be sent later to websockets
+// WalletChanged sends the wallet info to web clients after the wallet key is replaced
+func (Network) WalletChanged() {
+	sendUpdateToWebClient()
+}
+
+// blockListeners are called with every block added to the blockchain, guarded by blockListenersLock
+var blockListeners []func(blockchain.Block)
+var blockListenersLock sync.Mutex
+
+// RegisterBlockListener registers a function called with every block added to the blockchain, such as api streams of new blocks
+// listeners are called after web clients are notified, they must not block
+func RegisterBlockListener(listener func(blockchain.Block)) {
+	blockListenersLock.Lock()
+	defer blockListenersLock.Unlock()
+	blockListeners = append(blockListeners, listener)
+}
+
+// BlockAdded notifies web clients subscribed to blocks and registered block listeners about a new block in a blockchain
+func (Network) BlockAdded(block blockchain.Block) {
+	sendBlockEventToWebClients(block)
+	blockListenersLock.Lock()
+	var listeners []func(blockchain.Block) = append([]func(blockchain.Block){}, blockListeners...)
+	blockListenersLock.Unlock()
+	for _, listener := range listeners {
+		listener(block)
+	}
+}
+
+// buildMessage builds a JSON message to be sent later to websockets, peers get messages encoded with their codec by send
 func buildMessage(data interface{}, code string) ([]byte, error) {
 	var msg Message = Message{
-		Code: code,
-		Data: data,
+		Code:   code,
+		Origin: nodeId,
+		Data:   data,
 	}
 
 	dataBytes, err := json.Marshal(msg)
 
 	if err != nil {
-		log.Println(err)
+		logger.Error("failed to encode message", "code", code, "err", err)
 		return nil, err
 	}
 
 	return dataBytes, nil
 }
 
-// broadcast broadcasts data to all peers
+// broadcast broadcasts data created by this node to all peers
 func broadcast(data interface{}, code string) {
+	broadcastExcept(data, code, nodeId, nil)
+}
 
-	dataBytes, err := buildMessage(data, code)
-	if err != nil {
-		return
-	}
+// broadcastExcept broadcasts data originating from a given node to all peers except a given one, usually the peer the data came from
+// the data is never sent back to its origin node
+func broadcastExcept(data interface{}, code string, origin string, except *Peer) {
+
+	message := newEncodedMessage(data, code, origin)
 
 	peerSocketListLock.Lock()
-	for _, socket := range peers {
-		send(socket, dataBytes)
+	for _, p := range peers {
+		if p != except && p.NodeId != origin {
+			message.sendTo(p)
+		}
 	}
 	peerSocketListLock.Unlock()
 }
 
-// send sends byte data to a websocket
-func send(ws *websocket.Conn, dataBytes []byte) {
-	peerSendLock.Lock()
-	err := ws.WriteMessage(websocket.TextMessage, dataBytes)
-	peerSendLock.Unlock()
+// outbox holds messages waiting to be written to a peer
+// done is closed when the peer is removed, full is set once the peer is found too slow
+// codec holds the codec used to encode messages for the peer, it changes once the handshake is completed
+type outbox struct {
+	messages chan frame
+	done     chan struct{}
+	full     int32
+	codec    atomic.Value
+}
+
+// newOutbox creates an empty outbox
+func newOutbox() *outbox {
+	o := &outbox{
+		messages: make(chan frame, sendQueueSize),
+		done:     make(chan struct{}),
+	}
+	o.codec.Store(jsonCodec)
+	return o
+}
+
+// send encodes a message created by this node with a peer's codec and queues it to be written to the peer
+func send(p *Peer, data interface{}, code string) {
+	f, err := peerCodec(p).encode(data, code, nodeId)
 	if err != nil {
-		log.Println(err)
+		return
+	}
+	enqueue(p, f)
+}
+
+// enqueue queues a frame to be written to a peer by its writer goroutine
+// a peer whose queue is full is too slow to keep up and gets disconnected
+func enqueue(p *Peer, f frame) {
+	select {
+	case <-p.outbox.done:
+		return
+	default:
+	}
+
+	select {
+	case p.outbox.messages <- f:
+	default:
+		if atomic.CompareAndSwapInt32(&p.outbox.full, 0, 1) {
+			logger.Warn("send queue of peer is full, disconnecting", "peer", p.Address)
+			go closePeer(p, websocket.CloseTryAgainLater, "send queue full")
+		}
+	}
+}
+
+// writer writes queued messages to a peer one at a time, so that a slow peer does not block others
+// on write error the connection is closed and the peer is removed by its reader
+func writer(p *Peer) {
+	for {
+		select {
+		case f := <-p.outbox.messages:
+			p.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+			if err := p.conn.WriteMessage(f.messageType, f.dataBytes); err != nil {
+				logger.Warn("failed to write to peer", "peer", p.Address, "err", err)
+				p.conn.Close()
+				return
+			}
+		case <-p.outbox.done:
+			return
+		}
 	}
 }
 
 // unmarshalDtoToBlocks unmarshales dto to a collection of blocks
-func unmarshalDtoToBlocks(byteData []byte) ([]blockchain.Block, error) {
+func unmarshalDtoToBlocks(c *codec, byteData []byte) ([]blockchain.Block, error) {
 	blocks := &[]blockchain.Block{}
-	dto := Message{Data: blocks}
-	err := json.Unmarshal(byteData, &dto)
-	return *blocks, err
+	if err := decodeStrict(c, byteData, blocks); err != nil {
+		return nil, err
+	}
+	return *blocks, validateBlocks(*blocks)
 }
 
 // unmarshalDtoToTxPool unmarshales dto to a collection of transactions
-func unmarshalDtoToTxPool(byteData []byte) ([]tx.Transaction, error) {
+func unmarshalDtoToTxPool(c *codec, byteData []byte) ([]tx.Transaction, error) {
 	txs := &[]tx.Transaction{}
-	dto := Message{Data: txs}
-	err := json.Unmarshal(byteData, &dto)
-	return *txs, err
+	if err := decodeStrict(c, byteData, txs); err != nil {
+		return nil, err
+	}
+	return *txs, validateTransactions(*txs)
 }
 
-// handleReceivedBlocks handles received blocks: replaces chain if received blocks are valid
-func handleReceivedBlocks(blocks []blockchain.Block) {
+// updatePeerHeight records the best block a peer is known to have, lower blocks are ignored
+func updatePeerHeight(p *Peer, height int, hash string) {
+	peerSocketListLock.Lock()
+	defer peerSocketListLock.Unlock()
+	if height > p.Height || p.LatestHash == "" && height == p.Height {
+		p.Height = height
+		p.LatestHash = hash
+	}
+}
+
+// BestPeerHeight returns the highest block index among connected peers, 0 if there are no peers
+func BestPeerHeight() int {
+	peerSocketListLock.Lock()
+	defer peerSocketListLock.Unlock()
+	var best int = 0
+	for _, p := range peers {
+		if p.handshakeDone && p.Height > best {
+			best = p.Height
+		}
+	}
+	return best
+}
+
+// extendingSuffix returns received blocks following a given tip, nil if none of them extends it
+func extendingSuffix(blocks []blockchain.Block, tip blockchain.Block) []blockchain.Block {
+	for n := 0; n < len(blocks); n++ {
+		if blocks[n].Fields.PrevHash == tip.Hash && blocks[n].Fields.Index == tip.Fields.Index+1 {
+			return blocks[n:]
+		}
+	}
+	return nil
+}
+
+// handleReceivedBlocks handles blocks received from a peer: appends blocks extending the chain,
+// or replaces chain if received blocks are valid and fork from it
+func handleReceivedBlocks(p *Peer, origin string, blocks []blockchain.Block) {
 	if len(blocks) == 0 {
 		return
 	}
+	markBlocksKnown(p, blocks)
+	updatePeerHeight(p, blocks[len(blocks)-1].Fields.Index, blocks[len(blocks)-1].Hash)
 	var latestBlockReceived blockchain.Block = blocks[len(blocks)-1]
-	blockchain.Lock.Lock()
 	var latestBlockHeld blockchain.Block = blockchain.GetLatestBlock()
-	blockchain.Lock.Unlock()
+	var known bool = blockchain.HasBlock(latestBlockReceived.Hash)
+	defer addSavedTransactionsOnceSynced(latestBlockReceived)
 
-	if latestBlockReceived.Fields.Index > latestBlockHeld.Fields.Index {
+	if !known && latestBlockReceived.Fields.Index > latestBlockHeld.Fields.Index {
 		if latestBlockHeld.Hash == latestBlockReceived.Fields.PrevHash {
-			blockchain.Lock.Lock()
-			if blockchain.AddBlockToChain(latestBlockReceived) {
-				latestBlock := []blockchain.Block{blockchain.GetLatestBlock()}
-				broadcast(latestBlock, blockchainMsg)
-			}
-			blockchain.Lock.Unlock()
+			handleNextBlock(p, origin, latestBlockReceived)
 		} else if len(blocks) == 1 {
-			fmt.Println("some blocks are missing, requesting all blocks")
-			broadcast(nil, getAllBlocksMsg)
+			logger.Info("some blocks are missing, requesting blocks by range", "peer", p.Address, "height", latestBlockReceived.Fields.Index)
+			startRangeSync(p, latestBlockReceived.Fields.Index)
 		} else {
-			blockchain.Lock.Lock()
-			blockchain.ReplaceChain(blocks)
-			blockchain.Lock.Unlock()
+			// blocks following the tip are appended without validating the whole chain again
+			if suffix := extendingSuffix(blocks, latestBlockHeld); suffix != nil {
+				err := blockchain.AppendBlocks(suffix)
+				if err == nil {
+					announceBlock(latestBlockReceived)
+					return
+				}
+				logger.Debug("received blocks not appended, replacing chain", "peer", p.Address, "err", err)
+			}
+			err := replaceChain(blocks)
+			if err != nil {
+				sendError(p, blockchainMsg, fmt.Sprintf("chain rejected: %s", err.Error()))
+			}
 		}
 	}
 }
 
+// addSavedTransactionsOnceSynced adds saved transactions to the pool once the chain holds the latest block of a peer,
+// or one at least as high, and no chain download is in progress
+func addSavedTransactionsOnceSynced(latestBlockReceived blockchain.Block) {
+	if IsSyncing() {
+		return
+	}
+	if blockchain.HasBlock(latestBlockReceived.Hash) || blockchain.GetLatestBlock().Fields.Index >= latestBlockReceived.Fields.Index {
+		blockchain.AddSavedTransactions()
+	}
+}
+
+// handleNextBlock adds a received block extending the chain and announces it further
+// copies of the block forwarded by other peers are neither validated again nor relayed
+func handleNextBlock(p *Peer, origin string, block blockchain.Block) {
+	// the block keeps the origin it was announced with, if it was requested after an INV
+	if !seenBlocks.markProcessed(block.Hash, p, origin) {
+		return
+	}
+	if blockchain.GetLatestBlock().Hash != block.Fields.PrevHash {
+		// another block was added meanwhile, the received one is handled like any block not extending the chain
+		logger.Debug("block no longer extends the chain", "hash", block.Hash, "peer", p.Address)
+		return
+	}
+	addNextBlock(p, block)
+}
+
+// addBlockToChain validates a block and adds it to the blockchain, tests replace it to count validated blocks
+var addBlockToChain func(blockchain.Block) error = blockchain.AddBlockToChain
+
+// replaceChain validates a whole received chain and replaces the blockchain with it, tests replace it to count full validations
+var replaceChain func([]blockchain.Block) error = blockchain.ReplaceChain
+
+// addNextBlock adds a block extending the chain and announces it further
+// a block with a timestamp slightly ahead of the clock is held until the timestamp is acceptable
+func addNextBlock(p *Peer, block blockchain.Block) {
+	var err error = addBlockToChain(block)
+	if err == nil {
+		announceBlock(block)
+	} else if blockchain.GetLatestBlock().Hash != block.Fields.PrevHash {
+		logger.Debug("block no longer extends the chain", "hash", block.Hash, "peer", p.Address)
+	} else if !holdFutureBlock(p, block, err) {
+		sendError(p, blockchainMsg, err.Error())
+	}
+}
+
 // handleMessage handles messages received through webscoket connection
-func handleMessage(ws *websocket.Conn, code string, messageBytes []byte) {
+// origin is the id of the node that created the message, relayed data keeps it
+func handleMessage(p *Peer, c *codec, code string, origin string, messageBytes []byte) {
 	switch code {
 
 	// handle a case when peer requests latest block in a blockchain
 	case getLatestBlockMsg:
-		responseBytes, err := buildMessage([]blockchain.Block{blockchain.GetLatestBlock()}, blockchainMsg)
+		send(p, []blockchain.Block{blockchain.GetLatestBlock()}, blockchainMsg)
+
+	// handle a case when peer requests all blocks in a blockchain
+	case getAllBlocksMsg:
+		send(p, getAllBlocksReply(), blockchainMsg)
+
+	// handle a case when peer sends a list of blocks
+	case blockchainMsg:
+		logger.Debug("blockchain received", "peer", p.Address)
+		blocks, err := unmarshalDtoToBlocks(c, messageBytes)
 		if err != nil {
-			log.Println(err)
+			rejectMessage(p, code, invalidDataScore, err.Error())
 			return
 		}
-		send(ws, responseBytes)
+		handleReceivedBlocks(p, origin, blocks)
+		// the reply to the latest block request made on connect is followed by a transaction pool request
+		if takeAwaitingLatest(p) {
+			requestTransactionPool(p)
+		}
+		takeAwaitingResync(p)
 
-	// handle a case when peer requests all blocks in a blockchain
-	case getAllBlocksMsg:
-		responseBytes, err := buildMessage(blockchain.GetBlockChain(), blockchainMsg)
+	// handle a case when peer requests a range of blocks during sync
+	case getBlocksRangeMsg:
+		request, err := unmarshalDtoToBlocksRangeRequest(c, messageBytes)
 		if err != nil {
-			log.Println(err)
+			rejectMessage(p, code, invalidDataScore, err.Error())
 			return
 		}
-		send(ws, responseBytes)
+		handleGetBlocksRange(p, request)
 
-	// handle a case when peer sends a list of blocks
-	case blockchainMsg:
-		fmt.Println("blockchain received")
-		blocks, err := unmarshalDtoToBlocks(messageBytes)
+	// handle a case when peer sends a range of blocks requested during sync
+	case blocksRangeMsg:
+		blocks, err := unmarshalDtoToBlocks(c, messageBytes)
 		if err != nil {
-			log.Println(err)
+			rejectMessage(p, code, invalidDataScore, err.Error())
 			return
 		}
-		handleReceivedBlocks(blocks)
+		handleBlocksRange(p, blocks)
 
-	// handle a case when peer requests a list of transactions in transaction pool
-	case getTxPoolMsg:
-		responseBytes, err := buildMessage(txpool.GetTransactionPool(), txPoolMsg)
+	// handle a case when peer announces a block by its hash
+	case invMsg:
+		item, err := unmarshalDtoToInventoryItem(c, messageBytes)
+		if err != nil {
+			rejectMessage(p, code, invalidDataScore, err.Error())
+			return
+		}
+		handleInventory(p, item, origin)
+
+	// handle a case when peer requests a full block announced earlier
+	case getDataMsg:
+		request, err := unmarshalDtoToGetDataRequest(c, messageBytes)
 		if err != nil {
-			log.Println(err)
+			rejectMessage(p, code, invalidDataScore, err.Error())
 			return
 		}
-		send(ws, responseBytes)
+		handleGetData(p, request)
+
+	// handle a case when peer requests a list of transactions in transaction pool
+	case getTxPoolMsg:
+		send(p, txpool.GetTransactionPool(), txPoolMsg)
 
 	// handle a case when peer send a list of transactions in his transaction pool
 	case txPoolMsg:
-		fmt.Println("tx pool received")
-		txs, err := unmarshalDtoToTxPool(messageBytes)
+		logger.Debug("tx pool received", "peer", p.Address)
+		txs, err := unmarshalDtoToTxPool(c, messageBytes)
 		if err != nil {
-			log.Println(err)
+			rejectMessage(p, code, invalidDataScore, err.Error())
 			return
 		}
+		// accepted transactions are relayed by the txpool listener to all peers but this one
+		// transactions seen before are skipped, whether they were accepted or not
 		for _, tx := range txs {
-			err := blockchain.HandleReceivedTransaction(tx)
-			if err == nil {
-				broadcast(txpool.GetTransactionPool(), txPoolMsg)
+			if !seenTransactions.add(tx.Id, p, origin) {
+				continue
+			}
+			// a transaction already in the pool was received from another peer, it is not an error of this one
+			if err := blockchain.HandleReceivedTransaction(tx); err != nil && !errors.Is(err, txpool.ErrAlreadyInPool) {
+				sendError(p, txPoolMsg, fmt.Sprintf("transaction %s rejected: %s", tx.Id, err.Error()))
 			}
 		}
 
+	// handle a case when peer requests addresses of known peers
+	case getPeersMsg:
+		send(p, getAddressesFor(p), peersMsg)
+
+	// handle a case when peer sends addresses of its peers
+	case peersMsg:
+		addresses, err := unmarshalDtoToAddresses(c, messageBytes)
+		if err != nil {
+			rejectMessage(p, code, invalidDataScore, err.Error())
+			return
+		}
+		go handleReceivedAddresses(p, addresses)
+
 	default:
-		log.Printf("unsupported message code: %s", code)
+		rejectMessage(p, code, malformedMessageScore, fmt.Sprintf("unsupported message code: %s", code))
 	}
 
 	sendUpdateToWebClient()
 }
 
-// sendUpdateToWebClient sends current wallet balance and wallet address to connected web client
-func sendUpdateToWebClient() {
-	if webClientSocket == nil {
-		return
+// removePeerAtIndex removes a peer from the list at a given index
+func removePeerAtIndex(peers_ []*Peer, index int) {
+	peers = append(peers_[:index], peers_[index+1:]...)
+}
+
+// removePeer closes connection to a given peer and removes it from the list
+// returns false if the peer was already removed
+func removePeer(p *Peer) bool {
+	peerSocketListLock.Lock()
+	for index, peer := range peers {
+		if peer == p {
+			peer.conn.Close()
+			close(peer.outbox.done)
+			removePeerAtIndex(peers, index)
+			var peerCount int = len(peers)
+			peerSocketListLock.Unlock()
+			sendPeerEventToWebClients(peerDisconnectedMsg, p, peerCount)
+			return true
+		}
 	}
+	peerSocketListLock.Unlock()
+	return false
+}
 
-	walletInfo := struct {
-		Balance float64
-		Address string
-	}{
-		Balance: blockchain.GetAccountBalance(),
-		Address: wallet.GetBase58Address(),
+// findPeer returns a connected peer with a given address, nil if not found
+func findPeer(address string) *Peer {
+	peerSocketListLock.Lock()
+	defer peerSocketListLock.Unlock()
+	for _, peer := range peers {
+		if peer.Address == address {
+			return peer
+		}
 	}
+	return nil
+}
 
-	dataBytes, _ := buildMessage(walletInfo, walletInfoMsg)
-	webClientSendLock.Lock()
-	err := webClientSocket.WriteMessage(websocket.TextMessage, dataBytes)
-	if err != nil {
-		log.Println(err)
+// closePeer sends a close frame with a given code and reason to a peer and removes it from the list
+// returns false if the peer was already removed
+func closePeer(p *Peer, code int, reason string) bool {
+	closeMessage := websocket.FormatCloseMessage(code, reason)
+	if err := p.conn.WriteControl(websocket.CloseMessage, closeMessage, time.Now().Add(time.Second)); err != nil {
+		logger.Debug("failed to send close frame", "peer", p.Address, "err", err)
 	}
-	webClientSendLock.Unlock()
+	return removePeer(p)
 }
 
-// removePeerAtIndex removes a peer from the list at a given index
-func removePeerAtIndex(sockets_ []*websocket.Conn, index int) {
-	peers = append(sockets_[:index], sockets_[index+1:]...)
+// disconnectPeer closes connection to a peer with a given address and removes it from the list
+// returns false if there is no connected peer with this address
+func disconnectPeer(address string) bool {
+	var p *Peer = findPeer(address)
+	if p == nil {
+		return false
+	}
+	return closePeer(p, websocket.CloseNormalClosure, "peer removed")
+}
+
+// RemovePeer disconnects a peer with a given address
+// its reader goroutine stops once the connection is closed, reconnection attempts are cancelled
+func RemovePeer(address string) error {
+	var wasOutbound bool = forgetOutboundPeer(address)
+	if disconnectPeer(address) {
+		logger.Info("peer removed", "peer", address)
+		return nil
+	}
+	if wasOutbound {
+		logger.Info("reconnection to peer cancelled", "peer", address)
+		return nil
+	}
+	return ErrPeerNotFound
+}
+
+// CloseAll sends close frames to all peers and web clients and stops reconnection attempts
+// outbound peers are saved before they are closed, so that they can be restored on the next start
+func CloseAll() {
+	atomic.StoreInt32(&closing, 1)
+	stopReconnecting()
+	outboundPeersLock.Lock()
+	savePeers()
+	outboundPeersLock.Unlock()
+
+	for _, client := range getWebClients() {
+		closeWebClient(client, websocket.CloseGoingAway, "shutting down")
+	}
+
+	peerSocketListLock.Lock()
+	var toClose []*Peer = append([]*Peer{}, peers...)
+	peerSocketListLock.Unlock()
+	for _, p := range toClose {
+		closePeer(p, websocket.CloseGoingAway, "shutting down")
+	}
+}
+
+// isClosing checks if CloseAll was called, no new connections are made after that
+func isClosing() bool {
+	return atomic.LoadInt32(&closing) == 1
 }
 
 // reader listens for messages on websocket connection and sends them to be handled further
-func reader(ws *websocket.Conn) {
+func reader(p *Peer) {
 	for {
+		// messages already buffered are not handled once the peer is removed
+		select {
+		case <-p.outbox.done:
+			return
+		default:
+		}
+
 		// read in a message
-		messageType, messageBytes, err := ws.ReadMessage()
+		messageType, messageBytes, err := p.conn.ReadMessage()
 
 		if err != nil {
-			log.Println(err)
-			peerSocketListLock.Lock()
-			for index, socket := range peers {
-				if socket == ws {
-					socket.Close()
-					removePeerAtIndex(peers, index)
-					break
-				}
+			logger.Info("peer disconnected", "peer", p.Address, "err", err)
+			if err == websocket.ErrReadLimit {
+				misbehave(p, oversizedMessageScore, "message too large")
+			}
+			// peer removed on purpose is already gone from the list and must not be reconnected
+			// neither is a duplicate connection closed by the peer, as another connection to it is kept
+			if removePeer(p) && p.Direction == outbound && !isDuplicateClose(err) {
+				scheduleReconnect(p.Address)
 			}
-			peerSocketListLock.Unlock()
 			break
 		}
 
-		if messageType != websocket.TextMessage {
-			log.Println("text message types expected")
+		peerSocketListLock.Lock()
+		p.LastMessageAt = time.Now()
+		peerSocketListLock.Unlock()
+
+		// text frames hold JSON messages and binary frames hold messages in other enabled encodings
+		c := codecForFrame(messageType)
+		if c == nil {
+			logger.Warn("unsupported message type", "peer", p.Address, "type", messageType)
 			continue
 		}
 
-		messageStruct := Message{}
+		// data is decoded later by the handler of a given message code
+		messageStruct := struct {
+			Code   string
+			Origin string
+		}{}
 
-		err = json.Unmarshal(messageBytes, &messageStruct)
+		err = c.unmarshal(messageBytes, &messageStruct, false)
 
 		if err != nil {
-			log.Println(err)
+			rejectMessage(p, "", malformedMessageScore, err.Error())
 			continue
 		}
 
-		handleMessage(ws, messageStruct.Code, messageBytes)
-	}
-}
+		if !rateLimit(p, messageStruct.Code) {
+			continue
+		}
 
-// WsEndpoint starts a websocket connection to web client
-func WsEndpoint(w http.ResponseWriter, r *http.Request) {
-	upgrader.CheckOrigin = func(r *http.Request) bool { return true }
+		// nothing but HELLO and ERROR is accepted until the handshake is completed
+		if messageStruct.Code == helloMsg {
+			handleHello(p, c, messageBytes)
+			continue
+		}
+		if messageStruct.Code == errorMsg {
+			handleError(p, c, messageBytes)
+			continue
+		}
+		if !isHandshakeDone(p) {
+			logger.Warn("ignoring message before handshake", "code", messageStruct.Code, "peer", p.Address)
+			continue
+		}
 
-	ws, err := upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		log.Println(err)
-		return
-	}
-	webClientSocketLock.Lock()
-	webClientSocket = ws
-	webClientSocketLock.Unlock()
-	log.Println("Web client Connected")
+		// a message created by this node came back through another peer, it was already handled here
+		if messageStruct.Origin == nodeId {
+			logger.Debug("ignoring message originating from this node", "code", messageStruct.Code, "peer", p.Address)
+			continue
+		}
+		if messageStruct.Origin == "" {
+			messageStruct.Origin = p.NodeId
+		}
 
-	sendUpdateToWebClient()
+		handleMessage(p, c, messageStruct.Code, messageStruct.Origin, messageBytes)
+	}
 }
 
 // P2pEndpoint accepts a bidirectional connection from a peer
 func P2pEndpoint(w http.ResponseWriter, r *http.Request) {
 	upgrader.CheckOrigin = func(r *http.Request) bool { return true }
 
+	if isClosing() {
+		http.Error(w, ErrClosing.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
 	ws, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Println(err)
+		logger.Warn("failed to upgrade peer connection", "peer", r.RemoteAddr, "err", err)
 		return
 	}
 
-	peerSocketListLock.Lock()
-	peers = append(peers, ws)
-	peerSocketListLock.Unlock()
-
-	log.Println("Peer connected")
+	if !hasFreeSlot(inbound) {
+		logger.Warn("rejecting peer", "peer", ws.RemoteAddr().String(), "err", errInboundLimit)
+		rejectConnection(ws, errInboundLimit.Error())
+		return
+	}
 
-	go reader(ws)
+	if err := sendHello(ws); err != nil {
+		logger.Warn("failed to send hello", "peer", ws.RemoteAddr().String(), "err", err)
+		ws.Close()
+		return
+	}
 
-	getLatestBlockMsgBytes, err := buildMessage(nil, getLatestBlockMsg)
+	p, err := addPeer(ws, ws.RemoteAddr().String(), inbound)
 	if err != nil {
-		log.Println(err)
+		logger.Warn("rejecting peer", "peer", ws.RemoteAddr().String(), "err", err)
+		rejectConnection(ws, err.Error())
+		return
 	}
 
-	go send(ws, getLatestBlockMsgBytes)
-
-	time.Sleep(500 * time.Millisecond)
+	logger.Info("peer connected", "peer", p.Address, "direction", "inbound")
 
-	go broadcast(nil, getTxPoolMsg)
+	// latest block and transaction pool are requested once the handshake is completed
+	go reader(p)
+	expectHandshake(p)
 }
 
 // AddPeer starts a bidirectional connection from a peer
+// a peer address is either a host:port pair or a full ws:// or wss:// url
+// the peer is reconnected automatically if the connection drops
+// ErrAlreadyConnected is returned if there already is a connection to this address
+// ErrOutboundLimit is returned if all outbound connection slots are used
 func AddPeer(peerAddress string) error {
-	ws, _, err := websocket.DefaultDialer.Dial(fmt.Sprintf("ws://%s/p2p", peerAddress), nil)
-	if err != nil {
+	if err := connectPeer(peerAddress); err != nil {
 		return err
 	}
+	rememberOutboundPeer(peerAddress)
+	return nil
+}
 
-	peerSocketListLock.Lock()
-	peers = append(peers, ws)
-	peerSocketListLock.Unlock()
+// connectPeer dials a peer and starts the handshake, followed by the usual exchange of latest block and transaction pool
+func connectPeer(peerAddress string) error {
+	if isClosing() {
+		return ErrClosing
+	}
+	if isConnectedAddress(peerAddress) {
+		return ErrAlreadyConnected
+	}
+	if !hasFreeSlot(outbound) {
+		return ErrOutboundLimit
+	}
 
-	log.Println("Peer Connected")
+	u, err := peerURL(peerAddress)
+	if err != nil {
+		return err
+	}
+	ws, _, err := dialer.Dial(u, nil)
+	if err != nil {
+		return err
+	}
 
-	go reader(ws)
+	if err := sendHello(ws); err != nil {
+		ws.Close()
+		return err
+	}
 
-	getLatestBlockMsgBytes, err := buildMessage(nil, getLatestBlockMsg)
+	p, err := addPeer(ws, peerAddress, outbound)
 	if err != nil {
-		log.Println(err)
+		ws.Close()
+		return err
 	}
 
-	go send(ws, getLatestBlockMsgBytes)
-
-	time.Sleep(500 * time.Millisecond)
+	logger.Info("peer connected", "peer", p.Address, "direction", "outbound")
 
-	go broadcast(nil, getTxPoolMsg)
+	// latest block and transaction pool are requested once the handshake is completed
+	go reader(p)
+	expectHandshake(p)
 
 	return nil
 }
@@ -0,0 +1,462 @@
+package p2p
+
+import (
+	"encoding/json"
+	"fmt"
+	"naivecoin/blockchain"
+	tx "naivecoin/transactions"
+	"naivecoin/txpool"
+	"naivecoin/utils"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestMain(m *testing.M) {
+	blockchain.SetNetwork(Network{})
+	txpool.RegisterListener(Network{}.HandlePoolEvent)
+	addBlockToChain = func(block blockchain.Block) error {
+		validatedBlocksLock.Lock()
+		validatedBlocks[block.Hash]++
+		validatedBlocksLock.Unlock()
+		return blockchain.AddBlockToChain(block)
+	}
+	replaceChain = func(blocks []blockchain.Block) error {
+		validatedBlocksLock.Lock()
+		replacedChains++
+		validatedBlocksLock.Unlock()
+		return blockchain.ReplaceChain(blocks)
+	}
+	os.Exit(m.Run())
+}
+
+// validatedBlocks counts how many times each block received from peers was validated,
+// replacedChains how many received chains were validated as a whole
+var validatedBlocks map[string]int = map[string]int{}
+var replacedChains int
+var validatedBlocksLock sync.Mutex
+
+// countReplacedChains returns how many received chains were validated as a whole
+func countReplacedChains() int {
+	validatedBlocksLock.Lock()
+	defer validatedBlocksLock.Unlock()
+	return replacedChains
+}
+
+// countValidations returns how many times a block with a given hash was validated
+func countValidations(hash string) int {
+	validatedBlocksLock.Lock()
+	defer validatedBlocksLock.Unlock()
+	return validatedBlocks[hash]
+}
+
+// testWaitTimeout is how long a test waits for a node to react to a message
+const testWaitTimeout time.Duration = 10 * time.Second
+
+// waitFor polls a condition until it holds, failing the test if it doesn't in time
+func waitFor(tb testing.TB, what string, condition func() bool) {
+	var deadline time.Time = time.Now().Add(testWaitTimeout)
+	for !condition() {
+		if time.Now().After(deadline) {
+			tb.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// startNode serves this node's p2p endpoint, peers connected during a test are closed when it ends
+func startNode(tb testing.TB) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(P2pEndpoint))
+	tb.Cleanup(func() {
+		peerSocketListLock.Lock()
+		var toClose []*Peer = append([]*Peer{}, peers...)
+		peerSocketListLock.Unlock()
+		for _, p := range toClose {
+			closePeer(p, websocket.CloseNormalClosure, "test finished")
+		}
+		server.Close()
+	})
+	return server
+}
+
+// testMessage is a message received by a test peer
+type testMessage struct {
+	Code   string
+	Origin string
+	Data   json.RawMessage
+}
+
+// testPeer stands in for another node connected to this one, it speaks JSON only
+// messages it receives are recorded unless it is stalled, a stalled peer never reads
+type testPeer struct {
+	conn     *websocket.Conn
+	nodeId   string
+	lock     sync.Mutex
+	received []testMessage
+	closeErr error
+}
+
+// dialTestPeer connects a test peer to a node and completes the handshake
+func dialTestPeer(tb testing.TB, server *httptest.Server, stalled bool) *testPeer {
+	tp := connectTestPeer(tb, server, newNodeId(), stalled)
+	waitFor(tb, "handshake", func() bool {
+		return tp.peer() != nil
+	})
+	return tp
+}
+
+// connectTestPeer connects a test peer with a given node id to a node and sends its HELLO without waiting for the handshake
+func connectTestPeer(tb testing.TB, server *httptest.Server, nodeId_ string, stalled bool) *testPeer {
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+p2pPath, nil)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tp := &testPeer{conn: conn, nodeId: nodeId_}
+	tb.Cleanup(func() {
+		conn.Close()
+	})
+	if err := tp.hello(); err != nil {
+		tb.Fatal(err)
+	}
+	if !stalled {
+		go tp.read()
+	}
+	return tp
+}
+
+// hello sends HELLO message of a test peer
+func (tp *testPeer) hello() error {
+	return tp.write(tp.nodeId, helloMsg, helloData{
+		Version:     protocolVersion,
+		GenesisHash: blockchain.GenesisBlock.Hash,
+		NodeId:      tp.nodeId,
+		Encodings:   []string{jsonCodec.name},
+	})
+}
+
+// send sends a message created by a test peer
+func (tp *testPeer) send(tb testing.TB, code string, data interface{}) {
+	tp.sendFrom(tb, tp.nodeId, code, data)
+}
+
+// sendFrom sends a message originating from a given node, as if a test peer relayed it
+func (tp *testPeer) sendFrom(tb testing.TB, origin string, code string, data interface{}) {
+	if err := tp.write(origin, code, data); err != nil {
+		tb.Fatal(err)
+	}
+}
+
+// write writes a JSON message originating from a given node to the connection of a test peer
+func (tp *testPeer) write(origin string, code string, data interface{}) error {
+	dataBytes, err := json.Marshal(Message{Code: code, Origin: origin, Data: data})
+	if err != nil {
+		return err
+	}
+	tp.lock.Lock()
+	defer tp.lock.Unlock()
+	return tp.conn.WriteMessage(websocket.TextMessage, dataBytes)
+}
+
+// read records messages received by a test peer until its connection is closed
+func (tp *testPeer) read() {
+	for {
+		_, messageBytes, err := tp.conn.ReadMessage()
+		if err != nil {
+			tp.lock.Lock()
+			tp.closeErr = err
+			tp.lock.Unlock()
+			return
+		}
+		var message testMessage
+		if err := json.Unmarshal(messageBytes, &message); err != nil {
+			continue
+		}
+		tp.lock.Lock()
+		tp.received = append(tp.received, message)
+		tp.lock.Unlock()
+	}
+}
+
+// messages returns messages with a given code received by a test peer
+func (tp *testPeer) messages(code string) []testMessage {
+	tp.lock.Lock()
+	defer tp.lock.Unlock()
+	var result []testMessage = []testMessage{}
+	for _, message := range tp.received {
+		if message.Code == code {
+			result = append(result, message)
+		}
+	}
+	return result
+}
+
+// closedAsDuplicate checks if this node closed the connection of a test peer as a duplicate
+func (tp *testPeer) closedAsDuplicate() bool {
+	tp.lock.Lock()
+	defer tp.lock.Unlock()
+	return isDuplicateClose(tp.closeErr)
+}
+
+// peer returns the peer this node holds for a test peer once the handshake is completed, nil otherwise
+func (tp *testPeer) peer() *Peer {
+	peerSocketListLock.Lock()
+	defer peerSocketListLock.Unlock()
+	for _, p := range peers {
+		if p.handshakeDone && p.NodeId == tp.nodeId {
+			return p
+		}
+	}
+	return nil
+}
+
+// sync waits until this node has handled all messages sent by a test peer so far
+// messages are handled in order, so once the latest block requested last is received, everything sent before was handled
+// and whatever the node queued for other peers meanwhile is queued ahead of their own sync replies
+func (tp *testPeer) sync(tb testing.TB) {
+	var count int = len(tp.messages(blockchainMsg))
+	tp.send(tb, getLatestBlockMsg, nil)
+	waitFor(tb, "latest block", func() bool {
+		return len(tp.messages(blockchainMsg)) > count
+	})
+}
+
+// testPayload is broadcast to peers by tests, it is large enough to fill socket buffers quickly
+type testPayload struct {
+	Sequence int
+	Padding  string
+}
+
+func TestSlowPeerDoesNotBlockBroadcast(test *testing.T) {
+	server := startNode(test)
+	fast := dialTestPeer(test, server, false)
+	stalled := dialTestPeer(test, server, true)
+
+	// the stalled peer never reads, once socket buffers are full its queue fills up and it is disconnected
+	// meanwhile the fast peer keeps receiving every message in order
+	const batches, batchSize int = 8, sendQueueSize / 2
+	var padding string = strings.Repeat("x", 16*1024)
+	var sent int = 0
+	var started time.Time = time.Now()
+	for batch := 0; batch < batches; batch++ {
+		for n := 0; n < batchSize; n++ {
+			broadcast(testPayload{Sequence: sent, Padding: padding}, walletInfoMsg)
+			sent++
+		}
+		waitFor(test, "fast peer to receive a batch", func() bool {
+			return len(fast.messages(walletInfoMsg)) == sent
+		})
+	}
+	if elapsed := time.Since(started); elapsed >= writeTimeout {
+		test.Fatalf("broadcast to the fast peer took %s, it must not wait for the stalled peer", elapsed)
+	}
+
+	for n, message := range fast.messages(walletInfoMsg) {
+		var payload testPayload
+		if err := json.Unmarshal(message.Data, &payload); err != nil {
+			test.Fatal(err)
+		}
+		if payload.Sequence != n {
+			test.Fatalf("message %d received as %d, write order must be kept", payload.Sequence, n)
+		}
+	}
+	waitFor(test, "stalled peer to be disconnected", func() bool {
+		return stalled.peer() == nil
+	})
+	if fast.peer() == nil {
+		test.Fatal("fast peer must stay connected")
+	}
+}
+
+// testKeyAddress returns a private key derived from a number and the full public key address it owns
+func testKeyAddress(tb testing.TB, n int) (string, string) {
+	var privateKey string = fmt.Sprintf("%064x", n)
+	publicKey, err := utils.GetPublicKey(privateKey)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	address, err := utils.Base58Encode(publicKey)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return privateKey, address
+}
+
+// testChain returns count blocks mined on a given block paying an address, hashed as blocks of the default chain parameters are,
+// blocks are 10 seconds apart, so the difficulty of the chain they extend is kept
+func testChain(tb testing.TB, prevBlock blockchain.Block, count int, address string) []blockchain.Block {
+	var blocks []blockchain.Block = []blockchain.Block{}
+	for n := 0; n < count; n++ {
+		var index int = prevBlock.Fields.Index + 1
+		prevBlock = mineTestBlock(tb, blockchain.BlockFields{
+			Index:        index,
+			PrevHash:     prevBlock.Hash,
+			Ts:           prevBlock.Fields.Ts + 10,
+			Transactions: []tx.Transaction{tx.GetCoinbaseTransaction(address, index, prevBlock.Hash)},
+			Difficulty:   prevBlock.Fields.Difficulty,
+		})
+		blocks = append(blocks, prevBlock)
+	}
+	return blocks
+}
+
+// mineTestBlock returns a block of given fields with the first nonce whose hash meets their difficulty
+func mineTestBlock(tb testing.TB, fields blockchain.BlockFields) blockchain.Block {
+	for {
+		var hash string = utils.Hash(fields)
+		hashInBinary, err := utils.HexToBin(hash)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		if strings.HasPrefix(hashInBinary, strings.Repeat("0", int(fields.Difficulty))) {
+			return blockchain.Block{Fields: fields, Hash: hash}
+		}
+		fields.Nonce++
+	}
+}
+
+// checkLinked checks that blocks follow each other
+func checkLinked(blocks []blockchain.Block) error {
+	for n := 1; n < len(blocks); n++ {
+		if blocks[n].Fields.PrevHash != blocks[n-1].Hash || blocks[n].Fields.Index != blocks[n-1].Fields.Index+1 {
+			return fmt.Errorf("block %d does not follow block %d", blocks[n].Fields.Index, blocks[n-1].Fields.Index)
+		}
+	}
+	return nil
+}
+
+// TestApiReadsDuringReceivedBlocks reads the chain the way api handlers do while received blocks replace and extend it,
+// run with -race to check reads don't race with writes of the p2p reader
+func TestApiReadsDuringReceivedBlocks(test *testing.T) {
+	server := startNode(test)
+	a := dialTestPeer(test, server, false)
+	_, address := testKeyAddress(test, 391)
+
+	// two forks of the genesis block, both longer than the chain of other tests, the second one with more work
+	var forkA []blockchain.Block = append([]blockchain.Block{blockchain.GenesisBlock}, testChain(test, blockchain.GenesisBlock, 60, address)...)
+	var forkB []blockchain.Block = append(append([]blockchain.Block{}, forkA[:20]...), testChain(test, forkA[19], 50, address)...)
+	var extension []blockchain.Block = testChain(test, forkB[len(forkB)-1], 6, address)
+
+	done := make(chan struct{})
+	errs := make(chan error, 4)
+	var readers sync.WaitGroup
+	var read = func(check func() error) {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				if err := check(); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	read(func() error {
+		var snapshot blockchain.ChainSnapshot = blockchain.GetChainSnapshot()
+		var tip blockchain.Block = snapshot.Blocks[len(snapshot.Blocks)-1]
+		if tip.Hash != snapshot.TipHash || tip.Fields.Index != snapshot.Height {
+			return fmt.Errorf("snapshot tip %d %s does not match its height %d and hash %s", tip.Fields.Index, tip.Hash, snapshot.Height, snapshot.TipHash)
+		}
+		return checkLinked(snapshot.Blocks)
+	})
+	read(func() error {
+		if err := checkLinked(blockchain.GetBlockChain()); err != nil {
+			return err
+		}
+		return checkLinked(blockchain.GetBlocksRange(5, 40))
+	})
+	read(func() error {
+		var latest blockchain.Block = blockchain.GetLatestBlock()
+		blockchain.GetBlockByHash(latest.Hash)
+		blockchain.GetTransaction(latest.Fields.Transactions[0].Id)
+		blockchain.HasBlock(forkA[len(forkA)-1].Hash)
+		blockchain.GetDifficultyForecast()
+		return nil
+	})
+	read(func() error {
+		var balance blockchain.AddressBalance = blockchain.GetBalanceForAddress(address)
+		var unspent float64 = 0
+		for _, unspentTxOut := range blockchain.GetUnspentTxOutsForAddress(address) {
+			unspent += unspentTxOut.Amount
+		}
+		blockchain.GetUnspentTxOuts()
+		if balance.Balance < 0 || unspent < 0 {
+			return fmt.Errorf("negative balance of %s", address)
+		}
+		return nil
+	})
+
+	// the first fork replaces the chain, the second one replaces it again, it is extended by a suffix and by a single block
+	a.send(test, blockchainMsg, forkA)
+	a.send(test, blockchainMsg, forkB)
+	a.send(test, blockchainMsg, append([]blockchain.Block{forkB[len(forkB)-1]}, extension[:5]...))
+	a.send(test, blockchainMsg, extension[5:])
+	a.sync(test)
+	close(done)
+	readers.Wait()
+
+	select {
+	case err := <-errs:
+		test.Fatal(err)
+	default:
+	}
+	if tip := blockchain.GetLatestBlock(); tip.Hash != extension[5].Hash {
+		test.Fatalf("expected the extended second fork, got tip %d %s", tip.Fields.Index, tip.Hash)
+	}
+	if err := checkLinked(blockchain.GetBlockChain()); err != nil {
+		test.Fatal(err)
+	}
+}
+
+func TestExtensionOfLongChainAppended(test *testing.T) {
+	server := startNode(test)
+	a := dialTestPeer(test, server, false)
+	_, address := testKeyAddress(test, 394)
+
+	// a chain of 1000 blocks of more work than the chain of other tests, extended by 5 blocks twice
+	var chain []blockchain.Block = append([]blockchain.Block{blockchain.GenesisBlock}, testChain(test, blockchain.GenesisBlock, 1000, address)...)
+	if err := blockchain.ReplaceChain(chain); err != nil {
+		test.Fatal(err)
+	}
+	var first []blockchain.Block = testChain(test, chain[len(chain)-1], 5, address)
+	var second []blockchain.Block = testChain(test, first[len(first)-1], 5, address)
+	var replacedBefore int = countReplacedChains()
+
+	// the extension alone, and the whole extended chain, as a peer answering a request for all blocks sends it
+	a.send(test, blockchainMsg, first)
+	a.send(test, blockchainMsg, append(append(append([]blockchain.Block{}, chain...), first...), second...))
+	a.sync(test)
+
+	if tip := blockchain.GetLatestBlock(); tip.Hash != second[len(second)-1].Hash {
+		test.Fatalf("expected tip %d %s, got %d %s", second[len(second)-1].Fields.Index, second[len(second)-1].Hash, tip.Fields.Index, tip.Hash)
+	}
+	if replaced := countReplacedChains() - replacedBefore; replaced != 0 {
+		test.Fatalf("blocks extending the chain were validated as a whole chain %d times", replaced)
+	}
+	if length := len(blockchain.GetBlockChain()); length != 1011 {
+		test.Fatalf("expected 1011 blocks, got %d", length)
+	}
+
+	// a longer fork does not extend the chain, so it is validated as a whole
+	_, forkAddress := testKeyAddress(test, 3940)
+	var fork []blockchain.Block = append(append([]blockchain.Block{}, chain...), testChain(test, chain[len(chain)-1], 11, forkAddress)...)
+	a.send(test, blockchainMsg, fork)
+	a.sync(test)
+	if replaced := countReplacedChains() - replacedBefore; replaced != 1 {
+		test.Fatalf("expected the fork to be validated as a whole once, got %d", replaced)
+	}
+	if tip := blockchain.GetLatestBlock(); tip.Hash != fork[len(fork)-1].Hash {
+		test.Fatalf("expected the fork to replace the chain, got tip %d %s", tip.Fields.Index, tip.Hash)
+	}
+}
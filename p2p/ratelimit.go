@@ -0,0 +1,68 @@
+package p2p
+
+import (
+	"fmt"
+	"naivecoin/utils"
+	"time"
+)
+
+// maxRateLimitDelay is the longest a message from a peer over its budget is delayed
+// messages that would have to wait longer are dropped and the peer's misbehavior score is increased
+const maxRateLimitDelay time.Duration = 5 * time.Second
+
+// rateLimitScore is added to the misbehavior score of a peer for every dropped message
+const rateLimitScore int = 10
+
+// RateBucket is a token bucket limiting the number of messages of one kind accepted from a peer
+type RateBucket = utils.RateBucket
+
+// PeerRateLimit holds separate budgets for cheap messages and messages that are expensive to answer
+type PeerRateLimit struct {
+	Cheap     RateBucket
+	Expensive RateBucket
+}
+
+// rate limits applied to new peers
+var cheapRate, cheapBurst float64 = 20, 50
+var expensiveRate, expensiveBurst float64 = 0.2, 3
+
+// SetRateLimits sets the number of messages per second and the burst size accepted from a single peer,
+// separately for cheap messages and for messages that are expensive to answer, e.g. full chain requests
+func SetRateLimits(cheapRate_ float64, cheapBurst_ float64, expensiveRate_ float64, expensiveBurst_ float64) {
+	cheapRate, cheapBurst = cheapRate_, cheapBurst_
+	expensiveRate, expensiveBurst = expensiveRate_, expensiveBurst_
+}
+
+// newPeerRateLimit creates rate limits for a new peer
+func newPeerRateLimit() PeerRateLimit {
+	return PeerRateLimit{
+		Cheap:     utils.NewRateBucket(cheapRate, cheapBurst),
+		Expensive: utils.NewRateBucket(expensiveRate, expensiveBurst),
+	}
+}
+
+// isExpensiveMessage checks if answering a message with a given code requires serializing large data
+func isExpensiveMessage(code string) bool {
+	return code == getAllBlocksMsg || code == getTxPoolMsg
+}
+
+// rateLimit delays handling of a message from a peer that is over its budget
+// returns false if the message must be dropped, the peer's misbehavior score is increased in that case
+func rateLimit(p *Peer, code string) bool {
+	peerSocketListLock.Lock()
+	var bucket *RateBucket = &p.RateLimit.Cheap
+	if isExpensiveMessage(code) {
+		bucket = &p.RateLimit.Expensive
+	}
+	wait, ok := bucket.Take(time.Now(), maxRateLimitDelay)
+	peerSocketListLock.Unlock()
+
+	if !ok {
+		rejectMessage(p, code, rateLimitScore, fmt.Sprintf("rate limit exceeded for %s", code))
+		return false
+	}
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+	return true
+}
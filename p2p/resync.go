@@ -0,0 +1,118 @@
+package p2p
+
+import (
+	"context"
+	"errors"
+	"naivecoin/blockchain"
+	"sync/atomic"
+	"time"
+)
+
+// resyncPollInterval is how often a resync checks for peer replies and the end of catch-up
+const resyncPollInterval time.Duration = 100 * time.Millisecond
+
+// resyncReplyTimeout is how long a resync waits for peers to reply with their latest blocks
+const resyncReplyTimeout time.Duration = 10 * time.Second
+
+// ErrResyncInProgress is returned when a resync is requested while another one is running
+var ErrResyncInProgress = errors.New("resync already in progress")
+
+// resyncing is set to 1 while a resync is running
+var resyncing int32
+
+// ResyncResult describes a completed resync
+// Adopted is set if the tip changed to a block received from peers, CatchingUp if blocks were still being downloaded when it returned
+type ResyncResult struct {
+	PeersQueried int
+	PeersReplied int
+	Adopted      bool
+	CatchingUp   bool
+	Height       int
+	TipHash      string
+}
+
+// IsResyncing checks if a resync is running
+func IsResyncing() bool {
+	return atomic.LoadInt32(&resyncing) == 1
+}
+
+// Resync asks every connected peer for its latest block, a peer with a higher tip is caught up with
+// the same way as a tip received on connect: by range download or chain replacement
+// it returns once catch-up is completed or the context is done
+func Resync(ctx context.Context) (ResyncResult, error) {
+	if !atomic.CompareAndSwapInt32(&resyncing, 0, 1) {
+		return ResyncResult{}, ErrResyncInProgress
+	}
+	defer atomic.StoreInt32(&resyncing, 0)
+
+	var tipBefore blockchain.Block = blockchain.GetLatestBlock()
+
+	var queried []*Peer = []*Peer{}
+	peerSocketListLock.Lock()
+	for _, p := range peers {
+		if p.handshakeDone {
+			p.awaitingResync = true
+			queried = append(queried, p)
+		}
+	}
+	peerSocketListLock.Unlock()
+	logger.Info("resyncing", "peers", len(queried), "height", tipBefore.Fields.Index)
+	for _, p := range queried {
+		send(p, nil, getLatestBlockMsg)
+	}
+
+	replyCtx, cancel := context.WithTimeout(ctx, resyncReplyTimeout)
+	defer cancel()
+	for countAwaitingResync(queried) > 0 && sleepContext(replyCtx, resyncPollInterval) {
+	}
+	var replied int = len(queried) - countAwaitingResync(queried)
+	for (IsSyncing() || blockchain.IsReplacingChain()) && sleepContext(ctx, resyncPollInterval) {
+	}
+
+	var tipAfter blockchain.Block = blockchain.GetLatestBlock()
+	var result ResyncResult = ResyncResult{
+		PeersQueried: len(queried),
+		PeersReplied: replied,
+		Adopted:      tipAfter.Hash != tipBefore.Hash && tipAfter.Fields.Index > tipBefore.Fields.Index,
+		CatchingUp:   IsSyncing() || blockchain.IsReplacingChain(),
+		Height:       tipAfter.Fields.Index,
+		TipHash:      tipAfter.Hash,
+	}
+	logger.Info("resync finished", "replied", replied, "adopted", result.Adopted, "height", result.Height)
+	return result, nil
+}
+
+// countAwaitingResync returns the number of queried peers that are connected and have not replied yet
+func countAwaitingResync(queried []*Peer) int {
+	var awaiting int = 0
+	for _, p := range queried {
+		if !findConnectedPeer(p) {
+			continue
+		}
+		peerSocketListLock.Lock()
+		if p.awaitingResync {
+			awaiting++
+		}
+		peerSocketListLock.Unlock()
+	}
+	return awaiting
+}
+
+// takeAwaitingResync checks if a peer was asked for its latest block by a resync and clears the flag
+func takeAwaitingResync(p *Peer) bool {
+	peerSocketListLock.Lock()
+	defer peerSocketListLock.Unlock()
+	var awaiting bool = p.awaitingResync
+	p.awaitingResync = false
+	return awaiting
+}
+
+// sleepContext waits for a given duration, it returns false if the context is done first
+func sleepContext(ctx context.Context, duration time.Duration) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(duration):
+		return true
+	}
+}
@@ -0,0 +1,104 @@
+package p2p
+
+import (
+	"container/list"
+	"sync"
+)
+
+// maxSeenTransactions limits the number of transaction ids remembered by seenTransactions
+const maxSeenTransactions int = 10000
+
+// maxSeenBlocks limits the number of block hashes remembered by seenBlocks
+const maxSeenBlocks int = 1024
+
+// seenEntry records where an item came from, whether it was processed and whether it was relayed to other peers
+// source is the peer the item was received from, nil for items created by this node
+// origin is the id of the node that created the item
+type seenEntry struct {
+	id        string
+	source    *Peer
+	origin    string
+	processed bool
+	relayed   bool
+}
+
+// seenCache is a bounded LRU of recently seen item ids, the least recently seen ids are forgotten first
+type seenCache struct {
+	lock    sync.Mutex
+	maxSize int
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+// seenTransactions holds ids of transactions recently received from peers or relayed to them
+var seenTransactions *seenCache = newSeenCache(maxSeenTransactions)
+
+// seenBlocks holds hashes of blocks recently received from peers, with the nodes they originate from
+var seenBlocks *seenCache = newSeenCache(maxSeenBlocks)
+
+// newSeenCache creates an empty cache holding at most maxSize ids
+func newSeenCache(maxSize int) *seenCache {
+	return &seenCache{
+		maxSize: maxSize,
+		order:   list.New(),
+		entries: map[string]*list.Element{},
+	}
+}
+
+// add records an id received from a given source and originating from a given node, returns false if the id was already seen
+func (c *seenCache) add(id string, source *Peer, origin string) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if element, found := c.entries[id]; found {
+		c.order.MoveToFront(element)
+		return false
+	}
+	c.push(&seenEntry{id: id, source: source, origin: origin})
+	return true
+}
+
+// push adds a new entry and forgets the least recently seen one if the cache is full, c.lock must be held
+func (c *seenCache) push(entry *seenEntry) *list.Element {
+	element := c.order.PushFront(entry)
+	c.entries[entry.id] = element
+	if c.order.Len() > c.maxSize {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*seenEntry).id)
+	}
+	return element
+}
+
+// markRelayed marks an id as relayed and returns the peer it came from and the node it originates from
+// ids not seen before are created by this node; ok is false if the id was already relayed
+func (c *seenCache) markRelayed(id string) (source *Peer, origin string, ok bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	element, found := c.entries[id]
+	if !found {
+		element = c.push(&seenEntry{id: id, origin: nodeId})
+	}
+	var entry *seenEntry = element.Value.(*seenEntry)
+	if entry.relayed {
+		return nil, "", false
+	}
+	entry.relayed = true
+	return entry.source, entry.origin, true
+}
+
+// markProcessed marks an id received from a given source and originating from a given node as processed
+// the source and origin recorded when the id was first seen are kept; returns false if the id was already processed
+func (c *seenCache) markProcessed(id string, source *Peer, origin string) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	element, found := c.entries[id]
+	if !found {
+		element = c.push(&seenEntry{id: id, source: source, origin: origin})
+	}
+	var entry *seenEntry = element.Value.(*seenEntry)
+	if entry.processed {
+		return false
+	}
+	entry.processed = true
+	return true
+}
@@ -0,0 +1,119 @@
+package p2p
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"naivecoin/blockchain"
+	tx "naivecoin/transactions"
+	"testing"
+)
+
+// testSpendableTransaction mines a block paying to a fresh key and returns a transaction spending its coinbase
+func testSpendableTransaction(tb testing.TB, n int) tx.Transaction {
+	privateKey, address := testKeyAddress(tb, n)
+	block, err := blockchain.ProduceNextBlock(context.Background(), address)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	var coinbase tx.Transaction = block.Fields.Transactions[0]
+	var spent []tx.UnspentTxOut = []tx.UnspentTxOut{{
+		TxOutId:    coinbase.Id,
+		TxOutIndex: 0,
+		Address:    address,
+		Amount:     coinbase.TxOuts[0].Amount,
+	}}
+	var transaction tx.Transaction = tx.Transaction{
+		Version: tx.CurrentTxVersion,
+		TxIns:   tx.TxInCollection{{TxOutId: coinbase.Id, TxOutIndex: 0}},
+		TxOuts:  tx.TxOutCollection{{Address: address, Amount: coinbase.TxOuts[0].Amount}},
+	}
+	transaction.Id = tx.GetTransactionId(transaction)
+	signature, err := tx.SignTxIn(transaction, 0, privateKey, spent)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	transaction.TxIns[0].Signature = signature
+	return transaction
+}
+
+// countTransactionMessages counts TX_POOL messages received by a test peer holding a transaction with a given id
+func countTransactionMessages(tb testing.TB, tp *testPeer, txId string) int {
+	var count int = 0
+	for _, message := range tp.messages(txPoolMsg) {
+		var transactions []tx.Transaction
+		if err := json.Unmarshal(message.Data, &transactions); err != nil {
+			tb.Fatal(err)
+		}
+		for _, transaction := range transactions {
+			if transaction.Id == txId {
+				count++
+			}
+		}
+	}
+	return count
+}
+
+func TestTransactionRelayedOnce(test *testing.T) {
+	var transaction tx.Transaction = testSpendableTransaction(test, 331)
+	server := startNode(test)
+
+	// this node sits between two other nodes: a sends a transaction, which this node relays to c only
+	a := dialTestPeer(test, server, false)
+	c := dialTestPeer(test, server, false)
+	a.send(test, txPoolMsg, []tx.Transaction{transaction})
+	waitFor(test, "transaction to be relayed", func() bool {
+		return countTransactionMessages(test, c, transaction.Id) > 0
+	})
+	if message := c.messages(txPoolMsg)[0]; message.Origin != a.nodeId {
+		test.Fatalf("relayed transaction must keep its origin %s, got %s", a.nodeId, message.Origin)
+	}
+
+	// c relays the transaction back as gossip does, and a sends it again, neither copy is relayed any further
+	c.sendFrom(test, a.nodeId, txPoolMsg, []tx.Transaction{transaction})
+	a.send(test, txPoolMsg, []tx.Transaction{transaction})
+	a.sync(test)
+	c.sync(test)
+
+	if count := countTransactionMessages(test, c, transaction.Id); count != 1 {
+		test.Fatalf("transaction relayed to c %d times, expected once", count)
+	}
+	if count := countTransactionMessages(test, a, transaction.Id); count != 0 {
+		test.Fatalf("transaction relayed back to its source %d times", count)
+	}
+}
+
+func TestBlockValidatedOnce(test *testing.T) {
+	server := startNode(test)
+	a := dialTestPeer(test, server, false)
+	c := dialTestPeer(test, server, false)
+
+	// a block extending the chain, its validation fails, but it must not be tried again either way
+	var tip blockchain.Block = blockchain.GetLatestBlock()
+	var index int = tip.Fields.Index + 1
+	var block blockchain.Block = blockchain.Block{
+		Fields: blockchain.BlockFields{
+			Index:        index,
+			PrevHash:     tip.Hash,
+			Ts:           tip.Fields.Ts + 10,
+			Transactions: []tx.Transaction{tx.GetCoinbaseTransaction(blockchain.GenesisTransaction.TxOuts[0].Address, index, tip.Hash)},
+		},
+		Hash: fmt.Sprintf("%064x", 340),
+	}
+
+	// both neighbours forward the block, a forwards it twice and c announces it as well
+	a.send(test, blockchainMsg, []blockchain.Block{block})
+	c.sendFrom(test, a.nodeId, blockchainMsg, []blockchain.Block{block})
+	a.send(test, blockchainMsg, []blockchain.Block{block})
+	c.send(test, invMsg, inventoryItem{Height: index, Hash: block.Hash})
+	a.sync(test)
+	c.sync(test)
+
+	if count := countValidations(block.Hash); count != 1 {
+		test.Fatalf("block validated %d times, expected once", count)
+	}
+	if requests := c.messages(getDataMsg); len(requests) != 0 {
+		test.Fatalf("block already received must not be requested, got %d requests", len(requests))
+	}
+}
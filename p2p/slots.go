@@ -0,0 +1,69 @@
+package p2p
+
+import (
+	"errors"
+)
+
+// limits on the number of connected peers in each direction
+var maxInboundPeers int = 32
+var maxOutboundPeers int = 8
+
+// ErrOutboundLimit is returned when dialing a peer while all outbound slots are used
+var ErrOutboundLimit = errors.New("outbound peer limit reached")
+
+// errInboundLimit is returned when accepting a peer while all inbound slots are used
+var errInboundLimit = errors.New("too many peers")
+
+// SlotUsage describes how many connection slots in one direction are used
+type SlotUsage struct {
+	Used int
+	Max  int
+}
+
+// PeerSlots describes connection slot usage for inbound and outbound peers
+type PeerSlots struct {
+	Inbound  SlotUsage
+	Outbound SlotUsage
+}
+
+// SetPeerLimits sets the maximum number of inbound and outbound peers
+func SetPeerLimits(maxInbound int, maxOutbound int) {
+	maxInboundPeers = maxInbound
+	maxOutboundPeers = maxOutbound
+}
+
+// countPeers returns the number of connected peers in a given direction, peerSocketListLock must be held
+func countPeers(direction string) int {
+	var count int = 0
+	for _, p := range peers {
+		if p.Direction == direction {
+			count++
+		}
+	}
+	return count
+}
+
+// maxPeersFor returns the maximum number of peers in a given direction
+func maxPeersFor(direction string) int {
+	if direction == inbound {
+		return maxInboundPeers
+	}
+	return maxOutboundPeers
+}
+
+// hasFreeSlot checks if another peer can be connected in a given direction
+func hasFreeSlot(direction string) bool {
+	peerSocketListLock.Lock()
+	defer peerSocketListLock.Unlock()
+	return countPeers(direction) < maxPeersFor(direction)
+}
+
+// GetPeerSlots returns current connection slot usage
+func GetPeerSlots() PeerSlots {
+	peerSocketListLock.Lock()
+	defer peerSocketListLock.Unlock()
+	return PeerSlots{
+		Inbound:  SlotUsage{Used: countPeers(inbound), Max: maxInboundPeers},
+		Outbound: SlotUsage{Used: countPeers(outbound), Max: maxOutboundPeers},
+	}
+}
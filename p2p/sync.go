@@ -0,0 +1,245 @@
+package p2p
+
+import (
+	"fmt"
+	"naivecoin/blockchain"
+	"sync"
+	"time"
+)
+
+// message codes used to download the chain in chunks
+const (
+	getBlocksRangeMsg = "GET_BLOCKS_RANGE"
+	blocksRangeMsg    = "BLOCKS_RANGE"
+)
+
+// maxBlocksPerRange limits the number of blocks sent in a single BLOCKS_RANGE message
+const maxBlocksPerRange int = 200
+
+// maxAllBlocks limits the length of a chain sent in reply to GET_ALL_BLOCKS
+// longer chains are downloaded with GET_BLOCKS_RANGE
+const maxAllBlocks int = 1000
+
+// rangeSyncTimeout is how long to wait for a BLOCKS_RANGE reply before sync can be restarted with another peer
+const rangeSyncTimeout time.Duration = 30 * time.Second
+
+// blocksRangeRequest requests blocks with indices from FromIndex to ToIndex, inclusive
+type blocksRangeRequest struct {
+	FromIndex int
+	ToIndex   int
+}
+
+// rangeSyncState describes a chain download from a single peer
+// candidate holds a chain forking from the local one, it replaces the local chain once fully downloaded
+type rangeSyncState struct {
+	peer          *Peer
+	target        int
+	requestedFrom int
+	requestedTo   int
+	requestedAt   time.Time
+	candidate     []blockchain.Block
+}
+
+// rangeSync is the chain download in progress, nil if there is none
+var rangeSync *rangeSyncState
+var rangeSyncLock sync.Mutex
+
+// IsSyncing checks if the chain is being downloaded from a peer
+func IsSyncing() bool {
+	rangeSyncLock.Lock()
+	defer rangeSyncLock.Unlock()
+	return rangeSync != nil && time.Since(rangeSync.requestedAt) < rangeSyncTimeout
+}
+
+// unmarshalDtoToBlocksRangeRequest unmarshales dto to a GET_BLOCKS_RANGE request
+func unmarshalDtoToBlocksRangeRequest(c *codec, byteData []byte) (blocksRangeRequest, error) {
+	request := &blocksRangeRequest{}
+	if err := decodeStrict(c, byteData, request); err != nil {
+		return blocksRangeRequest{}, err
+	}
+	if request.FromIndex < 0 || request.ToIndex < request.FromIndex {
+		return blocksRangeRequest{}, fmt.Errorf("invalid blocks range %d-%d", request.FromIndex, request.ToIndex)
+	}
+	return *request, nil
+}
+
+// handleGetBlocksRange sends requested blocks to a peer, at most maxBlocksPerRange of them
+// the reply is empty if the chain is shorter than the requested range start
+func handleGetBlocksRange(p *Peer, request blocksRangeRequest) {
+	var toIndex int = request.ToIndex
+	if toIndex > request.FromIndex+maxBlocksPerRange-1 {
+		toIndex = request.FromIndex + maxBlocksPerRange - 1
+	}
+	send(p, blockchain.GetBlocksRange(request.FromIndex, toIndex), blocksRangeMsg)
+}
+
+// getAllBlocksReply returns the chain sent in reply to GET_ALL_BLOCKS
+// chains longer than maxAllBlocks are not sent, the latest block is sent instead, so that the peer syncs by range
+func getAllBlocksReply() []blockchain.Block {
+	var snapshot blockchain.ChainSnapshot = blockchain.GetChainSnapshot()
+	if len(snapshot.Blocks) > maxAllBlocks {
+		return []blockchain.Block{snapshot.Blocks[len(snapshot.Blocks)-1]}
+	}
+	return snapshot.Blocks
+}
+
+// startRangeSync starts downloading blocks from a peer up to a given height
+// a download already in progress with another peer is not interrupted unless it timed out
+func startRangeSync(p *Peer, target int) {
+	rangeSyncLock.Lock()
+	defer rangeSyncLock.Unlock()
+	if rangeSync != nil && time.Since(rangeSync.requestedAt) < rangeSyncTimeout && findConnectedPeer(rangeSync.peer) {
+		if rangeSync.peer == p && target > rangeSync.target {
+			rangeSync.target = target
+		}
+		return
+	}
+
+	var fromIndex int = blockchain.GetLatestBlock().Fields.Index + 1
+
+	logger.Info("syncing blocks", "from", fromIndex, "to", target, "peer", p.Address)
+	rangeSync = &rangeSyncState{peer: p, target: target}
+	requestRange(fromIndex)
+}
+
+// requestRange requests the next chunk of blocks starting at a given index, rangeSyncLock must be held
+func requestRange(fromIndex int) {
+	var toIndex int = fromIndex + maxBlocksPerRange - 1
+	if toIndex > rangeSync.target {
+		toIndex = rangeSync.target
+	}
+	rangeSync.requestedFrom = fromIndex
+	rangeSync.requestedTo = toIndex
+	rangeSync.requestedAt = time.Now()
+
+	send(rangeSync.peer, blocksRangeRequest{FromIndex: fromIndex, ToIndex: toIndex}, getBlocksRangeMsg)
+}
+
+// findConnectedPeer checks if a given peer is still connected
+func findConnectedPeer(p *Peer) bool {
+	peerSocketListLock.Lock()
+	defer peerSocketListLock.Unlock()
+	for _, peer := range peers {
+		if peer == p {
+			return true
+		}
+	}
+	return false
+}
+
+// isContiguousRange checks that blocks have consecutive indices starting at a given index
+func isContiguousRange(blocks []blockchain.Block, fromIndex int) bool {
+	for n := 0; n < len(blocks); n++ {
+		if blocks[n].Fields.Index != fromIndex+n {
+			return false
+		}
+	}
+	return true
+}
+
+// handleBlocksRange handles a chunk of blocks downloaded from the sync peer
+// blocks extending the local chain are appended right away, blocks forking from it are collected
+// and replace the local chain once the download is completed; if the chunk doesn't connect to the local chain,
+// an earlier range is requested to find the fork point
+func handleBlocksRange(p *Peer, blocks []blockchain.Block) {
+	rangeSyncLock.Lock()
+	defer rangeSyncLock.Unlock()
+	if rangeSync == nil || rangeSync.peer != p {
+		logger.Warn("ignoring unrequested blocks range", "peer", p.Address)
+		return
+	}
+
+	if len(blocks) > rangeSync.requestedTo-rangeSync.requestedFrom+1 || !isContiguousRange(blocks, rangeSync.requestedFrom) {
+		rangeSync = nil
+		rejectMessage(p, blocksRangeMsg, invalidDataScore, "blocks range does not match the request")
+		return
+	}
+	if len(blocks) == 0 {
+		finishRangeSync()
+		return
+	}
+	markBlocksKnown(p, blocks)
+	updatePeerHeight(p, blocks[len(blocks)-1].Fields.Index, blocks[len(blocks)-1].Hash)
+
+	err := applyBlocksRange(blocks)
+	if err != nil {
+		logger.Warn("sync failed", "peer", p.Address, "err", err)
+		sendError(p, blocksRangeMsg, err.Error())
+		rangeSync = nil
+		return
+	}
+	if rangeSync.requestedFrom != blocks[0].Fields.Index {
+		// an earlier range was requested to find the fork point
+		return
+	}
+
+	var lastIndex int = blocks[len(blocks)-1].Fields.Index
+	if lastIndex >= rangeSync.target || lastIndex < rangeSync.requestedTo {
+		finishRangeSync()
+		return
+	}
+	requestRange(lastIndex + 1)
+}
+
+// applyBlocksRange appends a chunk to the local chain or to the candidate chain
+// rangeSyncLock must be held, blocks are appended only if they still extend the chain
+func applyBlocksRange(blocks []blockchain.Block) error {
+	if rangeSync.candidate != nil {
+		if blocks[0].Fields.PrevHash != rangeSync.candidate[len(rangeSync.candidate)-1].Hash {
+			return fmt.Errorf("block %d does not extend the downloaded chain", blocks[0].Fields.Index)
+		}
+		rangeSync.candidate = append(rangeSync.candidate, blocks...)
+		return nil
+	}
+
+	// skip blocks the local chain already has
+	var chain []blockchain.Block = blockchain.GetBlockChain()
+	var first int = 0
+	for first < len(blocks) && blocks[first].Fields.Index < len(chain) && chain[blocks[first].Fields.Index].Hash == blocks[first].Hash {
+		first++
+	}
+	if first == len(blocks) {
+		return nil
+	}
+
+	var forkBlock blockchain.Block = blocks[first]
+	var prevIndex int = forkBlock.Fields.Index - 1
+	if prevIndex >= len(chain) {
+		return fmt.Errorf("block %d is beyond the local chain", forkBlock.Fields.Index)
+	}
+	if chain[prevIndex].Hash != forkBlock.Fields.PrevHash {
+		if blocks[0].Fields.Index <= 1 {
+			return fmt.Errorf("peer chain does not share blocks with the local chain")
+		}
+		var fromIndex int = blocks[0].Fields.Index - maxBlocksPerRange
+		if fromIndex < 1 {
+			fromIndex = 1
+		}
+		requestRange(fromIndex)
+		return nil
+	}
+
+	if prevIndex == len(chain)-1 {
+		return blockchain.AppendBlocks(blocks[first:])
+	}
+	// the chain is a copy, the candidate may extend it
+	rangeSync.candidate = append(chain[:prevIndex+1], blocks[first:]...)
+	return nil
+}
+
+// finishRangeSync replaces the local chain with a downloaded fork, if any, and announces the new tip
+// rangeSyncLock must be held
+func finishRangeSync() {
+	if rangeSync.candidate != nil {
+		if err := replaceChain(rangeSync.candidate); err != nil {
+			logger.Warn("downloaded chain not accepted", "peer", rangeSync.peer.Address, "err", err)
+		}
+	}
+	var latestBlock blockchain.Block = blockchain.GetLatestBlock()
+
+	logger.Info("sync completed", "peer", rangeSync.peer.Address, "height", latestBlock.Fields.Index, "hash", latestBlock.Hash)
+	rangeSync = nil
+	blockchain.AddSavedTransactions()
+	announceBlock(latestBlock)
+	sendUpdateToWebClient()
+}
@@ -0,0 +1,58 @@
+package p2p
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+// dialer is used to connect to peers, its TLS configuration applies to wss:// addresses only
+var dialer *websocket.Dialer = websocket.DefaultDialer
+
+// p2pPath is the path of the p2p endpoint, used when a peer address has no path
+const p2pPath = "/p2p"
+
+// SetTLSConfig sets the TLS configuration used to dial wss:// peers
+func SetTLSConfig(config *tls.Config) {
+	dialer = &websocket.Dialer{
+		Proxy:            websocket.DefaultDialer.Proxy,
+		HandshakeTimeout: websocket.DefaultDialer.HandshakeTimeout,
+		TLSClientConfig:  config,
+	}
+}
+
+// isPeerURL checks if a peer address is a full URL rather than a host:port pair
+func isPeerURL(address string) bool {
+	return strings.Contains(address, "://")
+}
+
+// parsePeerURL parses a ws:// or wss:// peer address
+func parsePeerURL(address string) (*url.URL, error) {
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "ws" && u.Scheme != "wss" {
+		return nil, fmt.Errorf("unsupported peer url scheme %q, expected ws or wss", u.Scheme)
+	}
+	return u, nil
+}
+
+// peerURL returns a websocket url to dial for a given peer address
+// addresses can be host:port pairs, dialed over plain ws://, or full ws:// and wss:// urls
+func peerURL(address string) (string, error) {
+	if !isPeerURL(address) {
+		return fmt.Sprintf("ws://%s%s", address, p2pPath), nil
+	}
+	u, err := parsePeerURL(address)
+	if err != nil {
+		return "", err
+	}
+	if u.Path == "" {
+		u.Path = p2pPath
+	}
+	return u.String(), nil
+}
@@ -0,0 +1,116 @@
+package p2p
+
+import (
+	"errors"
+	"fmt"
+	"naivecoin/blockchain"
+	tx "naivecoin/transactions"
+
+	"github.com/gorilla/websocket"
+)
+
+// maxMessageSize limits the size of a single message read from a peer, in bytes
+var maxMessageSize int64 = 4 << 20
+
+// limits applied to data received from peers before it is handed to the blockchain package
+const (
+	maxBlocksPerMessage       int    = 100000
+	maxTransactionsPerMessage int    = 5000
+	maxTxInsPerTransaction    int    = 1000
+	maxTxOutsPerTransaction   int    = 1000
+	maxDifficulty             uint32 = 256
+)
+
+// misbehavior scores added for protocol violations, a peer reaching banScore is disconnected
+const (
+	malformedMessageScore int = 10
+	invalidDataScore      int = 20
+	oversizedMessageScore int = 100
+	banScore              int = 100
+)
+
+// SetMaxMessageSize sets the maximum size of a message accepted from a peer, in bytes
+func SetMaxMessageSize(size int64) {
+	maxMessageSize = size
+}
+
+// decodeStrict decodes message data into a given value, rejecting fields it does not define
+func decodeStrict(c *codec, byteData []byte, data interface{}) error {
+	dto := Message{Data: data}
+	return c.unmarshal(byteData, &dto, true)
+}
+
+// misbehave adds to a peer's misbehavior score and disconnects it once banScore is reached
+func misbehave(p *Peer, score int, reason string) {
+	peerSocketListLock.Lock()
+	p.MisbehaviorScore += score
+	var total int = p.MisbehaviorScore
+	peerSocketListLock.Unlock()
+
+	logger.Warn("peer misbehaved", "peer", p.Address, "reason", reason, "score", total)
+	if total >= banScore {
+		forgetOutboundPeer(p.Address)
+		if closePeer(p, websocket.ClosePolicyViolation, "misbehaving") {
+			logger.Warn("disconnected misbehaving peer", "peer", p.Address)
+		}
+	}
+}
+
+// validateTransactionFields checks the ranges of transaction fields received from a peer
+func validateTransactionFields(transaction tx.Transaction) error {
+	if len(transaction.TxIns) > maxTxInsPerTransaction {
+		return fmt.Errorf("transaction %s has too many inputs: %d", transaction.Id, len(transaction.TxIns))
+	}
+	if len(transaction.TxOuts) > maxTxOutsPerTransaction {
+		return fmt.Errorf("transaction %s has too many outputs: %d", transaction.Id, len(transaction.TxOuts))
+	}
+	for _, txIn := range transaction.TxIns {
+		if txIn.TxOutIndex < 0 {
+			return fmt.Errorf("transaction %s has negative txOut index", transaction.Id)
+		}
+	}
+	return tx.ValidateTxOutAmounts(transaction)
+}
+
+// validateTransactions checks the ranges of transactions received from a peer
+func validateTransactions(transactions []tx.Transaction) error {
+	if len(transactions) > maxTransactionsPerMessage {
+		return fmt.Errorf("too many transactions: %d", len(transactions))
+	}
+	for _, transaction := range transactions {
+		if err := validateTransactionFields(transaction); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateBlocks checks the ranges of block fields received from a peer
+func validateBlocks(blocks []blockchain.Block) error {
+	if len(blocks) > maxBlocksPerMessage {
+		return fmt.Errorf("too many blocks: %d", len(blocks))
+	}
+	for _, block := range blocks {
+		if block.Fields.Index < 0 {
+			return fmt.Errorf("block %s has negative index", block.Hash)
+		}
+		if block.Fields.Difficulty > maxDifficulty {
+			return fmt.Errorf("block %s has difficulty out of range", block.Hash)
+		}
+		if err := validateTransactions(block.Fields.Transactions); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateInventoryItem checks the ranges of a block announcement received from a peer
+func validateInventoryItem(item inventoryItem) error {
+	if item.Height < 0 {
+		return errors.New("negative block height")
+	}
+	if len(item.Hash) != 64 {
+		return errors.New("invalid block hash")
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package p2p
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"naivecoin/blockchain"
+	tx "naivecoin/transactions"
+	"naivecoin/txpool"
+	"naivecoin/utils"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// amountPlaceholder is the amount of the second txOut of testAmountTransaction, replaced by the amount under test in JSON
+const amountPlaceholder string = "12345.5"
+
+// testAmountTransaction returns a transaction whose second txOut pays a given amount
+func testAmountTransaction(tb testing.TB, amount float64) tx.Transaction {
+	_, address := testKeyAddress(tb, 1)
+	var transaction tx.Transaction = tx.Transaction{
+		Version: tx.CurrentTxVersion,
+		TxIns:   tx.TxInCollection{{TxOutId: utils.Hash("txOut"), TxOutIndex: 0}},
+		TxOuts:  tx.TxOutCollection{{Address: address, Amount: 50}, {Address: address, Amount: amount}},
+	}
+	transaction.Id = tx.GetTransactionId(transaction)
+	return transaction
+}
+
+// jsonWithAmount returns a JSON message of a given code holding data, with the placeholder amount replaced by a JSON literal
+func jsonWithAmount(tb testing.TB, code string, data interface{}, literal string) []byte {
+	dataBytes, err := json.Marshal(Message{Code: code, Data: data})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if !strings.Contains(string(dataBytes), amountPlaceholder) {
+		tb.Fatal("placeholder amount missing from the message")
+	}
+	return []byte(strings.Replace(string(dataBytes), amountPlaceholder, literal, 1))
+}
+
+func TestInvalidAmountsFromJsonRefused(test *testing.T) {
+	var transaction tx.Transaction = testAmountTransaction(test, 12345.5)
+	var block blockchain.Block = blockchain.Block{Fields: blockchain.BlockFields{Index: 1, Transactions: []tx.Transaction{transaction}}, Hash: utils.Hash("block")}
+
+	// JSON has no NaN or Infinity, such amounts and ones out of float64 range can't be decoded
+	var cases = []struct {
+		literal   string
+		decodable bool
+	}{
+		{"-50", true},
+		{"-0.000001", true},
+		{"0", true},
+		{"-0", true},
+		{"1e-400", true},
+		{"1000000000001", true},
+		{"1e308", true},
+		{"1e400", false},
+		{"-1e400", false},
+		{"NaN", false},
+		{"Infinity", false},
+		{"-Infinity", false},
+		{`"NaN"`, false},
+		{`"+Inf"`, false},
+	}
+	for _, c := range cases {
+		txs, err := unmarshalDtoToTxPool(jsonCodec, jsonWithAmount(test, txPoolMsg, []tx.Transaction{transaction}, c.literal))
+		if err == nil {
+			test.Fatalf("amount %s: transaction must be refused, got %v", c.literal, txs)
+		}
+		if c.decodable && !errors.Is(err, tx.ErrInvalidTxOutAmount) {
+			test.Fatalf("amount %s: expected %v, got %v", c.literal, tx.ErrInvalidTxOutAmount, err)
+		}
+		if blocks, err := unmarshalDtoToBlocks(jsonCodec, jsonWithAmount(test, blockchainMsg, []blockchain.Block{block}, c.literal)); err == nil {
+			test.Fatalf("amount %s: block must be refused, got %v", c.literal, blocks)
+		} else if c.decodable && !errors.Is(err, tx.ErrInvalidTxOutAmount) {
+			test.Fatalf("amount %s: expected %v for the block, got %v", c.literal, tx.ErrInvalidTxOutAmount, err)
+		}
+	}
+
+	if _, err := unmarshalDtoToTxPool(jsonCodec, jsonWithAmount(test, txPoolMsg, []tx.Transaction{transaction}, "10")); err != nil {
+		test.Fatalf("positive amount must be accepted: %v", err)
+	}
+}
+
+func TestInvalidAmountsFromMsgpackRefused(test *testing.T) {
+	// msgpack carries NaN and infinities, they reach validateTransactionFields
+	for _, amount := range []float64{-50, 0, math.Copysign(0, -1), math.NaN(), math.Inf(1), math.Inf(-1), math.MaxFloat64, tx.MaxMoney + 1} {
+		var transaction tx.Transaction = testAmountTransaction(test, amount)
+		if err := validateTransactionFields(transaction); !errors.Is(err, tx.ErrInvalidTxOutAmount) {
+			test.Fatalf("amount %v: expected %v, got %v", amount, tx.ErrInvalidTxOutAmount, err)
+		}
+		dataBytes, err := msgpackCodec.marshal(Message{Code: txPoolMsg, Data: []tx.Transaction{transaction}})
+		if err != nil {
+			test.Fatal(err)
+		}
+		if _, err := unmarshalDtoToTxPool(msgpackCodec, dataBytes); !errors.Is(err, tx.ErrInvalidTxOutAmount) {
+			test.Fatalf("amount %v: expected %v, got %v", amount, tx.ErrInvalidTxOutAmount, err)
+		}
+	}
+}
+
+func TestPeerSendingNegativeAmountPenalized(test *testing.T) {
+	server := startNode(test)
+	tp := dialTestPeer(test, server, false)
+	var transaction tx.Transaction = testAmountTransaction(test, 12345.5)
+
+	tp.lock.Lock()
+	var err error = tp.conn.WriteMessage(websocket.TextMessage, jsonWithAmount(test, txPoolMsg, []tx.Transaction{transaction}, "-50"))
+	tp.lock.Unlock()
+	if err != nil {
+		test.Fatal(err)
+	}
+	tp.sync(test)
+
+	if txpool.HasTransaction(transaction.Id) {
+		test.Fatal("transaction with a negative amount must not enter the pool")
+	}
+	var p *Peer = tp.peer()
+	peerSocketListLock.Lock()
+	var score int = p.MisbehaviorScore
+	peerSocketListLock.Unlock()
+	if score != invalidDataScore {
+		test.Fatalf("expected misbehavior score %d, got %d", invalidDataScore, score)
+	}
+}
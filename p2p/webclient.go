@@ -0,0 +1,279 @@
+package p2p
+
+import (
+	"encoding/json"
+	"naivecoin/blockchain"
+	"naivecoin/txpool"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// message codes used by web clients to manage subscriptions
+const (
+	subscribeMsg   = "SUBSCRIBE"
+	unsubscribeMsg = "UNSUBSCRIBE"
+)
+
+// event codes sent to subscribed web clients
+const (
+	newBlockMsg         = "NEW_BLOCK"
+	txAddedMsg          = "TX_ADDED"
+	txRemovedMsg        = "TX_REMOVED"
+	peerConnectedMsg    = "PEER_CONNECTED"
+	peerDisconnectedMsg = "PEER_DISCONNECTED"
+)
+
+// topics web clients can subscribe to
+const (
+	blocksTopic = "blocks"
+	txPoolTopic = "txpool"
+	peersTopic  = "peers"
+)
+
+// maxWebClientMessageSize limits the size of a message read from a web client, in bytes
+const maxWebClientMessageSize int64 = 64 * 1024
+
+// webClient is a connection to a web client, writes to it are serialized by sendLock
+// subscriptions are guarded by webClientsLock
+type webClient struct {
+	conn          *websocket.Conn
+	sendLock      sync.Mutex
+	subscriptions map[string]bool
+}
+
+// blockSummary describes a block without its transactions, Miner summarizes miner stats while the node mines
+type blockSummary struct {
+	Index            int
+	Hash             string
+	PrevHash         string
+	Ts               uint64
+	Difficulty       uint32
+	TransactionCount int
+	Miner            string `json:",omitempty"`
+}
+
+// txRemovedEvent describes a transaction removed from the transaction pool and the reason it was removed
+type txRemovedEvent struct {
+	Id     string
+	Reason txpool.PoolEventType
+}
+
+// peerEvent describes a peer that connected or disconnected and the resulting number of connected peers
+type peerEvent struct {
+	Address   string
+	Direction string
+	PeerCount int
+}
+
+// webClients is the set of connected web clients
+var webClients map[*webClient]bool = map[*webClient]bool{}
+var webClientsLock sync.Mutex
+
+// addWebClient adds a connection to the set of web clients
+func addWebClient(ws *websocket.Conn) *webClient {
+	var client *webClient = &webClient{conn: ws, subscriptions: map[string]bool{}}
+	webClientsLock.Lock()
+	webClients[client] = true
+	webClientsLock.Unlock()
+	return client
+}
+
+// removeWebClient closes connection to a web client and removes it from the set
+func removeWebClient(client *webClient) {
+	webClientsLock.Lock()
+	if webClients[client] {
+		delete(webClients, client)
+		logger.Info("web client disconnected", "client", client.conn.RemoteAddr().String())
+	}
+	webClientsLock.Unlock()
+	client.conn.Close()
+}
+
+// closeWebClient sends a close frame with a given code and reason to a web client and removes it from the set
+func closeWebClient(client *webClient, code int, reason string) {
+	closeMessage := websocket.FormatCloseMessage(code, reason)
+	if err := client.conn.WriteControl(websocket.CloseMessage, closeMessage, time.Now().Add(time.Second)); err != nil {
+		logger.Debug("failed to send close frame", "client", client.conn.RemoteAddr().String(), "err", err)
+	}
+	removeWebClient(client)
+}
+
+// getWebClients returns a snapshot of connected web clients
+func getWebClients() []*webClient {
+	webClientsLock.Lock()
+	defer webClientsLock.Unlock()
+	var clients []*webClient = []*webClient{}
+	for client := range webClients {
+		clients = append(clients, client)
+	}
+	return clients
+}
+
+// sendToWebClient sends byte data to a web client, the client is removed if it can't be written to
+func sendToWebClient(client *webClient, dataBytes []byte) {
+	client.sendLock.Lock()
+	err := client.conn.WriteMessage(websocket.TextMessage, dataBytes)
+	client.sendLock.Unlock()
+	if err != nil {
+		logger.Info("failed to write to web client", "client", client.conn.RemoteAddr().String(), "err", err)
+		removeWebClient(client)
+	}
+}
+
+// buildWalletInfoMessage builds a message with current wallet balances and wallet address, the same data /api/wallet returns
+func buildWalletInfoMessage() ([]byte, error) {
+	return buildMessage(blockchain.GetWalletInfo(), walletInfoMsg)
+}
+
+// sendUpdateToWebClient sends current wallet balance and wallet address to all connected web clients
+func sendUpdateToWebClient() {
+	var clients []*webClient = getWebClients()
+	if len(clients) == 0 {
+		return
+	}
+
+	dataBytes, err := buildWalletInfoMessage()
+	if err != nil {
+		return
+	}
+	for _, client := range clients {
+		sendToWebClient(client, dataBytes)
+	}
+}
+
+// getSubscribedWebClients returns web clients subscribed to a given topic
+func getSubscribedWebClients(topic string) []*webClient {
+	webClientsLock.Lock()
+	defer webClientsLock.Unlock()
+	var clients []*webClient = []*webClient{}
+	for client := range webClients {
+		if client.subscriptions[topic] {
+			clients = append(clients, client)
+		}
+	}
+	return clients
+}
+
+// sendEventToWebClients sends an event to all web clients subscribed to a given topic
+func sendEventToWebClients(topic string, code string, data interface{}) {
+	var clients []*webClient = getSubscribedWebClients(topic)
+	if len(clients) == 0 {
+		return
+	}
+
+	dataBytes, err := buildMessage(data, code)
+	if err != nil {
+		return
+	}
+	for _, client := range clients {
+		sendToWebClient(client, dataBytes)
+	}
+}
+
+// sendBlockEventToWebClients sends a summary of a new block to web clients subscribed to blocks
+func sendBlockEventToWebClients(block blockchain.Block) {
+	var summary blockSummary = blockSummary{
+		Index:            block.Fields.Index,
+		Hash:             block.Hash,
+		PrevHash:         block.Fields.PrevHash,
+		Ts:               block.Fields.Ts,
+		Difficulty:       block.Fields.Difficulty,
+		TransactionCount: len(block.Fields.Transactions),
+	}
+	if stats := blockchain.GetMinerStats(); stats.Mining || stats.BlocksFound > 0 {
+		summary.Miner = stats.Summary()
+	}
+	sendEventToWebClients(blocksTopic, newBlockMsg, summary)
+}
+
+// sendPoolEventToWebClients sends a transaction pool change to web clients subscribed to txpool
+func sendPoolEventToWebClients(event txpool.PoolEvent) {
+	if event.Type == txpool.TxAdded {
+		sendEventToWebClients(txPoolTopic, txAddedMsg, event.Transaction)
+		return
+	}
+	sendEventToWebClients(txPoolTopic, txRemovedMsg, txRemovedEvent{Id: event.Transaction.Id, Reason: event.Type})
+}
+
+// sendPeerEventToWebClients sends a peer connection change to web clients subscribed to peers
+func sendPeerEventToWebClients(code string, p *Peer, peerCount int) {
+	sendEventToWebClients(peersTopic, code, peerEvent{Address: p.Address, Direction: p.Direction, PeerCount: peerCount})
+}
+
+// isValidTopic checks if web clients can subscribe to a given topic
+func isValidTopic(topic string) bool {
+	return topic == blocksTopic || topic == txPoolTopic || topic == peersTopic
+}
+
+// handleWebClientMessage subscribes or unsubscribes a web client from topics
+func handleWebClientMessage(client *webClient, messageBytes []byte) {
+	topics := &[]string{}
+	messageStruct := Message{Data: topics}
+	if err := json.Unmarshal(messageBytes, &messageStruct); err != nil {
+		logger.Warn("invalid web client message", "client", client.conn.RemoteAddr().String(), "err", err)
+		return
+	}
+	if messageStruct.Code != subscribeMsg && messageStruct.Code != unsubscribeMsg {
+		logger.Warn("unsupported web client message code", "code", messageStruct.Code)
+		return
+	}
+
+	webClientsLock.Lock()
+	defer webClientsLock.Unlock()
+	for _, topic := range *topics {
+		if !isValidTopic(topic) {
+			logger.Warn("unknown web client topic", "topic", topic)
+			continue
+		}
+		if messageStruct.Code == subscribeMsg {
+			client.subscriptions[topic] = true
+		} else {
+			delete(client.subscriptions, topic)
+		}
+	}
+}
+
+// webClientReader handles subscription messages sent by a web client, it also detects closed connections
+func webClientReader(client *webClient) {
+	for {
+		messageType, messageBytes, err := client.conn.ReadMessage()
+		if err != nil {
+			removeWebClient(client)
+			return
+		}
+		if messageType != websocket.TextMessage {
+			continue
+		}
+		handleWebClientMessage(client, messageBytes)
+	}
+}
+
+// WsEndpoint starts a websocket connection to web client
+func WsEndpoint(w http.ResponseWriter, r *http.Request) {
+	upgrader.CheckOrigin = func(r *http.Request) bool { return true }
+
+	if isClosing() {
+		http.Error(w, ErrClosing.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		logger.Warn("failed to upgrade web client connection", "client", r.RemoteAddr, "err", err)
+		return
+	}
+	ws.SetReadLimit(maxWebClientMessageSize)
+	client := addWebClient(ws)
+	logger.Info("web client connected", "client", ws.RemoteAddr().String())
+
+	go webClientReader(client)
+
+	dataBytes, err := buildWalletInfoMessage()
+	if err != nil {
+		return
+	}
+	sendToWebClient(client, dataBytes)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"naivecoin/utils"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// apiClientIdleTime is the time after which rate limits of a client that sent no requests are forgotten
+const apiClientIdleTime time.Duration = 10 * time.Minute
+
+// apiClientRateLimit holds separate budgets of a client for cheap requests and requests that mine or dump the chain
+type apiClientRateLimit struct {
+	cheap     utils.RateBucket
+	expensive utils.RateBucket
+}
+
+// rate limits applied to api clients, a zero rate with a zero burst disables a limit
+var apiCheapRate, apiCheapBurst float64 = 20, 40
+var apiExpensiveRate, apiExpensiveBurst float64 = 0.5, 3
+
+// apiRateLimitLocalhost applies rate limits to clients on the loopback interface as well
+var apiRateLimitLocalhost bool = false
+
+// apiRequestTimeout is the deadline of the context of an api request
+var apiRequestTimeout time.Duration = time.Minute
+
+// apiClients holds rate limits by client ip, guarded by apiClientsLock
+var apiClients map[string]*apiClientRateLimit = map[string]*apiClientRateLimit{}
+var apiClientsLock sync.Mutex
+var apiClientsSweptAt time.Time = time.Now()
+
+// clientIp returns the ip address of the client of a request
+func clientIp(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// isRateLimited checks if requests of a client are rate limited
+func isRateLimited(ip string) bool {
+	if apiRateLimitLocalhost {
+		return true
+	}
+	var parsed net.IP = net.ParseIP(ip)
+	return parsed == nil || !parsed.IsLoopback()
+}
+
+// takeApiToken takes a token from a cheap or expensive bucket of a client, returns how long to wait if there is none
+func takeApiToken(ip string, expensive bool) (time.Duration, bool) {
+	apiClientsLock.Lock()
+	defer apiClientsLock.Unlock()
+	var now time.Time = time.Now()
+	if now.Sub(apiClientsSweptAt) >= apiClientIdleTime {
+		for clientIp, limit := range apiClients {
+			if limit.cheap.IsIdle(now, apiClientIdleTime) && limit.expensive.IsIdle(now, apiClientIdleTime) {
+				delete(apiClients, clientIp)
+			}
+		}
+		apiClientsSweptAt = now
+	}
+	limit, found := apiClients[ip]
+	if !found {
+		limit = &apiClientRateLimit{
+			cheap:     utils.NewRateBucket(apiCheapRate, apiCheapBurst),
+			expensive: utils.NewRateBucket(apiExpensiveRate, apiExpensiveBurst),
+		}
+		apiClients[ip] = limit
+	}
+	var bucket *utils.RateBucket = &limit.cheap
+	if expensive {
+		bucket = &limit.expensive
+	}
+	if bucket.Rate == 0 && bucket.Burst == 0 {
+		return 0, true
+	}
+	return bucket.Take(now, 0)
+}
+
+// writeTooManyRequests responds to a request of a client over its budget
+func writeTooManyRequests(w http.ResponseWriter, wait time.Duration) {
+	if wait > 0 {
+		w.Header().Set("Retry-After", fmt.Sprint(int64(math.Ceil(wait.Seconds()))))
+	}
+	writeError(w, http.StatusTooManyRequests, codeRateLimited, "rate limit exceeded")
+}
+
+// rateLimitHandler takes a cheap token for every api request and sets the deadline of its context
+func rateLimitHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var ip string = clientIp(r)
+		if isRateLimited(ip) {
+			if wait, ok := takeApiToken(ip, false); !ok {
+				writeTooManyRequests(w, wait)
+				return
+			}
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), apiRequestTimeout)
+		defer cancel()
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// expensive wraps a handler of an endpoint that mines or serializes the whole chain, it takes an expensive token as well
+func expensive(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var ip string = clientIp(r)
+		if isRateLimited(ip) {
+			if wait, ok := takeApiToken(ip, true); !ok {
+				writeTooManyRequests(w, wait)
+				return
+			}
+		}
+		handler(w, r)
+	}
+}
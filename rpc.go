@@ -0,0 +1,392 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"naivecoin/blockchain"
+	"naivecoin/p2p"
+	tx "naivecoin/transactions"
+	"naivecoin/txpool"
+	"net/http"
+)
+
+// error codes of JSON-RPC 2.0, errors of the node itself are reported as rpcServerError with the api error code in data
+const (
+	rpcParseError     int = -32700
+	rpcInvalidRequest int = -32600
+	rpcMethodNotFound int = -32601
+	rpcInvalidParams  int = -32602
+	rpcInternalError  int = -32603
+	rpcServerError    int = -32000
+)
+
+// maxRpcBodySize limits the size of a JSON-RPC request body, in bytes
+const maxRpcBodySize int64 = 1 << 20
+
+// maxRpcBatchSize limits the number of requests in a JSON-RPC batch
+const maxRpcBatchSize int = 100
+
+// rpcError is an error object of a JSON-RPC response
+type rpcError struct {
+	Code    int         `json:"code"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+func (e *rpcError) Error() string {
+	return e.Message
+}
+
+// rpcErrorData carries the api error code of a server error with its details
+type rpcErrorData struct {
+	Code    string      `json:"code"`
+	Details interface{} `json:"details,omitempty"`
+}
+
+// newRpcServerError returns a server error with a given api error code
+func newRpcServerError(code string, message string) *rpcError {
+	return &rpcError{Code: rpcServerError, Message: message, Data: rpcErrorData{Code: code}}
+}
+
+// toRpcError returns a JSON-RPC error for an error of a method, errors of the node are mapped like api errors are
+func toRpcError(err error) *rpcError {
+	var rpcErr *rpcError
+	if errors.As(err, &rpcErr) {
+		return rpcErr
+	}
+	var apiErr *apiError = toApiError(err)
+	return &rpcError{Code: rpcServerError, Message: apiErr.Message, Data: rpcErrorData{Code: apiErr.Code, Details: apiErr.Details}}
+}
+
+// rpcResponse is a JSON-RPC response, Id is null if the id of a request could not be read
+type rpcResponse struct {
+	Jsonrpc string          `json:"jsonrpc"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+	Id      json.RawMessage `json:"id"`
+}
+
+// rpcMethod is a method callable over JSON-RPC
+// mutating methods require the api token, expensive methods take an expensive rate limit token of the client
+type rpcMethod struct {
+	call      func(r *http.Request, params json.RawMessage) (interface{}, error)
+	mutating  bool
+	expensive bool
+}
+
+// rpcMethods are methods callable over JSON-RPC by name, they are named like bitcoind methods
+var rpcMethods map[string]rpcMethod = map[string]rpcMethod{
+	"getblockcount":     {call: rpcGetBlockCount},
+	"getbestblockhash":  {call: rpcGetBestBlockHash},
+	"getblock":          {call: rpcGetBlock},
+	"getrawtransaction": {call: rpcGetRawTransaction},
+	"gettransaction":    {call: rpcGetTransaction},
+	"getbalance":        {call: rpcGetBalance},
+	"sendtoaddress":     {call: rpcSendToAddress, mutating: true},
+	"getpeerinfo":       {call: rpcGetPeerInfo},
+	"getmempoolinfo":    {call: rpcGetMempoolInfo},
+	"generate":          {call: rpcGenerate, mutating: true, expensive: true},
+}
+
+// decodeRpcParams decodes params given by position or by name into values, in the order of names
+// the first required params must be given, the other values are kept if their params are not
+func decodeRpcParams(params json.RawMessage, names []string, required int, values ...interface{}) error {
+	params = bytes.TrimSpace(params)
+	if len(params) == 0 || bytes.Equal(params, []byte("null")) {
+		if required > 0 {
+			return &rpcError{Code: rpcInvalidParams, Message: "missing param " + names[0]}
+		}
+		return nil
+	}
+
+	switch params[0] {
+	case '[':
+		var positional []json.RawMessage
+		if err := json.Unmarshal(params, &positional); err != nil {
+			return &rpcError{Code: rpcInvalidParams, Message: "invalid params: " + err.Error()}
+		}
+		if len(positional) > len(names) {
+			return &rpcError{Code: rpcInvalidParams, Message: fmt.Sprintf("too many params, expected at most %d", len(names))}
+		}
+		if len(positional) < required {
+			return &rpcError{Code: rpcInvalidParams, Message: "missing param " + names[len(positional)]}
+		}
+		for n := 0; n < len(positional); n++ {
+			if err := json.Unmarshal(positional[n], values[n]); err != nil {
+				return &rpcError{Code: rpcInvalidParams, Message: fmt.Sprintf("invalid param %s: %s", names[n], err.Error())}
+			}
+		}
+	case '{':
+		var named map[string]json.RawMessage
+		if err := json.Unmarshal(params, &named); err != nil {
+			return &rpcError{Code: rpcInvalidParams, Message: "invalid params: " + err.Error()}
+		}
+		var known map[string]bool = map[string]bool{}
+		for n := 0; n < len(names); n++ {
+			known[names[n]] = true
+			value, found := named[names[n]]
+			if !found {
+				if n < required {
+					return &rpcError{Code: rpcInvalidParams, Message: "missing param " + names[n]}
+				}
+				continue
+			}
+			if err := json.Unmarshal(value, values[n]); err != nil {
+				return &rpcError{Code: rpcInvalidParams, Message: fmt.Sprintf("invalid param %s: %s", names[n], err.Error())}
+			}
+		}
+		for name := range named {
+			if !known[name] {
+				return &rpcError{Code: rpcInvalidParams, Message: "unknown param " + name}
+			}
+		}
+	default:
+		return &rpcError{Code: rpcInvalidParams, Message: "params must be an array or an object"}
+	}
+	return nil
+}
+
+// rpcGetBlockCount returns the index of the latest block
+func rpcGetBlockCount(r *http.Request, params json.RawMessage) (interface{}, error) {
+	if err := decodeRpcParams(params, nil, 0); err != nil {
+		return nil, err
+	}
+	return blockchain.GetLatestBlock().Fields.Index, nil
+}
+
+// rpcGetBestBlockHash returns the hash of the latest block
+func rpcGetBestBlockHash(r *http.Request, params json.RawMessage) (interface{}, error) {
+	if err := decodeRpcParams(params, nil, 0); err != nil {
+		return nil, err
+	}
+	return blockchain.GetLatestBlock().Hash, nil
+}
+
+// rpcGetBlock returns a block of the current blockchain by its hash
+func rpcGetBlock(r *http.Request, params json.RawMessage) (interface{}, error) {
+	var hash string
+	if err := decodeRpcParams(params, []string{"blockhash"}, 1, &hash); err != nil {
+		return nil, err
+	}
+	block, found := blockchain.GetBlockByHash(hash)
+	if !found {
+		return nil, newRpcServerError(codeNotFound, "block not found")
+	}
+	return block, nil
+}
+
+// rpcGetRawTransaction returns a transaction from the current blockchain or the transaction pool by its id
+func rpcGetRawTransaction(r *http.Request, params json.RawMessage) (interface{}, error) {
+	var txId string
+	if err := decodeRpcParams(params, []string{"txid"}, 1, &txId); err != nil {
+		return nil, err
+	}
+	info, found := blockchain.GetTransaction(txId)
+	if !found {
+		return nil, newRpcServerError(codeNotFound, "transaction not found")
+	}
+	return info.Transaction, nil
+}
+
+// rpcGetTransaction returns a transaction by its id with the block including it and the number of confirmations
+func rpcGetTransaction(r *http.Request, params json.RawMessage) (interface{}, error) {
+	var txId string
+	if err := decodeRpcParams(params, []string{"txid"}, 1, &txId); err != nil {
+		return nil, err
+	}
+	info, found := blockchain.GetTransaction(txId)
+	if !found {
+		return nil, newRpcServerError(codeNotFound, "transaction not found")
+	}
+	return info, nil
+}
+
+// rpcGetBalance returns the confirmed balance of the wallet, or of a given address
+func rpcGetBalance(r *http.Request, params json.RawMessage) (interface{}, error) {
+	var address string
+	if err := decodeRpcParams(params, []string{"address"}, 0, &address); err != nil {
+		return nil, err
+	}
+	if address == "" {
+		return blockchain.GetBalances().Confirmed, nil
+	}
+	if !tx.IsValidBase58Address(address) {
+		return nil, blockchain.ErrInvalidAddress
+	}
+	return blockchain.GetBalanceForAddress(address).Balance, nil
+}
+
+// rpcSendToAddress creates a transaction paying an amount to an address, adds it to the transaction pool and returns its id
+// the transaction pays the minimum fee rate of the transaction pool unless feerate is given
+func rpcSendToAddress(r *http.Request, params json.RawMessage) (interface{}, error) {
+	var request transactionRequest
+	if err := decodeRpcParams(params, []string{"address", "amount", "feerate"}, 2, &request.Address, &request.Amount, &request.FeeRate); err != nil {
+		return nil, err
+	}
+	if fieldErrors := request.validate(); len(fieldErrors) > 0 {
+		return nil, fieldErrorsToApiError(fieldErrors)
+	}
+	transaction, _, err := blockchain.SendTransaction(request.Address, request.Amount, request.sendOptions())
+	if err != nil {
+		return nil, err
+	}
+	return transaction.Id, nil
+}
+
+// rpcGetPeerInfo returns connected peers
+func rpcGetPeerInfo(r *http.Request, params json.RawMessage) (interface{}, error) {
+	if err := decodeRpcParams(params, nil, 0); err != nil {
+		return nil, err
+	}
+	return p2p.GetPeers(), nil
+}
+
+// rpcGetMempoolInfo returns utilization and limits of the transaction pool with its minimum fee rate
+func rpcGetMempoolInfo(r *http.Request, params json.RawMessage) (interface{}, error) {
+	if err := decodeRpcParams(params, nil, 0); err != nil {
+		return nil, err
+	}
+	return struct {
+		txpool.PoolStats
+		MinFeeRate float64
+	}{PoolStats: txpool.GetPoolStats(), MinFeeRate: txpool.GetMinFeeRate()}, nil
+}
+
+// rpcGenerate mines a number of blocks, paying address or the reward address of the node, and returns their hashes
+// mining stops if the request is cancelled or its deadline passes
+func rpcGenerate(r *http.Request, params json.RawMessage) (interface{}, error) {
+	var count int
+	var address string
+	if err := decodeRpcParams(params, []string{"nblocks", "address"}, 1, &count, &address); err != nil {
+		return nil, err
+	}
+	if count < 1 || count > maxGenerateBlocks {
+		return nil, &rpcError{Code: rpcInvalidParams, Message: fmt.Sprintf("nblocks must be between 1 and %d", maxGenerateBlocks)}
+	}
+	return blockchain.GenerateBlocks(r.Context(), count, address)
+}
+
+// callRpc calls a method of a single request, returns nil for a notification, which gets no response
+func callRpc(r *http.Request, request json.RawMessage) *rpcResponse {
+	var response *rpcResponse = &rpcResponse{Jsonrpc: "2.0"}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(request, &fields); err != nil || fields == nil {
+		response.Error = &rpcError{Code: rpcInvalidRequest, Message: "request must be an object"}
+		return response
+	}
+	id, hasId := fields["id"]
+	if hasId {
+		var idValue interface{}
+		if json.Unmarshal(id, &idValue) != nil {
+			response.Error = &rpcError{Code: rpcInvalidRequest, Message: "invalid id"}
+			return response
+		}
+		switch idValue.(type) {
+		case string, float64, nil:
+			response.Id = id
+		default:
+			response.Error = &rpcError{Code: rpcInvalidRequest, Message: "id must be a string, a number or null"}
+			return response
+		}
+	}
+	var version string
+	if json.Unmarshal(fields["jsonrpc"], &version) != nil || version != "2.0" {
+		response.Error = &rpcError{Code: rpcInvalidRequest, Message: "jsonrpc must be \"2.0\""}
+		return response
+	}
+	var methodName string
+	if json.Unmarshal(fields["method"], &methodName) != nil || methodName == "" {
+		response.Error = &rpcError{Code: rpcInvalidRequest, Message: "method must be a string"}
+		return response
+	}
+
+	result, err := invokeRpcMethod(r, methodName, fields["params"])
+	if !hasId {
+		return nil
+	}
+	if err != nil {
+		response.Error = toRpcError(err)
+		return response
+	}
+	if response.Result, err = json.Marshal(result); err != nil {
+		response.Result = nil
+		response.Error = &rpcError{Code: rpcInternalError, Message: "failed to encode result: " + err.Error()}
+	}
+	return response
+}
+
+// invokeRpcMethod checks the api token and rate limits of a method and calls it
+func invokeRpcMethod(r *http.Request, methodName string, params json.RawMessage) (interface{}, error) {
+	method, found := rpcMethods[methodName]
+	if !found {
+		return nil, &rpcError{Code: rpcMethodNotFound, Message: "method not found: " + methodName}
+	}
+	if method.mutating && !isAuthenticated(r) {
+		return nil, newRpcServerError(codeUnauthorized, "missing or invalid api token")
+	}
+	if method.expensive {
+		var ip string = clientIp(r)
+		if isRateLimited(ip) {
+			if _, ok := takeApiToken(ip, true); !ok {
+				return nil, newRpcServerError(codeRateLimited, "rate limit exceeded")
+			}
+		}
+	}
+	return method.call(r, params)
+}
+
+// rpcEndpoint serves JSON-RPC 2.0 requests, a single request or a batch of them
+// responses of a batch are returned in an array, notifications get no response
+func rpcEndpoint(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxRpcBodySize))
+	if err != nil {
+		writeRpcResponse(w, &rpcResponse{Jsonrpc: "2.0", Error: &rpcError{Code: rpcParseError, Message: "failed to read request: " + err.Error()}})
+		return
+	}
+	body = bytes.TrimSpace(body)
+	if !json.Valid(body) {
+		writeRpcResponse(w, &rpcResponse{Jsonrpc: "2.0", Error: &rpcError{Code: rpcParseError, Message: "invalid JSON"}})
+		return
+	}
+
+	if body[0] != '[' {
+		var response *rpcResponse = callRpc(r, body)
+		if response == nil {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		writeRpcResponse(w, response)
+		return
+	}
+
+	var batch []json.RawMessage
+	json.Unmarshal(body, &batch)
+	if len(batch) == 0 {
+		writeRpcResponse(w, &rpcResponse{Jsonrpc: "2.0", Error: &rpcError{Code: rpcInvalidRequest, Message: "empty batch"}})
+		return
+	}
+	if len(batch) > maxRpcBatchSize {
+		writeRpcResponse(w, &rpcResponse{Jsonrpc: "2.0", Error: &rpcError{Code: rpcInvalidRequest, Message: fmt.Sprintf("batch of more than %d requests", maxRpcBatchSize)}})
+		return
+	}
+	var responses []*rpcResponse = []*rpcResponse{}
+	for n := 0; n < len(batch); n++ {
+		if response := callRpc(r, batch[n]); response != nil {
+			responses = append(responses, response)
+		}
+	}
+	if len(responses) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeRpcResponse(w, responses)
+}
+
+// writeRpcResponse writes a JSON-RPC response or a batch of them, JSON-RPC errors are reported with status 200
+func writeRpcResponse(w http.ResponseWriter, response interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
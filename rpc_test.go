@@ -0,0 +1,249 @@
+package main
+
+import (
+	"encoding/json"
+	"naivecoin/blockchain"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// testRpcResponse is a JSON-RPC response as a client reads it
+type testRpcResponse struct {
+	Jsonrpc string
+	Result  json.RawMessage
+	Error   *struct {
+		Code    int
+		Message string
+		Data    *rpcErrorData
+	}
+	Id json.RawMessage
+}
+
+// postRpc sends a JSON-RPC request body to the rpc endpoint, with the api token if authenticated is set
+func postRpc(tb testing.TB, body string, authenticated bool) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(http.MethodPost, "/rpc", strings.NewReader(body))
+	if authenticated {
+		request.Header.Set("Authorization", "Bearer "+apiToken)
+	}
+	recorder := httptest.NewRecorder()
+	rpcEndpoint(recorder, request)
+	return recorder
+}
+
+// callTestRpc sends a single JSON-RPC request and decodes its response
+func callTestRpc(tb testing.TB, body string, authenticated bool) testRpcResponse {
+	recorder := postRpc(tb, body, authenticated)
+	if recorder.Code != http.StatusOK {
+		tb.Fatalf("%s: expected status %d, got %d", body, http.StatusOK, recorder.Code)
+	}
+	var response testRpcResponse
+	if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+		tb.Fatalf("%s: %v in %s", body, err, recorder.Body.String())
+	}
+	if response.Jsonrpc != "2.0" {
+		tb.Fatalf("%s: expected jsonrpc 2.0, got %q", body, response.Jsonrpc)
+	}
+	return response
+}
+
+// setApiToken sets the api token until the test ends
+func setApiToken(tb testing.TB, token string) {
+	var previous string = apiToken
+	apiToken = token
+	tb.Cleanup(func() { apiToken = previous })
+}
+
+func TestRpcDispatch(test *testing.T) {
+	var latest blockchain.Block = blockchain.GetLatestBlock()
+	var cases = []struct {
+		body     string
+		expected interface{}
+	}{
+		{`{"jsonrpc":"2.0","method":"getblockcount","id":1}`, latest.Fields.Index},
+		{`{"jsonrpc":"2.0","method":"getblockcount","params":[],"id":1}`, latest.Fields.Index},
+		{`{"jsonrpc":"2.0","method":"getbestblockhash","params":null,"id":"a"}`, latest.Hash},
+		{`{"jsonrpc":"2.0","method":"getblock","params":["` + latest.Hash + `"],"id":2}`, latest},
+		{`{"jsonrpc":"2.0","method":"getblock","params":{"blockhash":"` + latest.Hash + `"},"id":2}`, latest},
+		{`{"jsonrpc":"2.0","method":"getrawtransaction","params":["` + latest.Fields.Transactions[0].Id + `"],"id":3}`, latest.Fields.Transactions[0]},
+	}
+	for _, c := range cases {
+		response := callTestRpc(test, c.body, false)
+		if response.Error != nil {
+			test.Fatalf("%s: %s", c.body, response.Error.Message)
+		}
+		expected, err := json.Marshal(c.expected)
+		if err != nil {
+			test.Fatal(err)
+		}
+		if string(response.Result) != string(expected) {
+			test.Fatalf("%s: expected %s, got %s", c.body, expected, response.Result)
+		}
+	}
+
+	// the id of a request is echoed as given
+	for _, id := range []string{`1`, `"abc"`, `null`, `1.5`} {
+		response := callTestRpc(test, `{"jsonrpc":"2.0","method":"getblockcount","id":`+id+`}`, false)
+		if string(response.Id) != id {
+			test.Fatalf("expected id %s, got %s", id, response.Id)
+		}
+	}
+}
+
+func TestRpcErrors(test *testing.T) {
+	setApiToken(test, "token")
+	var cases = []struct {
+		body          string
+		authenticated bool
+		code          int
+		dataCode      string
+	}{
+		{`{"jsonrpc":"2.0","method":"getblok","id":1}`, false, rpcMethodNotFound, ""},
+		{`{"jsonrpc":"2.0","method":"getblock","id":1}`, false, rpcInvalidParams, ""},
+		{`{"jsonrpc":"2.0","method":"getblock","params":[],"id":1}`, false, rpcInvalidParams, ""},
+		{`{"jsonrpc":"2.0","method":"getblock","params":[1],"id":1}`, false, rpcInvalidParams, ""},
+		{`{"jsonrpc":"2.0","method":"getblock","params":["a","b"],"id":1}`, false, rpcInvalidParams, ""},
+		{`{"jsonrpc":"2.0","method":"getblock","params":{"hash":"a"},"id":1}`, false, rpcInvalidParams, ""},
+		{`{"jsonrpc":"2.0","method":"getblock","params":"a","id":1}`, false, rpcInvalidParams, ""},
+		{`{"jsonrpc":"2.0","method":"getblockcount","params":[1],"id":1}`, false, rpcInvalidParams, ""},
+		{`{"jsonrpc":"2.0","method":"generate","params":[0],"id":1}`, true, rpcInvalidParams, ""},
+		{`{"jsonrpc":"2.0","method":"generate","params":["1"],"id":1}`, true, rpcInvalidParams, ""},
+		{`{"jsonrpc":"2.0","method":"getblock","params":["00"],"id":1}`, false, rpcServerError, codeNotFound},
+		{`{"jsonrpc":"2.0","method":"gettransaction","params":{"txid":"00"},"id":1}`, false, rpcServerError, codeNotFound},
+		{`{"jsonrpc":"2.0","method":"getbalance","params":["not an address"],"id":1}`, false, rpcServerError, codeInvalidAddress},
+		{`{"jsonrpc":"2.0","method":"sendtoaddress","params":["a",1],"id":1}`, false, rpcServerError, codeUnauthorized},
+		{`{"jsonrpc":"2.0","method":"generate","params":[1],"id":1}`, false, rpcServerError, codeUnauthorized},
+		{`{"jsonrpc":"2.0","method":"sendtoaddress","params":["not an address",1],"id":1}`, true, rpcServerError, codeInvalidAddress},
+		{`{"jsonrpc":"2.0","method":"sendtoaddress","params":["a"],"id":1}`, true, rpcInvalidParams, ""},
+		{`{"method":"getblockcount","id":1}`, false, rpcInvalidRequest, ""},
+		{`{"jsonrpc":"1.0","method":"getblockcount","id":1}`, false, rpcInvalidRequest, ""},
+		{`{"jsonrpc":"2.0","id":1}`, false, rpcInvalidRequest, ""},
+		{`{"jsonrpc":"2.0","method":1,"id":1}`, false, rpcInvalidRequest, ""},
+		{`{"jsonrpc":"2.0","method":"getblockcount","id":{}}`, false, rpcInvalidRequest, ""},
+		{`{"jsonrpc":"2.0","method":"getblockcount","id":[1]}`, false, rpcInvalidRequest, ""},
+		{`"getblockcount"`, false, rpcInvalidRequest, ""},
+		{`null`, false, rpcInvalidRequest, ""},
+		{`{"jsonrpc":"2.0","method":"getblockcount"`, false, rpcParseError, ""},
+		{``, false, rpcParseError, ""},
+		{`[]`, false, rpcInvalidRequest, ""},
+	}
+	for _, c := range cases {
+		response := callTestRpc(test, c.body, c.authenticated)
+		if response.Error == nil {
+			test.Fatalf("%s: expected error %d, got result %s", c.body, c.code, response.Result)
+		}
+		if response.Error.Code != c.code {
+			test.Fatalf("%s: expected error %d, got %d %s", c.body, c.code, response.Error.Code, response.Error.Message)
+		}
+		if c.dataCode != "" && (response.Error.Data == nil || response.Error.Data.Code != c.dataCode) {
+			test.Fatalf("%s: expected error data code %s, got %+v", c.body, c.dataCode, response.Error.Data)
+		}
+		if response.Result != nil {
+			test.Fatalf("%s: an error response must not have a result", c.body)
+		}
+	}
+}
+
+func TestRpcBatch(test *testing.T) {
+	var latest blockchain.Block = blockchain.GetLatestBlock()
+	recorder := postRpc(test, `[
+		{"jsonrpc":"2.0","method":"getblockcount","id":1},
+		{"jsonrpc":"2.0","method":"getblockcount"},
+		{"jsonrpc":"2.0","method":"nosuchmethod","id":"b"},
+		1,
+		{"jsonrpc":"2.0","method":"getbestblockhash","id":3}
+	]`, false)
+	var responses []testRpcResponse
+	if err := json.Unmarshal(recorder.Body.Bytes(), &responses); err != nil {
+		test.Fatalf("%v in %s", err, recorder.Body.String())
+	}
+	// the notification gets no response, the others are answered in order
+	if len(responses) != 4 {
+		test.Fatalf("expected 4 responses, got %s", recorder.Body.String())
+	}
+	if string(responses[0].Id) != "1" || string(responses[0].Result) != jsonString(test, latest.Fields.Index) {
+		test.Fatalf("unexpected first response %s", recorder.Body.String())
+	}
+	if string(responses[1].Id) != `"b"` || responses[1].Error == nil || responses[1].Error.Code != rpcMethodNotFound {
+		test.Fatalf("expected method not found for id b, got %s", recorder.Body.String())
+	}
+	if string(responses[2].Id) != "null" || responses[2].Error == nil || responses[2].Error.Code != rpcInvalidRequest {
+		test.Fatalf("expected invalid request without id, got %s", recorder.Body.String())
+	}
+	if string(responses[3].Id) != "3" || string(responses[3].Result) != jsonString(test, latest.Hash) {
+		test.Fatalf("unexpected last response %s", recorder.Body.String())
+	}
+
+	// notifications only, single or batched, are answered with no content
+	for _, body := range []string{
+		`{"jsonrpc":"2.0","method":"getblockcount"}`,
+		`{"jsonrpc":"2.0","method":"nosuchmethod"}`,
+		`[{"jsonrpc":"2.0","method":"getblockcount"},{"jsonrpc":"2.0","method":"getbestblockhash"}]`,
+	} {
+		if recorder := postRpc(test, body, false); recorder.Code != http.StatusNoContent || recorder.Body.Len() != 0 {
+			test.Fatalf("%s: expected no content, got %d %s", body, recorder.Code, recorder.Body.String())
+		}
+	}
+
+	var batch []string = []string{}
+	for n := 0; n <= maxRpcBatchSize; n++ {
+		batch = append(batch, `{"jsonrpc":"2.0","method":"getblockcount","id":1}`)
+	}
+	if response := callTestRpc(test, "["+strings.Join(batch, ",")+"]", false); response.Error == nil || response.Error.Code != rpcInvalidRequest {
+		test.Fatalf("expected a batch of %d requests to be refused", len(batch))
+	}
+}
+
+// jsonString returns the JSON encoding of a value
+func jsonString(tb testing.TB, value interface{}) string {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return string(encoded)
+}
+
+func TestDecodeRpcParams(test *testing.T) {
+	var cases = []struct {
+		params   string
+		required int
+		valid    bool
+		first    string
+		second   int
+	}{
+		{``, 0, true, "default", 7},
+		{`null`, 0, true, "default", 7},
+		{`null`, 1, false, "", 0},
+		{`[]`, 0, true, "default", 7},
+		{`["a"]`, 1, true, "a", 7},
+		{`["a", 2]`, 1, true, "a", 2},
+		{`{"first": "a"}`, 1, true, "a", 7},
+		{`{"second": 2, "first": "a"}`, 2, true, "a", 2},
+		{`{"second": 2}`, 1, false, "", 0},
+		{`{"first": "a", "third": 3}`, 1, false, "", 0},
+		{`["a", 2, 3]`, 1, false, "", 0},
+		{`[1]`, 1, false, "", 0},
+		{`["a", "2"]`, 1, false, "", 0},
+		{`"a"`, 1, false, "", 0},
+		{`1`, 0, false, "", 0},
+	}
+	for _, c := range cases {
+		var first string = "default"
+		var second int = 7
+		err := decodeRpcParams(json.RawMessage(c.params), []string{"first", "second"}, c.required, &first, &second)
+		if !c.valid {
+			var rpcErr *rpcError = toRpcError(err)
+			if err == nil || rpcErr.Code != rpcInvalidParams {
+				test.Fatalf("%s: expected invalid params, got %v", c.params, err)
+			}
+			continue
+		}
+		if err != nil {
+			test.Fatalf("%s: %v", c.params, err)
+		}
+		if first != c.first || second != c.second {
+			test.Fatalf("%s: expected %s and %d, got %s and %d", c.params, c.first, c.second, first, second)
+		}
+	}
+}
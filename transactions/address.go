@@ -0,0 +1,103 @@
+package transactions
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"naivecoin/utils"
+
+	"golang.org/x/crypto/ripemd160"
+)
+
+// pubKeyHashVersion is the version byte of pubkey-hash addresses
+const pubKeyHashVersion byte = 0x00
+
+// PubKeyHashTxVersion is the first transaction version that may pay to and spend from pubkey-hash addresses
+// transactions of version 0 use full public key addresses only, as the genesis transaction does
+const PubKeyHashTxVersion int = 1
+
+// CanonicalIdTxVersion is the first transaction version whose id hashes the canonical encoding of the transaction
+// ids of earlier versions concatenate fields in a way two different transactions may share
+const CanonicalIdTxVersion int = 2
+
+// CanonicalSignatureTxVersion is the first transaction version whose signatures must have low S and canonical encoding,
+// so that nobody but the signer can change them
+const CanonicalSignatureTxVersion int = 3
+
+// CoinbasePrevHashTxVersion is the first transaction version whose coinbase txIn refers to the hash of the prev block in TxOutId,
+// so that coinbase ids of blocks on different branches differ even for the same height, address and extra nonce
+const CoinbasePrevHashTxVersion int = 4
+
+// CurrentTxVersion is the version new transactions are created with
+const CurrentTxVersion int = CoinbasePrevHashTxVersion
+
+// maxTransactionVersion is the latest transaction version accepted
+const maxTransactionVersion int = CoinbasePrevHashTxVersion
+
+// GetPubKeyHashAddress returns the short address of a hex encoded public key:
+// base58check of the version byte and RIPEMD-160 of SHA-256 of the key
+func GetPubKeyHashAddress(publicKey string) (string, error) {
+	publicKeyBytes, err := hex.DecodeString(publicKey)
+	if err != nil || len(publicKeyBytes) == 0 {
+		return "", errors.New("public key is not hex encoded")
+	}
+	var payload []byte = append([]byte{pubKeyHashVersion}, hashPublicKey(publicKeyBytes)...)
+	return utils.Base58Encode(hex.EncodeToString(append(payload, utils.Checksum(payload)...)))
+}
+
+// hashPublicKey returns RIPEMD-160 of SHA-256 of a public key
+func hashPublicKey(publicKeyBytes []byte) []byte {
+	sha := sha256.Sum256(publicKeyBytes)
+	hasher := ripemd160.New()
+	hasher.Write(sha[:])
+	return hasher.Sum(nil)
+}
+
+// decodePubKeyHashAddress returns the public key hash held by a pubkey-hash address, false if the address is not one
+func decodePubKeyHashAddress(address string) ([]byte, bool) {
+	decodedHex, err := utils.Base58Decode(address)
+	if err != nil {
+		return nil, false
+	}
+	decoded, err := hex.DecodeString(decodedHex)
+	if err != nil || len(decoded) != 1+ripemd160.Size+4 || decoded[0] != pubKeyHashVersion {
+		return nil, false
+	}
+	var payload []byte = decoded[:1+ripemd160.Size]
+	if !bytes.Equal(utils.Checksum(payload), decoded[1+ripemd160.Size:]) {
+		return nil, false
+	}
+	return payload[1:], true
+}
+
+// IsPubKeyHashAddress checks if an address is a pubkey-hash address with a valid checksum
+func IsPubKeyHashAddress(address string) bool {
+	_, ok := decodePubKeyHashAddress(address)
+	return ok
+}
+
+// addressMatchesPublicKey checks if an address of either form belongs to a hex encoded public key
+func addressMatchesPublicKey(address string, publicKey string) bool {
+	if pubKeyHash, ok := decodePubKeyHashAddress(address); ok {
+		publicKeyBytes, err := hex.DecodeString(publicKey)
+		return err == nil && bytes.Equal(hashPublicKey(publicKeyBytes), pubKeyHash)
+	}
+	decoded, err := utils.Base58Decode(address)
+	return err == nil && decoded == publicKey
+}
+
+// GetRequiredVersion returns the lowest transaction version that can pay to given txOuts and spend given unspent txOuts
+func GetRequiredVersion(txOuts []TxOut, spentTxOuts []UnspentTxOut) int {
+	for _, txOut := range txOuts {
+		if IsPubKeyHashAddress(txOut.Address) {
+			return PubKeyHashTxVersion
+		}
+	}
+	for _, spentTxOut := range spentTxOuts {
+		if IsPubKeyHashAddress(spentTxOut.Address) {
+			return PubKeyHashTxVersion
+		}
+	}
+	return 0
+}
@@ -1,19 +1,43 @@
 package transactions
 
 import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
 	"naivecoin/utils"
+	"runtime"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 )
 
 const coinBaseAmount float64 = 50
 
+// MaxMoney is the largest amount a transaction may pay, far more than coinbase transactions can create in the lifetime of the chain
+const MaxMoney float64 = 1e12
+
+// ErrInvalidTxOutAmount is returned when a txOut amount is not a positive finite number or is above MaxMoney
+var ErrInvalidTxOutAmount = errors.New("invalid txOut amount")
+
+var logger *utils.Logger = utils.NewLogger("transactions")
+
 // TxIn defines structure of an incoming transaction
 type TxIn struct {
 	TxOutId    string
 	TxOutIndex int
 	Signature  string
+	// ExtraNonce is only set in coinbase txIns, it makes coinbase transactions unique
+	// for the same address and block height
+	ExtraNonce uint64
+	// PubKey is the public key of the spender, revealed when spending a txOut of a pubkey-hash address and empty otherwise
+	// like the signature, it is not a part of the transaction id
+	PubKey string `json:",omitempty" msgpack:",omitempty"`
 }
 
 // TxInCollection defines a collection of incoming transactions
@@ -22,7 +46,11 @@ type TxInCollection []TxIn
 // TxIn Content function to return contents of an incoming transaction in a string form
 func (t TxIn) Content() string {
 	// signature field is left out on purpose, as it will be computed later
-	return fmt.Sprintf("%s;%d", t.TxOutId, t.TxOutIndex)
+	// extra nonce is left out when not set to keep ids of existing transactions (genesis) unchanged
+	if t.ExtraNonce == 0 {
+		return fmt.Sprintf("%s;%d", t.TxOutId, t.TxOutIndex)
+	}
+	return fmt.Sprintf("%s;%d;%d", t.TxOutId, t.TxOutIndex, t.ExtraNonce)
 }
 
 // TxInCollection Content function to return contents of a collection of incoming transactions in a string form
@@ -66,42 +94,150 @@ type UnspentTxOut struct {
 }
 
 // Transaction defines a structure of incoming and outgoing transactions
+// Version is 0 for transactions using full public key addresses only, see PubKeyHashTxVersion and CanonicalIdTxVersion
 type Transaction struct {
-	Id     string
-	TxIns  TxInCollection
-	TxOuts TxOutCollection
+	Id      string
+	TxIns   TxInCollection
+	TxOuts  TxOutCollection
+	Version int `json:",omitempty" msgpack:",omitempty"`
 }
 
-// GetTransactionId returns an Id for a transaction based on SHA-256 hash of its contents
+// hasher computes transaction ids, set from chain parameters
+var hasher utils.Hasher = utils.SHA256Hasher{}
+
+// SetHasher sets the hasher transaction ids are computed with
+func SetHasher(hasher_ utils.Hasher) {
+	hasher = hasher_
+}
+
+// coinbasePrevHashHeight is the height from which every coinbase txIn must refer to the prev block hash, whatever the
+// version of the coinbase transaction, set from chain parameters
+var coinbasePrevHashHeight int = 0
+
+// SetCoinbasePrevHashHeight sets the height from which coinbase transactions must refer to the prev block hash
+func SetCoinbasePrevHashHeight(height int) {
+	coinbasePrevHashHeight = height
+}
+
+// hashContent returns the hex encoded hash of transaction contents
+func hashContent(content string) string {
+	return hex.EncodeToString(hasher.Sum(content))
+}
+
+// GetTransactionId returns an Id for a transaction based on a hash of its contents, SHA-256 unless chain parameters set another hasher
+// transactions of CanonicalIdTxVersion and later hash their canonical encoding,
+// older versions hash their Content strings to keep ids of existing transactions unchanged, version 0 is left out of them
 func GetTransactionId(transaction Transaction) string {
-	return utils.Hash(transaction.TxIns.Content() + ";" + transaction.TxOuts.Content())
+	if transaction.Version >= CanonicalIdTxVersion {
+		return hashContent(canonicalContent(transaction))
+	}
+	if transaction.Version != 0 {
+		return hashContent(fmt.Sprintf("v%d;", transaction.Version) + transaction.TxIns.Content() + ";" + transaction.TxOuts.Content())
+	}
+	return hashContent(transaction.TxIns.Content() + ";" + transaction.TxOuts.Content())
+}
+
+// canonicalContent encodes the signed fields of a transaction unambiguously: every field is prefixed with its length
+// and every collection with its number of items, amounts keep full precision
+// signatures and public keys are left out, as in Content strings
+func canonicalContent(transaction Transaction) string {
+	var b strings.Builder
+	utils.WriteCanonicalField(&b, strconv.Itoa(transaction.Version))
+	utils.WriteCanonicalField(&b, strconv.Itoa(len(transaction.TxIns)))
+	for _, txIn := range transaction.TxIns {
+		utils.WriteCanonicalField(&b, txIn.TxOutId)
+		utils.WriteCanonicalField(&b, strconv.Itoa(txIn.TxOutIndex))
+		utils.WriteCanonicalField(&b, strconv.FormatUint(txIn.ExtraNonce, 10))
+	}
+	utils.WriteCanonicalField(&b, strconv.Itoa(len(transaction.TxOuts)))
+	for _, txOut := range transaction.TxOuts {
+		utils.WriteCanonicalField(&b, txOut.Address)
+		utils.WriteCanonicalField(&b, strconv.FormatFloat(txOut.Amount, 'g', -1, 64))
+	}
+	return b.String()
+}
+
+// GetTransactionSize returns the size of a transaction serialized the same way it is sent to peers
+func GetTransactionSize(transaction Transaction) int {
+	bytes, err := json.Marshal(transaction)
+	if err != nil {
+		return 0
+	}
+	return len(bytes)
+}
+
+// GetTransactionFee returns a fee paid by a transaction: the difference between its txIn and txOut amounts
+// fees are not collected by the miner, they are burned
+func GetTransactionFee(transaction Transaction, unspentTxOuts_ []UnspentTxOut) float64 {
+	var fee float64
+	for n := 0; n < len(transaction.TxIns); n++ {
+		fee += getTxInAmount(transaction.TxIns[n], unspentTxOuts_)
+	}
+	for n := 0; n < len(transaction.TxOuts); n++ {
+		fee -= transaction.TxOuts[n].Amount
+	}
+	return fee
+}
+
+// GetFeeRate returns a fee paid by a transaction per byte of its serialized size
+func GetFeeRate(transaction Transaction, unspentTxOuts_ []UnspentTxOut) float64 {
+	var size int = GetTransactionSize(transaction)
+	if size == 0 {
+		return 0
+	}
+	return GetTransactionFee(transaction, unspentTxOuts_) / float64(size)
+}
+
+// signatureCheck verifies the signature of a txIn of a transaction with the public key of the txOut it spends
+type signatureCheck func(txIn TxIn, transaction Transaction, publicKey string) bool
+
+// verifyTxInSignature verifies the signature of a txIn of a transaction with a given public key
+func verifyTxInSignature(txIn TxIn, transaction Transaction, publicKey string) bool {
+	// signatures of earlier transactions were not normalized, requiring canonical ones would invalidate them
+	return utils.VerifySignature(transaction.Id, txIn.Signature, publicKey, transaction.Version >= CanonicalSignatureTxVersion)
 }
 
 // validateTxIn validates an incoming transaction, returns true if valid, false otherwise
-func validateTxIn(txIn TxIn, transaction Transaction, unspentTxOuts_ []UnspentTxOut) bool {
-	// new transaction must reference a previously unspent outgoing transaction
-	var referencedUTxOut UnspentTxOut
-	var found bool = false
-	for _, v := range unspentTxOuts_ {
-		if v.TxOutId == txIn.TxOutId && v.TxOutIndex == txIn.TxOutIndex {
-			referencedUTxOut = v
-			found = true
-			break
-		}
+func validateTxIn(txIn TxIn, transaction Transaction, unspentTxOuts_ []UnspentTxOut, checkSignature signatureCheck) bool {
+	referencedUTxOut, publicKey, err := resolveTxInPublicKey(txIn, transaction, unspentTxOuts_)
+	if err != nil {
+		logger.Warn("invalid txIn", "tx", transaction.Id, "txIn", txIn.Content(), "err", err)
+		return false
 	}
-	if !found {
-		fmt.Println("referenced txOut not found: " + txIn.Content())
+	if !checkSignature(txIn, transaction, publicKey) {
+		logger.Warn("invalid txIn signature", "tx", transaction.Id, "signature", txIn.Signature, "address", referencedUTxOut.Address)
 		return false
 	}
+	return true
+}
+
+// resolveTxInPublicKey returns the unspent txOut a txIn spends and the public key its signature is verified with
+func resolveTxInPublicKey(txIn TxIn, transaction Transaction, unspentTxOuts_ []UnspentTxOut) (UnspentTxOut, string, error) {
+	// new transaction must reference a previously unspent outgoing transaction
+	referencedUTxOut, err := findUnspentTxOut(txIn.TxOutId, txIn.TxOutIndex, unspentTxOuts_)
+	if err != nil {
+		return UnspentTxOut{}, "", errors.New("referenced txOut not found")
+	}
 
+	// a pubkey-hash address commits to a public key the spender reveals, a full public key address is the key itself
 	var base58Address string = referencedUTxOut.Address
-	var publicKey = utils.Base58Decode(base58Address)
-	var isValidSignature bool = utils.VerifySignature(transaction.Id, txIn.Signature, publicKey)
-	if !isValidSignature {
-		fmt.Printf("invalid txIn signature: %s txId: %s address: %s", txIn.Signature, transaction.Id, referencedUTxOut.Address)
-		return false
+	if IsPubKeyHashAddress(base58Address) {
+		if transaction.Version < PubKeyHashTxVersion {
+			return UnspentTxOut{}, "", fmt.Errorf("txIn spends a pubkey-hash address in a transaction of version %d", transaction.Version)
+		}
+		if !addressMatchesPublicKey(base58Address, txIn.PubKey) {
+			return UnspentTxOut{}, "", errors.New("txIn public key does not match the address it spends")
+		}
+		return referencedUTxOut, txIn.PubKey, nil
 	}
-	return true
+	if txIn.PubKey != "" {
+		return UnspentTxOut{}, "", errors.New("txIn spending a full public key address must not reveal a public key")
+	}
+	publicKey, err := utils.Base58Decode(base58Address)
+	if err != nil {
+		return UnspentTxOut{}, "", fmt.Errorf("txIn spends an invalid address %s: %w", base58Address, err)
+	}
+	return referencedUTxOut, publicKey, nil
 }
 
 // getTxInAmount returns an amount of txOut that is referenced by a txIn
@@ -123,10 +259,25 @@ func findUnspentTxOut(txOutId string, txOutIndex int, unspentTxOuts_ []UnspentTx
 	return UnspentTxOut{}, fmt.Errorf("unspent txOut not found")
 }
 
-// GetCoinbaseTransaction returns a coinbase transaction
-func GetCoinbaseTransaction(base58Address string, blockIndex int) Transaction {
+// newExtraNonce returns a random non-zero extra nonce for a coinbase transaction
+func newExtraNonce() uint64 {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		logger.Error("failed to generate extra nonce", "err", err)
+	}
+	var extraNonce uint64 = binary.BigEndian.Uint64(b[:])
+	if extraNonce == 0 {
+		return 1
+	}
+	return extraNonce
+}
+
+// GetCoinbaseTransaction returns a coinbase transaction of a block at a given index following a block with a given hash
+func GetCoinbaseTransaction(base58Address string, blockIndex int, prevHash string) Transaction {
 	var txIn TxIn = TxIn{
+		TxOutId:    prevHash,
 		TxOutIndex: blockIndex,
+		ExtraNonce: newExtraNonce(),
 	}
 
 	var txOut TxOut = TxOut{
@@ -135,25 +286,83 @@ func GetCoinbaseTransaction(base58Address string, blockIndex int) Transaction {
 	}
 
 	var t Transaction = Transaction{
-		TxIns:  TxInCollection{txIn},
-		TxOuts: TxOutCollection{txOut},
+		TxIns:   TxInCollection{txIn},
+		TxOuts:  TxOutCollection{txOut},
+		Version: CurrentTxVersion,
 	}
 
 	t.Id = GetTransactionId(t)
 	return t
 }
 
-// ValidateTransaction validates transactions: must have valid id, valid txIn, total txIn amount must be equal to txOut amount
+// IncrementExtraNonce returns a copy of a coinbase transaction with the next extra nonce and a recomputed id
+// used as additional proof-of-work search space when block nonce is exhausted
+func IncrementExtraNonce(coinbaseTx Transaction) Transaction {
+	var txIns TxInCollection = make(TxInCollection, len(coinbaseTx.TxIns))
+	copy(txIns, coinbaseTx.TxIns)
+	txIns[0].ExtraNonce++
+	// zero extra nonce is not included in the id, skip it on overflow
+	if txIns[0].ExtraNonce == 0 {
+		txIns[0].ExtraNonce = 1
+	}
+	coinbaseTx.TxIns = txIns
+	coinbaseTx.Id = GetTransactionId(coinbaseTx)
+	return coinbaseTx
+}
+
+// ValidateTxOutAmounts checks that every txOut of a transaction pays a positive finite amount and they pay no more than MaxMoney together
+// a negative amount would let other txOuts pay more than the txIns spend, a NaN one would poison every sum it is added to
+func ValidateTxOutAmounts(transaction Transaction) error {
+	var total float64
+	for n := 0; n < len(transaction.TxOuts); n++ {
+		var amount float64 = transaction.TxOuts[n].Amount
+		if math.IsNaN(amount) || math.IsInf(amount, 0) || amount <= 0 || amount > MaxMoney {
+			return fmt.Errorf("%w: txOut %d of tx %s pays %v", ErrInvalidTxOutAmount, n, transaction.Id, amount)
+		}
+		total += amount
+	}
+	if total > MaxMoney {
+		return fmt.Errorf("%w: txOuts of tx %s pay %v, more than %v", ErrInvalidTxOutAmount, transaction.Id, total, MaxMoney)
+	}
+	return nil
+}
+
+// validateVersion checks that a transaction has a known version which allows the addresses it pays to
+func validateVersion(transaction Transaction) bool {
+	if transaction.Version < 0 || transaction.Version > maxTransactionVersion {
+		logger.Warn("unsupported tx version", "tx", transaction.Id, "version", transaction.Version)
+		return false
+	}
+	if transaction.Version < GetRequiredVersion(transaction.TxOuts, nil) {
+		logger.Warn("tx of an old version pays to a pubkey-hash address", "tx", transaction.Id, "version", transaction.Version)
+		return false
+	}
+	return true
+}
+
+// ValidateTransaction validates transactions: must have valid id and version, valid txIn, total txIn amount must not be less than txOut amount
 func ValidateTransaction(transaction Transaction, unspentTxOuts_ []UnspentTxOut) bool {
+	return validateTransaction(transaction, unspentTxOuts_, verifyTxInSignature)
+}
+
+// validateTransaction validates a transaction as ValidateTransaction does, checking signatures of its txIns with a given check
+func validateTransaction(transaction Transaction, unspentTxOuts_ []UnspentTxOut, checkSignature signatureCheck) bool {
 	if GetTransactionId(transaction) != transaction.Id {
-		fmt.Println("Invalid tx id: " + transaction.Id)
+		logger.Warn("invalid tx id", "tx", transaction.Id)
+		return false
+	}
+	if !validateVersion(transaction) {
+		return false
+	}
+	if err := ValidateTxOutAmounts(transaction); err != nil {
+		logger.Warn("invalid tx amounts", "tx", transaction.Id, "err", err)
 		return false
 	}
 
 	var totalTxInValues float64
 	for n := 0; n < len(transaction.TxIns); n++ {
-		if !validateTxIn(transaction.TxIns[n], transaction, unspentTxOuts_) {
-			fmt.Println("some of the txIns are invalid in tx: " + transaction.Id)
+		if !validateTxIn(transaction.TxIns[n], transaction, unspentTxOuts_, checkSignature) {
+			logger.Warn("some of the txIns are invalid", "tx", transaction.Id)
 			return false
 		}
 		totalTxInValues += getTxInAmount(transaction.TxIns[n], unspentTxOuts_)
@@ -164,8 +373,9 @@ func ValidateTransaction(transaction Transaction, unspentTxOuts_ []UnspentTxOut)
 		totalTxOutValues += transaction.TxOuts[n].Amount
 	}
 
-	if totalTxInValues != totalTxOutValues {
-		fmt.Println("totalTxOutValues != totalTxInValues in tx: " + transaction.Id)
+	// the difference between txIn and txOut amounts is the transaction fee
+	if totalTxInValues < totalTxOutValues {
+		logger.Warn("tx spends more than its txIns", "tx", transaction.Id, "txIns", totalTxInValues, "txOuts", totalTxOutValues)
 		return false
 	}
 
@@ -173,25 +383,40 @@ func ValidateTransaction(transaction Transaction, unspentTxOuts_ []UnspentTxOut)
 }
 
 // validateCoinbaseTx validates a coinbase transaction: msut have valid id, exactly one txIn and txOut, valid index and amount
-func validateCoinbaseTx(transaction Transaction, blockIndex int) bool {
+// any extra nonce is accepted, as it is covered by the transaction id
+// from coinbasePrevHashHeight on the txIn must refer to the prev block hash whatever the version, below it only CoinbasePrevHashTxVersion
+// coinbases must, an older version would otherwise let blocks of different branches share coinbase ids again
+func validateCoinbaseTx(transaction Transaction, blockIndex int, prevHash string) bool {
 	if GetTransactionId(transaction) != transaction.Id {
-		fmt.Println("invalid coinbase tx id: " + transaction.Id)
+		logger.Warn("invalid coinbase tx id", "tx", transaction.Id)
+		return false
+	}
+	if !validateVersion(transaction) {
 		return false
 	}
 	if len(transaction.TxIns) != 1 {
-		fmt.Println("one txIn must be specified in the coinbase transaction")
+		logger.Warn("one txIn must be specified in the coinbase transaction", "tx", transaction.Id, "txIns", len(transaction.TxIns))
 		return false
 	}
 	if transaction.TxIns[0].TxOutIndex != blockIndex {
-		fmt.Println("the txIn signature in coinbase tx must be the block height")
+		logger.Warn("the txIn of the coinbase transaction must refer to the block height", "tx", transaction.Id, "index", blockIndex)
+		return false
+	}
+	var commitsPrevHash bool = transaction.Version >= CoinbasePrevHashTxVersion || blockIndex >= coinbasePrevHashHeight
+	if commitsPrevHash && transaction.TxIns[0].TxOutId != prevHash {
+		logger.Warn("the txIn of the coinbase transaction must refer to the prev block hash", "tx", transaction.Id, "prevHash", prevHash)
 		return false
 	}
 	if len(transaction.TxOuts) != 1 {
-		fmt.Println("invalid number of txOuts in coinbase transaction")
+		logger.Warn("invalid number of txOuts in coinbase transaction", "tx", transaction.Id, "txOuts", len(transaction.TxOuts))
+		return false
+	}
+	if err := ValidateTxOutAmounts(transaction); err != nil {
+		logger.Warn("invalid coinbase tx amounts", "tx", transaction.Id, "err", err)
 		return false
 	}
 	if transaction.TxOuts[0].Amount != coinBaseAmount {
-		fmt.Println("invalid coinbase amount in coinbase transaction")
+		logger.Warn("invalid coinbase amount in coinbase transaction", "tx", transaction.Id, "amount", transaction.TxOuts[0].Amount)
 		return false
 	}
 	return true
@@ -203,7 +428,7 @@ func hasDuplicateTxIns(txIns []TxIn) bool {
 	for n := 0; n < len(txIns); n++ {
 		var key string = txIns[n].TxOutId + fmt.Sprint(txIns[n].TxOutIndex)
 		if hashmap[key] {
-			fmt.Println("has duplicate txIn: " + key)
+			logger.Warn("duplicate txIn", "txIn", key)
 			return true
 		}
 		hashmap[key] = true
@@ -212,17 +437,24 @@ func hasDuplicateTxIns(txIns []TxIn) bool {
 }
 
 // validateBlockTransactions validates provided transactions: must have a valid coinbase tx, no duplicates txIns, valid txIns
-func validateBlockTransactions(transactions []Transaction, unspentTxOuts_ []UnspentTxOut, blockIndex int) bool {
+// the coinbase id must not be the id of an unspent txOut, so that txOuts of two coinbase transactions are never confused
+func validateBlockTransactions(transactions []Transaction, unspentTxOuts_ []UnspentTxOut, blockIndex int, prevHash string) bool {
 	if len(transactions) == 0 {
-		fmt.Println("the first transaction in the block must be coinbase transaction")
+		logger.Warn("the first transaction in the block must be coinbase transaction", "index", blockIndex)
 		return false
 	}
 
 	var coinbaseTx = transactions[0]
-	if !validateCoinbaseTx(coinbaseTx, blockIndex) {
-		fmt.Println("invalid coinbase transaction: " + fmt.Sprintf("%v", coinbaseTx))
+	if !validateCoinbaseTx(coinbaseTx, blockIndex, prevHash) {
+		logger.Warn("invalid coinbase transaction", "tx", coinbaseTx.Id, "index", blockIndex)
 		return false
 	}
+	for n := 0; n < len(unspentTxOuts_); n++ {
+		if unspentTxOuts_[n].TxOutId == coinbaseTx.Id {
+			logger.Warn("coinbase transaction has the id of an unspent txOut", "tx", coinbaseTx.Id, "index", blockIndex)
+			return false
+		}
+	}
 
 	// flatten txIns list
 	var txInsFlattened []TxIn = []TxIn{}
@@ -234,9 +466,13 @@ func validateBlockTransactions(transactions []Transaction, unspentTxOuts_ []Unsp
 		return false
 	}
 
-	// validate all but coinbase transactions
+	// validate all but coinbase transactions, in order, with signatures verified beforehand on all cores
+	var signatures map[signedTxIn]bool = verifySignatures(transactions[1:], unspentTxOuts_)
+	var checkSignature signatureCheck = func(txIn TxIn, transaction Transaction, publicKey string) bool {
+		return signatures[signedTxIn{txId: transaction.Id, txOutId: txIn.TxOutId, txOutIndex: txIn.TxOutIndex}]
+	}
 	for n := 1; n < len(transactions); n++ {
-		if !ValidateTransaction(transactions[n], unspentTxOuts_) {
+		if !validateTransaction(transactions[n], unspentTxOuts_, checkSignature) {
 			return false
 		}
 	}
@@ -244,8 +480,79 @@ func validateBlockTransactions(transactions []Transaction, unspentTxOuts_ []Unsp
 	return true
 }
 
+// signedTxIn identifies a txIn of a block by its transaction and the txOut it spends, txIns of a block spend distinct txOuts
+type signedTxIn struct {
+	txId       string
+	txOutId    string
+	txOutIndex int
+}
+
+// verifySignatures verifies signatures of all txIns of given transactions on up to GOMAXPROCS workers
+// returns whether each signature is valid, txIns whose public key can't be resolved are left out
+func verifySignatures(transactions []Transaction, unspentTxOuts_ []UnspentTxOut) map[signedTxIn]bool {
+	type signatureJob struct {
+		transaction int
+		txIn        int
+	}
+	var jobs []signatureJob = []signatureJob{}
+	for n := 0; n < len(transactions); n++ {
+		for m := 0; m < len(transactions[n].TxIns); m++ {
+			jobs = append(jobs, signatureJob{transaction: n, txIn: m})
+		}
+	}
+	var results []bool = make([]bool, len(jobs))
+	var resolved []bool = make([]bool, len(jobs))
+
+	var workers int = runtime.GOMAXPROCS(0)
+	if workers > len(jobs) {
+		workers = len(jobs)
+	}
+	var next int64 = -1
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				var n int = int(atomic.AddInt64(&next, 1))
+				if n >= len(jobs) {
+					return
+				}
+				var transaction Transaction = transactions[jobs[n].transaction]
+				var txIn TxIn = transaction.TxIns[jobs[n].txIn]
+				_, publicKey, err := resolveTxInPublicKey(txIn, transaction, unspentTxOuts_)
+				if err != nil {
+					continue
+				}
+				resolved[n] = true
+				results[n] = verifyTxInSignature(txIn, transaction, publicKey)
+			}
+		}()
+	}
+	wg.Wait()
+
+	var signatures map[signedTxIn]bool = make(map[signedTxIn]bool, len(jobs))
+	for n := 0; n < len(jobs); n++ {
+		if resolved[n] {
+			var txIn TxIn = transactions[jobs[n].transaction].TxIns[jobs[n].txIn]
+			signatures[signedTxIn{txId: transactions[jobs[n].transaction].Id, txOutId: txIn.TxOutId, txOutIndex: txIn.TxOutIndex}] = results[n]
+		}
+	}
+	return signatures
+}
+
 // SignTxIn returns a signature for transaction id, signed by provided private key
 func SignTxIn(transaction Transaction, txInIndex int, privateKey string, unspentTxOuts []UnspentTxOut) (string, error) {
+	key, err := utils.HexToPrivateKey(privateKey)
+	if err != nil {
+		return "", err
+	}
+	return SignTxInWithKey(transaction, txInIndex, key, unspentTxOuts)
+}
+
+// SignTxInWithKey returns a signature for transaction id, signed by a parsed private key,
+// so that a key signing several txIns is parsed once
+func SignTxInWithKey(transaction Transaction, txInIndex int, key *ecdsa.PrivateKey, unspentTxOuts []UnspentTxOut) (string, error) {
 	var txIn TxIn = transaction.TxIns[txInIndex]
 
 	referencedUnspentTxOut, err := findUnspentTxOut(txIn.TxOutId, txIn.TxOutIndex, unspentTxOuts)
@@ -253,14 +560,19 @@ func SignTxIn(transaction Transaction, txInIndex int, privateKey string, unspent
 		return "", err
 	}
 
-	var referencedBase58Address string = referencedUnspentTxOut.Address
-	var referencedPublicKey = utils.Base58Decode(referencedBase58Address)
-
-	if utils.GetPublicKey(privateKey) != referencedPublicKey {
+	if !addressMatchesPublicKey(referencedUnspentTxOut.Address, utils.PublicKeyToHex(&key.PublicKey)) {
 		return "", errors.New("trying to sign an input with private key that does not match the address that is referenced in txIn")
 	}
 
-	return utils.GetSignature(transaction.Id, privateKey), nil
+	idBytes, err := hex.DecodeString(transaction.Id)
+	if err != nil {
+		return "", fmt.Errorf("transaction id is not hex encoded: %s", transaction.Id)
+	}
+	signature, err := utils.SignHash(idBytes, key)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(signature), nil
 }
 
 // updateUnspentTxOuts updates unspent txOut
@@ -306,27 +618,33 @@ func updateUnspentTxOuts(transactions []Transaction, unspentTxOuts_ []UnspentTxO
 	return resultingUnspentTxOuts
 }
 
-// ProcessTransactions validates all given transactins, and returs an updated list of all unspent txOuts
-func ProcessTransactions(transactions []Transaction, unspentTxOuts_ []UnspentTxOut, blockIndex int) ([]UnspentTxOut, error) {
-	if !validateBlockTransactions(transactions, unspentTxOuts_, blockIndex) {
+// ProcessTransactions validates all given transactins of a block at a given index following a block with a given hash,
+// and returs an updated list of all unspent txOuts
+func ProcessTransactions(transactions []Transaction, unspentTxOuts_ []UnspentTxOut, blockIndex int, prevHash string) ([]UnspentTxOut, error) {
+	if !validateBlockTransactions(transactions, unspentTxOuts_, blockIndex, prevHash) {
 		return []UnspentTxOut{}, errors.New("invalid block transactions")
 	}
 	return updateUnspentTxOuts(transactions, unspentTxOuts_), nil
 }
 
-// IsValidAddress validates wallet address: must be of length 130, start with 04, contain only hex characters
-// TODO: wallet address better be base58 encoded: shorter, distinct characters
+// IsValidAddress validates wallet address: either a pubkey-hash address with a valid checksum,
+// or a full public key: must be of length 130, start with 04, contain only hex characters
 func IsValidBase58Address(base58Address string) bool {
-	address := utils.Base58Decode(base58Address)
-	if len(address) != 130 {
-		fmt.Println(address)
-		fmt.Println("invalid public key length")
+	if IsPubKeyHashAddress(base58Address) {
+		return true
+	}
+	address, err := utils.Base58Decode(base58Address)
+	if err != nil {
+		logger.Debug("invalid address", "address", base58Address, "err", err)
+		return false
+	} else if len(address) != 130 {
+		logger.Debug("invalid public key length", "address", base58Address, "length", len(address))
 		return false
 	} else if !utils.IsHex(address) {
-		fmt.Printf("public key must contain only hex characters: %s\n", address)
+		logger.Debug("public key must contain only hex characters", "address", base58Address)
 		return false
 	} else if !strings.HasPrefix(address, "04") {
-		fmt.Println("public key must start with 04")
+		logger.Debug("public key must start with 04", "address", base58Address)
 		return false
 	}
 	return true
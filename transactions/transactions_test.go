@@ -0,0 +1,297 @@
+package transactions
+
+import (
+	"encoding/asn1"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"math/rand"
+	"naivecoin/utils"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/crypto/secp256k1"
+)
+
+func TestCanonicalIdsOfContentCollisions(test *testing.T) {
+	// each pair is two different transactions with the same Content strings
+	var cases = []struct {
+		name   string
+		first  Transaction
+		second Transaction
+	}{
+		{
+			name:   "amounts beyond 6 decimals",
+			first:  Transaction{TxIns: TxInCollection{{TxOutId: "a", TxOutIndex: 0}}, TxOuts: TxOutCollection{{Address: "b", Amount: 1.0000001}}},
+			second: Transaction{TxIns: TxInCollection{{TxOutId: "a", TxOutIndex: 0}}, TxOuts: TxOutCollection{{Address: "b", Amount: 1.0000004}}},
+		},
+		{
+			name:   "txOut address holding another txOut",
+			first:  Transaction{TxIns: TxInCollection{{TxOutId: "a", TxOutIndex: 0}}, TxOuts: TxOutCollection{{Address: "b;1.000000c", Amount: 2}}},
+			second: Transaction{TxIns: TxInCollection{{TxOutId: "a", TxOutIndex: 0}}, TxOuts: TxOutCollection{{Address: "b", Amount: 1}, {Address: "c", Amount: 2}}},
+		},
+		{
+			name:   "txOut id holding another txIn",
+			first:  Transaction{TxIns: TxInCollection{{TxOutId: "a;1b", TxOutIndex: 2}}, TxOuts: TxOutCollection{{Address: "c", Amount: 1}}},
+			second: Transaction{TxIns: TxInCollection{{TxOutId: "a", TxOutIndex: 1}, {TxOutId: "b", TxOutIndex: 2}}, TxOuts: TxOutCollection{{Address: "c", Amount: 1}}},
+		},
+	}
+	for _, c := range cases {
+		for _, version := range []int{0, PubKeyHashTxVersion} {
+			c.first.Version, c.second.Version = version, version
+			if GetTransactionId(c.first) != GetTransactionId(c.second) {
+				test.Fatalf("%s: expected ids of version %d to collide", c.name, version)
+			}
+		}
+		for _, version := range []int{CanonicalIdTxVersion, CurrentTxVersion} {
+			c.first.Version, c.second.Version = version, version
+			if GetTransactionId(c.first) == GetTransactionId(c.second) {
+				test.Fatalf("%s: ids of version %d must differ", c.name, version)
+			}
+		}
+	}
+}
+
+func TestGenesisTransactionIdUnchanged(test *testing.T) {
+	var genesis Transaction = Transaction{
+		TxIns: TxInCollection{TxIn{}},
+		TxOuts: TxOutCollection{{
+			Address: "S7H2fmjGPxznuu9NPcnYCyEqdg1ebSbMN6AJRqQQo4Z1D1yQdKwEGwiJezSDka6yqHDSb2jqaf3Tewg1tryEbDzG",
+			Amount:  50,
+		}},
+	}
+	if id := GetTransactionId(genesis); id != "62530d1bbbf4f75200448207cbc3c84b4b67fe7a85eddf6f5c3e4bbac4461b82" {
+		test.Fatalf("genesis transaction id changed to %s", id)
+	}
+}
+
+// testAddress returns the full public key address of the test key n
+func testAddress(tb testing.TB, n int) (string, string) {
+	var privateKey string = fmt.Sprintf("%064x", n)
+	publicKey, err := utils.GetPublicKey(privateKey)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	address, err := utils.Base58Encode(publicKey)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return privateKey, address
+}
+
+// testSignedTransaction returns a transaction of a given version spending a txOut of the test key n, signed by that key
+func testSignedTransaction(tb testing.TB, version int, n int) (Transaction, []UnspentTxOut) {
+	privateKey, address := testAddress(tb, n)
+	var unspentTxOuts []UnspentTxOut = []UnspentTxOut{{TxOutId: utils.Hash("txOut"), TxOutIndex: 0, Address: address, Amount: 50}}
+	var transaction Transaction = Transaction{
+		Version: version,
+		TxIns:   TxInCollection{{TxOutId: unspentTxOuts[0].TxOutId, TxOutIndex: 0}},
+		TxOuts:  TxOutCollection{{Address: address, Amount: 50}},
+	}
+	transaction.Id = GetTransactionId(transaction)
+	signature, err := SignTxIn(transaction, 0, privateKey, unspentTxOuts)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	transaction.TxIns[0].Signature = signature
+	return transaction, unspentTxOuts
+}
+
+// malleate returns the other signature of the pair (R, S) and (R, N-S), valid for the same hash and key
+func malleate(tb testing.TB, signature string) string {
+	sigBytes, err := hex.DecodeString(signature)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	var sig struct{ R, S *big.Int }
+	if _, err := asn1.Unmarshal(sigBytes, &sig); err != nil {
+		tb.Fatal(err)
+	}
+	sig.S = new(big.Int).Sub(secp256k1.S256().Params().N, sig.S)
+	malleated, err := asn1.Marshal(sig)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return hex.EncodeToString(malleated)
+}
+
+func TestMalleatedSignatureRefused(test *testing.T) {
+	transaction, unspentTxOuts := testSignedTransaction(test, CurrentTxVersion, 1)
+	if !validateTxIn(transaction.TxIns[0], transaction, unspentTxOuts, verifyTxInSignature) {
+		test.Fatal("signature of the wallet must be valid")
+	}
+
+	var malleated TxIn = transaction.TxIns[0]
+	malleated.Signature = malleate(test, malleated.Signature)
+	sigBytes, _ := hex.DecodeString(malleated.Signature)
+	if utils.IsCanonicalSignature(sigBytes) {
+		test.Fatal("malleated signature must have high S")
+	}
+	if validateTxIn(malleated, transaction, unspentTxOuts, verifyTxInSignature) {
+		test.Fatal("malleated high-S signature must be refused")
+	}
+	if ValidateTransaction(Transaction{Id: transaction.Id, Version: transaction.Version, TxIns: TxInCollection{malleated}, TxOuts: transaction.TxOuts}, unspentTxOuts) {
+		test.Fatal("transaction with a malleated signature must be refused")
+	}
+
+	// transactions before canonical signatures keep accepting both signatures of the pair
+	legacy, legacyUnspentTxOuts := testSignedTransaction(test, CanonicalSignatureTxVersion-1, 1)
+	var legacyMalleated TxIn = legacy.TxIns[0]
+	legacyMalleated.Signature = malleate(test, legacyMalleated.Signature)
+	if !validateTxIn(legacyMalleated, legacy, legacyUnspentTxOuts, verifyTxInSignature) {
+		test.Fatalf("high-S signature of a version %d transaction must stay valid", legacy.Version)
+	}
+}
+
+func TestMalformedPublicKeysRefused(test *testing.T) {
+	var random *rand.Rand = rand.New(rand.NewSource(368))
+	_, address := testAddress(test, 1)
+	validKey, err := utils.Base58Decode(address)
+	if err != nil {
+		test.Fatal(err)
+	}
+	var publicKeys []string = []string{
+		validKey[:2],
+		validKey[:66],
+		validKey[:len(validKey)-2],
+		validKey[:len(validKey)-1] + "0",
+		"04" + strings.Repeat("0", 128),
+		"02" + validKey[2:66],
+		validKey + "00",
+	}
+	for n := 0; n < 50; n++ {
+		var key []byte = make([]byte, 1+random.Intn(80))
+		random.Read(key)
+		if n%2 == 0 {
+			key[0] = 4
+		}
+		publicKeys = append(publicKeys, hex.EncodeToString(key))
+	}
+
+	for _, publicKey := range publicKeys {
+		// the signature is a valid one of another key, so only the public key makes the txIn invalid
+		signed, _ := testSignedTransaction(test, CurrentTxVersion, 1)
+		fullAddress, err := utils.Base58Encode(publicKey)
+		if err != nil {
+			test.Fatal(err)
+		}
+		pubKeyHashAddress, err := GetPubKeyHashAddress(publicKey)
+		if err != nil {
+			test.Fatal(err)
+		}
+		for _, spent := range []struct {
+			address string
+			pubKey  string
+		}{{fullAddress, ""}, {pubKeyHashAddress, publicKey}} {
+			var unspentTxOuts []UnspentTxOut = []UnspentTxOut{{TxOutId: signed.TxIns[0].TxOutId, TxOutIndex: 0, Address: spent.address, Amount: 50}}
+			var txIn TxIn = signed.TxIns[0]
+			txIn.PubKey = spent.pubKey
+			if validateTxIn(txIn, signed, unspentTxOuts, verifyTxInSignature) {
+				test.Fatalf("txIn spending %s with public key %q must be invalid", spent.address, publicKey)
+			}
+		}
+		if utils.VerifySignature(signed.Id, signed.TxIns[0].Signature, publicKey, false) {
+			test.Fatalf("public key %q must not verify a signature", publicKey)
+		}
+	}
+
+	// a pubkey-hash address spent without revealing its public key, or with a truncated one
+	pubKeyHashAddress, err := GetPubKeyHashAddress(validKey)
+	if err != nil {
+		test.Fatal(err)
+	}
+	signed, _ := testSignedTransaction(test, CurrentTxVersion, 1)
+	var unspentTxOuts []UnspentTxOut = []UnspentTxOut{{TxOutId: signed.TxIns[0].TxOutId, TxOutIndex: 0, Address: pubKeyHashAddress, Amount: 50}}
+	for _, pubKey := range []string{"", validKey[:64], "zz"} {
+		var txIn TxIn = signed.TxIns[0]
+		txIn.PubKey = pubKey
+		if validateTxIn(txIn, signed, unspentTxOuts, verifyTxInSignature) {
+			test.Fatalf("txIn revealing public key %q must be invalid", pubKey)
+		}
+	}
+	for _, publicKey := range []string{"", "zz", validKey[:65]} {
+		if utils.VerifySignature(signed.Id, signed.TxIns[0].Signature, publicKey, false) {
+			test.Fatalf("public key %q must not verify a signature", publicKey)
+		}
+	}
+}
+
+// testBlockTransactions returns a coinbase transaction and count transactions each spending its own txOut, with the txOuts they spend
+func testBlockTransactions(tb testing.TB, count int) ([]Transaction, []UnspentTxOut) {
+	var prevHash string = utils.Hash("prev block")
+	_, minerAddress := testAddress(tb, 100)
+	var transactions []Transaction = []Transaction{GetCoinbaseTransaction(minerAddress, 1, prevHash)}
+	var unspentTxOuts []UnspentTxOut = []UnspentTxOut{}
+	for n := 0; n < count; n++ {
+		privateKey, address := testAddress(tb, 1+n%4)
+		var spent UnspentTxOut = UnspentTxOut{TxOutId: utils.Hash(fmt.Sprintf("txOut %d", n)), TxOutIndex: 0, Address: address, Amount: 50}
+		unspentTxOuts = append(unspentTxOuts, spent)
+		var transaction Transaction = Transaction{
+			Version: CurrentTxVersion,
+			TxIns:   TxInCollection{{TxOutId: spent.TxOutId, TxOutIndex: 0}},
+			TxOuts:  TxOutCollection{{Address: minerAddress, Amount: 50}},
+		}
+		transaction.Id = GetTransactionId(transaction)
+		signature, err := SignTxIn(transaction, 0, privateKey, unspentTxOuts)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		transaction.TxIns[0].Signature = signature
+		transactions = append(transactions, transaction)
+	}
+	return transactions, unspentTxOuts
+}
+
+func TestBlockWithOneBadSignatureRefused(test *testing.T) {
+	const count int = 500
+	transactions, unspentTxOuts := testBlockTransactions(test, count)
+	var prevHash string = transactions[0].TxIns[0].TxOutId
+	if !validateBlockTransactions(transactions, unspentTxOuts, 1, prevHash) {
+		test.Fatal("block transactions must be valid")
+	}
+
+	for _, position := range []int{1, count / 2, count} {
+		// the signature of another transaction is a well formed one, valid for another hash
+		var tampered []Transaction = append([]Transaction{}, transactions...)
+		var other int = 1 + position%count
+		tampered[position].TxIns = TxInCollection{tampered[position].TxIns[0]}
+		tampered[position].TxIns[0].Signature = transactions[other].TxIns[0].Signature
+
+		var signatures map[signedTxIn]bool = verifySignatures(tampered[1:], unspentTxOuts)
+		var invalid []string = []string{}
+		for signed, valid := range signatures {
+			if !valid {
+				invalid = append(invalid, signed.txId)
+			}
+		}
+		if len(signatures) != count || len(invalid) != 1 || invalid[0] != tampered[position].Id {
+			test.Fatalf("transaction %d: expected its signature alone invalid among %d, got %d invalid of %d", position, count, len(invalid), len(signatures))
+		}
+		if validateBlockTransactions(tampered, unspentTxOuts, 1, prevHash) {
+			test.Fatalf("block with a bad signature in transaction %d must be refused", position)
+		}
+		if _, err := ProcessTransactions(tampered, unspentTxOuts, 1, prevHash); err == nil {
+			test.Fatalf("processing a block with a bad signature in transaction %d must fail", position)
+		}
+	}
+}
+
+// BenchmarkVerifySignatures compares verifying signatures of a 500 transaction block one by one against verifySignatures
+func BenchmarkVerifySignatures(b *testing.B) {
+	transactions, unspentTxOuts := testBlockTransactions(b, 500)
+	b.Run("sequential", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			for _, transaction := range transactions[1:] {
+				_, publicKey, err := resolveTxInPublicKey(transaction.TxIns[0], transaction, unspentTxOuts)
+				if err != nil || !verifyTxInSignature(transaction.TxIns[0], transaction, publicKey) {
+					b.Fatal("signature must be valid")
+				}
+			}
+		}
+	})
+	b.Run("workers", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			verifySignatures(transactions[1:], unspentTxOuts)
+		}
+	})
+}
@@ -1,63 +1,699 @@
 package txpool
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	t "naivecoin/transactions"
+	"naivecoin/utils"
+	"os"
+	"sort"
+	"sync"
+	"time"
 )
 
-// txPool stores a list of transactions received from another peers
-var txPool []t.Transaction = []t.Transaction{}
+// txPoolLock guards the pool and its settings, exported functions acquire it, unexported helpers expect it to be held
+var txPoolLock sync.RWMutex
+
+var logger *utils.Logger = utils.NewLogger("txpool")
+
+// txPoolEntry holds a transaction in the pool together with txOuts it spends, its serialized size, fee, fee rate and admission time
+type txPoolEntry struct {
+	transaction t.Transaction
+	spentTxOuts []t.UnspentTxOut
+	size        int
+	fee         float64
+	feeRate     float64
+	addedAt     time.Time
+}
+
+// now returns current time, replaced in tests to control pool entries age
+var now func() time.Time = time.Now
+
+// txPool stores a list of transactions received from another peers, oldest first
+var txPool []txPoolEntry = []txPoolEntry{}
+
+// txPoolIds holds ids of transactions in the pool
+var txPoolIds map[string]bool = map[string]bool{}
+
+// txPoolBytes is the total serialized size of transactions in the pool
+var txPoolBytes int
+
+// maximum number of transactions and total serialized size of the pool, zero means no limit
+var (
+	maxPoolCount int = 5000
+	maxPoolBytes int = 5 * 1024 * 1024
+)
+
+// replace-by-fee settings: when enabled, a transaction conflicting with pool transactions replaces them
+// if it pays a fee higher than their total fee by at least minReplacementFeeIncrement
+var (
+	replaceByFee               bool    = false
+	minReplacementFeeIncrement float64 = 0.001
+)
+
+// minFeeRate is the minimum fee per byte a transaction must pay to be accepted to the pool
+// this is a node-local policy, blocks containing transactions paying less are still valid
+var minFeeRate float64 = 0
+
+// FeeTooLowError is returned when a transaction pays a fee rate below the minimum accepted by the pool
+type FeeTooLowError struct {
+	Got  float64
+	Need float64
+}
+
+func (e FeeTooLowError) Error() string {
+	return fmt.Sprintf("fee too low: got %g, need %g per byte", e.Got, e.Need)
+}
+
+// PoolEventType describes a change of the transaction pool
+type PoolEventType string
+
+// pool event types
+const (
+	TxAdded          PoolEventType = "added"
+	TxRemovedByBlock PoolEventType = "removed-by-block"
+	TxExpired        PoolEventType = "expired"
+	TxReplaced       PoolEventType = "replaced"
+	TxEvicted        PoolEventType = "evicted"
+	TxRemoved        PoolEventType = "removed"
+)
+
+// PoolEvent is emitted to pool listeners when a transaction is added to or removed from the pool
+type PoolEvent struct {
+	Type        PoolEventType
+	Transaction t.Transaction
+}
+
+// listeners are called on every pool change
+var (
+	listeners     []func(PoolEvent)
+	listenersLock sync.Mutex
+)
+
+// ErrPoolFull is returned when a transaction cannot be added because the pool is full
+var ErrPoolFull = errors.New("mempool full")
+
+// ErrNotInPool is returned when a transaction with a given id is not found in the pool
+var ErrNotInPool = errors.New("transaction not found in pool")
+
+// ErrAlreadyInPool is returned when a transaction with the same id is already in the pool
+var ErrAlreadyInPool = errors.New("transaction already in pool")
+
+// ErrConflictingSpend is matched by ConflictingSpendError
+var ErrConflictingSpend = errors.New("transaction spends txOuts already spent by a pool transaction")
+
+// ConflictingSpendError is returned when a transaction spends a txOut a pool transaction spends and it can't replace it
+type ConflictingSpendError struct {
+	ConflictingTxId string
+}
+
+func (e ConflictingSpendError) Error() string {
+	return fmt.Sprintf("%s: %s", ErrConflictingSpend.Error(), e.ConflictingTxId)
+}
+
+func (e ConflictingSpendError) Is(target error) bool {
+	return target == ErrConflictingSpend
+}
+
+// removedTxTtl is how long ids of manually removed transactions are remembered
+const removedTxTtl time.Duration = 10 * time.Minute
+
+// removedTxs holds ids of manually removed transactions and the time they were removed
+// so that peers gossiping them back do not immediately re-add them to the pool
+var removedTxs map[string]time.Time = map[string]time.Time{}
+
+// PoolStats describes current utilization of the transaction pool
+type PoolStats struct {
+	Count    int
+	MaxCount int
+	Bytes    int
+	MaxBytes int
+}
+
+// RegisterListener registers a function called on every pool change
+// listeners are called after the pool lock is released, so they may read the pool
+func RegisterListener(listener func(PoolEvent)) {
+	listenersLock.Lock()
+	defer listenersLock.Unlock()
+	listeners = append(listeners, listener)
+}
+
+// notify calls registered listeners with given events
+func notify(events []PoolEvent) {
+	listenersLock.Lock()
+	var listenersCpy []func(PoolEvent) = append([]func(PoolEvent){}, listeners...)
+	listenersLock.Unlock()
+	for _, event := range events {
+		for _, listener := range listenersCpy {
+			listener(event)
+		}
+	}
+}
+
+// SetMaxPoolSize sets the maximum number of transactions and total size in bytes of the pool, zero means no limit
+func SetMaxPoolSize(maxCount int, maxBytes int) {
+	txPoolLock.Lock()
+	defer txPoolLock.Unlock()
+	maxPoolCount = maxCount
+	maxPoolBytes = maxBytes
+}
+
+// SetReplaceByFee enables or disables replace-by-fee and sets the minimum fee increment for a replacement
+func SetReplaceByFee(enabled bool, minFeeIncrement float64) {
+	txPoolLock.Lock()
+	defer txPoolLock.Unlock()
+	replaceByFee = enabled
+	minReplacementFeeIncrement = minFeeIncrement
+}
+
+// SetMinFeeRate sets the minimum fee per byte a transaction must pay to be accepted to the pool
+func SetMinFeeRate(feeRate float64) {
+	txPoolLock.Lock()
+	defer txPoolLock.Unlock()
+	minFeeRate = feeRate
+}
+
+// GetMinFeeRate returns the minimum fee per byte a transaction must pay to be accepted to the pool
+func GetMinFeeRate() float64 {
+	txPoolLock.RLock()
+	defer txPoolLock.RUnlock()
+	return minFeeRate
+}
+
+// GetPoolStats returns current utilization and limits of the transaction pool
+func GetPoolStats() PoolStats {
+	txPoolLock.RLock()
+	defer txPoolLock.RUnlock()
+	return PoolStats{
+		Count:    len(txPool),
+		MaxCount: maxPoolCount,
+		Bytes:    txPoolBytes,
+		MaxBytes: maxPoolBytes,
+	}
+}
 
 // GetTransactionPool returns a deep copy of the transaction pool
 func GetTransactionPool() []t.Transaction {
+	txPoolLock.RLock()
+	defer txPoolLock.RUnlock()
+	return getTransactions()
+}
+
+// HasTransaction checks if a transaction with a given id is in the pool
+func HasTransaction(txId string) bool {
+	txPoolLock.RLock()
+	defer txPoolLock.RUnlock()
+	return txPoolIds[txId]
+}
+
+// getTransactions returns a copy of transactions in the pool
+func getTransactions() []t.Transaction {
 	cpy := make([]t.Transaction, len(txPool))
-	copy(cpy, txPool)
+	for n := 0; n < len(txPool); n++ {
+		cpy[n] = txPool[n].transaction
+	}
 	return cpy
 }
 
 // AddToTransactionPool validates and if valid adds a given transaction to a transaction pool
-func AddToTransactionPool(tx t.Transaction, unspentTxOuts []t.UnspentTxOut) error {
+// if the pool is full, transactions with the lowest fee rate are evicted to make room for a new one
+// if replace-by-fee is enabled, conflicting pool transactions paying a lower fee are replaced and returned
+// a transaction already in the pool is not validated again, ErrAlreadyInPool is returned for it
+func AddToTransactionPool(tx t.Transaction, unspentTxOuts []t.UnspentTxOut) ([]t.Transaction, error) {
+	if HasTransaction(tx.Id) {
+		return nil, ErrAlreadyInPool
+	}
+	// amounts are checked first, the fee rate of a transaction with a negative or NaN amount is meaningless
+	if err := t.ValidateTxOutAmounts(tx); err != nil {
+		return nil, err
+	}
+	// fee rate is cheap to compute, check it before verifying signatures
+	var feeRate float64 = t.GetFeeRate(tx, unspentTxOuts)
+	if requiredFeeRate := GetMinFeeRate(); feeRate < requiredFeeRate {
+		return nil, FeeTooLowError{Got: feeRate, Need: requiredFeeRate}
+	}
+
 	if !t.ValidateTransaction(tx, unspentTxOuts) {
-		return errors.New("trying to add invalid tx to pool")
+		return nil, errors.New("trying to add invalid tx to pool")
+	}
+
+	var entry txPoolEntry = txPoolEntry{
+		transaction: tx,
+		spentTxOuts: getSpentTxOuts(tx, unspentTxOuts),
+		size:        t.GetTransactionSize(tx),
+		fee:         t.GetTransactionFee(tx, unspentTxOuts),
+		feeRate:     feeRate,
+		addedAt:     now(),
+	}
+
+	var events []PoolEvent = []PoolEvent{}
+	// deferred calls run in reverse order, listeners are notified after the lock is released
+	defer func() { notify(events) }()
+	txPoolLock.Lock()
+	defer txPoolLock.Unlock()
+
+	// the transaction may have been added while it was validated
+	if txPoolIds[tx.Id] {
+		return nil, ErrAlreadyInPool
+	}
+	conflicting := getConflictingEntries(tx)
+	if len(conflicting) > 0 {
+		if err := canReplace(entry, conflicting); err != nil {
+			return nil, err
+		}
+	}
+
+	evictionCandidates, ok := getEvictionCandidates(entry, conflicting)
+	if !ok {
+		return nil, ErrPoolFull
 	}
 
-	if !isValidTxForPool(tx, txPool) {
-		return errors.New("trying to add invalid tx to pool")
+	var replaced []t.Transaction = []t.Transaction{}
+	for _, index := range conflicting {
+		logger.Info("replacing tx in txPool", "tx", txPool[index].transaction.Id, "replacement", tx.Id)
+		replaced = append(replaced, txPool[index].transaction)
+		events = append(events, PoolEvent{Type: TxReplaced, Transaction: txPool[index].transaction})
+	}
+	for _, index := range evictionCandidates {
+		logger.Info("txPool is full, evicting tx", "tx", txPool[index].transaction.Id, "feeRate", txPool[index].feeRate)
+		events = append(events, PoolEvent{Type: TxEvicted, Transaction: txPool[index].transaction})
+	}
+	// remove from the end, so that remaining indexes stay valid
+	var removed []int = append(append([]int{}, conflicting...), evictionCandidates...)
+	sort.Sort(sort.Reverse(sort.IntSlice(removed)))
+	for _, index := range removed {
+		removeEntryAtIndex(index)
 	}
 
 	//fmt.Printf("adding to txPool: %v", tx)
-	txPool = append(txPool, tx)
+	txPool = append(txPool, entry)
+	txPoolIds[tx.Id] = true
+	txPoolBytes += entry.size
+	events = append(events, PoolEvent{Type: TxAdded, Transaction: tx})
+	return replaced, nil
+}
+
+// canReplace checks if a given entry is allowed to replace conflicting pool entries
+func canReplace(entry txPoolEntry, conflicting []int) error {
+	if !replaceByFee {
+		logger.Debug("tx spends a txIn already found in the txPool", "tx", entry.transaction.Id, "conflicting", txPool[conflicting[0]].transaction.Id)
+		return ConflictingSpendError{ConflictingTxId: txPool[conflicting[0]].transaction.Id}
+	}
+	var conflictingFee float64
+	for _, index := range conflicting {
+		conflictingFee += txPool[index].fee
+	}
+	if entry.fee <= conflictingFee || entry.fee < conflictingFee+minReplacementFeeIncrement {
+		return fmt.Errorf("replacement fee too low: got %f, need %f", entry.fee, conflictingFee+minReplacementFeeIncrement)
+	}
 	return nil
 }
 
+// getEvictionCandidates returns indexes of the lowest fee rate entries that must be evicted to make room for a given entry
+// entries at replaced indexes are about to be removed, they are not counted and not evicted
+// returns false if the entry does not fit or does not pay a higher fee rate than the entries it would evict
+func getEvictionCandidates(entry txPoolEntry, replaced []int) ([]int, bool) {
+	if maxPoolBytes > 0 && entry.size > maxPoolBytes {
+		return nil, false
+	}
+
+	var (
+		count      int   = len(txPool)
+		bytes      int   = txPoolBytes
+		order      []int = []int{}
+		candidates []int = []int{}
+	)
+	for n := 0; n < len(txPool); n++ {
+		if containsIndex(replaced, n) {
+			count--
+			bytes -= txPool[n].size
+			continue
+		}
+		order = append(order, n)
+	}
+	// lowest fee rate first, the oldest first among equal fee rates
+	sort.SliceStable(order, func(i, j int) bool {
+		return txPool[order[i]].feeRate < txPool[order[j]].feeRate
+	})
+
+	for n := 0; n < len(order) && !hasRoomFor(count, bytes, entry); n++ {
+		var candidate txPoolEntry = txPool[order[n]]
+		if entry.feeRate <= candidate.feeRate {
+			return nil, false
+		}
+		candidates = append(candidates, order[n])
+		count--
+		bytes -= candidate.size
+	}
+	return candidates, true
+}
+
+// containsIndex checks if a given list of indexes contains a specified index
+func containsIndex(indexes []int, index int) bool {
+	for n := 0; n < len(indexes); n++ {
+		if indexes[n] == index {
+			return true
+		}
+	}
+	return false
+}
+
+// hasRoomFor checks if a given entry fits into a pool of a given count and size without exceeding its limits
+func hasRoomFor(count int, bytes int, entry txPoolEntry) bool {
+	if maxPoolCount > 0 && count+1 > maxPoolCount {
+		return false
+	}
+	if maxPoolBytes > 0 && bytes+entry.size > maxPoolBytes {
+		return false
+	}
+	return true
+}
+
+// removeEntryAtIndex removes a pool entry at a given index
+func removeEntryAtIndex(index int) {
+	delete(txPoolIds, txPool[index].transaction.Id)
+	txPoolBytes -= txPool[index].size
+	txPool = append(txPool[:index], txPool[index+1:]...)
+}
+
+// GetTransactionsByFeeRate returns up to maxCount pool transactions sorted by fee rate, highest first
+// transactions spending txIns already consumed by a higher fee rate transaction are skipped
+// maxCount of zero or less means no limit
+func GetTransactionsByFeeRate(unspentTxOuts []t.UnspentTxOut, maxCount int) []t.Transaction {
+	txPoolLock.RLock()
+	defer txPoolLock.RUnlock()
+	var entries []txPoolEntry = make([]txPoolEntry, len(txPool))
+	for n := 0; n < len(txPool); n++ {
+		entries[n] = txPool[n]
+		entries[n].feeRate = t.GetFeeRate(txPool[n].transaction, unspentTxOuts)
+	}
+	// stable sort keeps insertion order among equal fee rates
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].feeRate > entries[j].feeRate
+	})
+
+	var selected []t.Transaction = []t.Transaction{}
+	var consumedTxIns []t.TxIn = []t.TxIn{}
+	for n := 0; n < len(entries); n++ {
+		if maxCount > 0 && len(selected) >= maxCount {
+			break
+		}
+		var isSpendable bool = true
+		for _, txIn := range entries[n].transaction.TxIns {
+			if containsTxIn(consumedTxIns, txIn) || !hasTxIn(txIn, unspentTxOuts) {
+				isSpendable = false
+				break
+			}
+		}
+		if !isSpendable {
+			continue
+		}
+		selected = append(selected, entries[n].transaction)
+		consumedTxIns = append(consumedTxIns, entries[n].transaction.TxIns...)
+	}
+	return selected
+}
+
+// PoolTxIn describes a txIn of a pool transaction together with the txOut it spends
+type PoolTxIn struct {
+	TxOutId    string
+	TxOutIndex int
+	Address    string
+	Amount     float64
+}
+
+// PoolTransaction describes a transaction held in the pool: inputs and outputs summary, fee, size and age
+type PoolTransaction struct {
+	Id           string
+	TxIns        []PoolTxIn
+	TxOuts       t.TxOutCollection
+	InputAmount  float64
+	OutputAmount float64
+	Fee          float64
+	Size         int
+	AgeSeconds   int64
+}
+
+// toPoolTransaction builds a pool transaction view, resolving its txIns against a given list of unspent txOuts
+func toPoolTransaction(entry txPoolEntry, unspentTxOuts []t.UnspentTxOut) PoolTransaction {
+	var poolTx PoolTransaction = PoolTransaction{
+		Id:         entry.transaction.Id,
+		TxIns:      []PoolTxIn{},
+		TxOuts:     entry.transaction.TxOuts,
+		Fee:        t.GetTransactionFee(entry.transaction, unspentTxOuts),
+		Size:       entry.size,
+		AgeSeconds: int64(now().Sub(entry.addedAt).Seconds()),
+	}
+	for _, txIn := range entry.transaction.TxIns {
+		var poolTxIn PoolTxIn = PoolTxIn{
+			TxOutId:    txIn.TxOutId,
+			TxOutIndex: txIn.TxOutIndex,
+		}
+		if unspentTxOut, found := findUnspentTxOut(txIn, unspentTxOuts); found {
+			poolTxIn.Address = unspentTxOut.Address
+			poolTxIn.Amount = unspentTxOut.Amount
+		}
+		poolTx.TxIns = append(poolTx.TxIns, poolTxIn)
+		poolTx.InputAmount += poolTxIn.Amount
+	}
+	for _, txOut := range entry.transaction.TxOuts {
+		poolTx.OutputAmount += txOut.Amount
+	}
+	return poolTx
+}
+
+// GetPoolTransactions returns descriptions of all transactions in the pool, oldest first
+func GetPoolTransactions(unspentTxOuts []t.UnspentTxOut) []PoolTransaction {
+	txPoolLock.RLock()
+	defer txPoolLock.RUnlock()
+	var poolTxs []PoolTransaction = []PoolTransaction{}
+	for n := 0; n < len(txPool); n++ {
+		poolTxs = append(poolTxs, toPoolTransaction(txPool[n], unspentTxOuts))
+	}
+	return poolTxs
+}
+
+// GetPoolTransaction returns a description of a pool transaction with a given id, false if it is not in the pool
+func GetPoolTransaction(txId string, unspentTxOuts []t.UnspentTxOut) (PoolTransaction, bool) {
+	txPoolLock.RLock()
+	defer txPoolLock.RUnlock()
+	for n := 0; n < len(txPool); n++ {
+		if txPool[n].transaction.Id == txId {
+			return toPoolTransaction(txPool[n], unspentTxOuts), true
+		}
+	}
+	return PoolTransaction{}, false
+}
+
+// AddressPoolTransaction describes how a pool transaction affects a given address
+type AddressPoolTransaction struct {
+	Id string
+	// Outgoing is set if the transaction spends txOuts owned by the address
+	Outgoing bool
+	Received float64
+	Spent    float64
+}
+
+// AddressPending describes pending incoming and outgoing amounts of an address in the pool
+type AddressPending struct {
+	Address      string
+	Incoming     float64
+	Outgoing     float64
+	Transactions []AddressPoolTransaction
+}
+
+// GetTransactionsForAddress returns pool transactions paying to a given address or spending its txOuts
+// change returned to the address by its own outgoing transactions is not counted as incoming
+func GetTransactionsForAddress(base58Address string) AddressPending {
+	txPoolLock.RLock()
+	defer txPoolLock.RUnlock()
+	var pending AddressPending = AddressPending{
+		Address:      base58Address,
+		Transactions: []AddressPoolTransaction{},
+	}
+	for _, entry := range txPool {
+		var addressTx AddressPoolTransaction = AddressPoolTransaction{Id: entry.transaction.Id}
+		for _, txOut := range entry.transaction.TxOuts {
+			if txOut.Address == base58Address {
+				addressTx.Received += txOut.Amount
+			}
+		}
+		for _, spentTxOut := range entry.spentTxOuts {
+			if spentTxOut.Address == base58Address {
+				addressTx.Outgoing = true
+				addressTx.Spent += spentTxOut.Amount
+			}
+		}
+		if addressTx.Received == 0 && !addressTx.Outgoing {
+			continue
+		}
+		if addressTx.Outgoing {
+			pending.Outgoing += addressTx.Spent - addressTx.Received
+		} else {
+			pending.Incoming += addressTx.Received
+		}
+		pending.Transactions = append(pending.Transactions, addressTx)
+	}
+	return pending
+}
+
+// RemoveTransaction removes a transaction with a given id from the pool and returns it
+// removal is refused if another pool transaction spends outputs of the removed transaction
+func RemoveTransaction(txId string) (t.Transaction, error) {
+	var events []PoolEvent = []PoolEvent{}
+	defer func() { notify(events) }()
+	txPoolLock.Lock()
+	defer txPoolLock.Unlock()
+	for n := 0; n < len(txPool); n++ {
+		if txPool[n].transaction.Id != txId {
+			continue
+		}
+		for _, entry := range txPool {
+			for _, txIn := range entry.transaction.TxIns {
+				if txIn.TxOutId == txId {
+					return t.Transaction{}, fmt.Errorf("transaction outputs are spent by pool transaction %s, remove it first", entry.transaction.Id)
+				}
+			}
+		}
+		var removed t.Transaction = txPool[n].transaction
+		removeEntryAtIndex(n)
+		removedTxs[txId] = now()
+		events = append(events, PoolEvent{Type: TxRemoved, Transaction: removed})
+		return removed, nil
+	}
+	return t.Transaction{}, ErrNotInPool
+}
+
+// IsRecentlyRemoved checks if a transaction with a given id was manually removed from the pool recently
+func IsRecentlyRemoved(txId string) bool {
+	txPoolLock.Lock()
+	defer txPoolLock.Unlock()
+	for id, removedAt := range removedTxs {
+		if now().Sub(removedAt) > removedTxTtl {
+			delete(removedTxs, id)
+		}
+	}
+	_, found := removedTxs[txId]
+	return found
+}
+
+// ExpireOlderThan removes transactions that were added to the pool more than a given duration ago
+// returns the removed transactions
+func ExpireOlderThan(d time.Duration) []t.Transaction {
+	var events []PoolEvent = []PoolEvent{}
+	defer func() { notify(events) }()
+	txPoolLock.Lock()
+	defer txPoolLock.Unlock()
+	var expired []t.Transaction = []t.Transaction{}
+	var deadline time.Time = now().Add(-d)
+	for n := len(txPool) - 1; n >= 0; n-- {
+		if txPool[n].addedAt.Before(deadline) {
+			logger.Info("tx expired in txPool", "tx", txPool[n].transaction.Id)
+			expired = append(expired, txPool[n].transaction)
+			events = append(events, PoolEvent{Type: TxExpired, Transaction: txPool[n].transaction})
+			removeEntryAtIndex(n)
+		}
+	}
+	return expired
+}
+
+// SaveToFile writes transactions in the pool to a given file as json, followed by pending transactions not in the pool
+func SaveToFile(path string, pending []t.Transaction) error {
+	txPoolLock.RLock()
+	defer txPoolLock.RUnlock()
+	var txs []t.Transaction = getTransactions()
+	var inPool map[string]bool = map[string]bool{}
+	for n := 0; n < len(txs); n++ {
+		inPool[txs[n].Id] = true
+	}
+	for n := 0; n < len(pending); n++ {
+		if !inPool[pending[n].Id] {
+			txs = append(txs, pending[n])
+		}
+	}
+	bytes, err := json.Marshal(txs)
+	if err != nil {
+		return err
+	}
+	// write to a temporary file first, so that a crash does not leave a partially written file
+	var tmpPath string = path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, bytes, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// ReadFromFile reads transactions written by SaveToFile from a given file
+func ReadFromFile(path string) ([]t.Transaction, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var txs []t.Transaction = []t.Transaction{}
+	if err := json.Unmarshal(content, &txs); err != nil {
+		return nil, err
+	}
+	return txs, nil
+}
+
 // hasTxIn checks if unspent transactions list contains a given txIn - transaction to be spent
 func hasTxIn(txIn t.TxIn, unspentTxOuts []t.UnspentTxOut) bool {
+	_, found := findUnspentTxOut(txIn, unspentTxOuts)
+	return found
+}
+
+// findUnspentTxOut finds an unspent txOut referenced by a given txIn
+func findUnspentTxOut(txIn t.TxIn, unspentTxOuts []t.UnspentTxOut) (t.UnspentTxOut, bool) {
 	for n := 0; n < len(unspentTxOuts); n++ {
 		if unspentTxOuts[n].TxOutId == txIn.TxOutId && unspentTxOuts[n].TxOutIndex == txIn.TxOutIndex {
-			return true
+			return unspentTxOuts[n], true
 		}
 	}
-	return false
+	return t.UnspentTxOut{}, false
+}
+
+// getSpentTxOuts returns unspent txOuts referenced by txIns of a given transaction
+func getSpentTxOuts(tx t.Transaction, unspentTxOuts []t.UnspentTxOut) []t.UnspentTxOut {
+	var spentTxOuts []t.UnspentTxOut = []t.UnspentTxOut{}
+	for _, txIn := range tx.TxIns {
+		if unspentTxOut, found := findUnspentTxOut(txIn, unspentTxOuts); found {
+			spentTxOuts = append(spentTxOuts, unspentTxOut)
+		}
+	}
+	return spentTxOuts
 }
 
 // UpdateTransactionPool updates transaction pool with valid transactions
 // transaction is valid if unspent transactions list contains it
 func UpdateTransactionPool(unspentTxOuts_ []t.UnspentTxOut) {
-	var newTxPool []t.Transaction = []t.Transaction{}
+	var events []PoolEvent = []PoolEvent{}
+	defer func() { notify(events) }()
+	txPoolLock.Lock()
+	defer txPoolLock.Unlock()
+	var newTxPool []txPoolEntry = []txPoolEntry{}
+	var newTxPoolIds map[string]bool = make(map[string]bool, len(txPool))
+	var newTxPoolBytes int
 	for i := 0; i < len(txPool); i++ {
 		isValid := true
-		for j := 0; j < len(txPool[i].TxIns); j++ {
-			if !hasTxIn(txPool[i].TxIns[j], unspentTxOuts_) {
+		for j := 0; j < len(txPool[i].transaction.TxIns); j++ {
+			if !hasTxIn(txPool[i].transaction.TxIns[j], unspentTxOuts_) {
 				isValid = false
 				break
 			}
 		}
 		if isValid {
 			newTxPool = append(newTxPool, txPool[i])
+			newTxPoolIds[txPool[i].transaction.Id] = true
+			newTxPoolBytes += txPool[i].size
+		} else {
+			events = append(events, PoolEvent{Type: TxRemovedByBlock, Transaction: txPool[i].transaction})
 		}
 	}
 	txPool = newTxPool
+	txPoolIds = newTxPoolIds
+	txPoolBytes = newTxPoolBytes
 }
 
 // containsTxIn checks if a given lists of txIns has a specified txIn
@@ -70,24 +706,16 @@ func containsTxIn(txIns []t.TxIn, txIn t.TxIn) bool {
 	return false
 }
 
-// getTxPoolIns flattens the list of txIns included in transaction pool
-func getTxPoolIns(txPool_ []t.Transaction) []t.TxIn {
-	var txInsFlattened []t.TxIn = []t.TxIn{}
-	for n := 0; n < len(txPool_); n++ {
-		txInsFlattened = append(txInsFlattened, txPool_[n].TxIns...)
-	}
-	return txInsFlattened
-}
-
-// isValidTxForPool checks if transaction is already present in the pool
-func isValidTxForPool(tx t.Transaction, txPool_ []t.Transaction) bool {
-	var txPoolIns []t.TxIn = getTxPoolIns(txPool_)
-
-	for n := 0; n < len(tx.TxIns); n++ {
-		if containsTxIn(txPoolIns, tx.TxIns[n]) {
-			fmt.Println("txIn already found in the txPool")
-			return false
+// getConflictingEntries returns indexes of pool entries spending any of the txIns of a given transaction
+func getConflictingEntries(tx t.Transaction) []int {
+	var conflicting []int = []int{}
+	for n := 0; n < len(txPool); n++ {
+		for _, txIn := range tx.TxIns {
+			if containsTxIn(txPool[n].transaction.TxIns, txIn) {
+				conflicting = append(conflicting, n)
+				break
+			}
 		}
 	}
-	return true
+	return conflicting
 }
@@ -0,0 +1,297 @@
+package txpool
+
+import (
+	"errors"
+	"fmt"
+	t "naivecoin/transactions"
+	"naivecoin/utils"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testKey returns a private key derived from a number and the full public key address it owns
+func testKey(tb testing.TB, n int) (string, string) {
+	var privateKey string = fmt.Sprintf("%064x", n)
+	publicKey, err := utils.GetPublicKey(privateKey)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	address, err := utils.Base58Encode(publicKey)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return privateKey, address
+}
+
+// testUnspentTxOuts returns count unspent txOuts of a given amount owned by an address
+func testUnspentTxOuts(address string, count int, amount float64) []t.UnspentTxOut {
+	var unspentTxOuts []t.UnspentTxOut = []t.UnspentTxOut{}
+	for n := 0; n < count; n++ {
+		unspentTxOuts = append(unspentTxOuts, t.UnspentTxOut{
+			TxOutId:    fmt.Sprintf("%064x", 1000+n),
+			TxOutIndex: 0,
+			Address:    address,
+			Amount:     amount,
+		})
+	}
+	return unspentTxOuts
+}
+
+// testTransaction returns a transaction spending given txOuts, paying amount to an address and leaving fee to be burned
+func testTransaction(tb testing.TB, privateKey string, spent []t.UnspentTxOut, address string, amount float64, fee float64) t.Transaction {
+	var transaction t.Transaction = t.Transaction{Version: t.CurrentTxVersion}
+	var total float64
+	for _, unspentTxOut := range spent {
+		transaction.TxIns = append(transaction.TxIns, t.TxIn{TxOutId: unspentTxOut.TxOutId, TxOutIndex: unspentTxOut.TxOutIndex})
+		total += unspentTxOut.Amount
+	}
+	transaction.TxOuts = t.TxOutCollection{{Address: address, Amount: amount}}
+	if change := total - amount - fee; change > 0 {
+		transaction.TxOuts = append(transaction.TxOuts, t.TxOut{Address: spent[0].Address, Amount: change})
+	}
+	transaction.Id = t.GetTransactionId(transaction)
+	for n := 0; n < len(transaction.TxIns); n++ {
+		signature, err := t.SignTxIn(transaction, n, privateKey, spent)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		transaction.TxIns[n].Signature = signature
+	}
+	return transaction
+}
+
+// resetPool empties the pool and restores its settings and clock when the test ends
+func resetPool(tb testing.TB) {
+	txPoolLock.Lock()
+	txPool = []txPoolEntry{}
+	txPoolIds = map[string]bool{}
+	txPoolBytes = 0
+	removedTxs = map[string]time.Time{}
+	txPoolLock.Unlock()
+	tb.Cleanup(func() {
+		now = time.Now
+		SetMaxPoolSize(5000, 5*1024*1024)
+		SetReplaceByFee(false, 0.001)
+		SetMinFeeRate(0)
+	})
+}
+
+// fakeClock replaces the pool clock with one that moves only when advanced
+func fakeClock(tb testing.TB) func(d time.Duration) {
+	var current time.Time = time.Unix(1700000000, 0)
+	now = func() time.Time { return current }
+	return func(d time.Duration) { current = current.Add(d) }
+}
+
+func TestExpireOlderThan(test *testing.T) {
+	resetPool(test)
+	var advance func(time.Duration) = fakeClock(test)
+	privateKey, address := testKey(test, 1)
+	_, recipient := testKey(test, 2)
+	var unspentTxOuts []t.UnspentTxOut = testUnspentTxOuts(address, 2, 10)
+
+	// listeners can't be unregistered, the lock keeps later tests adding from several goroutines race free
+	var expiredEvents []string = []string{}
+	var eventsLock sync.Mutex
+	RegisterListener(func(event PoolEvent) {
+		eventsLock.Lock()
+		defer eventsLock.Unlock()
+		if event.Type == TxExpired {
+			expiredEvents = append(expiredEvents, event.Transaction.Id)
+		}
+	})
+
+	var oldTx t.Transaction = testTransaction(test, privateKey, unspentTxOuts[:1], recipient, 5, 0.1)
+	if _, err := AddToTransactionPool(oldTx, unspentTxOuts); err != nil {
+		test.Fatal(err)
+	}
+	advance(23 * time.Hour)
+	var newTx t.Transaction = testTransaction(test, privateKey, unspentTxOuts[1:], recipient, 5, 0.1)
+	if _, err := AddToTransactionPool(newTx, unspentTxOuts); err != nil {
+		test.Fatal(err)
+	}
+
+	if expired := ExpireOlderThan(24 * time.Hour); len(expired) != 0 {
+		test.Fatalf("expired %d transactions before the ttl", len(expired))
+	}
+	advance(time.Hour + time.Second)
+	var expired []t.Transaction = ExpireOlderThan(24 * time.Hour)
+	if len(expired) != 1 || expired[0].Id != oldTx.Id {
+		test.Fatalf("expected %s to expire, got %v", oldTx.Id, expired)
+	}
+	if HasTransaction(oldTx.Id) || !HasTransaction(newTx.Id) {
+		test.Fatal("only the old transaction must leave the pool")
+	}
+	eventsLock.Lock()
+	var events []string = append([]string{}, expiredEvents...)
+	eventsLock.Unlock()
+	if len(events) != 1 || events[0] != oldTx.Id {
+		test.Fatalf("expected an expired event for %s, got %v", oldTx.Id, events)
+	}
+	// the txOut of the expired transaction can be spent again
+	if _, err := AddToTransactionPool(testTransaction(test, privateKey, unspentTxOuts[:1], recipient, 4, 0.2), unspentTxOuts); err != nil {
+		test.Fatalf("txOut of an expired transaction is still locked: %v", err)
+	}
+}
+
+func TestRemoveTransaction(test *testing.T) {
+	resetPool(test)
+	var advance func(time.Duration) = fakeClock(test)
+	privateKey, address := testKey(test, 1)
+	_, recipient := testKey(test, 2)
+	var unspentTxOuts []t.UnspentTxOut = testUnspentTxOuts(address, 1, 10)
+
+	var transaction t.Transaction = testTransaction(test, privateKey, unspentTxOuts, recipient, 5, 0.1)
+	if _, err := AddToTransactionPool(transaction, unspentTxOuts); err != nil {
+		test.Fatal(err)
+	}
+	removed, err := RemoveTransaction(transaction.Id)
+	if err != nil || removed.Id != transaction.Id {
+		test.Fatalf("expected %s to be removed, got %s: %v", transaction.Id, removed.Id, err)
+	}
+	if HasTransaction(transaction.Id) {
+		test.Fatal("removed transaction is still in the pool")
+	}
+	if _, err := RemoveTransaction(transaction.Id); err != ErrNotInPool {
+		test.Fatalf("expected ErrNotInPool removing twice, got %v", err)
+	}
+
+	// the id is remembered for a while, so that gossip doesn't bring the transaction right back
+	if !IsRecentlyRemoved(transaction.Id) {
+		test.Fatal("removed transaction is not remembered")
+	}
+	advance(removedTxTtl + time.Second)
+	if IsRecentlyRemoved(transaction.Id) {
+		test.Fatal("removed transaction is remembered after the ttl")
+	}
+}
+
+func TestRemoveTransactionSpentByPoolTransaction(test *testing.T) {
+	resetPool(test)
+	privateKey, address := testKey(test, 1)
+	var unspentTxOuts []t.UnspentTxOut = testUnspentTxOuts(address, 1, 10)
+
+	var parent t.Transaction = testTransaction(test, privateKey, unspentTxOuts, address, 5, 0.1)
+	if _, err := AddToTransactionPool(parent, unspentTxOuts); err != nil {
+		test.Fatal(err)
+	}
+	// the child spends an output of the parent, as if the parent was already confirmed
+	var parentTxOut t.UnspentTxOut = t.UnspentTxOut{TxOutId: parent.Id, TxOutIndex: 0, Address: address, Amount: 5}
+	var childUnspentTxOuts []t.UnspentTxOut = append(append([]t.UnspentTxOut{}, unspentTxOuts...), parentTxOut)
+	var child t.Transaction = testTransaction(test, privateKey, []t.UnspentTxOut{parentTxOut}, address, 4, 0.1)
+	if _, err := AddToTransactionPool(child, childUnspentTxOuts); err != nil {
+		test.Fatal(err)
+	}
+
+	if _, err := RemoveTransaction(parent.Id); err == nil {
+		test.Fatal("removing a transaction spent by another pool transaction must be refused")
+	}
+	if !HasTransaction(parent.Id) || !HasTransaction(child.Id) {
+		test.Fatal("refused removal changed the pool")
+	}
+	if _, err := RemoveTransaction(child.Id); err != nil {
+		test.Fatal(err)
+	}
+	if _, err := RemoveTransaction(parent.Id); err != nil {
+		test.Fatalf("parent can be removed once the child is gone: %v", err)
+	}
+}
+
+func TestReplaceByFee(test *testing.T) {
+	resetPool(test)
+	privateKey, address := testKey(test, 1)
+	_, recipient := testKey(test, 2)
+	var unspentTxOuts []t.UnspentTxOut = testUnspentTxOuts(address, 1, 10)
+
+	var original t.Transaction = testTransaction(test, privateKey, unspentTxOuts, recipient, 5, 0.1)
+	if _, err := AddToTransactionPool(original, unspentTxOuts); err != nil {
+		test.Fatal(err)
+	}
+	var replacement t.Transaction = testTransaction(test, privateKey, unspentTxOuts, recipient, 5, 0.2)
+
+	// conflicting spends are refused unless replace-by-fee is enabled
+	if _, err := AddToTransactionPool(replacement, unspentTxOuts); !errors.Is(err, ErrConflictingSpend) {
+		test.Fatalf("expected a conflicting spend error, got %v", err)
+	}
+
+	SetReplaceByFee(true, 0.5)
+	if _, err := AddToTransactionPool(replacement, unspentTxOuts); err == nil {
+		test.Fatal("replacement paying less than the fee increment more must be refused")
+	}
+
+	SetReplaceByFee(true, 0.05)
+	replaced, err := AddToTransactionPool(replacement, unspentTxOuts)
+	if err != nil {
+		test.Fatal(err)
+	}
+	if len(replaced) != 1 || replaced[0].Id != original.Id {
+		test.Fatalf("expected %s to be reported replaced, got %v", original.Id, replaced)
+	}
+	if HasTransaction(original.Id) || !HasTransaction(replacement.Id) {
+		test.Fatal("the pool must hold the replacement only")
+	}
+
+	// updating the pool keeps the replacement and doesn't bring the original back
+	UpdateTransactionPool(unspentTxOuts)
+	if HasTransaction(original.Id) || !HasTransaction(replacement.Id) {
+		test.Fatal("updating the pool resurrected the replaced transaction")
+	}
+}
+
+// run with -race: the pool is added to and updated from several goroutines at once, as HTTP handlers and peers do
+func TestConcurrentAddAndUpdate(test *testing.T) {
+	resetPool(test)
+	privateKey, address := testKey(test, 1)
+	_, recipient := testKey(test, 2)
+	var unspentTxOuts []t.UnspentTxOut = testUnspentTxOuts(address, 40, 10)
+	var transactions []t.Transaction = []t.Transaction{}
+	for n := 0; n < len(unspentTxOuts); n++ {
+		transactions = append(transactions, testTransaction(test, privateKey, unspentTxOuts[n:n+1], recipient, 5, 0.1))
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for n := w; n < len(transactions); n += 4 {
+				AddToTransactionPool(transactions[n], unspentTxOuts)
+				GetTransactionsByFeeRate(unspentTxOuts, 0)
+			}
+		}(w)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		// every update confirms one more transaction, spending its txOut
+		for n := 0; n < len(unspentTxOuts)/2; n++ {
+			UpdateTransactionPool(unspentTxOuts[n+1:])
+			GetPoolStats()
+			GetTransactionPool()
+		}
+	}()
+	wg.Wait()
+
+	UpdateTransactionPool(unspentTxOuts[len(unspentTxOuts)/2:])
+	var stats PoolStats = GetPoolStats()
+	var pool []t.Transaction = GetTransactionPool()
+	if stats.Count != len(pool) {
+		test.Fatalf("pool count %d does not match %d transactions", stats.Count, len(pool))
+	}
+	var bytes int
+	for _, transaction := range pool {
+		if !HasTransaction(transaction.Id) {
+			test.Fatalf("pool transaction %s is not indexed", transaction.Id)
+		}
+		bytes += t.GetTransactionSize(transaction)
+	}
+	if stats.Bytes != bytes {
+		test.Fatalf("pool size %d does not match %d bytes of its transactions", stats.Bytes, bytes)
+	}
+	for n := len(unspentTxOuts) / 2; n < len(transactions); n++ {
+		if !HasTransaction(transactions[n].Id) {
+			test.Fatalf("transaction %s spending an unspent txOut is missing", transactions[n].Id)
+		}
+	}
+}
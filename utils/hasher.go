@@ -0,0 +1,73 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Hasher computes hashes of blocks and transaction contents
+type Hasher interface {
+	// Name identifies the hasher in chain parameters
+	Name() string
+	// Sum returns the hash of an object
+	Sum(o interface{}) []byte
+}
+
+// CanonicalEncoder is implemented by objects with an unambiguous byte encoding
+type CanonicalEncoder interface {
+	CanonicalBytes() []byte
+}
+
+// SHA256Hasher hashes an object formatted by %v with a single SHA-256, the scheme Hash uses
+type SHA256Hasher struct{}
+
+// Name returns the name of the hasher
+func (SHA256Hasher) Name() string {
+	return "sha256"
+}
+
+// Sum returns SHA-256 of an object formatted by %v
+func (SHA256Hasher) Sum(o interface{}) []byte {
+	return HashBytes(o)
+}
+
+// DoubleSHA256Hasher hashes canonical bytes of an object with SHA-256 applied twice
+// objects without a canonical encoding, such as transaction contents which are strings already, are formatted by %v
+type DoubleSHA256Hasher struct{}
+
+// Name returns the name of the hasher
+func (DoubleSHA256Hasher) Name() string {
+	return "double-sha256"
+}
+
+// Sum returns SHA-256 of SHA-256 of canonical bytes of an object
+func (DoubleSHA256Hasher) Sum(o interface{}) []byte {
+	var data []byte
+	if encoder, ok := o.(CanonicalEncoder); ok {
+		data = encoder.CanonicalBytes()
+	} else {
+		data = []byte(fmt.Sprintf("%v", o))
+	}
+	first := sha256.Sum256(data)
+	second := sha256.Sum256(first[:])
+	return second[:]
+}
+
+// GetHasher returns a hasher by its name
+func GetHasher(name string) (Hasher, error) {
+	for _, hasher := range []Hasher{SHA256Hasher{}, DoubleSHA256Hasher{}} {
+		if hasher.Name() == name {
+			return hasher, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown hasher %q", name)
+}
+
+// WriteCanonicalField writes a field prefixed with its length in bytes, so that concatenated fields can't be confused
+func WriteCanonicalField(b *strings.Builder, field string) {
+	b.WriteString(strconv.Itoa(len(field)))
+	b.WriteString(":")
+	b.WriteString(field)
+}
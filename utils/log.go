@@ -0,0 +1,124 @@
+package utils
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// LogLevel is the severity of a log message, messages below the level set by SetLogLevel are dropped
+type LogLevel int32
+
+const (
+	LevelDebug LogLevel = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+// logLevelNames are names of log levels accepted by ParseLogLevel, in the order of levels
+var logLevelNames []string = []string{"debug", "info", "warn", "error"}
+
+// logLevel is the lowest level of messages written
+var logLevel int32 = int32(LevelInfo)
+
+// String returns the name of a log level
+func (level LogLevel) String() string {
+	if level < LevelDebug || level > LevelError {
+		return "level(" + strconv.Itoa(int(level)) + ")"
+	}
+	return logLevelNames[level]
+}
+
+// ParseLogLevel returns a log level by its name
+func ParseLogLevel(name string) (LogLevel, error) {
+	for n := 0; n < len(logLevelNames); n++ {
+		if logLevelNames[n] == strings.ToLower(name) {
+			return LogLevel(n), nil
+		}
+	}
+	return LevelInfo, fmt.Errorf("unknown log level %q, expected one of %s", name, strings.Join(logLevelNames, ", "))
+}
+
+// SetLogLevel sets the lowest level of messages written by all loggers
+func SetLogLevel(level LogLevel) {
+	atomic.StoreInt32(&logLevel, int32(level))
+}
+
+// Logger writes leveled messages of a package through the standard logger, with fields given as key-value pairs
+// e.g. 2021/06/20 12:00:00 WARN blockchain: invalid block hash=00ab index=3
+type Logger struct {
+	component string
+}
+
+// NewLogger returns a logger of a package, the component name prefixes its messages
+func NewLogger(component string) *Logger {
+	return &Logger{component: component}
+}
+
+// Enabled checks if messages of a given level are written
+func (l *Logger) Enabled(level LogLevel) bool {
+	return int32(level) >= atomic.LoadInt32(&logLevel)
+}
+
+// Debug writes a message about details useful when tracking down a problem, such as mining progress
+func (l *Logger) Debug(msg string, fields ...interface{}) {
+	l.write(LevelDebug, msg, fields)
+}
+
+// Info writes a message about normal operation of the node
+func (l *Logger) Info(msg string, fields ...interface{}) {
+	l.write(LevelInfo, msg, fields)
+}
+
+// Warn writes a message about rejected blocks, transactions and misbehaving peers
+func (l *Logger) Warn(msg string, fields ...interface{}) {
+	l.write(LevelWarn, msg, fields)
+}
+
+// Error writes a message about failures of the node itself, such as failed disk writes
+func (l *Logger) Error(msg string, fields ...interface{}) {
+	l.write(LevelError, msg, fields)
+}
+
+// write formats a message with its fields and writes it if its level is enabled
+func (l *Logger) write(level LogLevel, msg string, fields []interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+	var b strings.Builder
+	b.WriteString(strings.ToUpper(level.String()))
+	b.WriteString(" ")
+	b.WriteString(l.component)
+	b.WriteString(": ")
+	b.WriteString(msg)
+	for n := 0; n < len(fields); n += 2 {
+		b.WriteString(" ")
+		if n+1 == len(fields) {
+			// a value without a key is kept rather than dropped
+			b.WriteString("!BADKEY=")
+			b.WriteString(formatLogValue(fields[n]))
+			break
+		}
+		b.WriteString(fmt.Sprint(fields[n]))
+		b.WriteString("=")
+		b.WriteString(formatLogValue(fields[n+1]))
+	}
+	log.Output(3, b.String())
+}
+
+// formatLogValue formats a field value, quoting it if it is empty or would be confused with other fields
+func formatLogValue(value interface{}) string {
+	var s string
+	if err, ok := value.(error); ok {
+		s = err.Error()
+	} else {
+		s = fmt.Sprint(value)
+	}
+	if s == "" || strings.ContainsAny(s, " =\"\t\n") {
+		return strconv.Quote(s)
+	}
+	return s
+}
@@ -0,0 +1,52 @@
+package utils
+
+import (
+	"math"
+	"time"
+)
+
+// RateBucket is a token bucket limiting the number of requests of one kind accepted from a client
+// Rate is the number of requests per second, Burst is the bucket capacity
+// Delayed and Dropped count requests that were over the budget
+type RateBucket struct {
+	Rate      float64
+	Burst     float64
+	Tokens    float64
+	Delayed   int
+	Dropped   int
+	updatedAt time.Time
+}
+
+// NewRateBucket creates a full token bucket
+func NewRateBucket(rate float64, burst float64) RateBucket {
+	return RateBucket{Rate: rate, Burst: burst, Tokens: burst, updatedAt: time.Now()}
+}
+
+// Take takes a token from a bucket and returns how long to wait before the request can be handled
+// the token is only taken if the wait is not longer than maxDelay, ok is false otherwise and the wait is
+// the time until a token is available, zero if the bucket never refills
+func (b *RateBucket) Take(now time.Time, maxDelay time.Duration) (time.Duration, bool) {
+	b.Tokens = math.Min(b.Burst, b.Tokens+now.Sub(b.updatedAt).Seconds()*b.Rate)
+	b.updatedAt = now
+	if b.Tokens >= 1 {
+		b.Tokens--
+		return 0, true
+	}
+	if b.Rate <= 0 {
+		b.Dropped++
+		return 0, false
+	}
+	var wait time.Duration = time.Duration((1 - b.Tokens) / b.Rate * float64(time.Second))
+	if wait > maxDelay {
+		b.Dropped++
+		return wait, false
+	}
+	b.Tokens--
+	b.Delayed++
+	return wait, true
+}
+
+// IsIdle checks if a bucket was not used for a given time, an idle bucket is full again
+func (b *RateBucket) IsIdle(now time.Time, idleTime time.Duration) bool {
+	return now.Sub(b.updatedAt) >= idleTime
+}
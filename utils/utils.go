@@ -2,12 +2,14 @@
 package utils
 
 import (
+	"bytes"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/asn1"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"math/big"
 	"regexp"
@@ -25,38 +27,53 @@ type signature struct {
 // Hash computes a SHA-256 hash for a given object
 // https://blog.8bitzen.com/posts/22-08-2019-how-to-hash-a-struct-in-go
 func Hash(o interface{}) string {
+	return hex.EncodeToString(HashBytes(o))
+}
+
+// HashBytes computes the same SHA-256 hash as Hash and returns it as bytes
+func HashBytes(o interface{}) []byte {
 	h := sha256.New()
 	h.Write([]byte(fmt.Sprintf("%v", o)))
-	return fmt.Sprintf("%x", h.Sum(nil))
-}
-
-var hexDict = map[string]string{
-	"0": "0000",
-	"1": "0001",
-	"2": "0010",
-	"3": "0011",
-	"4": "0100",
-	"5": "0101",
-	"6": "0110",
-	"7": "0111",
-	"8": "1000",
-	"9": "1001",
-	"a": "1010",
-	"b": "1011",
-	"c": "1100",
-	"d": "1101",
-	"e": "1110",
-	"f": "1111",
+	return h.Sum(nil)
+}
+
+// hexDigitBits holds binary representations of hex digits, indexed by digit value
+var hexDigitBits = [16]string{
+	"0000", "0001", "0010", "0011",
+	"0100", "0101", "0110", "0111",
+	"1000", "1001", "1010", "1011",
+	"1100", "1101", "1110", "1111",
+}
+
+// hexDigitValue returns the value of a hex digit of either case, false if a character is not a hex digit
+func hexDigitValue(c byte) (int, bool) {
+	switch {
+	case c >= '0' && c <= '9':
+		return int(c - '0'), true
+	case c >= 'a' && c <= 'f':
+		return int(c-'a') + 10, true
+	case c >= 'A' && c <= 'F':
+		return int(c-'A') + 10, true
+	}
+	return 0, false
 }
 
 // HexToBin converts hex string to a string of ones and zeros (binary representation)
+// every hex digit gives 4 bits, so leading zeros are kept; an empty string or a non-hex character is an error
 func HexToBin(hex string) (string, error) {
-	hex = strings.ToLower(hex)
-	var result string
+	if len(hex) == 0 {
+		return "", errors.New("empty hex string")
+	}
+	var result strings.Builder
+	result.Grow(4 * len(hex))
 	for n := 0; n < len(hex); n++ {
-		result += hexDict[string(hex[n])]
+		value, ok := hexDigitValue(hex[n])
+		if !ok {
+			return "", fmt.Errorf("invalid hex character %q at position %d", hex[n], n)
+		}
+		result.WriteString(hexDigitBits[value])
 	}
-	return result, nil
+	return result.String(), nil
 }
 
 // IsHex checks if a given string has only hex characters
@@ -65,69 +82,193 @@ func IsHex(s string) bool {
 	return hexTest.MatchString(s)
 }
 
+// ErrInvalidPrivateKey is returned when a private key is not 32 hex encoded bytes of a number from 1 to the curve order minus 1
+var ErrInvalidPrivateKey = errors.New("invalid private key")
+
 // GetPublicKey computes hex encoded public key from a given hex encoded private key
-func GetPublicKey(privateKey string) (publicKey string) {
-	pk := hexToPrivateKey(privateKey)
-	return fmt.Sprintf("%x", elliptic.Marshal(secp256k1.S256(), pk.PublicKey.X, pk.PublicKey.Y))
+func GetPublicKey(privateKey string) (string, error) {
+	pk, err := HexToPrivateKey(privateKey)
+	if err != nil {
+		return "", err
+	}
+	return PublicKeyToHex(&pk.PublicKey), nil
 }
 
-// hexToPrivateKey converts hex encoded private key to a PrivateKey struct
-func hexToPrivateKey(privateKey string) *ecdsa.PrivateKey {
+// PublicKeyToHex encodes a public key as hex of its uncompressed form
+func PublicKeyToHex(pub *ecdsa.PublicKey) string {
+	return fmt.Sprintf("%x", elliptic.Marshal(secp256k1.S256(), pub.X, pub.Y))
+}
+
+// ValidatePrivateKey checks that a hex encoded private key is a valid secp256k1 private key
+func ValidatePrivateKey(privateKey string) error {
+	_, err := privateKeyToInt(privateKey)
+	return err
+}
+
+// privateKeyToInt decodes a hex encoded private key of 64 characters, leading zeros included, and checks its range
+func privateKeyToInt(privateKey string) (*big.Int, error) {
+	keyBytes, err := hex.DecodeString(privateKey)
+	if err != nil || len(keyBytes) != 32 {
+		return nil, ErrInvalidPrivateKey
+	}
+	var d *big.Int = new(big.Int).SetBytes(keyBytes)
+	if d.Sign() == 0 || d.Cmp(secp256k1.S256().Params().N) >= 0 {
+		return nil, ErrInvalidPrivateKey
+	}
+	return d, nil
+}
+
+// HexToPrivateKey converts hex encoded private key to a PrivateKey struct
+func HexToPrivateKey(privateKey string) (*ecdsa.PrivateKey, error) {
+	d, err := privateKeyToInt(privateKey)
+	if err != nil {
+		return nil, err
+	}
 	pk := new(ecdsa.PrivateKey)
-	pk.D, _ = new(big.Int).SetString(privateKey, 16)
+	pk.D = d
 	pk.PublicKey.Curve = secp256k1.S256()
 	pk.PublicKey.X, pk.PublicKey.Y = pk.PublicKey.Curve.ScalarBaseMult(pk.D.Bytes())
-	return pk
+	return pk, nil
 }
 
-// hexToPublicKey converts hex encoded public key to a PublicKey struct
-func hexToPublicKey(publicKey string) *ecdsa.PublicKey {
-	pk := new(ecdsa.PublicKey)
-	publicKeyBytes, _ := hex.DecodeString(publicKey)
+// HexToPublicKey converts hex encoded public key to a PublicKey struct, checking it is a point on the curve
+func HexToPublicKey(publicKey string) (*ecdsa.PublicKey, error) {
+	publicKeyBytes, err := hex.DecodeString(publicKey)
+	if err != nil {
+		return nil, errors.New("public key is not hex encoded")
+	}
 	x, y := elliptic.Unmarshal(secp256k1.S256(), publicKeyBytes)
+	if x == nil || y == nil || !secp256k1.S256().IsOnCurve(x, y) {
+		return nil, errors.New("public key is not a point on the curve")
+	}
+	pk := new(ecdsa.PublicKey)
 	pk.X = x
 	pk.Y = y
 	pk.Curve = secp256k1.S256()
-	return pk
+	return pk, nil
+}
+
+// SignHash signs a hash with a private key and returns the DER encoded signature
+// S is normalized to the lower half of the curve order, so the signature is the canonical one of the pair (R, S) and (R, N-S)
+func SignHash(hash []byte, key *ecdsa.PrivateKey) ([]byte, error) {
+	if key == nil {
+		return nil, ErrInvalidPrivateKey
+	}
+	r, s, err := ecdsa.Sign(rand.Reader, key, hash)
+	if err != nil {
+		return nil, err
+	}
+	var sig signature = signature{R: r, S: s}
+	if !isLowS(s) {
+		sig.S = new(big.Int).Sub(secp256k1.S256().Params().N, s)
+	}
+	return asn1.Marshal(sig)
 }
 
-// GetSignature returns a signature for a given hash, using provided private key
-func GetSignature(hash string, privateKey string) string {
-	hashBytes, _ := hex.DecodeString(hash)
-	key := hexToPrivateKey(privateKey)
+// VerifyHash verifies a DER encoded signature of a hash with a public key
+// false with no error means the signature does not match, an error means the signature or the key is malformed
+func VerifyHash(hash []byte, sig []byte, pub *ecdsa.PublicKey) (bool, error) {
+	if pub == nil || pub.X == nil || pub.Y == nil {
+		return false, errors.New("invalid public key")
+	}
+	var esig signature
+	if _, err := asn1.Unmarshal(sig, &esig); err != nil {
+		return false, fmt.Errorf("invalid signature: %s", err.Error())
+	}
+	if esig.R == nil || esig.S == nil {
+		return false, errors.New("invalid signature: missing R or S")
+	}
+	return ecdsa.Verify(pub, hash, esig.R, esig.S), nil
+}
 
-	var sig signature = signature{}
-	r, s, _ := ecdsa.Sign(rand.Reader, key, hashBytes)
-	sig.R = r
-	sig.S = s
+// IsCanonicalSignature checks if a DER encoded signature has low S and is encoded the way SignHash encodes it,
+// both can otherwise be changed by anyone without invalidating the signature
+func IsCanonicalSignature(sig []byte) bool {
+	var esig signature
+	if rest, err := asn1.Unmarshal(sig, &esig); err != nil || len(rest) != 0 || esig.R == nil || esig.S == nil {
+		return false
+	}
+	marshaled, err := asn1.Marshal(esig)
+	return err == nil && bytes.Equal(marshaled, sig) && isLowS(esig.S)
+}
 
-	marshaled, _ := asn1.Marshal(sig)
-	return fmt.Sprintf("%x", marshaled)
+// GetSignature returns a hex encoded signature for a given hex encoded hash, using provided private key, see SignHash
+func GetSignature(hash string, privateKey string) (string, error) {
+	hashBytes, err := hex.DecodeString(hash)
+	if err != nil {
+		return "", fmt.Errorf("hash is not hex encoded: %s", hash)
+	}
+	key, err := HexToPrivateKey(privateKey)
+	if err != nil {
+		return "", err
+	}
+	sig, err := SignHash(hashBytes, key)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(sig), nil
+}
+
+// isLowS checks if S of a signature is in the lower half of the curve order
+func isLowS(s *big.Int) bool {
+	var halfOrder *big.Int = new(big.Int).Rsh(secp256k1.S256().Params().N, 1)
+	return s.Cmp(halfOrder) <= 0
 }
 
-// VerifySignature verifies a signature for a given hash, using provided public key
-func VerifySignature(hash string, sig string, publicKeyHex string) bool {
-	publicKey := hexToPublicKey(publicKeyHex)
-	hashBytes, _ := hex.DecodeString(hash)
+// VerifySignature verifies a hex encoded signature for a given hex encoded hash, using provided public key, see VerifyHash
+// requireCanonical also rejects signatures that are not canonical or not lowercase hex, see IsCanonicalSignature
+// a malformed hash, public key or signature makes the signature invalid
+func VerifySignature(hash string, sig string, publicKeyHex string, requireCanonical bool) bool {
+	publicKey, err := HexToPublicKey(publicKeyHex)
+	if err != nil {
+		return false
+	}
+	hashBytes, err := hex.DecodeString(hash)
+	if err != nil {
+		return false
+	}
+	sigBytes, err := hex.DecodeString(sig)
+	if err != nil {
+		return false
+	}
+	if requireCanonical && (!IsCanonicalSignature(sigBytes) || hex.EncodeToString(sigBytes) != sig) {
+		return false
+	}
+	isValid, err := VerifyHash(hashBytes, sigBytes, publicKey)
+	return err == nil && isValid
+}
 
-	sigBytes, _ := hex.DecodeString(sig)
+// base58Alphabet is the Bitcoin base58 alphabet, it leaves out 0, O, I and l, which are easy to confuse
+const base58Alphabet string = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
 
-	var esig signature
-	// invalid signature will be unmarshaled incorrectly and cause a memory address error when verified
-	// check for error to prevent this from happening
-	_, err := asn1.Unmarshal(sigBytes, &esig)
-	if err == nil {
-		return ecdsa.Verify(publicKey, hashBytes, esig.R, esig.S)
+// Base58Encode encodes hex encoded bytes in base58, an empty or non-hex input is an error
+func Base58Encode(str string) (string, error) {
+	if len(str) == 0 {
+		return "", errors.New("nothing to encode in base58")
 	}
-	return false
+	bytes, err := hex.DecodeString(str)
+	if err != nil {
+		return "", fmt.Errorf("base58 input is not hex encoded: %s", err.Error())
+	}
+	return base58.Encode(bytes), nil
 }
 
-func Base58Encode(str string) string {
-	bytes, _ := hex.DecodeString(str)
-	return base58.Encode(bytes)
+// Base58Decode decodes a base58 string to hex, an empty string or a character outside the base58 alphabet is an error
+func Base58Decode(base58str string) (string, error) {
+	if len(base58str) == 0 {
+		return "", errors.New("empty base58 string")
+	}
+	for n := 0; n < len(base58str); n++ {
+		if strings.IndexByte(base58Alphabet, base58str[n]) < 0 {
+			return "", fmt.Errorf("invalid base58 character %q at position %d", base58str[n], n)
+		}
+	}
+	return hex.EncodeToString(base58.Decode(base58str)), nil
 }
 
-func Base58Decode(base58str string) string {
-	bytes := base58.Decode(base58str)
-	return hex.EncodeToString(bytes)
+// Checksum returns the first 4 bytes of double SHA-256 of a payload, used by base58check encodings
+func Checksum(payload []byte) []byte {
+	first := sha256.Sum256(payload)
+	second := sha256.Sum256(first[:])
+	return second[:4]
 }
@@ -0,0 +1,169 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/crypto/secp256k1"
+)
+
+func TestHexToBin(test *testing.T) {
+	var cases = map[string]string{
+		"0":    "0000",
+		"f":    "1111",
+		"F":    "1111",
+		"00ff": "0000000011111111",
+		"aB9":  "101010111001",
+		"0001": "0000000000000001",
+	}
+	for hex, expected := range cases {
+		bin, err := HexToBin(hex)
+		if err != nil {
+			test.Fatalf("%q: %v", hex, err)
+		}
+		if bin != expected {
+			test.Fatalf("%q: expected %s, got %s", hex, expected, bin)
+		}
+	}
+}
+
+func TestHexToBinRejectsInvalidInput(test *testing.T) {
+	for _, hex := range []string{"", "g", "0x12", "12 34", "ab\x00", "é1", "-1"} {
+		if bin, err := HexToBin(hex); err == nil {
+			test.Fatalf("%q: expected an error, got %s", hex, bin)
+		}
+	}
+}
+
+func TestHexToBinRandomInput(test *testing.T) {
+	var random *rand.Rand = rand.New(rand.NewSource(362))
+	const digits string = "0123456789abcdefABCDEF"
+	for n := 0; n < 10000; n++ {
+		var b strings.Builder
+		var length int = 1 + random.Intn(70)
+		for i := 0; i < length; i++ {
+			b.WriteByte(digits[random.Intn(len(digits))])
+		}
+		var hex string = b.String()
+
+		bin, err := HexToBin(hex)
+		if err != nil {
+			test.Fatalf("%q: %v", hex, err)
+		}
+		// every digit gives 4 bits, the value matches big.Int parsing, leading zeros included
+		value, _ := new(big.Int).SetString(hex, 16)
+		var expected string = fmt.Sprintf("%0*b", 4*len(hex), value)
+		if bin != expected {
+			test.Fatalf("%q: expected %s, got %s", hex, expected, bin)
+		}
+
+		// a single character outside hex digits anywhere makes the input invalid
+		var position int = random.Intn(len(hex))
+		var invalid string = hex[:position] + string(rune('g'+random.Intn(20))) + hex[position+1:]
+		if _, err := HexToBin(invalid); err == nil {
+			test.Fatalf("%q: expected an error", invalid)
+		}
+	}
+}
+
+func TestValidatePrivateKey(test *testing.T) {
+	var order string = fmt.Sprintf("%064x", secp256k1.S256().Params().N)
+	var cases = map[string]bool{
+		"":                              false,
+		"00":                            false,
+		strings.Repeat("0", 64):         false,
+		strings.Repeat("0", 63) + "1":   true,
+		strings.Repeat("0", 62) + "1":   false,
+		"1":                             false,
+		strings.Repeat("0", 65) + "1":   false,
+		strings.Repeat("0", 63) + "g":   false,
+		"00" + strings.Repeat("ab", 31): true,
+		strings.Repeat("ab", 31):        false,
+		order:                           false,
+		order[:63] + "0":                true,
+		strings.Repeat("f", 64):         false,
+	}
+	for privateKey, valid := range cases {
+		if err := ValidatePrivateKey(privateKey); (err == nil) != valid {
+			test.Fatalf("%q: expected valid %v, got %v", privateKey, valid, err)
+		}
+		key, err := HexToPrivateKey(privateKey)
+		if valid && (err != nil || key == nil) {
+			test.Fatalf("%q: %v", privateKey, err)
+		} else if !valid && (!errors.Is(err, ErrInvalidPrivateKey) || key != nil) {
+			test.Fatalf("%q: expected %v, got %v", privateKey, ErrInvalidPrivateKey, err)
+		}
+	}
+}
+
+func TestPrivateKeyWithLeadingZeros(test *testing.T) {
+	// the same number with its leading zero bytes is a different key than without them, only the 64 character form is one
+	var privateKey string = "0000" + strings.Repeat("12", 30)
+	key, err := HexToPrivateKey(privateKey)
+	if err != nil {
+		test.Fatal(err)
+	}
+	if fmt.Sprintf("%064x", key.D) != privateKey {
+		test.Fatalf("expected key %s, got %064x", privateKey, key.D)
+	}
+	publicKey, err := GetPublicKey(privateKey)
+	if err != nil {
+		test.Fatal(err)
+	}
+	signature, err := GetSignature(Hash("message"), privateKey)
+	if err != nil {
+		test.Fatal(err)
+	}
+	if !VerifySignature(Hash("message"), signature, publicKey, true) {
+		test.Fatal("signature of a key with leading zeros must be valid")
+	}
+	if _, err := GetPublicKey(strings.TrimLeft(privateKey, "0")); !errors.Is(err, ErrInvalidPrivateKey) {
+		test.Fatalf("expected %v for a key without its leading zeros, got %v", ErrInvalidPrivateKey, err)
+	}
+	if _, err := SignHash([]byte("hash"), nil); !errors.Is(err, ErrInvalidPrivateKey) {
+		test.Fatalf("expected %v signing without a key, got %v", ErrInvalidPrivateKey, err)
+	}
+}
+
+func TestBase58RoundTrip(test *testing.T) {
+	var cases = map[string]string{
+		"00":       "1",
+		"0000ff":   "115Q",
+		"61":       "2g",
+		"04abcdef": "7vf9Y",
+	}
+	for hex, encoded := range cases {
+		base58str, err := Base58Encode(hex)
+		if err != nil {
+			test.Fatalf("%q: %v", hex, err)
+		}
+		if base58str != encoded {
+			test.Fatalf("%q: expected %s, got %s", hex, encoded, base58str)
+		}
+		decoded, err := Base58Decode(base58str)
+		if err != nil {
+			test.Fatalf("%q: %v", base58str, err)
+		}
+		if decoded != hex {
+			test.Fatalf("%q: expected %s decoded, got %s", base58str, hex, decoded)
+		}
+	}
+}
+
+func TestBase58RejectsInvalidInput(test *testing.T) {
+	// 0, O, I and l are left out of the alphabet, decoding must not skip or misread them
+	for _, base58str := range []string{"", "0", "O", "I", "l", "2g0", "O2g", "2gI", "l2g", "2g 5Q", "2g+", "2gé"} {
+		if decoded, err := Base58Decode(base58str); err == nil {
+			test.Fatalf("%q: expected an error, got %s", base58str, decoded)
+		}
+	}
+	for _, hex := range []string{"", "0", "abc", "zz", "0x12"} {
+		if encoded, err := Base58Encode(hex); err == nil {
+			test.Fatalf("%q: expected an error, got %s", hex, encoded)
+		}
+	}
+}
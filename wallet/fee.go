@@ -0,0 +1,39 @@
+package wallet
+
+import (
+	"math"
+)
+
+// feeStep is the smallest fee increment used when computing transaction fees
+const feeStep float64 = 0.000001
+
+// serialized sizes used to estimate the size of a transaction before it is signed, in bytes
+// each is an upper bound of its part of JSON the size of a transaction is measured on:
+// the envelope holds a version, txIns hold the longest DER signature and a revealed public key, txOuts the longest address and amount
+const (
+	txEnvelopeSize int = 108
+	txInSize       int = 418
+	txOutSize      int = 138
+)
+
+// EstimateTransactionSize returns the largest serialized size of a transaction with given numbers of txIns and txOuts
+func EstimateTransactionSize(inputCount int, outputCount int) int {
+	var size int = txEnvelopeSize + inputCount*txInSize + outputCount*txOutSize
+	// txIns and txOuts are separated by commas
+	if inputCount > 1 {
+		size += inputCount - 1
+	}
+	if outputCount > 1 {
+		size += outputCount - 1
+	}
+	return size
+}
+
+// EstimateFee returns a fee a transaction with given numbers of txIns and txOuts pays at a given fee per byte
+// the fee is rounded up to feeStep, so the transaction never pays less than the fee rate
+func EstimateFee(inputCount int, outputCount int, feeRate float64) float64 {
+	if feeRate <= 0 {
+		return 0
+	}
+	return math.Ceil(feeRate*float64(EstimateTransactionSize(inputCount, outputCount))/feeStep) * feeStep
+}
@@ -0,0 +1,59 @@
+package wallet
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	t "naivecoin/transactions"
+	"testing"
+)
+
+func TestEstimateFee(test *testing.T) {
+	if fee := EstimateFee(3, 2, 0); fee != 0 {
+		test.Fatalf("expected no fee at zero fee rate, got %v", fee)
+	}
+	// the fee is rounded up to feeStep, never below the fee rate: 664 bytes at 0.0000001 are 66.4 steps
+	var size int = EstimateTransactionSize(1, 1)
+	if fee := EstimateFee(1, 1, 0.0000001); size != 664 || math.Abs(fee-67*feeStep) > feeStep/2 {
+		test.Fatalf("expected fee of %d bytes rounded up to %v, got %v", size, 67*feeStep, fee)
+	}
+	if EstimateFee(2, 1, 0.001) <= EstimateFee(1, 1, 0.001) || EstimateFee(1, 2, 0.001) <= EstimateFee(1, 1, 0.001) {
+		test.Fatal("every txIn and txOut must add to the fee")
+	}
+}
+
+func TestCreateTransactionCoversFeeOfAddedInputs(test *testing.T) {
+	var path string = restoreTestWallet(test, testMnemonic)
+	var keystoreBefore []byte = readFile(test, path)
+	var feeRate float64 = 0.001
+	// the amount is covered by two txOuts, but not with the fee of two txIns, so a third one is added
+	var unspentTxOuts []t.UnspentTxOut = testUnspentTxOuts(GetBase58Address(), 5, 5, 5, 5)
+	var amount float64 = 10 - EstimateFee(2, 1, feeRate)/2
+
+	transaction, err := CreateTransaction(testRecipient(test), amount, feeRate, unspentTxOuts, nil)
+	if err != nil {
+		test.Fatal(err)
+	}
+	if len(transaction.TxIns) != 3 || len(transaction.TxOuts) != 2 {
+		test.Fatalf("expected 3 txIns and change, got %d txIns and %d txOuts", len(transaction.TxIns), len(transaction.TxOuts))
+	}
+	var fee float64 = t.GetTransactionFee(transaction, unspentTxOuts)
+	if requiredFee := EstimateFee(3, 2, feeRate); fee < requiredFee-1e-9 {
+		test.Fatalf("transaction pays %v, less than the estimated fee %v", fee, requiredFee)
+	}
+	if size := t.GetTransactionSize(transaction); size > EstimateTransactionSize(3, 2) {
+		test.Fatalf("transaction of %d bytes is bigger than its estimate %d", size, EstimateTransactionSize(3, 2))
+	}
+	if feeRate_ := t.GetFeeRate(transaction, unspentTxOuts); feeRate_ < feeRate {
+		test.Fatalf("transaction pays %v per byte, less than %v", feeRate_, feeRate)
+	}
+
+	// the whole balance can't pay the fee as well, the wallet refuses rather than underpaying
+	if _, err := CreateTransaction(testRecipient(test), 20, feeRate, unspentTxOuts, nil); !errors.Is(err, ErrInsufficientFunds) {
+		test.Fatalf("expected %v, got %v", ErrInsufficientFunds, err)
+	}
+	// neither building a transaction nor refusing one touches the keystore
+	if !bytes.Equal(readFile(test, path), keystoreBefore) || len(GetAddresses()) != restoredAddressCount {
+		test.Fatal("estimating a fee must not issue addresses")
+	}
+}
@@ -0,0 +1,278 @@
+package wallet
+
+import (
+	"crypto/hmac"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"math/big"
+	t "naivecoin/transactions"
+	"naivecoin/utils"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/crypto/secp256k1"
+)
+
+// hardenedOffset marks child key indexes derived with the parent private key
+const hardenedOffset uint32 = 0x80000000
+
+// childKeyDomain separates child key derivation from other uses of the master key
+const childKeyDomain string = "naivecoin child key"
+
+// restoredAddressCount is the number of addresses issued for a restored wallet,
+// so that funds received to addresses issued before the wallet was lost are found
+const restoredAddressCount int = 20
+
+// walletAddress holds both forms of an address of a wallet key: the full public key and the pubkey-hash address
+type walletAddress struct {
+	publicKey  string
+	pubKeyHash string
+}
+
+// addresses holds issued addresses, the first one is the primary address of the master key
+// privateKeys holds private keys of issued addresses in the same order while the wallet is unlocked, nil while it is locked
+var addresses []walletAddress = []walletAddress{}
+var privateKeys [][]byte
+var keysLock sync.Mutex
+
+var logger *utils.Logger = utils.NewLogger("wallet")
+
+// shortAddresses makes the wallet give out pubkey-hash addresses instead of full public key addresses
+// funds sent to either form of an issued address belong to the wallet
+var shortAddresses bool = false
+
+// SetShortAddresses sets whether the wallet gives out pubkey-hash addresses or full public key addresses
+func SetShortAddresses(enabled bool) {
+	shortAddresses = enabled
+}
+
+// newWalletAddress returns both forms of the address of a private key
+func newWalletAddress(privateKey_ string) (walletAddress, error) {
+	publicKey, err := utils.GetPublicKey(privateKey_)
+	if err != nil {
+		return walletAddress{}, err
+	}
+	publicKeyAddress, err := utils.Base58Encode(publicKey)
+	if err != nil {
+		return walletAddress{}, err
+	}
+	pubKeyHashAddress, err := t.GetPubKeyHashAddress(publicKey)
+	if err != nil {
+		return walletAddress{}, err
+	}
+	return walletAddress{publicKey: publicKeyAddress, pubKeyHash: pubKeyHashAddress}, nil
+}
+
+// String returns the form of the address the wallet gives out
+func (a walletAddress) String() string {
+	if shortAddresses {
+		return a.pubKeyHash
+	}
+	return a.publicKey
+}
+
+// changeToNewAddress makes transactions send change to a fresh address instead of the primary one
+var changeToNewAddress bool = true
+
+// SetChangeToNewAddress sets whether transactions send change to a fresh address or to the primary address
+func SetChangeToNewAddress(enabled bool) {
+	changeToNewAddress = enabled
+}
+
+// deriveChildKey derives a hardened child private key with a given index from the master key
+// the child key is HMAC-SHA512 of the index keyed by the master key, so it can't be computed from public data
+func deriveChildKey(masterKey string, index int) (string, error) {
+	masterKeyBytes, err := hex.DecodeString(masterKey)
+	if err != nil {
+		return "", err
+	}
+	indexBytes := make([]byte, 4)
+	binary.BigEndian.PutUint32(indexBytes, uint32(index)|hardenedOffset)
+
+	mac := hmac.New(sha512.New, masterKeyBytes)
+	mac.Write([]byte(childKeyDomain))
+	mac.Write(indexBytes)
+	var keyBytes []byte = mac.Sum(nil)[:32]
+
+	var key *big.Int = new(big.Int).SetBytes(keyBytes)
+	if key.Sign() == 0 || key.Cmp(secp256k1.S256().Params().N) >= 0 {
+		return "", errors.New("derived child key is not valid")
+	}
+	return hex.EncodeToString(keyBytes), nil
+}
+
+// deriveKeys derives private keys and addresses of a given number of issued addresses from the master key
+func deriveKeys(masterKey string, addressCount int) ([]walletAddress, [][]byte, error) {
+	var derivedAddresses []walletAddress = []walletAddress{}
+	var derivedKeys [][]byte = [][]byte{}
+	for index := 0; index < addressCount; index++ {
+		var key string = masterKey
+		if index > 0 {
+			var err error
+			key, err = deriveChildKey(masterKey, index)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		keyBytes, err := hex.DecodeString(key)
+		if err != nil {
+			return nil, nil, err
+		}
+		address, err := newWalletAddress(key)
+		if err != nil {
+			return nil, nil, err
+		}
+		derivedAddresses = append(derivedAddresses, address)
+		derivedKeys = append(derivedKeys, keyBytes)
+	}
+	return derivedAddresses, derivedKeys, nil
+}
+
+// setMasterKey sets the master key of the wallet and derives keys of a given number of issued addresses
+// the wallet stays unlocked until it is locked
+func setMasterKey(masterKey string, addressCount int) error {
+	newAddresses, newKeys, err := deriveKeys(masterKey, addressCount)
+	if err != nil {
+		return err
+	}
+
+	keysLock.Lock()
+	defer keysLock.Unlock()
+	addresses = newAddresses
+	setPrivateKeys(newKeys)
+	return nil
+}
+
+// GetAddresses returns all issued addresses of the wallet, starting with the primary address
+func GetAddresses() []string {
+	keysLock.Lock()
+	defer keysLock.Unlock()
+	var issued []string = []string{}
+	for _, address := range addresses {
+		issued = append(issued, address.String())
+	}
+	return issued
+}
+
+// GetNewAddress derives the next address of the wallet and saves the number of issued addresses to the keystore
+// the master key is needed to derive an address, so the wallet must be unlocked
+func GetNewAddress() (string, error) {
+	keysLock.Lock()
+	defer keysLock.Unlock()
+	address, childKeyBytes, err := deriveNextAddress()
+	if err != nil {
+		return "", err
+	}
+	if err := issueAddress(address, childKeyBytes); err != nil {
+		return "", err
+	}
+	return address.String(), nil
+}
+
+// deriveNextAddress derives the address GetNewAddress issues next with its private key, without issuing it
+// keysLock must be held
+func deriveNextAddress() (walletAddress, []byte, error) {
+	if len(addresses) == 0 {
+		return walletAddress{}, nil, errors.New("wallet is not initialized")
+	}
+	if privateKeys == nil {
+		return walletAddress{}, nil, ErrWalletLocked
+	}
+	childKey, err := deriveChildKey(hex.EncodeToString(privateKeys[0]), len(addresses))
+	if err != nil {
+		return walletAddress{}, nil, err
+	}
+	childKeyBytes, err := hex.DecodeString(childKey)
+	if err != nil {
+		return walletAddress{}, nil, err
+	}
+	address, err := newWalletAddress(childKey)
+	if err != nil {
+		return walletAddress{}, nil, err
+	}
+	return address, childKeyBytes, nil
+}
+
+// issueAddress saves the number of issued addresses with a derived address to the keystore and adds the address to the wallet
+// keysLock must be held
+func issueAddress(address walletAddress, keyBytes []byte) error {
+	if err := saveAddressCount(len(addresses) + 1); err != nil {
+		return err
+	}
+	addresses = append(addresses, address)
+	privateKeys = append(privateKeys, keyBytes)
+	return nil
+}
+
+// getChangeAddress returns an address transactions send change to, the primary address if a fresh one can't be derived
+// a fresh address is the next one to be issued, it is only reserved here: the keystore is not touched until
+// IssueChangeAddress is called for a transaction admitted to the pool, so building a transaction that is then
+// estimated or rejected issues nothing, and the next transaction sends change to the same address
+func getChangeAddress() string {
+	if !changeToNewAddress {
+		return GetBase58Address()
+	}
+	keysLock.Lock()
+	address, _, err := deriveNextAddress()
+	keysLock.Unlock()
+	if err != nil {
+		logger.Warn("failed to derive change address, sending change to the primary address", "err", err)
+		return GetBase58Address()
+	}
+	return address.String()
+}
+
+// IssueChangeAddress issues the change address reserved for a transaction once the transaction is admitted to the pool
+// nothing is issued if the transaction sends no change to the address next to be issued
+func IssueChangeAddress(transaction t.Transaction) error {
+	keysLock.Lock()
+	defer keysLock.Unlock()
+	address, keyBytes, err := deriveNextAddress()
+	if err != nil {
+		return err
+	}
+	for _, txOut := range transaction.TxOuts {
+		if txOut.Address == address.publicKey || txOut.Address == address.pubKeyHash {
+			return issueAddress(address, keyBytes)
+		}
+	}
+	return nil
+}
+
+// getPrivateKeys returns private keys of all issued addresses, by address of either form, ErrWalletLocked if the wallet is locked
+func getPrivateKeys() (map[string]string, error) {
+	keysLock.Lock()
+	defer keysLock.Unlock()
+	if privateKeys == nil {
+		return nil, ErrWalletLocked
+	}
+	var keysByAddress map[string]string = map[string]string{}
+	for n := 0; n < len(addresses); n++ {
+		keysByAddress[addresses[n].publicKey] = hex.EncodeToString(privateKeys[n])
+		keysByAddress[addresses[n].pubKeyHash] = hex.EncodeToString(privateKeys[n])
+	}
+	return keysByAddress, nil
+}
+
+// getAddressSet returns the set of all issued addresses in both forms, it is available while the wallet is locked
+func getAddressSet() map[string]bool {
+	keysLock.Lock()
+	defer keysLock.Unlock()
+	var addressSet map[string]bool = map[string]bool{}
+	for _, address := range addresses {
+		addressSet[address.publicKey] = true
+		addressSet[address.pubKeyHash] = true
+	}
+	return addressSet
+}
+
+// saveAddressCount updates the number of issued addresses in the keystore
+func saveAddressCount(addressCount int) error {
+	keystore, err := readKeystore(keystorePath)
+	if err != nil {
+		return err
+	}
+	keystore.AddressCount = addressCount
+	return writeKeystoreFile(keystorePath, keystore)
+}
@@ -0,0 +1,123 @@
+package wallet
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	t "naivecoin/transactions"
+	"naivecoin/utils"
+	"testing"
+)
+
+// testRecipient returns an address the wallet does not own
+func testRecipient(tb testing.TB) string {
+	address, err := getBase58AddressFor(fmt.Sprintf("%064x", 2))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return address
+}
+
+// testUnspentTxOuts returns unspent txOuts of given amounts owned by an address
+func testUnspentTxOuts(address string, amounts ...float64) []t.UnspentTxOut {
+	var unspentTxOuts []t.UnspentTxOut = []t.UnspentTxOut{}
+	for n, amount := range amounts {
+		unspentTxOuts = append(unspentTxOuts, t.UnspentTxOut{
+			TxOutId:    utils.Hash(fmt.Sprintf("txOut %d", n)),
+			TxOutIndex: 0,
+			Address:    address,
+			Amount:     amount,
+		})
+	}
+	return unspentTxOuts
+}
+
+// readFile returns the content of a file, failing the test if it can't be read
+func readFile(tb testing.TB, path string) []byte {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return content
+}
+
+// isIssued checks if an address is one of the issued addresses of the wallet
+func isIssued(address string) bool {
+	for _, issued := range GetAddresses() {
+		if issued == address {
+			return true
+		}
+	}
+	return false
+}
+
+func TestChangeAddressIssuedOnlyOnceAdmitted(test *testing.T) {
+	var path string = restoreTestWallet(test, testMnemonic)
+	var unspentTxOuts []t.UnspentTxOut = testUnspentTxOuts(GetBase58Address(), 50)
+	var keystoreBefore []byte = readFile(test, path)
+
+	first, err := CreateTransaction(testRecipient(test), 10, 0, unspentTxOuts, nil)
+	if err != nil {
+		test.Fatal(err)
+	}
+	if len(first.TxOuts) != 2 {
+		test.Fatalf("expected a change txOut, got %d txOuts", len(first.TxOuts))
+	}
+	var changeAddress string = first.TxOuts[1].Address
+	if changeAddress == GetBase58Address() || isIssued(changeAddress) {
+		test.Fatalf("change must go to a fresh address, got %s", changeAddress)
+	}
+	if !bytes.Equal(readFile(test, path), keystoreBefore) || len(GetAddresses()) != restoredAddressCount {
+		test.Fatal("building a transaction must not issue its change address")
+	}
+
+	// the first transaction was never admitted, so the next one reuses its change address
+	second, err := CreateTransaction(testRecipient(test), 20, 0, unspentTxOuts, nil)
+	if err != nil {
+		test.Fatal(err)
+	}
+	if second.TxOuts[1].Address != changeAddress {
+		test.Fatalf("expected change to reserved address %s, got %s", changeAddress, second.TxOuts[1].Address)
+	}
+
+	if err := IssueChangeAddress(second); err != nil {
+		test.Fatal(err)
+	}
+	if !isIssued(changeAddress) {
+		test.Fatal("change address of an admitted transaction must be issued")
+	}
+	keystore, err := readKeystore(path)
+	if err != nil {
+		test.Fatal(err)
+	}
+	if keystore.AddressCount != restoredAddressCount+1 {
+		test.Fatalf("expected %d addresses saved to the keystore, got %d", restoredAddressCount+1, keystore.AddressCount)
+	}
+	if balance := GetBalance(append(unspentTxOuts, t.UnspentTxOut{TxOutId: second.Id, TxOutIndex: 1, Address: changeAddress, Amount: 30})); balance != 80 {
+		test.Fatalf("change must belong to the wallet, expected balance 80, got %v", balance)
+	}
+
+	third, err := CreateTransaction(testRecipient(test), 10, 0, unspentTxOuts, nil)
+	if err != nil {
+		test.Fatal(err)
+	}
+	if third.TxOuts[1].Address == changeAddress {
+		test.Fatal("an issued change address must not be reserved again")
+	}
+}
+
+func TestIssueChangeAddressWithoutChange(test *testing.T) {
+	var path string = restoreTestWallet(test, testMnemonic)
+	var keystoreBefore []byte = readFile(test, path)
+
+	transaction, err := CreateTransaction(testRecipient(test), 50, 0, testUnspentTxOuts(GetBase58Address(), 50), nil)
+	if err != nil {
+		test.Fatal(err)
+	}
+	if err := IssueChangeAddress(transaction); err != nil {
+		test.Fatal(err)
+	}
+	if !bytes.Equal(readFile(test, path), keystoreBefore) || len(GetAddresses()) != restoredAddressCount {
+		test.Fatal("a transaction without change must not issue an address")
+	}
+}
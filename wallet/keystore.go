@@ -0,0 +1,223 @@
+package wallet
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// keystorePath stores a path for the encrypted private key, set by InitWallet and RestoreFromMnemonic
+var keystorePath string = "./wallet.json"
+
+// scrypt parameters used to derive an encryption key from a passphrase
+const (
+	scryptN      int = 1 << 15
+	scryptR      int = 8
+	scryptP      int = 1
+	scryptKeyLen int = 32
+)
+
+// ErrWrongPassphrase is returned when the keystore can't be decrypted with a given passphrase
+var ErrWrongPassphrase = errors.New("wrong passphrase")
+
+// kdfParams holds scrypt parameters and salt used to derive the encryption key
+type kdfParams struct {
+	N      int
+	R      int
+	P      int
+	KeyLen int
+	Salt   string
+}
+
+// keystoreCrypto holds the encrypted private key, encoded as hex strings
+type keystoreCrypto struct {
+	Cipher     string
+	CipherText string
+	Nonce      string
+	Kdf        string
+	KdfParams  kdfParams
+}
+
+// keystoreFile is the content of the keystore file
+// Address is the primary address, AddressCount is the number of addresses issued from the encrypted master key
+type keystoreFile struct {
+	Version      int
+	Address      string
+	AddressCount int
+	Crypto       keystoreCrypto
+}
+
+// deriveKey derives an encryption key from a passphrase with scrypt
+func deriveKey(passphrase string, params kdfParams) ([]byte, error) {
+	salt, err := hex.DecodeString(params.Salt)
+	if err != nil {
+		return nil, err
+	}
+	return scrypt.Key([]byte(passphrase), salt, params.N, params.R, params.P, params.KeyLen)
+}
+
+// encryptKey encrypts a hex encoded private key with a passphrase using scrypt and AES-GCM
+func encryptKey(privateKey string, passphrase string) (keystoreFile, error) {
+	keyBytes, err := hex.DecodeString(privateKey)
+	if err != nil {
+		return keystoreFile{}, err
+	}
+
+	salt := make([]byte, 32)
+	if _, err := rand.Read(salt); err != nil {
+		return keystoreFile{}, err
+	}
+	params := kdfParams{N: scryptN, R: scryptR, P: scryptP, KeyLen: scryptKeyLen, Salt: hex.EncodeToString(salt)}
+	derivedKey, err := deriveKey(passphrase, params)
+	if err != nil {
+		return keystoreFile{}, err
+	}
+
+	gcm, err := newGCM(derivedKey)
+	if err != nil {
+		return keystoreFile{}, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return keystoreFile{}, err
+	}
+	cipherText := gcm.Seal(nil, nonce, keyBytes, nil)
+	address, err := getBase58AddressFor(privateKey)
+	if err != nil {
+		return keystoreFile{}, err
+	}
+
+	return keystoreFile{
+		Version: 1,
+		Address: address,
+		Crypto: keystoreCrypto{
+			Cipher:     "aes-256-gcm",
+			CipherText: hex.EncodeToString(cipherText),
+			Nonce:      hex.EncodeToString(nonce),
+			Kdf:        "scrypt",
+			KdfParams:  params,
+		},
+	}, nil
+}
+
+// decryptKey decrypts a private key from a keystore, returns ErrWrongPassphrase if the passphrase does not match
+func decryptKey(keystore keystoreFile, passphrase string) (string, error) {
+	if keystore.Crypto.Cipher != "aes-256-gcm" || keystore.Crypto.Kdf != "scrypt" {
+		return "", fmt.Errorf("unsupported keystore: %s with %s", keystore.Crypto.Cipher, keystore.Crypto.Kdf)
+	}
+	derivedKey, err := deriveKey(passphrase, keystore.Crypto.KdfParams)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := newGCM(derivedKey)
+	if err != nil {
+		return "", err
+	}
+	nonce, err := hex.DecodeString(keystore.Crypto.Nonce)
+	if err != nil || len(nonce) != gcm.NonceSize() {
+		return "", errors.New("invalid keystore nonce")
+	}
+	cipherText, err := hex.DecodeString(keystore.Crypto.CipherText)
+	if err != nil {
+		return "", errors.New("invalid keystore cipher text")
+	}
+	keyBytes, err := gcm.Open(nil, nonce, cipherText, nil)
+	if err != nil {
+		return "", ErrWrongPassphrase
+	}
+	return hex.EncodeToString(keyBytes), nil
+}
+
+// decryptKeystore decrypts the master key from the keystore, returns ErrWrongPassphrase if a passphrase does not match
+func decryptKeystore(passphrase string) (string, error) {
+	keystore, err := readKeystore(keystorePath)
+	if err != nil {
+		return "", err
+	}
+	return decryptKey(keystore, passphrase)
+}
+
+// newGCM creates an AES-GCM cipher with a given key
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// ReadAddress returns the primary address kept in the keystore at a given path, it is read without the passphrase
+func ReadAddress(keystorePath_ string) (string, error) {
+	keystore, err := readKeystore(keystorePath_)
+	if err != nil {
+		return "", err
+	}
+	if keystore.Address == "" {
+		return "", fmt.Errorf("no address in keystore %s", keystorePath_)
+	}
+	return keystore.Address, nil
+}
+
+// readKeystore reads a keystore file
+func readKeystore(path string) (keystoreFile, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return keystoreFile{}, err
+	}
+	var keystore keystoreFile
+	if err := json.Unmarshal(content, &keystore); err != nil {
+		return keystoreFile{}, fmt.Errorf("invalid keystore %s: %s", path, err.Error())
+	}
+	return keystore, nil
+}
+
+// writeKeystore encrypts a master private key and writes it to a keystore file with a given number of issued addresses
+func writeKeystore(path string, privateKey string, passphrase string, addressCount int) error {
+	keystore, err := encryptKey(privateKey, passphrase)
+	if err != nil {
+		return err
+	}
+	keystore.AddressCount = addressCount
+	return writeKeystoreFile(path, keystore)
+}
+
+// writeKeystoreFile writes a keystore to a file readable by the owner only
+func writeKeystoreFile(path string, keystore keystoreFile) error {
+	content, err := json.MarshalIndent(keystore, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, content, 0600)
+}
+
+// removeSecurely overwrites a file with zeros before removing it
+func removeSecurely(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(make([]byte, info.Size())); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
@@ -0,0 +1,79 @@
+package wallet
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrWalletLocked is returned when spending or issuing addresses needs private keys while the wallet is locked
+var ErrWalletLocked = errors.New("wallet is locked")
+
+// lockGeneration counts unlocks, so that the expiry of an earlier unlock does not lock the wallet unlocked again later
+// lockTimer locks the wallet when the current unlock expires, both are guarded by keysLock
+var lockGeneration int
+var lockTimer *time.Timer
+
+// setPrivateKeys replaces private keys of issued addresses, zeroing the previous ones, nil locks the wallet
+// it cancels a pending expiry, keysLock must be held
+func setPrivateKeys(newKeys [][]byte) {
+	for _, key := range privateKeys {
+		for n := range key {
+			key[n] = 0
+		}
+	}
+	privateKeys = newKeys
+	lockGeneration++
+	if lockTimer != nil {
+		lockTimer.Stop()
+		lockTimer = nil
+	}
+}
+
+// Unlock decrypts the keystore with a given passphrase and keeps private keys in memory for a given time
+// a zero timeout keeps the wallet unlocked until Lock is called
+func Unlock(passphrase string, timeout time.Duration) error {
+	masterKey, err := decryptKeystore(passphrase)
+	if err != nil {
+		return err
+	}
+	var addressCount int = len(GetAddresses())
+	unlockedAddresses, unlockedKeys, err := deriveKeys(masterKey, addressCount)
+	if err != nil {
+		return err
+	}
+
+	keysLock.Lock()
+	defer keysLock.Unlock()
+	if len(addresses) != addressCount || len(addresses) == 0 || unlockedAddresses[0].publicKey != addresses[0].publicKey {
+		return errors.New("keystore does not match the wallet")
+	}
+	setPrivateKeys(unlockedKeys)
+	if timeout > 0 {
+		var generation int = lockGeneration
+		lockTimer = time.AfterFunc(timeout, func() { lockIfGeneration(generation) })
+	}
+	return nil
+}
+
+// Lock zeroes private keys kept in memory, addresses and balances remain available
+func Lock() {
+	keysLock.Lock()
+	defer keysLock.Unlock()
+	setPrivateKeys(nil)
+}
+
+// lockIfGeneration locks the wallet if it was not unlocked or locked again since a given unlock
+func lockIfGeneration(generation int) {
+	keysLock.Lock()
+	defer keysLock.Unlock()
+	if lockGeneration == generation {
+		setPrivateKeys(nil)
+	}
+}
+
+// IsLocked checks if private keys of the wallet are not in memory
+func IsLocked() bool {
+	keysLock.Lock()
+	defer keysLock.Unlock()
+	return privateKeys == nil
+}
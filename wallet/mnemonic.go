@@ -0,0 +1,104 @@
+package wallet
+
+import (
+	"crypto/hmac"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/crypto/secp256k1"
+	"github.com/tyler-smith/go-bip39"
+)
+
+// mnemonicEntropyBits is the size of entropy a new mnemonic encodes, 256 bits make 24 words
+const mnemonicEntropyBits int = 256
+
+// masterKeySalt is the HMAC key BIP32 uses to derive the master key from a seed
+const masterKeySalt string = "Bitcoin seed"
+
+// ErrInvalidMnemonic is returned when mnemonic words are not in the BIP39 word list or their checksum does not match
+var ErrInvalidMnemonic = errors.New("invalid mnemonic")
+
+// ErrWalletExists is returned when restoring a wallet while the keystore already exists
+var ErrWalletExists = errors.New("wallet already exists")
+
+// newMnemonic generates a new BIP39 mnemonic
+func newMnemonic() (string, error) {
+	entropy, err := bip39.NewEntropy(mnemonicEntropyBits)
+	if err != nil {
+		return "", err
+	}
+	return bip39.NewMnemonic(entropy)
+}
+
+// normalizeMnemonic lowercases mnemonic words and separates them with single spaces
+func normalizeMnemonic(words string) string {
+	return strings.Join(strings.Fields(strings.ToLower(words)), " ")
+}
+
+// privateKeyFromMnemonic derives a hex encoded private key from a BIP39 mnemonic,
+// the key is the BIP32 master key of the mnemonic's seed, so the same words always give the same key
+func privateKeyFromMnemonic(mnemonic string) (string, error) {
+	seed, err := bip39.NewSeedWithErrorChecking(mnemonic, "")
+	if err != nil {
+		return "", ErrInvalidMnemonic
+	}
+	mac := hmac.New(sha512.New, []byte(masterKeySalt))
+	mac.Write(seed)
+	var keyBytes []byte = mac.Sum(nil)[:32]
+
+	var key *big.Int = new(big.Int).SetBytes(keyBytes)
+	if key.Sign() == 0 || key.Cmp(secp256k1.S256().Params().N) >= 0 {
+		return "", errors.New("mnemonic does not give a valid private key")
+	}
+	return hex.EncodeToString(keyBytes), nil
+}
+
+// createFromMnemonic generates a new mnemonic, encrypts the private key derived from it to the keystore
+// and prints the mnemonic, which is never shown again
+func createFromMnemonic(passphrase string) error {
+	mnemonic, err := newMnemonic()
+	if err != nil {
+		return err
+	}
+	newPrivateKey, err := privateKeyFromMnemonic(mnemonic)
+	if err != nil {
+		return err
+	}
+	if err := writeKeystore(keystorePath, newPrivateKey, passphrase, 1); err != nil {
+		return err
+	}
+	if err := setMasterKey(newPrivateKey, 1); err != nil {
+		return err
+	}
+	fmt.Printf("new wallet with encrypted private key created to : %s\n", keystorePath)
+	fmt.Printf("Write down these words, they restore your wallet if %s is lost, and are not shown again:\n%s\n", keystorePath, mnemonic)
+	return nil
+}
+
+// RestoreFromMnemonic rebuilds the private key from BIP39 mnemonic words and encrypts it to the keystore at a given path
+// the first restoredAddressCount addresses are issued again; an existing keystore is never overwritten
+func RestoreFromMnemonic(keystorePath_ string, words string, passphrase string) error {
+	keystorePath = keystorePath_
+	if _, err := os.Stat(keystorePath); err == nil {
+		return ErrWalletExists
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	restoredKey, err := privateKeyFromMnemonic(normalizeMnemonic(words))
+	if err != nil {
+		return err
+	}
+	if err := writeKeystore(keystorePath, restoredKey, passphrase, restoredAddressCount); err != nil {
+		return err
+	}
+	if err := Reload(passphrase); err != nil {
+		return err
+	}
+	fmt.Printf("wallet restored to %s\n", keystorePath)
+	return nil
+}
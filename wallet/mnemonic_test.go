@@ -0,0 +1,94 @@
+package wallet
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testMnemonic is the BIP39 test vector of all-zero entropy
+const testMnemonic string = "abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon about"
+
+// testMnemonicMasterKey is the BIP32 master key of testMnemonic with an empty BIP39 passphrase
+const testMnemonicMasterKey string = "1837c1be8e2995ec11cda2b066151be2cfb48adf9e47b151d46adab3a21cdf67"
+
+// testMnemonicAddress is the primary address of a wallet restored from testMnemonic
+const testMnemonicAddress string = "Rp5t1QwM983wkK9mkVx5exYg87HUw2BieTFZV8XBYZ4ndwGQ6RCuwmvfWtiCFQio3hgyS2PNbEaMuF9ttyRdZNce"
+
+// restoreTestWallet restores a wallet from mnemonic words to a new keystore, the wallet is deleted when the test ends
+func restoreTestWallet(tb testing.TB, words string) string {
+	var path string = filepath.Join(tb.TempDir(), "wallet.json")
+	tb.Cleanup(deleteWallet)
+	if err := RestoreFromMnemonic(path, words, "test"); err != nil {
+		tb.Fatal(err)
+	}
+	return path
+}
+
+func TestPrivateKeyFromMnemonic(test *testing.T) {
+	privateKey_, err := privateKeyFromMnemonic(testMnemonic)
+	if err != nil {
+		test.Fatal(err)
+	}
+	if privateKey_ != testMnemonicMasterKey {
+		test.Fatalf("expected master key %s, got %s", testMnemonicMasterKey, privateKey_)
+	}
+}
+
+func TestRestoreFromMnemonicGivesSameAddress(test *testing.T) {
+	// words are matched whatever their case and spacing
+	for _, words := range []string{testMnemonic, "  " + strings.ToUpper(testMnemonic) + "\n", strings.Replace(testMnemonic, " ", "\t ", 3)} {
+		restoreTestWallet(test, words)
+		if address := GetBase58Address(); address != testMnemonicAddress {
+			test.Fatalf("expected address %s restored from %q, got %s", testMnemonicAddress, words, address)
+		}
+		if count := len(GetAddresses()); count != restoredAddressCount {
+			test.Fatalf("expected %d addresses issued again, got %d", restoredAddressCount, count)
+		}
+		deleteWallet()
+	}
+}
+
+func TestRestoreFromMnemonicRejectsInvalidWords(test *testing.T) {
+	var cases = map[string]string{
+		"bad checksum":  strings.Repeat("abandon ", 12),
+		"unknown word":  strings.Replace(testMnemonic, "about", "aboot", 1),
+		"too few words": "abandon abandon about",
+		"empty":         "",
+	}
+	for name, words := range cases {
+		var path string = filepath.Join(test.TempDir(), "wallet.json")
+		if err := RestoreFromMnemonic(path, words, "test"); !errors.Is(err, ErrInvalidMnemonic) {
+			test.Errorf("%s: expected %v, got %v", name, ErrInvalidMnemonic, err)
+		}
+	}
+}
+
+func TestRestoreFromMnemonicKeepsExistingWallet(test *testing.T) {
+	var path string = restoreTestWallet(test, testMnemonic)
+	if err := RestoreFromMnemonic(path, testMnemonic, "test"); !errors.Is(err, ErrWalletExists) {
+		test.Fatalf("expected %v, got %v", ErrWalletExists, err)
+	}
+}
+
+func TestNewMnemonicRestoresItsKey(test *testing.T) {
+	mnemonic, err := newMnemonic()
+	if err != nil {
+		test.Fatal(err)
+	}
+	if count := len(strings.Fields(mnemonic)); count != 24 {
+		test.Fatalf("expected 24 words, got %d", count)
+	}
+	first, err := privateKeyFromMnemonic(mnemonic)
+	if err != nil {
+		test.Fatal(err)
+	}
+	second, err := privateKeyFromMnemonic(normalizeMnemonic(strings.ToUpper(mnemonic)))
+	if err != nil {
+		test.Fatal(err)
+	}
+	if first != second {
+		test.Fatal("the same mnemonic must give the same key")
+	}
+}
@@ -1,8 +1,7 @@
 package wallet
 
 import (
-	"crypto/elliptic"
-	"crypto/rand"
+	"crypto/ecdsa"
 	"encoding/hex"
 	"errors"
 	"fmt"
@@ -11,73 +10,148 @@ import (
 	t "naivecoin/transactions"
 	"naivecoin/utils"
 	"os"
-
-	"github.com/ethereum/go-ethereum/crypto/secp256k1"
+	"path/filepath"
+	"strings"
 )
 
-// privateKeyPath stores a path for private key
-// TODO: storing private key this way is unsecure
-const privateKeyPath string = "./private.key"
+// legacyPrivateKeyFile is the name of a file older versions saved the private key to unencrypted
+// such a key is moved to the keystore on InitWallet, the file is looked for next to the keystore
+const legacyPrivateKeyFile string = "private.key"
 
-// GetPublicFromWallet returns a public key for wallet, encoded as hex string
-func GetBase58Address() string {
-	publicKey := utils.GetPublicKey(GetPrivateFromWallet())
-	return utils.Base58Encode(publicKey)
-}
+// ErrInsufficientFunds is returned when spendable txOuts of the wallet don't cover an amount and its fee
+var ErrInsufficientFunds = errors.New("insufficient funds")
 
-// GetPrivateFromWallet returns a private key for wallter, encoded as hex string
-func GetPrivateFromWallet() string {
-	content, err := ioutil.ReadFile(privateKeyPath)
+// InsufficientFundsError is returned with the spendable balance of the wallet and the amount it had to cover, it matches ErrInsufficientFunds
+type InsufficientFundsError struct {
+	Have float64
+	Need float64
+}
 
-	if err != nil {
-		log.Fatal(err)
-	}
+func (e InsufficientFundsError) Error() string {
+	return fmt.Sprintf("%v (have %v, need %v)", ErrInsufficientFunds, e.Have, e.Need)
+}
 
-	privateKey := string(content)
+// Is makes errors.Is(err, ErrInsufficientFunds) true for an InsufficientFundsError
+func (e InsufficientFundsError) Is(target error) bool {
+	return target == ErrInsufficientFunds
+}
 
-	return privateKey
+// GetBase58Address returns the primary address of the wallet, derived from the master key
+// it is available while the wallet is locked
+func GetBase58Address() string {
+	keysLock.Lock()
+	defer keysLock.Unlock()
+	if len(addresses) == 0 {
+		log.Fatal("wallet is not initialized")
+	}
+	return addresses[0].String()
 }
 
-// generatePrivateKey generates a new private key and returns it as hex encoded string
-func generatePrivateKey() string {
-	keyBytes, _, _, _ := elliptic.GenerateKey(secp256k1.S256(), rand.Reader)
-	return hex.EncodeToString(keyBytes)
+// getBase58AddressFor returns an address for a given private key
+func getBase58AddressFor(privateKey_ string) (string, error) {
+	publicKey, err := utils.GetPublicKey(privateKey_)
+	if err != nil {
+		return "", err
+	}
+	return utils.Base58Encode(publicKey)
 }
 
-// InitWallet initializes wallet: generates a private key if does not exist
-func InitWallet() {
-	if _, err := os.Stat(privateKeyPath); err == nil {
-		return
-	} else if os.IsNotExist(err) {
-		var newPrivateKey = generatePrivateKey()
+// GetPrivateFromWallet returns the master private key for wallet, encoded as hex string, ErrWalletLocked if the wallet is locked
+func GetPrivateFromWallet() (string, error) {
+	keysLock.Lock()
+	defer keysLock.Unlock()
+	if len(addresses) == 0 {
+		return "", errors.New("wallet is not initialized")
+	}
+	if privateKeys == nil {
+		return "", ErrWalletLocked
+	}
+	return hex.EncodeToString(privateKeys[0]), nil
+}
 
-		//https://zetcode.com/golang/writefile/
-		f, err := os.Create(privateKeyPath)
+// getLegacyPrivateKeyPath returns a path of the unencrypted private key left by older versions next to the keystore
+func getLegacyPrivateKeyPath() string {
+	return filepath.Join(filepath.Dir(keystorePath), legacyPrivateKeyFile)
+}
 
-		if err != nil {
-			log.Fatal(err)
-		}
+// InitWallet initializes wallet: decrypts the private key from the keystore at a given path with a given passphrase,
+// or generates a new mnemonic and encrypts the private key derived from it if the keystore does not exist
+// an unencrypted private key left by older versions is encrypted and its file removed
+func InitWallet(keystorePath_ string, passphrase string) error {
+	keystorePath = keystorePath_
+	if _, err := os.Stat(keystorePath); err == nil {
+		return Reload(passphrase)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
 
-		defer f.Close()
+	if _, err := os.Stat(getLegacyPrivateKeyPath()); err == nil {
+		return migrateLegacyKey(passphrase)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
 
-		_, err2 := f.WriteString(newPrivateKey)
+	return createFromMnemonic(passphrase)
+}
 
-		if err2 != nil {
-			log.Fatal(err2)
-		}
+// Reload decrypts the keystore with a given passphrase and replaces keys and addresses kept in memory with the ones it holds
+// keys are read from disk only here, the wallet works from memory afterwards; the wallet is unlocked after a reload
+func Reload(passphrase string) error {
+	keystore, err := readKeystore(keystorePath)
+	if err != nil {
+		return err
+	}
+	decryptedKey, err := decryptKey(keystore, passphrase)
+	if err != nil {
+		return err
+	}
+	if err := utils.ValidatePrivateKey(decryptedKey); err != nil {
+		return fmt.Errorf("corrupt key file at %s", keystorePath)
+	}
+	// keystores written before addresses were derived from the master key hold the primary address only
+	var addressCount int = keystore.AddressCount
+	if addressCount < 1 {
+		addressCount = 1
+	}
+	return setMasterKey(decryptedKey, addressCount)
+}
 
-		fmt.Printf("new wallet with private key created to : %s", privateKeyPath)
+// migrateLegacyKey encrypts an unencrypted private key to the keystore and securely removes its file
+func migrateLegacyKey(passphrase string) error {
+	var legacyPrivateKeyPath string = getLegacyPrivateKeyPath()
+	content, err := ioutil.ReadFile(legacyPrivateKeyPath)
+	if err != nil {
+		return err
+	}
+	var legacyKey string = strings.TrimSpace(string(content))
+	if err := utils.ValidatePrivateKey(legacyKey); err != nil {
+		return fmt.Errorf("corrupt key file at %s", legacyPrivateKeyPath)
+	}
+	if err := writeKeystore(keystorePath, legacyKey, passphrase, 1); err != nil {
+		return err
 	}
+	if err := removeSecurely(legacyPrivateKeyPath); err != nil {
+		return fmt.Errorf("private key encrypted to %s, but %s could not be removed: %s", keystorePath, legacyPrivateKeyPath, err.Error())
+	}
+	if err := setMasterKey(legacyKey, 1); err != nil {
+		return err
+	}
+	logger.Info("private key encrypted to the keystore", "keyFile", legacyPrivateKeyPath, "keystore", keystorePath)
+	return nil
 }
 
-// deleteWallet deletes a private key if exists
+// deleteWallet deletes the keystore if exists
 func deleteWallet() {
-	if _, err := os.Stat(privateKeyPath); err == nil {
-		e := os.Remove(privateKeyPath)
+	if _, err := os.Stat(keystorePath); err == nil {
+		e := os.Remove(keystorePath)
 		if e != nil {
 			log.Fatal(e)
 		}
 	}
+	keysLock.Lock()
+	addresses = []walletAddress{}
+	setPrivateKeys(nil)
+	keysLock.Unlock()
 }
 
 // toUnsignedTxIn gets an unspent transaction and returns an unsigned txIn
@@ -89,16 +163,141 @@ func toUnsignedTxIn(unspentTxOut t.UnspentTxOut) t.TxIn {
 	return txIn
 }
 
-// CreateTransaction creates a transaction for sending given amount for a given address
-func CreateTransaction(base58Address string, amount float64, unspentTxOuts []t.UnspentTxOut, txPool []t.Transaction) t.Transaction {
-	var myPrivateKey string = GetPrivateFromWallet()
-	var myBase58Address string = GetBase58Address()
-	var myUnspentTxOutsA = FindUnspentTxOuts(myBase58Address, unspentTxOuts)
-	var myUnspentTxOuts = filterTxPoolTxs(myUnspentTxOutsA, txPool)
+// TxOutRef refers to a txOut by the id of its transaction and its index
+type TxOutRef struct {
+	TxOutId    string
+	TxOutIndex int
+}
 
+// SendOptions sets how a transaction pays its fee and which txOuts it spends
+// Fee is an absolute fee, FeeRate a fee per byte used when Fee is not set; non-empty TxOuts restrict inputs to those txOuts of the wallet
+type SendOptions struct {
+	FeeRate float64
+	Fee     *float64
+	TxOuts  []TxOutRef
+}
+
+// CreateTransaction creates a transaction for sending given amount for a given address, paying a given fee per byte
+// inputs are spent from any address of the wallet, change goes to a fresh address unless disabled,
+// which is issued by IssueChangeAddress once the transaction is admitted to the pool
+// an error is returned if the wallet is locked, can't cover the amount and the fee, or an input can't be signed
+func CreateTransaction(base58Address string, amount float64, feeRate float64, unspentTxOuts []t.UnspentTxOut, txPool []t.Transaction) (t.Transaction, error) {
+	return CreateTransactionWithOptions(base58Address, amount, SendOptions{FeeRate: feeRate}, unspentTxOuts, txPool)
+}
+
+// CreateTransactionWithOptions creates a transaction as CreateTransaction does, paying the fee and spending txOuts as options set
+func CreateTransactionWithOptions(base58Address string, amount float64, options SendOptions, unspentTxOuts []t.UnspentTxOut, txPool []t.Transaction) (t.Transaction, error) {
+	myPrivateKeys, err := getPrivateKeys()
+	if err != nil {
+		return t.Transaction{}, err
+	}
 	// filter from unspentOutputs such inputs that are referenced in pool
-	includedUnspentTxOuts, leftOverAmount, _ := FindTxOutsForAmount(amount, myUnspentTxOuts)
+	var myUnspentTxOutsA = FindUnspentTxOuts(unspentTxOuts)
+	var myUnspentTxOuts = filterTxPoolTxs(myUnspentTxOutsA, txPool)
+	if len(options.TxOuts) > 0 {
+		myUnspentTxOuts, err = selectTxOuts(myUnspentTxOuts, options.TxOuts)
+		if err != nil {
+			return t.Transaction{}, err
+		}
+	}
 
+	// adding inputs to cover the fee makes the transaction bigger and may require a bigger fee, repeat until it is covered
+	// an absolute fee is covered by the first selection
+	var fee float64
+	if options.Fee != nil {
+		fee = *options.Fee
+	}
+	var includedUnspentTxOuts []t.UnspentTxOut
+	var leftOverAmount float64
+	for {
+		includedUnspentTxOuts, leftOverAmount, err = FindTxOutsForAmount(amount+fee, myUnspentTxOuts)
+		if err != nil {
+			return t.Transaction{}, err
+		}
+		if options.Fee != nil {
+			break
+		}
+		var outputCount int = 1
+		if leftOverAmount > 0 {
+			outputCount = 2
+		}
+		var requiredFee float64 = EstimateFee(len(includedUnspentTxOuts), outputCount, options.FeeRate)
+		if requiredFee <= fee {
+			break
+		}
+		fee = requiredFee
+	}
+
+	var changeAddress string = GetBase58Address()
+	if leftOverAmount > 0 {
+		changeAddress = getChangeAddress()
+	}
+	return createSignedTransaction(base58Address, changeAddress, amount, leftOverAmount, includedUnspentTxOuts, myPrivateKeys, unspentTxOuts)
+}
+
+// CheckFunds checks that the spendable balance of the wallet covers an amount with the smallest fee options allow, before any transaction is built
+// txOuts referenced in pool transactions are not spendable and, if options select txOuts, only those are counted;
+// the chain has no coinbase maturity, so confirmed coinbase txOuts are spendable
+// an InsufficientFundsError is returned if they are not covered, the fee actually paid may be bigger once inputs are selected
+func CheckFunds(amount float64, options SendOptions, unspentTxOuts []t.UnspentTxOut, txPool []t.Transaction) error {
+	var myUnspentTxOuts []t.UnspentTxOut = filterTxPoolTxs(FindUnspentTxOuts(unspentTxOuts), txPool)
+	if len(options.TxOuts) > 0 {
+		selected, err := selectTxOuts(myUnspentTxOuts, options.TxOuts)
+		if err != nil {
+			return err
+		}
+		myUnspentTxOuts = selected
+	}
+	var fee float64 = EstimateFee(1, 1, options.FeeRate)
+	if options.Fee != nil {
+		fee = *options.Fee
+	}
+	var have float64 = sumTxOuts(myUnspentTxOuts)
+	if have < amount+fee {
+		return InsufficientFundsError{Have: have, Need: amount + fee}
+	}
+	return nil
+}
+
+// selectTxOuts returns unspent txOuts of the wallet referred to by given references, in their order
+// an error is returned if a reference is not a spendable txOut of the wallet
+func selectTxOuts(myUnspentTxOuts []t.UnspentTxOut, refs []TxOutRef) ([]t.UnspentTxOut, error) {
+	var selected []t.UnspentTxOut = []t.UnspentTxOut{}
+	for _, ref := range refs {
+		var found bool = false
+		for n := 0; n < len(myUnspentTxOuts); n++ {
+			if myUnspentTxOuts[n].TxOutId == ref.TxOutId && myUnspentTxOuts[n].TxOutIndex == ref.TxOutIndex {
+				selected = append(selected, myUnspentTxOuts[n])
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("txOut %s:%d is not a spendable txOut of the wallet", ref.TxOutId, ref.TxOutIndex)
+		}
+	}
+	return selected, nil
+}
+
+// SweepTo creates a transaction sending the whole spendable balance of the wallet to a given address, paying a given fee per byte
+// all unspent txOuts of the wallet are spent except those already spent by pool transactions, the fee is taken from the amount
+// and there is no change; the chain has no coinbase maturity, so coinbase txOuts are spendable as soon as they are confirmed
+func SweepTo(base58Address string, feeRate float64, unspentTxOuts []t.UnspentTxOut, txPool []t.Transaction) (t.Transaction, error) {
+	myPrivateKeys, err := getPrivateKeys()
+	if err != nil {
+		return t.Transaction{}, err
+	}
+	var myUnspentTxOuts []t.UnspentTxOut = filterTxPoolTxs(FindUnspentTxOuts(unspentTxOuts), txPool)
+	var total float64 = sumTxOuts(myUnspentTxOuts)
+	var fee float64 = EstimateFee(len(myUnspentTxOuts), 1, feeRate)
+	if len(myUnspentTxOuts) == 0 || total <= fee {
+		return t.Transaction{}, InsufficientFundsError{Have: total, Need: fee}
+	}
+	return createSignedTransaction(base58Address, "", total-fee, 0, myUnspentTxOuts, myPrivateKeys, unspentTxOuts)
+}
+
+// createSignedTransaction creates a transaction spending given unspent txOuts and signs each txIn with the key of the address owning its txOut
+func createSignedTransaction(base58Address string, changeAddress string, amount float64, leftOverAmount float64, includedUnspentTxOuts []t.UnspentTxOut, myPrivateKeys map[string]string, unspentTxOuts []t.UnspentTxOut) (t.Transaction, error) {
 	var unsignedTxIns []t.TxIn = []t.TxIn{}
 	for n := 0; n < len(includedUnspentTxOuts); n++ {
 		unsignedTxIns = append(unsignedTxIns, toUnsignedTxIn(includedUnspentTxOuts[n]))
@@ -106,33 +305,128 @@ func CreateTransaction(base58Address string, amount float64, unspentTxOuts []t.U
 
 	var tx t.Transaction = t.Transaction{
 		TxIns:  unsignedTxIns,
-		TxOuts: CreateTxOuts(base58Address, myBase58Address, amount, leftOverAmount),
+		TxOuts: CreateTxOuts(base58Address, changeAddress, amount, leftOverAmount),
 	}
+	// the version is a part of the id, the current one allows pubkey-hash addresses and gives canonical ids and signatures
+	tx.Version = t.CurrentTxVersion
 
 	tx.Id = t.GetTransactionId(tx)
 
+	// an address spending several txOuts has its key parsed once
+	var parsedKeys map[string]*ecdsa.PrivateKey = map[string]*ecdsa.PrivateKey{}
 	for index := 0; index < len(tx.TxIns); index++ {
-		tx.TxIns[index].Signature, _ = t.SignTxIn(tx, index, myPrivateKey, unspentTxOuts)
+		var address string = includedUnspentTxOuts[index].Address
+		key, ok := parsedKeys[address]
+		if !ok {
+			var err error
+			key, err = utils.HexToPrivateKey(myPrivateKeys[address])
+			if err != nil {
+				return t.Transaction{}, fmt.Errorf("failed to sign input %d: %s", index, err.Error())
+			}
+			parsedKeys[address] = key
+		}
+		signature, err := t.SignTxInWithKey(tx, index, key, unspentTxOuts)
+		if err != nil {
+			return t.Transaction{}, fmt.Errorf("failed to sign input %d: %s", index, err.Error())
+		}
+		tx.TxIns[index].Signature = signature
+		// spending a pubkey-hash address reveals the public key the address commits to
+		if t.IsPubKeyHashAddress(address) {
+			tx.TxIns[index].PubKey = utils.PublicKeyToHex(&key.PublicKey)
+		}
 	}
 
-	return tx
+	return tx, nil
 }
 
-// FindUnspentTxOuts returns a list of unused txOuts for a wallet
-func FindUnspentTxOuts(base58Address string, unspentTxOuts []t.UnspentTxOut) []t.UnspentTxOut {
+// FindUnspentTxOuts returns a list of unused txOuts owned by any address of a wallet
+func FindUnspentTxOuts(unspentTxOuts []t.UnspentTxOut) []t.UnspentTxOut {
+	var myAddresses map[string]bool = getAddressSet()
 	var myUnspentTxOuts []t.UnspentTxOut = []t.UnspentTxOut{}
 	for n := 0; n < len(unspentTxOuts); n++ {
-		if unspentTxOuts[n].Address == base58Address {
+		if myAddresses[unspentTxOuts[n].Address] {
 			myUnspentTxOuts = append(myUnspentTxOuts, unspentTxOuts[n])
 		}
 	}
 	return myUnspentTxOuts
 }
 
-// GetBalance returns balance of a wallet
-func GetBalance(base58Address string, unspentTxOuts []t.UnspentTxOut) float64 {
+// GetBalance returns balance of a wallet, summed over all its addresses
+func GetBalance(unspentTxOuts []t.UnspentTxOut) float64 {
+	return sumTxOuts(FindUnspentTxOuts(unspentTxOuts))
+}
+
+// Balances splits the balance of the wallet by how pool transactions affect it
+// Confirmed is the sum of unspent txOuts in the blockchain, Spendable leaves out txOuts spent by pool transactions,
+// PendingIncoming is what pool transactions pay to the wallet, change included, and PendingOutgoing is what they spend from it
+type Balances struct {
+	Confirmed       float64
+	Spendable       float64
+	PendingIncoming float64
+	PendingOutgoing float64
+}
+
+// GetBalances returns balances of the wallet for given unspent txOuts and transaction pool
+func GetBalances(unspentTxOuts []t.UnspentTxOut, txPool []t.Transaction) Balances {
+	return getBalances(getAddressSet(), FindUnspentTxOuts(unspentTxOuts), txPool)
+}
+
+// getBalances returns balances of a set of addresses owning given unspent txOuts
+func getBalances(myAddresses map[string]bool, myUnspentTxOuts []t.UnspentTxOut, txPool []t.Transaction) Balances {
+	var balances Balances = Balances{
+		Confirmed: sumTxOuts(myUnspentTxOuts),
+		Spendable: sumTxOuts(filterTxPoolTxs(myUnspentTxOuts, txPool)),
+	}
+	balances.PendingOutgoing = balances.Confirmed - balances.Spendable
+	for n := 0; n < len(txPool); n++ {
+		for _, txOut := range txPool[n].TxOuts {
+			if myAddresses[txOut.Address] {
+				balances.PendingIncoming += txOut.Amount
+			}
+		}
+	}
+	return balances
+}
+
+// WalletInfo describes the wallet: its primary address, balances, number of unspent txOuts it owns and whether it is locked
+type WalletInfo struct {
+	Address string
+	Balances
+	UnspentTxOutCount int
+	Locked            bool
+}
+
+// GetWalletInfo returns information about the wallet for given unspent txOuts and transaction pool
+func GetWalletInfo(unspentTxOuts []t.UnspentTxOut, txPool []t.Transaction) WalletInfo {
+	var myUnspentTxOuts []t.UnspentTxOut = FindUnspentTxOuts(unspentTxOuts)
+	return WalletInfo{
+		Address:           GetBase58Address(),
+		Balances:          getBalances(getAddressSet(), myUnspentTxOuts, txPool),
+		UnspentTxOutCount: len(myUnspentTxOuts),
+		Locked:            IsLocked(),
+	}
+}
+
+// FindUnspentTxOutsForAddress returns a list of unused txOuts of a given address, which need not belong to the wallet
+func FindUnspentTxOutsForAddress(base58Address string, unspentTxOuts []t.UnspentTxOut) []t.UnspentTxOut {
+	var addressUnspentTxOuts []t.UnspentTxOut = []t.UnspentTxOut{}
+	for n := 0; n < len(unspentTxOuts); n++ {
+		if unspentTxOuts[n].Address == base58Address {
+			addressUnspentTxOuts = append(addressUnspentTxOuts, unspentTxOuts[n])
+		}
+	}
+	return addressUnspentTxOuts
+}
+
+// GetBalanceForAddress returns balance of a given address, which need not belong to the wallet
+func GetBalanceForAddress(base58Address string, unspentTxOuts []t.UnspentTxOut) float64 {
+	return sumTxOuts(FindUnspentTxOutsForAddress(base58Address, unspentTxOuts))
+}
+
+// sumTxOuts returns the total amount of given unspent txOuts
+func sumTxOuts(unspentTxOuts []t.UnspentTxOut) float64 {
 	var balance float64
-	for _, txOut := range FindUnspentTxOuts(base58Address, unspentTxOuts) {
+	for _, txOut := range unspentTxOuts {
 		balance += txOut.Amount
 	}
 	return balance
@@ -150,7 +444,7 @@ func FindTxOutsForAmount(amount float64, unspentTxOuts []t.UnspentTxOut) ([]t.Un
 			return includedUnspentTxOuts, leftOverAmount, nil
 		}
 	}
-	return []t.UnspentTxOut{}, amount, errors.New("cannot create transaction from the available unspent transaction outputs")
+	return []t.UnspentTxOut{}, amount, InsufficientFundsError{Have: currentAmount, Need: amount}
 }
 
 // CreateTxOuts creates txOuts for a wallet
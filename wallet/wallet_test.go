@@ -0,0 +1,145 @@
+package wallet
+
+import (
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	t "naivecoin/transactions"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCreateTransactionFromEmptyWallet(test *testing.T) {
+	restoreTestWallet(test, testMnemonic)
+	// txOuts of other addresses are not spendable by the wallet
+	var unspentTxOuts []t.UnspentTxOut = testUnspentTxOuts(testRecipient(test), 50)
+
+	_, err := CreateTransaction(testRecipient(test), 10, 0, unspentTxOuts, nil)
+	var fundsErr InsufficientFundsError
+	if !errors.As(err, &fundsErr) || !errors.Is(err, ErrInsufficientFunds) {
+		test.Fatalf("expected %v, got %v", ErrInsufficientFunds, err)
+	}
+	if fundsErr.Have != 0 || fundsErr.Need != 10 {
+		test.Fatalf("expected to have 0 and need 10, got %v", fundsErr)
+	}
+	if err := CheckFunds(10, SendOptions{}, unspentTxOuts, nil); !errors.Is(err, ErrInsufficientFunds) {
+		test.Fatalf("expected %v checking funds, got %v", ErrInsufficientFunds, err)
+	}
+	if _, err := SweepTo(testRecipient(test), 0, unspentTxOuts, nil); !errors.Is(err, ErrInsufficientFunds) {
+		test.Fatalf("expected %v sweeping, got %v", ErrInsufficientFunds, err)
+	}
+}
+
+func TestCreateTransactionForExactBalance(test *testing.T) {
+	restoreTestWallet(test, testMnemonic)
+	var unspentTxOuts []t.UnspentTxOut = testUnspentTxOuts(GetBase58Address(), 20, 30)
+
+	transaction, err := CreateTransaction(testRecipient(test), 50, 0, unspentTxOuts, nil)
+	if err != nil {
+		test.Fatal(err)
+	}
+	if len(transaction.TxIns) != 2 || len(transaction.TxOuts) != 1 || transaction.TxOuts[0].Amount != 50 {
+		test.Fatalf("expected both txOuts spent to a single txOut of 50 without change, got %d txIns and txOuts %v", len(transaction.TxIns), transaction.TxOuts)
+	}
+	if !t.ValidateTransaction(transaction, unspentTxOuts) {
+		test.Fatal("transaction spending the whole balance must be valid")
+	}
+
+	// a single coin more is not covered, nor is the exact balance once a fee is due
+	if _, err := CreateTransaction(testRecipient(test), 50.000001, 0, unspentTxOuts, nil); !errors.Is(err, ErrInsufficientFunds) {
+		test.Fatalf("expected %v for more than the balance, got %v", ErrInsufficientFunds, err)
+	}
+	if _, err := CreateTransaction(testRecipient(test), 50, 0.001, unspentTxOuts, nil); !errors.Is(err, ErrInsufficientFunds) {
+		test.Fatalf("expected %v for the balance and a fee, got %v", ErrInsufficientFunds, err)
+	}
+}
+
+func TestCreateTransactionFromLockedWallet(test *testing.T) {
+	restoreTestWallet(test, testMnemonic)
+	var unspentTxOuts []t.UnspentTxOut = testUnspentTxOuts(GetBase58Address(), 50)
+	Lock()
+
+	if _, err := CreateTransaction(testRecipient(test), 10, 0, unspentTxOuts, nil); !errors.Is(err, ErrWalletLocked) {
+		test.Fatalf("expected %v, got %v", ErrWalletLocked, err)
+	}
+}
+
+func TestInitWalletRejectsCorruptKeyFile(test *testing.T) {
+	var cases = map[string]string{
+		"empty":             "",
+		"whitespace":        " \n",
+		"truncated":         testMnemonicMasterKey[:40],
+		"leading zeros cut": strings.TrimLeft("00"+testMnemonicMasterKey[2:], "0"),
+		"not hex":           strings.Repeat("z", 64),
+		"zero":              strings.Repeat("0", 64),
+	}
+	for name, content := range cases {
+		var dir string = test.TempDir()
+		var keystorePath string = filepath.Join(dir, "wallet.json")
+		var legacyPath string = filepath.Join(dir, legacyPrivateKeyFile)
+		if err := ioutil.WriteFile(legacyPath, []byte(content), 0600); err != nil {
+			test.Fatal(err)
+		}
+		err := InitWallet(keystorePath, "test")
+		if err == nil || err.Error() != "corrupt key file at "+legacyPath {
+			test.Fatalf("%s: expected corrupt key file at %s, got %v", name, legacyPath, err)
+		}
+		// nothing is migrated, the key file is kept for its owner to recover
+		if _, err := os.Stat(keystorePath); !os.IsNotExist(err) {
+			test.Fatalf("%s: keystore must not be written from a corrupt key file", name)
+		}
+		if string(readFile(test, legacyPath)) != content {
+			test.Fatalf("%s: corrupt key file must be kept", name)
+		}
+		deleteWallet()
+	}
+
+	// a keystore holding a truncated key once decrypted is reported the same way
+	var keystorePath string = filepath.Join(test.TempDir(), "wallet.json")
+	keystore, err := encryptKey(testMnemonicMasterKey, "test")
+	if err != nil {
+		test.Fatal(err)
+	}
+	derivedKey, err := deriveKey("test", keystore.Crypto.KdfParams)
+	if err != nil {
+		test.Fatal(err)
+	}
+	gcm, err := newGCM(derivedKey)
+	if err != nil {
+		test.Fatal(err)
+	}
+	nonce, _ := hex.DecodeString(keystore.Crypto.Nonce)
+	truncatedKey, _ := hex.DecodeString(testMnemonicMasterKey[:40])
+	keystore.Crypto.CipherText = hex.EncodeToString(gcm.Seal(nil, nonce, truncatedKey, nil))
+	if err := writeKeystoreFile(keystorePath, keystore); err != nil {
+		test.Fatal(err)
+	}
+	if err := InitWallet(keystorePath, "test"); err == nil || err.Error() != "corrupt key file at "+keystorePath {
+		test.Fatalf("expected corrupt key file at %s, got %v", keystorePath, err)
+	}
+	deleteWallet()
+}
+
+func TestInitWalletMigratesKeyWithLeadingZeros(test *testing.T) {
+	var dir string = test.TempDir()
+	var legacyKey string = "00" + testMnemonicMasterKey[2:]
+	if err := ioutil.WriteFile(filepath.Join(dir, legacyPrivateKeyFile), []byte(legacyKey+"\n"), 0600); err != nil {
+		test.Fatal(err)
+	}
+	test.Cleanup(deleteWallet)
+	if err := InitWallet(filepath.Join(dir, "wallet.json"), "test"); err != nil {
+		test.Fatal(err)
+	}
+	privateKey, err := GetPrivateFromWallet()
+	if err != nil {
+		test.Fatal(err)
+	}
+	if privateKey != legacyKey {
+		test.Fatalf("expected key %s with its leading zeros, got %s", legacyKey, privateKey)
+	}
+	if _, err := os.Stat(filepath.Join(dir, legacyPrivateKeyFile)); !os.IsNotExist(err) {
+		test.Fatal("migrated key file must be removed")
+	}
+}
@@ -0,0 +1,107 @@
+package wallet
+
+import (
+	"encoding/hex"
+	"fmt"
+	"naivecoin/utils"
+	"os"
+	"strings"
+	"time"
+)
+
+// wifVersion is the version byte prepended to a private key encoded in wallet import format
+const wifVersion byte = 0x80
+
+// ErrInvalidPrivateKey is returned when an imported private key can't be decoded or is not a valid secp256k1 key
+var ErrInvalidPrivateKey = utils.ErrInvalidPrivateKey
+
+// encodeWif encodes a hex encoded private key in wallet import format: base58 of version byte, key and 4 bytes of checksum
+func encodeWif(privateKey_ string) (string, error) {
+	keyBytes, err := hex.DecodeString(privateKey_)
+	if err != nil {
+		return "", err
+	}
+	var payload []byte = append([]byte{wifVersion}, keyBytes...)
+	return utils.Base58Encode(hex.EncodeToString(append(payload, utils.Checksum(payload)...)))
+}
+
+// decodeWif decodes a private key in wallet import format to hex, checking its version byte and checksum
+func decodeWif(wif string) (string, error) {
+	decodedHex, err := utils.Base58Decode(wif)
+	if err != nil {
+		return "", ErrInvalidPrivateKey
+	}
+	decoded, err := hex.DecodeString(decodedHex)
+	if err != nil || len(decoded) != 1+32+4 || decoded[0] != wifVersion {
+		return "", ErrInvalidPrivateKey
+	}
+	var payload []byte = decoded[:1+32]
+	if hex.EncodeToString(utils.Checksum(payload)) != hex.EncodeToString(decoded[1+32:]) {
+		return "", ErrInvalidPrivateKey
+	}
+	return hex.EncodeToString(payload[1:]), nil
+}
+
+// parsePrivateKey decodes a private key given in wallet import format or as 64 hex characters
+// and checks it is a valid secp256k1 private key, in range from 1 to the curve order
+func parsePrivateKey(key string) (string, error) {
+	key = strings.TrimSpace(key)
+	var hexKey string = strings.ToLower(key)
+	if len(key) != 64 {
+		var err error
+		hexKey, err = decodeWif(key)
+		if err != nil {
+			return "", err
+		}
+	}
+	if err := utils.ValidatePrivateKey(hexKey); err != nil {
+		return "", err
+	}
+	return hexKey, nil
+}
+
+// ExportPrivateKey returns the master private key in wallet import format, the keystore passphrase is required
+// the key is decrypted from the keystore, so it can be exported while the wallet is locked
+func ExportPrivateKey(passphrase string) (string, error) {
+	masterKey, err := decryptKeystore(passphrase)
+	if err != nil {
+		return "", err
+	}
+	return encodeWif(masterKey)
+}
+
+// ImportPrivateKey replaces the master key of the wallet with a private key given in wallet import format or as hex
+// the key is encrypted to the keystore with the current keystore passphrase, the previous keystore is kept as a backup
+// addresses derived from the previous master key are no longer used by the wallet
+func ImportPrivateKey(key string, passphrase string) error {
+	importedKey, err := parsePrivateKey(key)
+	if err != nil {
+		return err
+	}
+	if _, err := decryptKeystore(passphrase); err != nil {
+		return err
+	}
+	var backupPath string = fmt.Sprintf("%s.%d.bak", keystorePath, time.Now().Unix())
+	if err := os.Rename(keystorePath, backupPath); err != nil {
+		return err
+	}
+	if err := writeKeystore(keystorePath, importedKey, passphrase, 1); err != nil {
+		return restoreKeystoreBackup(backupPath, err)
+	}
+	if err := reloadWallet(passphrase); err != nil {
+		return restoreKeystoreBackup(backupPath, err)
+	}
+	logger.Info("private key imported", "keystore", keystorePath, "backup", backupPath)
+	return nil
+}
+
+// reloadWallet reloads keys from the keystore once a key is imported, replaced in tests
+var reloadWallet func(passphrase string) error = Reload
+
+// restoreKeystoreBackup moves the previous keystore back in place after an import failed with err, keys in memory are still its keys
+func restoreKeystoreBackup(backupPath string, err error) error {
+	if restoreErr := os.Rename(backupPath, keystorePath); restoreErr != nil {
+		return fmt.Errorf("%s, and the previous keystore could not be restored from %s: %s", err.Error(), backupPath, restoreErr.Error())
+	}
+	return err
+}
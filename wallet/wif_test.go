@@ -0,0 +1,68 @@
+package wallet
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+// keystoreBackups returns keystore backups left next to a keystore
+func keystoreBackups(tb testing.TB, path string) []string {
+	backups, err := filepath.Glob(path + ".*.bak")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return backups
+}
+
+func TestImportPrivateKey(test *testing.T) {
+	var path string = restoreTestWallet(test, testMnemonic)
+	wif, err := encodeWif(fmt.Sprintf("%064x", 2))
+	if err != nil {
+		test.Fatal(err)
+	}
+	if err := ImportPrivateKey(wif, "test"); err != nil {
+		test.Fatal(err)
+	}
+	if GetBase58Address() != testRecipient(test) {
+		test.Fatalf("expected the address of the imported key %s, got %s", testRecipient(test), GetBase58Address())
+	}
+	if exported, err := ExportPrivateKey("test"); err != nil || exported != wif {
+		test.Fatalf("expected the imported key %s exported, got %s and %v", wif, exported, err)
+	}
+	if backups := keystoreBackups(test, path); len(backups) != 1 {
+		test.Fatalf("expected the previous keystore kept as a backup, got %v", backups)
+	}
+}
+
+func TestImportPrivateKeyRestoresBackupWhenReloadFails(test *testing.T) {
+	var path string = restoreTestWallet(test, testMnemonic)
+	var address string = GetBase58Address()
+	var keystore []byte = readFile(test, path)
+	var reloadErr error = errors.New("reload failed")
+	reloadWallet = func(passphrase string) error { return reloadErr }
+	test.Cleanup(func() { reloadWallet = Reload })
+
+	wif, err := encodeWif(fmt.Sprintf("%064x", 2))
+	if err != nil {
+		test.Fatal(err)
+	}
+	if err := ImportPrivateKey(wif, "test"); !errors.Is(err, reloadErr) {
+		test.Fatalf("expected %v, got %v", reloadErr, err)
+	}
+	// the keystore on disk holds the key kept in memory
+	if string(readFile(test, path)) != string(keystore) {
+		test.Fatal("previous keystore must be restored")
+	}
+	if backups := keystoreBackups(test, path); len(backups) != 0 {
+		test.Fatalf("expected the backup moved back in place, got %v", backups)
+	}
+	if GetBase58Address() != address {
+		test.Fatalf("expected address %s kept, got %s", address, GetBase58Address())
+	}
+	reloadWallet = Reload
+	if err := Reload("test"); err != nil || GetBase58Address() != address {
+		test.Fatalf("expected the restored keystore to hold address %s, got %s and %v", address, GetBase58Address(), err)
+	}
+}